@@ -0,0 +1,832 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// AdminUserRequest is the body of user create and update requests.
+type AdminUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// AdminTokenResponse carries a newly minted access token.
+type AdminTokenResponse struct {
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+// AdminBulkDeleteRequest lists objects to delete. Repo, if set, is the
+// "user/repo" whose references are released; objects still referenced by other
+// repos are kept.
+type AdminBulkDeleteRequest struct {
+	Repo    string   `json:"repo,omitempty"`
+	Oids    []string `json:"oids"`
+	Confirm string   `json:"confirm,omitempty"`
+}
+
+// AdminBulkDeleteResponse reports the outcome for each requested oid, or for a
+// dry run what would happen along with the token confirming the deletion.
+type AdminBulkDeleteResponse struct {
+	DryRun  bool                    `json:"dry_run,omitempty"`
+	Confirm string                  `json:"confirm,omitempty"`
+	Objects []*AdminBulkDeleteEntry `json:"objects"`
+}
+
+// AdminBulkDeleteEntry is the result for one oid: deleted, soft_deleted
+// (restorable during the grace period), retained (still referenced, pinned
+// or under retention), not_found or error.
+type AdminBulkDeleteEntry struct {
+	Oid    string   `json:"oid"`
+	Result string   `json:"result"`
+	Repos  []string `json:"repos,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// AdminRepoMoveRequest names the repo whose objects move and where to, both
+// as "user/repo".
+type AdminRepoMoveRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AdminRepoMoveResponse reports a move with what both repos reference after.
+type AdminRepoMoveResponse struct {
+	*RepoMove
+	Usage []*RepoUsage `json:"usage"`
+}
+
+// bulkDeleteTokenLifetime is how long after the dry run a confirmation token
+// is accepted, so it can't be replayed once the objects have moved on.
+const bulkDeleteTokenLifetime = 10 * time.Minute
+
+// bulkDeleteKey keys the confirmation tokens of bulk deletes, so they don't
+// survive a restart.
+var bulkDeleteKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// AdminRetentionRequest sets the time until which an object is retained, in
+// RFC 3339.
+type AdminRetentionRequest struct {
+	RetainUntil *time.Time `json:"retain_until"`
+}
+
+// AdminJobRequest names the job to start and its parameters, those of the
+// admin endpoint running the same work.
+type AdminJobRequest struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params"`
+}
+
+type adminMessage struct {
+	Message string `json:"message"`
+}
+
+func (a *App) addAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/login", a.adminLoginHandler).Methods("GET")
+	r.HandleFunc("/admin/login/callback", a.adminLoginCallbackHandler).Methods("GET")
+	r.HandleFunc("/admin/users", a.requireAdmin(a.adminListUsersHandler)).Methods("GET")
+	r.HandleFunc("/admin/users", a.audited("user.create", a.requireAdmin(a.adminCreateUserHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{name}", a.requireAdmin(a.adminGetUserHandler)).Methods("GET")
+	r.HandleFunc("/admin/users/{name}", a.audited("user.update", a.requireAdmin(a.adminUpdateUserHandler))).Methods("PUT")
+	r.HandleFunc("/admin/users/{name}", a.audited("user.delete", a.requireAdmin(a.adminDeleteUserHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/users/{name}/tokens", a.audited("token.create", a.requireAdmin(a.adminCreateTokenHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/bulk-delete", a.audited("objects.bulk-delete", a.authorize(actionDelete, a.adminBulkDeleteHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects", a.requireAdmin(a.adminListObjectsHandler)).Methods("GET")
+	r.HandleFunc("/admin/objects/downloads", a.requireAdmin(a.adminTopDownloadsHandler)).Methods("GET")
+	r.HandleFunc("/admin/objects/rehash", a.requireAdmin(a.adminRehashStatusHandler)).Methods("GET")
+	r.HandleFunc("/admin/objects/rehash", a.audited("objects.rehash", a.requireAdmin(a.adminRehashHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/rehash", a.audited("objects.rehash-stop", a.requireAdmin(a.adminRehashStopHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/objects/rehash/resume", a.audited("objects.rehash-resume", a.requireAdmin(a.adminRehashResumeHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/rekey", a.requireAdmin(a.adminRekeyStatusHandler)).Methods("GET")
+	r.HandleFunc("/admin/objects/rekey", a.audited("objects.rekey", a.requireAdmin(a.adminRekeyHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/rekey", a.audited("objects.rekey-stop", a.requireAdmin(a.adminRekeyStopHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/objects/rekey/resume", a.audited("objects.rekey-resume", a.requireAdmin(a.adminRekeyResumeHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/{oid}/pin", a.audited("object.pin", a.requireAdmin(a.adminPinHandler))).Methods("PUT")
+	r.HandleFunc("/admin/objects/{oid}/pin", a.audited("object.unpin", a.requireAdmin(a.adminPinHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/objects/{oid}/retention", a.audited("object.retain", a.requireAdmin(a.adminRetentionHandler))).Methods("PUT")
+	r.HandleFunc("/admin/objects/{oid}/restore", a.audited("object.restore", a.requireAdmin(a.adminRestoreHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/fix-sizes", a.audited("objects.fix-sizes", a.requireAdmin(a.adminFixSizesHandler))).Methods("POST")
+	r.HandleFunc("/admin/objects/{oid}/fix-size", a.audited("object.fix-size", a.requireAdmin(a.adminFixSizeHandler))).Methods("POST")
+	r.HandleFunc("/admin/repos/move", a.audited("repos.move", a.requireAdmin(a.adminMoveRepoHandler))).Methods("POST")
+	r.HandleFunc("/admin/repos/usage", a.requireAdmin(a.adminRepoUsageHandler)).Methods("GET")
+	r.HandleFunc("/admin/content/clean-tmp", a.audited("content.clean-tmp", a.requireAdmin(a.adminCleanTempHandler))).Methods("POST")
+	r.HandleFunc("/admin/uploads", a.requireAdmin(a.adminListUploadsHandler)).Methods("GET")
+	r.HandleFunc("/admin/uploads/{id}", a.audited("upload.close", a.requireAdmin(a.adminCloseUploadHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/content/gc", a.audited("content.gc", a.requireAdmin(a.adminGCHandler))).Methods("POST")
+	r.HandleFunc("/admin/jobs", a.requireAdmin(a.adminListJobsHandler)).Methods("GET")
+	r.HandleFunc("/admin/jobs", a.audited("jobs.start", a.requireAdmin(a.adminStartJobHandler))).Methods("POST")
+	r.HandleFunc("/admin/jobs/{id}", a.requireAdmin(a.adminGetJobHandler)).Methods("GET")
+	r.HandleFunc("/admin/jobs/{id}/cancel", a.audited("jobs.cancel", a.requireAdmin(a.adminCancelJobHandler))).Methods("POST")
+	r.HandleFunc("/admin/faults", a.requireAdmin(a.adminFaultsHandler)).Methods("GET")
+	r.HandleFunc("/admin/faults", a.audited("faults.set", a.requireAdmin(a.adminFaultsHandler))).Methods("PUT", "DELETE")
+	r.HandleFunc("/admin/audit", a.requireAdmin(a.adminAuditHandler)).Methods("GET")
+	r.HandleFunc("/admin/stats", a.requireAdmin(a.adminStatsHandler)).Methods("GET")
+	r.HandleFunc("/admin/logs", a.requireAdmin(a.adminLogsHandler)).Methods("GET")
+	r.HandleFunc("/admin/logs/stream", a.requireAdmin(a.adminLogStreamHandler)).Methods("GET")
+}
+
+// requireAdmin allows requests authorized for administration, by default
+// those of the configured admin user and of meta store users with the admin
+// role.
+func (a *App) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return a.authorize(actionAdmin, h)
+}
+
+func (a *App) adminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	if users == nil {
+		users = []*MetaUser{}
+	}
+	writeAdminJSON(w, r, 200, users)
+}
+
+func (a *App) adminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.metaStore.User(mux.Vars(r)["name"])
+	if err == errUserNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, r, 200, user)
+}
+
+func (a *App) adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	context.Set(r, "AUDIT_TARGET", req.Name)
+
+	if req.Name == "" {
+		writeAdminError(w, r, 400, "Invalid username")
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleUser
+	}
+	if err := validateRole(req.Role); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	err := a.metaStore.CreateUser(req.Name, req.Password, req.Role)
+	if err == errUserExists {
+		writeAdminError(w, r, 409, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, r, 201, &MetaUser{Name: req.Name, Role: req.Role})
+}
+
+func (a *App) adminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	if req.Role != "" {
+		if err := validateRole(req.Role); err != nil {
+			writeAdminError(w, r, 400, err.Error())
+			return
+		}
+	}
+	if req.Password != "" {
+		if err := validatePassword(req.Password); err != nil {
+			writeAdminError(w, r, 400, err.Error())
+			return
+		}
+	}
+
+	err := a.metaStore.UpdateUser(name, req.Password, req.Role)
+	if err == errUserNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	user, err := a.metaStore.User(name)
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, user)
+}
+
+// adminDeleteUserHandler removes a user. With ?cascade=true the user's
+// access tokens are removed as well.
+func (a *App) adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if _, err := a.metaStore.User(name); err != nil {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+
+	if err := a.metaStore.DeleteUser(name); err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	if isTrue(r.FormValue("cascade")) {
+		if _, err := a.metaStore.DeleteTokens(name); err != nil {
+			writeAdminError(w, r, 500, err.Error())
+			return
+		}
+	}
+
+	w.WriteHeader(204)
+	logRequest(r, 204)
+}
+
+func (a *App) adminCreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	token, err := a.metaStore.AddToken(name)
+	if err == errUserNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, r, 201, &AdminTokenResponse{User: name, Token: token})
+}
+
+// adminBulkDeleteHandler deletes a list of objects. It has to be called with
+// ?dry_run=true first, which reports what would be deleted and returns the
+// confirmation token the real request must carry. Each object is released in
+// its own meta store transaction, so an error midway leaves every object either
+// deleted or intact.
+func (a *App) adminBulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminBulkDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	context.Set(r, "AUDIT_TARGET", fmt.Sprintf("%d objects of %q", len(req.Oids), req.Repo))
+
+	if len(req.Oids) == 0 {
+		writeAdminError(w, r, 400, "No oids to delete")
+		return
+	}
+
+	if isTrue(r.FormValue("dry_run")) {
+		context.Set(r, "AUDIT_DRY_RUN", true)
+		confirm := bulkDeleteToken(req.Repo, req.Oids, time.Now().Add(bulkDeleteTokenLifetime))
+		res := &AdminBulkDeleteResponse{DryRun: true, Confirm: confirm}
+		for _, oid := range req.Oids {
+			res.Objects = append(res.Objects, a.bulkDeletePreview(req.Repo, oid))
+		}
+		writeAdminJSON(w, r, 200, res)
+		return
+	}
+
+	if req.Confirm == "" {
+		writeAdminError(w, r, 400, "Missing confirmation, request a dry run first")
+		return
+	}
+	if err := checkBulkDeleteToken(req.Confirm, req.Repo, req.Oids, time.Now()); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	res := &AdminBulkDeleteResponse{}
+	for _, oid := range req.Oids {
+		res.Objects = append(res.Objects, a.bulkDeleteObject(req.Repo, oid))
+	}
+	writeAdminJSON(w, r, 200, res)
+}
+
+func (a *App) bulkDeletePreview(repo, oid string) *AdminBulkDeleteEntry {
+	e := &AdminBulkDeleteEntry{Oid: oid}
+
+	meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err == errObjectNotFound {
+		e.Result = "not_found"
+		return e
+	}
+	if err != nil {
+		e.Result, e.Error = "error", err.Error()
+		return e
+	}
+
+	meta.removeRepo(repo)
+	e.Repos = meta.Repos
+	e.Result = "deleted"
+	if len(meta.Repos) > 0 || meta.Pinned || meta.retained(time.Now()) {
+		e.Result = "retained"
+	} else if a.metaStore.SoftDelete {
+		e.Result = "soft_deleted"
+	}
+	return e
+}
+
+func (a *App) bulkDeleteObject(repo, oid string) *AdminBulkDeleteEntry {
+	e := &AdminBulkDeleteEntry{Oid: oid}
+
+	// An upload of the same object would write the content this removes
+	if claimed, _ := a.uploads.claim(oid, 0); !claimed {
+		e.Result, e.Error = "error", errUploadBusy.Error()
+		return e
+	}
+	defer a.uploads.finish(oid)
+
+	meta, deleted, err := a.metaStore.Release(oid, repo)
+	if err == errObjectNotFound {
+		e.Result = "not_found"
+		return e
+	}
+	if err != nil {
+		e.Result, e.Error = "error", err.Error()
+		return e
+	}
+
+	e.Repos = meta.Repos
+	if !deleted {
+		e.Result = "retained"
+		return e
+	}
+	// The content is kept for a restore until the expiry sweep reaps it
+	if meta.DeletedAt != nil {
+		e.Result = "soft_deleted"
+		return e
+	}
+
+	// The meta information is gone, so content left behind by a failure here
+	// is unreachable rather than corrupt.
+	e.Result = "deleted"
+	if err := a.contentStore.Delete(meta); err != nil {
+		e.Error = err.Error()
+	}
+	if a.replicator != nil {
+		if err := a.replicator.Delete(meta); err != nil && e.Error == "" {
+			e.Error = err.Error()
+		}
+	}
+	return e
+}
+
+// bulkDeleteToken returns the confirmation token for deleting oids from repo,
+// valid until expires. The expiry is carried in the clear and covered by the
+// MAC.
+func bulkDeleteToken(repo string, oids []string, expires time.Time) string {
+	return fmt.Sprintf("%d.%s", expires.Unix(), bulkDeleteMAC(repo, oids, expires.Unix()))
+}
+
+// checkBulkDeleteToken verifies that token confirms deleting oids from repo
+// and hasn't expired at now.
+func checkBulkDeleteToken(token, repo string, oids []string, now time.Time) error {
+	parts := strings.SplitN(token, ".", 2)
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) != 2 || err != nil ||
+		!hmac.Equal([]byte(parts[1]), []byte(bulkDeleteMAC(repo, oids, expires))) {
+		return errors.New("Confirmation does not match these objects")
+	}
+	if now.Unix() > expires {
+		return errors.New("Confirmation has expired, request a new dry run")
+	}
+	return nil
+}
+
+func bulkDeleteMAC(repo string, oids []string, expires int64) string {
+	sorted := append([]string(nil), oids...)
+	sort.Strings(sorted)
+
+	mac := hmac.New(sha256.New, bulkDeleteKey)
+	fmt.Fprintf(mac, "%d\n%s\n%s", expires, repo, strings.Join(sorted, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validatePassword enforces the minimum password policy for new passwords.
+func validatePassword(pass string) error {
+	if min := Config.PasswordMinLength(); len(pass) < min {
+		return fmt.Errorf("Password must be at least %d characters", min)
+	}
+	return nil
+}
+
+// adminListObjectsHandler lists the objects, optionally only those that are
+// or aren't pinned, and those with every tag filter given as tag=name or
+// tag=name:value. Soft deleted objects are only listed, on their own, with
+// deleted=true.
+func (a *App) adminListObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	objects, err := a.metaStore.Objects()
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	deleted := isTrue(r.FormValue("deleted"))
+	listed := make([]*MetaObject, 0, len(objects))
+	for _, o := range objects {
+		if (o.DeletedAt != nil) == deleted {
+			listed = append(listed, o)
+		}
+	}
+	objects = listed
+
+	if v := r.FormValue("pinned"); v != "" {
+		pinned := isTrue(v)
+		filtered := make([]*MetaObject, 0, len(objects))
+		for _, o := range objects {
+			if o.Pinned == pinned {
+				filtered = append(filtered, o)
+			}
+		}
+		objects = filtered
+	}
+
+	// Objects compressing worse than max_ratio, such as those barely worth
+	// compressing, are candidates for identity storage
+	if v := r.FormValue("max_ratio"); v != "" {
+		max, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			writeAdminError(w, r, 400, "Invalid max_ratio: "+v)
+			return
+		}
+		filtered := make([]*MetaObject, 0, len(objects))
+		for _, o := range objects {
+			if ratio := o.compressionRatio(); ratio > 0 && ratio <= max {
+				filtered = append(filtered, o)
+			}
+		}
+		objects = filtered
+	}
+
+	for _, tag := range r.Form["tag"] {
+		filtered := make([]*MetaObject, 0, len(objects))
+		for _, o := range objects {
+			if o.hasTag(tag) {
+				filtered = append(filtered, o)
+			}
+		}
+		objects = filtered
+	}
+
+	if objects == nil {
+		objects = []*MetaObject{}
+	}
+	writeAdminJSON(w, r, 200, objects)
+}
+
+// adminMoveRepoHandler moves the object references and locks of a repo to
+// another, as when it's renamed or transferred, without touching content.
+func (a *App) adminMoveRepoHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminRepoMoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	context.Set(r, "AUDIT_TARGET", req.From+" to "+req.To)
+
+	for _, name := range []string{req.From, req.To} {
+		if !validRepoName(name) {
+			writeAdminError(w, r, 400, "Invalid repo: "+name)
+			return
+		}
+	}
+	if req.From == req.To {
+		writeAdminError(w, r, 400, "Repos must differ")
+		return
+	}
+
+	move, err := a.metaStore.MoveRepo(req.From, req.To)
+	if err == errMoveNamespace {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	if err == errLocksConflict || err == errLocksShared {
+		writeAdminError(w, r, 409, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	res := &AdminRepoMoveResponse{RepoMove: move}
+	for _, name := range []string{req.From, req.To} {
+		usage, err := a.metaStore.Usage(name)
+		if err != nil {
+			writeAdminError(w, r, 500, err.Error())
+			return
+		}
+		res.Usage = append(res.Usage, usage)
+	}
+	logger.Log(kv{"fn": "adminMoveRepoHandler", "from": req.From, "to": req.To, "moved": move.Moved, "merged": move.Merged, "locks": move.Locks})
+	writeAdminJSON(w, r, 200, res)
+}
+
+// adminRepoUsageHandler reports the objects and bytes the repo parameter
+// references.
+func (a *App) adminRepoUsageHandler(w http.ResponseWriter, r *http.Request) {
+	repo := r.FormValue("repo")
+	if !validRepoName(repo) {
+		writeAdminError(w, r, 400, "Invalid repo: "+repo)
+		return
+	}
+	usage, err := a.metaStore.Usage(repo)
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, usage)
+}
+
+// validRepoName returns true for names of the "user/repo" form objects are
+// referenced by.
+func validRepoName(name string) bool {
+	parts := strings.Split(name, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// adminPinHandler pins an object on PUT and unpins it on DELETE.
+func (a *App) adminPinHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	context.Set(r, "AUDIT_TARGET", oid)
+
+	meta, err := a.metaStore.SetPinned(oid, r.Method == "PUT")
+	if err == errObjectNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, meta)
+}
+
+// adminRetentionHandler keeps an object from being removed until the
+// retain_until time of the request, refusing with 409 any time earlier than
+// the one set.
+func (a *App) adminRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	context.Set(r, "AUDIT_TARGET", oid)
+
+	var req AdminRetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	if req.RetainUntil == nil {
+		writeAdminError(w, r, 400, "Missing retain_until")
+		return
+	}
+
+	meta, err := a.metaStore.SetRetention(oid, *req.RetainUntil)
+	switch err {
+	case nil:
+	case errObjectNotFound:
+		writeAdminError(w, r, 404, err.Error())
+		return
+	case errRetainShorter:
+		writeAdminError(w, r, 409, err.Error())
+		return
+	default:
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	logger.Log(kv{"fn": "adminRetentionHandler", "oid": oid, "retain_until": meta.RetainUntil.Format(time.RFC3339)})
+	writeAdminJSON(w, r, 200, meta)
+}
+
+// adminRestoreHandler undoes the soft delete of an object.
+func (a *App) adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	context.Set(r, "AUDIT_TARGET", oid)
+
+	meta, err := a.metaStore.Restore(oid)
+	if err == errObjectNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err == errNotDeleted {
+		writeAdminError(w, r, 409, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, meta)
+}
+
+// cleanTemp removes the stale temporary files of the content store and, if
+// objects are replicated, those of the replica, adding up both results.
+func (a *App) cleanTemp(grace time.Duration) (*TempCleanup, error) {
+	stores := []objectStore{a.contentStore}
+	if a.replicator != nil {
+		stores = append(stores, a.replicator.secondary)
+	}
+
+	total := &TempCleanup{}
+	for _, store := range stores {
+		tc, ok := store.(tempCleaner)
+		if !ok {
+			continue
+		}
+		res, err := tc.CleanTemp(grace)
+		if err != nil {
+			return nil, err
+		}
+		total.Found += res.Found
+		total.Removed += res.Removed
+		total.Bytes += res.Bytes
+	}
+	return total, nil
+}
+
+// adminCleanTempHandler removes temporary files left behind by interrupted
+// uploads in the content store and the replica, as is done at startup. A
+// grace parameter overrides the configured grace period.
+func (a *App) adminCleanTempHandler(w http.ResponseWriter, r *http.Request) {
+	grace := Config.TempGrace()
+	if v := r.FormValue("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeAdminError(w, r, 400, "Invalid grace: "+v)
+			return
+		}
+		grace = d
+	}
+
+	if !a.gcMu.TryLock() {
+		writeAdminError(w, r, 409, errGCRunning.Error())
+		return
+	}
+	defer a.gcMu.Unlock()
+
+	res, err := a.cleanTemp(grace)
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	logger.Log(kv{"fn": "adminCleanTempHandler", "found": res.Found, "removed": res.Removed, "bytes": res.Bytes})
+	writeAdminJSON(w, r, 200, res)
+}
+
+// adminListUploadsHandler lists the tus upload sessions that weren't
+// finished.
+func (a *App) adminListUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, r, 200, tusServer.Sessions(Config.TusIdleTime()))
+}
+
+// adminCloseUploadHandler closes a tus upload session and removes its data,
+// for sessions stuck after their client went away. Sessions still receiving
+// data are refused with 409, unless force is set.
+func (a *App) adminCloseUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	context.Set(r, "AUDIT_TARGET", id)
+
+	session, err := tusServer.Close(id, Config.TusIdleTime(), isTrue(r.FormValue("force")))
+	switch err {
+	case nil:
+	case errTusSessionNotFound:
+		writeAdminError(w, r, 404, err.Error())
+		return
+	case errTusSessionActive:
+		writeAdminError(w, r, 409, "Upload session received data within the last "+Config.TusIdleTime().String()+", set force to close it anyway")
+		return
+	default:
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	logger.Log(kv{"fn": "adminCloseUploadHandler", "id": id, "oid": session.Oid, "received": session.Received, "active": session.Active})
+	writeAdminJSON(w, r, 200, session)
+}
+
+// validateRole accepts the built-in roles and those named in the action
+// policy.
+func validateRole(role string) error {
+	switch role {
+	case roleUser, roleAdmin:
+		return nil
+	}
+	if policy, err := Config.ActionPolicy(); err == nil && role != anyRole && policy.hasRole(role) {
+		return nil
+	}
+	return fmt.Errorf("Invalid role: %s", role)
+}
+
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+	logRequest(r, status)
+}
+
+func writeAdminError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeAdminJSON(w, r, status, &adminMessage{Message: message})
+}
+
+// adminListJobsHandler lists the running and last finished jobs, newest
+// first.
+func (a *App) adminListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, r, 200, a.jobs.Jobs())
+}
+
+// adminStartJobHandler starts a maintenance job in the background. Jobs of a
+// name already running are refused with 409.
+func (a *App) adminStartJobHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	context.Set(r, "AUDIT_TARGET", req.Name)
+
+	job, err := a.jobs.Start(req.Name, req.Params)
+	switch err {
+	case nil:
+	case errJobRunning, errGCRunning:
+		writeAdminError(w, r, 409, err.Error())
+		return
+	case errUnknownJob:
+		writeAdminError(w, r, 400, err.Error()+": "+req.Name)
+		return
+	default:
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 202, job)
+}
+
+// adminGetJobHandler reports the progress and stats of a job.
+func (a *App) adminGetJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := a.jobs.Job(mux.Vars(r)["id"])
+	if err != nil {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, job)
+}
+
+// adminCancelJobHandler cancels a running job and reports it once it
+// stopped.
+func (a *App) adminCancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	context.Set(r, "AUDIT_TARGET", id)
+
+	job, err := a.jobs.Cancel(r.Context(), id)
+	switch err {
+	case nil:
+	case errJobNotFound:
+		writeAdminError(w, r, 404, err.Error())
+		return
+	case errJobNotRunning:
+		writeAdminError(w, r, 409, err.Error())
+		return
+	default:
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, job)
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAdminUser = "admin"
+	testAdminPass = "adminpass"
+)
+
+func TestAdminUserLifecycle(t *testing.T) {
+	defer setupAdmin()()
+
+	res := adminAPI(t, "POST", "/admin/users", `{"name":"frodo","password":"ringbearer"}`)
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var user MetaUser
+	json.NewDecoder(res.Body).Decode(&user)
+	if user.Name != "frodo" || user.Role != roleUser {
+		t.Fatalf("expected created user frodo with role user, got %+v", user)
+	}
+
+	res, err := api("GET", "/user/repo/locks", metaMediaType, "frodo", "ringbearer", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected new user to authenticate, got %d", res.StatusCode)
+	}
+
+	res = adminAPI(t, "DELETE", "/admin/users/frodo", "")
+	if res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/user/repo/locks", metaMediaType, "frodo", "ringbearer", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected deleted user to fail authentication, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminUsersNeverExposeHashes(t *testing.T) {
+	defer setupAdmin()()
+
+	adminAPI(t, "POST", "/admin/users", `{"name":"sam","password":"gamgee123","role":"admin"}`)
+	defer testMetaStore.DeleteUser("sam")
+
+	for _, path := range []string{"/admin/users", "/admin/users/sam"} {
+		res := adminAPI(t, "GET", path, "")
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 for %s, got %d", path, res.StatusCode)
+		}
+
+		body, _ := ioutil.ReadAll(res.Body)
+		if bytes.Contains(body, []byte("$2a$")) || bytes.Contains(body, []byte("hash")) || bytes.Contains(body, []byte("gamgee123")) {
+			t.Fatalf("expected %s to not expose credentials, got %s", path, body)
+		}
+		if !bytes.Contains(body, []byte(`"role":"admin"`)) {
+			t.Fatalf("expected %s to include the role, got %s", path, body)
+		}
+	}
+}
+
+func TestAdminUserPasswordPolicy(t *testing.T) {
+	defer setupAdmin()()
+
+	res := adminAPI(t, "POST", "/admin/users", `{"name":"pippin","password":"short"}`)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
+	}
+
+	if _, err := testMetaStore.User("pippin"); err != errUserNotFound {
+		t.Fatalf("expected user to not be created, got %v", err)
+	}
+}
+
+func TestAdminUpdateUser(t *testing.T) {
+	defer setupAdmin()()
+
+	adminAPI(t, "POST", "/admin/users", `{"name":"merry","password":"brandybuck"}`)
+	defer testMetaStore.DeleteUser("merry")
+
+	res := adminAPI(t, "PUT", "/admin/users/merry", `{"password":"buckland1","role":"admin"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	if _, ok := testMetaStore.Authenticate("merry", "brandybuck"); ok {
+		t.Fatalf("expected old password to be rejected")
+	}
+	if _, ok := testMetaStore.Authenticate("merry", "buckland1"); !ok {
+		t.Fatalf("expected new password to be accepted")
+	}
+
+	// The user is now an admin and can use the admin API itself
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/admin/users", nil)
+	req.SetBasicAuth("merry", "buckland1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected admin role to grant admin access, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminDeleteUserCascadesTokens(t *testing.T) {
+	defer setupAdmin()()
+
+	adminAPI(t, "POST", "/admin/users", `{"name":"gandalf","password":"mithrandir"}`)
+
+	res := adminAPI(t, "POST", "/admin/users/gandalf/tokens", "")
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var tr AdminTokenResponse
+	json.NewDecoder(res.Body).Decode(&tr)
+	if _, ok := testMetaStore.Authenticate("gandalf", tr.Token); !ok {
+		t.Fatalf("expected token to authenticate")
+	}
+
+	res = adminAPI(t, "DELETE", "/admin/users/gandalf?cascade=true", "")
+	if res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+
+	if n, _ := testMetaStore.DeleteTokens("gandalf"); n != 0 {
+		t.Fatalf("expected tokens to be removed with the user, %d remained", n)
+	}
+}
+
+func TestAdminDeleteUserKeepsTokensFromNewUser(t *testing.T) {
+	defer setupAdmin()()
+
+	adminAPI(t, "POST", "/admin/users", `{"name":"gandalf","password":"mithrandir"}`)
+	res := adminAPI(t, "POST", "/admin/users/gandalf/tokens", "")
+	var tr AdminTokenResponse
+	json.NewDecoder(res.Body).Decode(&tr)
+
+	// Without cascade the token stays, but stops authenticating
+	if res := adminAPI(t, "DELETE", "/admin/users/gandalf", ""); res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+	if _, ok := testMetaStore.Authenticate("gandalf", tr.Token); ok {
+		t.Fatalf("expected the token of a removed user not to authenticate")
+	}
+
+	// A new user of the same name doesn't get it
+	adminAPI(t, "POST", "/admin/users", `{"name":"gandalf","password":"the white"}`)
+	defer testMetaStore.DeleteUser("gandalf")
+	if _, ok := testMetaStore.Authenticate("gandalf", tr.Token); ok {
+		t.Fatalf("expected the token of a removed user not to authenticate as a new one")
+	}
+	if n, _ := testMetaStore.DeleteTokens("gandalf"); n != 0 {
+		t.Fatalf("expected the old tokens to be removed with the new user, %d remained", n)
+	}
+}
+
+func TestAdminRequiresAdmin(t *testing.T) {
+	defer setupAdmin()()
+
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/admin/users", nil)
+	req.SetBasicAuth(testUser, testPass)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401 for a non-admin user, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminRefusesEmptyCredentials(t *testing.T) {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = "", ""
+	defer func() {
+		Config.AdminUser, Config.AdminPass = user, pass
+	}()
+
+	// Without an admin user configured, empty credentials must not match it
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/admin/users", nil)
+	req.SetBasicAuth("", "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401 for empty credentials, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminAuditRecordsActions(t *testing.T) {
+	defer setupAdmin()()
+
+	start := time.Now().UTC().Add(-time.Second)
+
+	adminAPI(t, "POST", "/admin/users", `{"name":"merry","password":"brandybuck"}`)
+	defer testMetaStore.DeleteUser("merry")
+
+	if res := adminAPI(t, "POST", "/admin/users/merry/tokens", ""); res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	req, _ := http.NewRequest("DELETE", lfsServer.URL+"/admin/users/merry", nil)
+	req.SetBasicAuth(testUser, testPass)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401 for a non-admin delete, got %d", res.StatusCode)
+	}
+
+	if res := adminAPI(t, "DELETE", "/admin/users/merry", ""); res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+
+	res = adminAPI(t, "GET", "/admin/audit?since="+start.Format(time.RFC3339), "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var entries []*AuditEntry
+	json.NewDecoder(res.Body).Decode(&entries)
+
+	expected := []AuditEntry{
+		{Actor: testAdminUser, Action: "user.create", Target: "merry", Outcome: auditSuccess},
+		{Actor: testAdminUser, Action: "token.create", Target: "merry", Outcome: auditSuccess},
+		{Actor: testUser, Action: "user.delete", Target: "merry", Outcome: auditDenied},
+		{Actor: testAdminUser, Action: "user.delete", Target: "merry", Outcome: auditSuccess},
+	}
+	if len(entries) < len(expected) {
+		t.Fatalf("expected at least %d audit entries, got %d", len(expected), len(entries))
+	}
+
+	entries = entries[len(entries)-len(expected):]
+	for i, e := range expected {
+		got := entries[i]
+		if got.Actor != e.Actor || got.Action != e.Action || got.Target != e.Target || got.Outcome != e.Outcome {
+			t.Fatalf("expected audit entry %d to be %+v, got %+v", i, e, *got)
+		}
+	}
+}
+
+func TestAdminAuditTimeRange(t *testing.T) {
+	defer setupAdmin()()
+
+	future := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	res := adminAPI(t, "GET", "/admin/audit?since="+future, "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var entries []*AuditEntry
+	json.NewDecoder(res.Body).Decode(&entries)
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries after %s, got %d", future, len(entries))
+	}
+
+	res = adminAPI(t, "GET", "/admin/audit?until=yesterday", "")
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an invalid time, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminBulkDelete(t *testing.T) {
+	defer setupAdmin()()
+	start := time.Now().UTC().Add(-time.Second)
+
+	first := putBulkObject(t, "first bulk object", "repo")
+	second := putBulkObject(t, "second bulk object", "repo")
+
+	body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s","%s","%s"]}`, first.Oid, second.Oid, nonExistingOid)
+	res := adminAPI(t, "POST", "/admin/objects/bulk-delete?dry_run=true", body)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 for a dry run, got %d", res.StatusCode)
+	}
+
+	var summary AdminBulkDeleteResponse
+	json.NewDecoder(res.Body).Decode(&summary)
+	if summary.Confirm == "" || len(summary.Objects) != 3 || summary.Objects[0].Result != "deleted" {
+		t.Fatalf("expected a dry run summary with a confirmation, got %+v", summary)
+	}
+	if !testContentStore.Exists(first) {
+		t.Fatalf("expected the dry run not to delete anything")
+	}
+
+	body = fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s","%s","%s"],"confirm":"%s"}`, first.Oid, second.Oid, nonExistingOid, summary.Confirm)
+	res = adminAPI(t, "POST", "/admin/objects/bulk-delete", body)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result AdminBulkDeleteResponse
+	json.NewDecoder(res.Body).Decode(&result)
+	expected := []string{"deleted", "deleted", "not_found"}
+	for i, e := range result.Objects {
+		if e.Result != expected[i] {
+			t.Fatalf("expected %s to be %s, got %+v", e.Oid, expected[i], e)
+		}
+	}
+
+	for _, meta := range []*MetaObject{first, second} {
+		if _, err := testMetaStore.Get(&RequestVars{Oid: meta.Oid}); err != errObjectNotFound {
+			t.Fatalf("expected meta of %s to be deleted, got: %v", meta.Oid, err)
+		}
+		if testContentStore.Exists(meta) {
+			t.Fatalf("expected content of %s to be deleted", meta.Oid)
+		}
+	}
+
+	// The dry run is audited as a preview, the delete as done
+	entries, err := testMetaStore.Audit(start, time.Time{})
+	if err != nil || len(entries) < 2 {
+		t.Fatalf("expected audit entries, got %d: %v", len(entries), err)
+	}
+	entries = entries[len(entries)-2:]
+	if entries[0].Outcome != auditPreview || entries[1].Outcome != auditSuccess {
+		t.Fatalf("expected a preview and a success, got %+v and %+v", *entries[0], *entries[1])
+	}
+}
+
+func TestAdminBulkDeleteUnknownObjects(t *testing.T) {
+	defer setupAdmin()()
+
+	missing := strings.Repeat("0", 64)
+	oids := []string{missing, nonExistingOid}
+	body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s","%s"]}`, missing, nonExistingOid)
+
+	// Objects never stored are reported by the dry run as they will be
+	var summary AdminBulkDeleteResponse
+	json.NewDecoder(adminAPI(t, "POST", "/admin/objects/bulk-delete?dry_run=true", body).Body).Decode(&summary)
+	if checkBulkDeleteToken(summary.Confirm, "bilbo/repo", oids, time.Now()) != nil || len(summary.Objects) != 2 {
+		t.Fatalf("expected a dry run summary with a confirmation, got %+v", summary)
+	}
+
+	body = fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s","%s"],"confirm":"%s"}`, missing, nonExistingOid, summary.Confirm)
+	var result AdminBulkDeleteResponse
+	json.NewDecoder(adminAPI(t, "POST", "/admin/objects/bulk-delete", body).Body).Decode(&result)
+	if len(result.Objects) != 2 {
+		t.Fatalf("expected a result for each oid, got %+v", result)
+	}
+	for i, e := range result.Objects {
+		if e.Result != "not_found" || e.Result != summary.Objects[i].Result {
+			t.Fatalf("expected %s to be not_found in both runs, got %+v and %+v", e.Oid, summary.Objects[i], e)
+		}
+	}
+}
+
+func TestAdminBulkDeleteRequiresConfirmation(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "unconfirmed bulk object", "repo")
+	defer testContentStore.Delete(meta)
+	defer testMetaStore.Release(meta.Oid, "bilbo/repo")
+
+	for _, confirm := range []string{"", "0123456789abcdef"} {
+		body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s"],"confirm":"%s"}`, meta.Oid, confirm)
+		res := adminAPI(t, "POST", "/admin/objects/bulk-delete", body)
+		if res.StatusCode != 400 {
+			t.Fatalf("expected status 400 for confirmation %q, got %d", confirm, res.StatusCode)
+		}
+	}
+
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected object to survive an unconfirmed delete")
+	}
+}
+
+func TestAdminBulkDeleteExpiredConfirmation(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "expired bulk object", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	oids := []string{meta.Oid}
+	body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s"],"confirm":"%s"}`, meta.Oid, bulkDeleteToken("bilbo/repo", oids, time.Now().Add(-time.Second)))
+	if res := adminAPI(t, "POST", "/admin/objects/bulk-delete", body); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an expired confirmation, got %d", res.StatusCode)
+	}
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected the content to be kept")
+	}
+}
+
+func TestAdminBulkDeleteSkipsObjectsBeingUploaded(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "uploading bulk object", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.uploads.claim(meta.Oid, 0)
+	defer app.uploads.finish(meta.Oid)
+
+	if e := app.bulkDeleteObject("bilbo/repo", meta.Oid); e.Result != "error" || e.Error != errUploadBusy.Error() {
+		t.Fatalf("expected the object being uploaded to be skipped, got %+v", e)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: meta.Oid}); err != nil {
+		t.Fatalf("expected the meta to be kept, got: %v", err)
+	}
+}
+
+func TestAdminBulkDeleteKeepsReferencedObjects(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "shared bulk object", "repo")
+	putBulkObject(t, "shared bulk object", "fork")
+	defer testContentStore.Delete(meta)
+	defer testMetaStore.Release(meta.Oid, "bilbo/fork")
+
+	oids := []string{meta.Oid}
+	body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s"],"confirm":"%s"}`, meta.Oid, bulkDeleteToken("bilbo/repo", oids, time.Now().Add(time.Minute)))
+	res := adminAPI(t, "POST", "/admin/objects/bulk-delete", body)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result AdminBulkDeleteResponse
+	json.NewDecoder(res.Body).Decode(&result)
+	if len(result.Objects) != 1 || result.Objects[0].Result != "retained" {
+		t.Fatalf("expected the object to be retained, got %+v", result.Objects)
+	}
+	if repos := result.Objects[0].Repos; len(repos) != 1 || repos[0] != "bilbo/fork" {
+		t.Fatalf("expected the fork to keep its reference, got %v", repos)
+	}
+
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected referenced content to be kept")
+	}
+}
+
+func TestAdminSoftDeleteRestore(t *testing.T) {
+	defer setupAdmin()()
+	testMetaStore.SoftDelete = true
+	defer func() { testMetaStore.SoftDelete = false }()
+
+	meta := putBulkObject(t, "soft deleted bulk object", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s"],"confirm":"%s"}`, meta.Oid, bulkDeleteToken("bilbo/repo", []string{meta.Oid}, time.Now().Add(time.Minute)))
+	var result AdminBulkDeleteResponse
+	json.NewDecoder(adminAPI(t, "POST", "/admin/objects/bulk-delete", body).Body).Decode(&result)
+	if len(result.Objects) != 1 || result.Objects[0].Result != "soft_deleted" {
+		t.Fatalf("expected the object to be soft deleted, got %+v", result.Objects)
+	}
+
+	// Deleted objects are hidden, but their content is kept
+	if _, err := testMetaStore.Get(&RequestVars{Oid: meta.Oid}); err != errObjectNotFound {
+		t.Fatalf("expected the deleted object to be hidden, got: %v", err)
+	}
+	if res, _ := api("GET", "/user/repo/objects/"+meta.Oid, contentMediaType, testUser, testPass, nil); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 downloading a deleted object, got %d", res.StatusCode)
+	}
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected the content to be kept for a restore")
+	}
+	if !listsObject(t, "/admin/objects?deleted=true", meta.Oid) || listsObject(t, "/admin/objects", meta.Oid) {
+		t.Fatalf("expected the object to be listed as deleted only")
+	}
+
+	res := adminAPI(t, "POST", "/admin/objects/"+meta.Oid+"/restore", "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 restoring, got %d", res.StatusCode)
+	}
+	restored, err := testMetaStore.Get(&RequestVars{Oid: meta.Oid})
+	if err != nil || restored.DeletedAt != nil || len(restored.Repos) != 1 || restored.Repos[0] != "bilbo/repo" {
+		t.Fatalf("expected the object to be restored with its references, got %+v: %v", restored, err)
+	}
+	if res := adminAPI(t, "POST", "/admin/objects/"+meta.Oid+"/restore", ""); res.StatusCode != 409 {
+		t.Fatalf("expected status 409 restoring an object that isn't deleted, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminSoftDeletedReupload(t *testing.T) {
+	testMetaStore.SoftDelete = true
+	defer func() { testMetaStore.SoftDelete = false }()
+
+	meta := putBulkObject(t, "soft deleted and uploaded again", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	if _, deleted, err := testMetaStore.Release(meta.Oid, "bilbo/repo"); err != nil || !deleted {
+		t.Fatalf("expected the object to be deleted, got %v", err)
+	}
+
+	again, err := testMetaStore.Put(&RequestVars{Oid: meta.Oid, Size: meta.Size, User: testUser, Repo: "fork"})
+	if err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if !again.Existing || again.DeletedAt != nil || len(again.Repos) != 1 || again.Repos[0] != "bilbo/fork" {
+		t.Fatalf("expected the upload to restore the object for the fork only, got %+v", again)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: meta.Oid}); err != nil {
+		t.Fatalf("expected the object to be visible again, got: %s", err)
+	}
+}
+
+// listsObject returns true if the admin object listing at path has oid.
+func listsObject(t *testing.T, path, oid string) bool {
+	var objects []*MetaObject
+	json.NewDecoder(adminAPI(t, "GET", path, "").Body).Decode(&objects)
+	for _, o := range objects {
+		if o.Oid == oid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAdminCleanTemp(t *testing.T) {
+	defer setupAdmin()()
+
+	stale := plantTemp(t, "lfs-content-test/ab/cd/admin-stale.gz.tmp", 2*time.Hour)
+	fresh := plantTemp(t, "lfs-content-test/ab/cd/admin-fresh.gz.tmp", time.Minute)
+	defer os.Remove(fresh)
+
+	res := adminAPI(t, "POST", "/admin/content/clean-tmp?grace=1h", "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var cleanup TempCleanup
+	if err := json.NewDecoder(res.Body).Decode(&cleanup); err != nil {
+		t.Fatalf("expected cleanup result, got: %s", err)
+	}
+	if cleanup.Removed != 1 {
+		t.Fatalf("expected one file to be removed, got %+v", cleanup)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expected the fresh temporary file to be kept, got: %s", err)
+	}
+
+	if res := adminAPI(t, "POST", "/admin/content/clean-tmp?grace=soon", ""); res.StatusCode != 400 {
+		t.Fatalf("expected an invalid grace to return 400, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminCleanTempOfReplica(t *testing.T) {
+	defer setupAdmin()()
+
+	replica, err := NewContentStore("lfs-replica-clean-test")
+	if err != nil {
+		t.Fatalf("expected to create the replica store, got: %s", err)
+	}
+	defer os.RemoveAll("lfs-replica-clean-test")
+
+	app := lfsServer.Config.Handler.(*App)
+	app.replicator = NewReplicator(testContentStore, replica)
+	defer func() { app.replicator = nil }()
+
+	stale := plantTemp(t, "lfs-replica-clean-test/ab/cd/replica-stale.gz.tmp", 2*time.Hour)
+	res := adminAPI(t, "POST", "/admin/content/clean-tmp?grace=1h", "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var cleanup TempCleanup
+	if err := json.NewDecoder(res.Body).Decode(&cleanup); err != nil {
+		t.Fatalf("expected cleanup result, got: %s", err)
+	}
+	if cleanup.Removed != 1 {
+		t.Fatalf("expected the replica's file to be removed, got %+v", cleanup)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file of the replica to be removed")
+	}
+}
+
+func TestAdminPinnedObjectsSurviveBulkDelete(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "pinned bulk object", "repo")
+	defer testContentStore.Delete(meta)
+	defer testMetaStore.Release(meta.Oid, "")
+
+	if res := adminAPI(t, "PUT", "/admin/objects/"+meta.Oid+"/pin", ""); res.StatusCode != 200 {
+		t.Fatalf("expected status 200 pinning, got %d", res.StatusCode)
+	}
+	if res := adminAPI(t, "PUT", "/admin/objects/"+strings.Repeat("0", 64)+"/pin", ""); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 pinning a missing object, got %d", res.StatusCode)
+	}
+
+	var pinned []*MetaObject
+	json.NewDecoder(adminAPI(t, "GET", "/admin/objects?pinned=true", "").Body).Decode(&pinned)
+	if len(pinned) != 1 || pinned[0].Oid != meta.Oid || !pinned[0].Pinned {
+		t.Fatalf("expected only the pinned object to be listed, got %+v", pinned)
+	}
+
+	res, err := api("GET", "/bilbo/repo/objects/"+meta.Oid+"/meta", "application/json", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var stored MetaObject
+	json.NewDecoder(res.Body).Decode(&stored)
+	if !stored.Pinned {
+		t.Fatalf("expected the meta endpoint to report the object as pinned")
+	}
+
+	bulkDelete := func() string {
+		oids := []string{meta.Oid}
+		body := fmt.Sprintf(`{"repo":"bilbo/repo","oids":["%s"],"confirm":"%s"}`, meta.Oid, bulkDeleteToken("bilbo/repo", oids, time.Now().Add(time.Minute)))
+		var result AdminBulkDeleteResponse
+		json.NewDecoder(adminAPI(t, "POST", "/admin/objects/bulk-delete", body).Body).Decode(&result)
+		if len(result.Objects) != 1 {
+			t.Fatalf("expected one result, got %+v", result.Objects)
+		}
+		return result.Objects[0].Result
+	}
+
+	if result := bulkDelete(); result != "retained" {
+		t.Fatalf("expected the pinned object to be retained, got %s", result)
+	}
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected pinned content to be kept")
+	}
+
+	if res := adminAPI(t, "DELETE", "/admin/objects/"+meta.Oid+"/pin", ""); res.StatusCode != 200 {
+		t.Fatalf("expected status 200 unpinning, got %d", res.StatusCode)
+	}
+
+	// Unpinned and no longer referenced, it is removed like any other object
+	if result := bulkDelete(); result != "deleted" {
+		t.Fatalf("expected the unpinned object to be deleted, got %s", result)
+	}
+	if testContentStore.Exists(meta) {
+		t.Fatalf("expected unpinned content to be deleted")
+	}
+}
+
+func TestAdminMoveRepo(t *testing.T) {
+	defer setupAdmin()()
+
+	only := putBulkObject(t, "object only the old repo has", "moved-old")
+	shared := putBulkObject(t, "object both repos have", "moved-old")
+	for _, m := range []*MetaObject{only, shared} {
+		defer removeMeta(m.Oid)
+		defer testContentStore.Delete(m)
+	}
+	putBulkObject(t, "object both repos have", "moved-new")
+
+	from, to := testUser+"/moved-old", testUser+"/moved-new"
+	res := adminAPI(t, "POST", "/admin/repos/move", `{"from":"`+from+`","to":"`+to+`"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var move AdminRepoMoveResponse
+	if err := json.NewDecoder(res.Body).Decode(&move); err != nil {
+		t.Fatalf("expected a move result, got: %s", err)
+	}
+	if move.Moved != 1 || move.Merged != 1 {
+		t.Fatalf("expected one object moved and one merged, got %+v", move.RepoMove)
+	}
+
+	// The shared object counts once towards the new repo
+	if len(move.Usage) != 2 || move.Usage[0].Objects != 0 || move.Usage[0].Bytes != 0 {
+		t.Fatalf("expected the old repo to reference nothing, got %+v", move.Usage)
+	}
+	if u := move.Usage[1]; u.Objects != 2 || u.Bytes != only.Size+shared.Size {
+		t.Fatalf("expected the new repo to reference both objects once, got %+v", u)
+	}
+
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: shared.Oid})
+	if err != nil || len(meta.Repos) != 1 || meta.Repos[0] != to {
+		t.Fatalf("expected the shared object to keep one reference of the new repo, got %+v: %v", meta, err)
+	}
+	if !testContentStore.Exists(only) || !testContentStore.Exists(shared) {
+		t.Fatalf("expected the content to be left alone")
+	}
+
+	if res := adminAPI(t, "POST", "/admin/repos/move", `{"from":"`+to+`","to":"`+to+`"}`); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for a move onto itself, got %d", res.StatusCode)
+	}
+	res = adminAPI(t, "GET", "/admin/repos/usage?repo="+to, "")
+	var usage RepoUsage
+	if err := json.NewDecoder(res.Body).Decode(&usage); err != nil || usage.Objects != 2 {
+		t.Fatalf("expected the usage of the new repo, got %+v: %v", usage, err)
+	}
+}
+
+// putBulkObject stores data as an object referenced by bilbo's repo.
+func putBulkObject(t *testing.T, data, repo string) *MetaObject {
+	sum := sha256.Sum256([]byte(data))
+	rv := &RequestVars{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data)), User: testUser, Repo: repo}
+
+	meta, err := testMetaStore.Put(rv)
+	if err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if err := testContentStore.Put(meta, strings.NewReader(data)); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+	return meta
+}
+
+func adminAPI(t *testing.T, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, lfsServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
+
+// setupAdmin configures the admin credentials and returns a function
+// restoring the previous ones.
+func setupAdmin() func() {
+	user, pass := Config.AdminUser, Config.AdminPass
+	Config.AdminUser, Config.AdminPass = testAdminUser, testAdminPass
+	return func() {
+		Config.AdminUser, Config.AdminPass = user, pass
+	}
+}
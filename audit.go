@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailed  = "failed"
+	auditPreview = "preview"
+)
+
+// audited records every request handled by h in the audit log as action. Wrap
+// the authorization check too, so refused attempts are recorded as denied.
+//
+// The actor is the authenticated user, or the user that was attempted. The
+// target is the {name} route variable unless the handler sets "AUDIT_TARGET"
+// in the request context. The outcome follows from the response status, and
+// handlers that report errors with a success status set "AUDIT_OUTCOME".
+// Handlers set "AUDIT_DRY_RUN" for dry runs, whose success is recorded as a
+// preview, as nothing was changed.
+func (a *App) audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, status: 200}
+		h(sr, r)
+
+		e := &AuditEntry{
+			Time:    time.Now().UTC(),
+			Action:  action,
+			Target:  mux.Vars(r)["name"],
+			Outcome: auditSuccess,
+		}
+
+		if user, ok := context.Get(r, "USER").(string); ok {
+			e.Actor = user
+		} else {
+			e.Actor, _, _ = r.BasicAuth()
+		}
+		if target, ok := context.Get(r, "AUDIT_TARGET").(string); ok {
+			e.Target = target
+		}
+
+		switch {
+		case sr.status == 401 || sr.status == 403:
+			e.Outcome = auditDenied
+		case sr.status >= 400:
+			e.Outcome = auditFailed
+		}
+		if outcome, ok := context.Get(r, "AUDIT_OUTCOME").(string); ok {
+			e.Outcome = outcome
+		}
+		if dryRun, _ := context.Get(r, "AUDIT_DRY_RUN").(bool); dryRun && e.Outcome == auditSuccess {
+			e.Outcome = auditPreview
+		}
+
+		if err := a.metaStore.AddAudit(e); err != nil {
+			logger.Log(kv{"fn": "audit", "action": action, "err": err.Error()})
+		}
+		logger.Log(kv{"fn": "audit", "actor": e.Actor, "action": e.Action, "target": e.Target, "outcome": e.Outcome, "request_id": context.Get(r, "RequestID")})
+	}
+}
+
+// adminAuditHandler lists audit entries, optionally limited to the RFC 3339
+// times in the since and until parameters.
+func (a *App) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var since, until time.Time
+	var err error
+
+	if v := r.FormValue("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAdminError(w, r, 400, "Invalid since: "+v)
+			return
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAdminError(w, r, 400, "Invalid until: "+v)
+			return
+		}
+	}
+
+	entries, err := a.metaStore.Audit(since, until)
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	if entries == nil {
+		entries = []*AuditEntry{}
+	}
+	writeAdminJSON(w, r, 200, entries)
+}
+
+// statusRecorder remembers the status written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wrote {
+		w.status = status
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Actions checked by an Authorizer.
+const (
+	actionDownload = "download"
+	actionUpload   = "upload"
+	actionVerify   = "verify"
+	actionBatch    = "batch"
+	actionLocks    = "locks"
+	actionLock     = "lock"
+	actionUnlock   = "unlock"
+	actionDelete   = "delete"
+	actionMetrics  = "metrics"
+	actionAdmin    = "admin"
+)
+
+// anyRole in a policy allows an action to anyone allowed on the server.
+const anyRole = "*"
+
+// rolePolicy maps actions to the roles allowed to perform them. Actions that
+// aren't listed are allowed to any role.
+type rolePolicy map[string][]string
+
+// defaultRolePolicy leaves deleting objects, metrics and administration to
+// admins.
+var defaultRolePolicy = rolePolicy{
+	actionDelete:  {roleAdmin},
+	actionMetrics: {roleAdmin},
+	actionAdmin:   {roleAdmin},
+}
+
+// parseRolePolicy parses a policy given as "action=role,role" entries
+// separated by semicolons, on top of defaultRolePolicy. Listing roles
+// other than the built-in ones makes them available to users.
+func parseRolePolicy(s string) (rolePolicy, error) {
+	p := make(rolePolicy)
+	for action, roles := range defaultRolePolicy {
+		p[action] = roles
+	}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Role policy entry isn't given as action=roles: %q", entry)
+		}
+
+		var roles []string
+		for _, role := range strings.Split(parts[1], ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+		p[strings.TrimSpace(parts[0])] = roles
+	}
+	return p, nil
+}
+
+// allows returns true if role may perform action. Admins may do everything,
+// so no policy locks them out.
+func (p rolePolicy) allows(action, role string) bool {
+	roles, ok := p[action]
+	if !ok || role == roleAdmin {
+		return true
+	}
+	for _, r := range roles {
+		if r == anyRole || r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRole returns true if role is named anywhere in the policy.
+func (p rolePolicy) hasRole(role string) bool {
+	for _, roles := range p {
+		for _, r := range roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errUnauthenticated = errors.New("Unauthenticated")
+
+// Identity is who made a request. The zero Identity is an anonymous client.
+type Identity struct {
+	Name string
+	Role string
+
+	// Signed is set for requests authorized by a signed link instead of
+	// credentials. They carry no user.
+	Signed bool
+}
+
+// Authenticator establishes the Identity of a request. It returns
+// errUnauthenticated if the request must not go on anonymously.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// Authorizer decides whether identity may perform action. oid is the object
+// the action is on, or empty if it isn't on a single object.
+type Authorizer interface {
+	Can(identity Identity, action string, oid string) bool
+}
+
+// metaStoreAuthenticator authenticates signed links and basic auth against
+// the configured admin and the users and tokens of a meta store.
+type metaStoreAuthenticator struct {
+	meta *MetaStore
+}
+
+func (m *metaStoreAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if validSignature(r) {
+		return Identity{Signed: true}, nil
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		if name, valid := m.meta.Authenticate(user, pass); valid {
+			id := Identity{Name: name, Role: roleUser}
+			if user != "" && pass != "" && checkBasicAuth(user, pass, ok) {
+				id.Role = roleAdmin
+			} else if u, err := m.meta.User(name); err == nil {
+				id.Role = u.Role
+			}
+			return id, nil
+		}
+	}
+
+	if Config.IsPublic() {
+		return Identity{}, nil
+	}
+	return Identity{}, errUnauthenticated
+}
+
+// policyAuthorizer allows actions by the role of the identity, as given by
+// its policy. Signed links only transfer content, and anonymous clients are
+// only allowed on a public server, and only actions open to any role.
+type policyAuthorizer struct {
+	policy rolePolicy
+}
+
+func (a *policyAuthorizer) Can(id Identity, action string, oid string) bool {
+	switch {
+	case id.Signed:
+		return action == actionDownload || action == actionUpload
+	case id.Name == "":
+		return Config.IsPublic() && a.policy.allows(action, anyRole)
+	}
+	return a.policy.allows(action, id.Role)
+}
+
+// authorize wraps h so that it only runs for requests the authorizer allows
+// to perform action, on the {oid} route variable if there is one. The
+// identity is stored as "IDENTITY" in the request context, its name as
+// "USER" and the action as "ACTION".
+func (a *App) authorize(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, "ACTION", action)
+		id, err := a.authenticator.Authenticate(r)
+		if err != nil || !a.authorizer.Can(id, action, mux.Vars(r)["oid"]) {
+			// Ask for credentials unless there are some that just don't
+			// allow this. Admin routes keep asking, as only other
+			// credentials can help there.
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/admin/"):
+				w.Header().Set("WWW-Authenticate", "Basic realm=admin")
+				writeAdminError(w, r, 401, http.StatusText(401))
+			case strings.HasPrefix(r.URL.Path, "/mgmt"):
+				w.Header().Set("WWW-Authenticate", "Basic realm=mgmt")
+				writeStatus(w, r, 401)
+			case err == nil && (id.Name != "" || id.Signed):
+				writeStatus(w, r, 403)
+			default:
+				w.Header().Set("WWW-Authenticate", "Basic realm=git-lfs-server")
+				writeStatus(w, r, 401)
+			}
+			return
+		}
+
+		context.Set(r, "IDENTITY", id)
+		if id.Name != "" {
+			context.Set(r, "USER", id.Name)
+		}
+		h(w, r)
+	}
+}
+
+// identity returns the Identity stored in the context of r by authorize.
+func identity(r *http.Request) Identity {
+	id, _ := context.Get(r, "IDENTITY").(Identity)
+	return id
+}
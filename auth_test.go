@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeActions(t *testing.T) {
+	authz := &stubAuthorizer{}
+	server := newStubAuthServer(&stubAuthenticator{id: Identity{Name: "frodo", Role: roleUser}}, authz)
+	defer server.Close()
+
+	tests := []struct {
+		method, path, accept, action string
+	}{
+		{"POST", "/user/repo/objects/batch", metaMediaType, actionBatch},
+		{"GET", "/user/repo/objects/" + contentOid, contentMediaType, actionDownload},
+		{"GET", "/user/repo/objects/" + contentOid, metaMediaType, actionDownload},
+		{"PUT", "/user/repo/objects/" + contentOid, contentMediaType, actionUpload},
+		{"POST", "/user/repo/objects", metaMediaType, actionUpload},
+		{"GET", "/user/repo/locks", metaMediaType, actionLocks},
+		{"POST", "/user/repo/locks/verify", metaMediaType, actionLocks},
+		{"POST", "/user/repo/locks", metaMediaType, actionLock},
+		{"POST", "/user/repo/locks/" + lockId + "/unlock", metaMediaType, actionUnlock},
+		{"POST", "/verify/" + contentOid, "", actionVerify},
+		{"POST", "/admin/objects/bulk-delete", "", actionDelete},
+		{"GET", "/admin/users", "", actionAdmin},
+	}
+
+	for _, test := range tests {
+		authz.asked = nil
+		res := stubRequest(t, server, test.method, test.path, test.accept, nil)
+
+		if len(authz.asked) != 1 || authz.asked[0] != test.action {
+			t.Errorf("expected %s %s to ask for %s, asked for %v", test.method, test.path, test.action, authz.asked)
+		}
+		status := 403
+		if strings.HasPrefix(test.path, "/admin/") {
+			status = 401
+		}
+		if res.StatusCode != status {
+			t.Errorf("expected denied %s %s to return %d, got %d", test.method, test.path, status, res.StatusCode)
+		}
+	}
+
+	authz.allow = map[string]bool{actionDownload: true}
+	res := stubRequest(t, server, "GET", "/user/repo/objects/"+contentOid, contentMediaType, nil)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected an allowed download to return 200, got %d", res.StatusCode)
+	}
+	if authz.oid != contentOid {
+		t.Fatalf("expected the object to be authorized, got %q", authz.oid)
+	}
+	res = stubRequest(t, server, "PUT", "/user/repo/objects/"+contentOid, contentMediaType, nil)
+	if res.StatusCode != 403 {
+		t.Fatalf("expected an upload to stay denied, got %d", res.StatusCode)
+	}
+}
+
+func TestAuthorizeUnauthenticated(t *testing.T) {
+	authz := &stubAuthorizer{allow: map[string]bool{actionDownload: true}}
+	server := newStubAuthServer(&stubAuthenticator{err: errUnauthenticated}, authz)
+	defer server.Close()
+
+	res := stubRequest(t, server, "GET", "/user/repo/objects/"+contentOid, contentMediaType, nil)
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+	if res.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected to be asked for credentials")
+	}
+	if len(authz.asked) != 0 {
+		t.Fatalf("expected no authorization without an identity, asked for %v", authz.asked)
+	}
+}
+
+func TestAuthorizeBatchObjects(t *testing.T) {
+	authz := &stubAuthorizer{allow: map[string]bool{actionBatch: true, actionDownload: true}, deny: nonExistingOid}
+	server := newStubAuthServer(&stubAuthenticator{id: Identity{Name: "frodo", Role: roleUser}}, authz)
+	defer server.Close()
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":1}]}`, contentOid, contentSize, nonExistingOid)
+	res := stubRequest(t, server, "POST", "/user/repo/objects/batch", metaMediaType, bytes.NewBufferString(body))
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
+	}
+	if len(batch.Objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(batch.Objects))
+	}
+	if batch.Objects[0].Error != nil || batch.Objects[0].Actions["download"] == nil {
+		t.Fatalf("expected the allowed object to be downloadable, got %+v", batch.Objects[0])
+	}
+	if batch.Objects[1].Error == nil || batch.Objects[1].Error.Code != 403 {
+		t.Fatalf("expected the denied object to get a 403 error, got %+v", batch.Objects[1])
+	}
+}
+
+func TestPolicyAuthorizerDefaults(t *testing.T) {
+	defer func(public string) { Config.Public = public }(Config.Public)
+	Config.Public = "false"
+
+	authz := &policyAuthorizer{policy: defaultRolePolicy}
+	user := Identity{Name: "frodo", Role: roleUser}
+	admin := Identity{Name: "gandalf", Role: roleAdmin}
+	signed := Identity{Signed: true}
+	anonymous := Identity{}
+
+	tests := []struct {
+		id      Identity
+		action  string
+		allowed bool
+	}{
+		{user, actionDownload, true},
+		{user, actionLock, true},
+		{user, actionAdmin, false},
+		{user, actionDelete, false},
+		{user, actionMetrics, false},
+		{admin, actionAdmin, true},
+		{admin, actionMetrics, true},
+		{signed, actionDownload, true},
+		{signed, actionUpload, true},
+		{signed, actionBatch, false},
+		{signed, actionLock, false},
+		{anonymous, actionDownload, false},
+	}
+
+	for _, test := range tests {
+		if allowed := authz.Can(test.id, test.action, contentOid); allowed != test.allowed {
+			t.Errorf("expected %+v doing %s to be %v, got %v", test.id, test.action, test.allowed, allowed)
+		}
+	}
+
+	Config.Public = "true"
+	if !authz.Can(anonymous, actionDownload, contentOid) {
+		t.Errorf("expected anonymous downloads from a public server")
+	}
+	if authz.Can(anonymous, actionAdmin, "") {
+		t.Errorf("expected no anonymous administration of a public server")
+	}
+}
+
+func TestPolicyAuthorizerRoles(t *testing.T) {
+	policy, err := parseRolePolicy("download=user,reader,ci; upload=user,ci; lock=user; unlock=user; locks=user,reader")
+	if err != nil {
+		t.Fatalf("expected the policy to parse, got: %s", err)
+	}
+	authz := &policyAuthorizer{policy: policy}
+
+	reader := Identity{Name: "mirror", Role: "reader"}
+	ci := Identity{Name: "builder", Role: "ci"}
+	admin := Identity{Name: "gandalf", Role: roleAdmin}
+
+	tests := []struct {
+		id      Identity
+		action  string
+		allowed bool
+	}{
+		{reader, actionDownload, true},
+		{reader, actionLocks, true},
+		{reader, actionUpload, false},
+		{reader, actionLock, false},
+		{ci, actionUpload, true},
+		{ci, actionDownload, true},
+		{ci, actionUnlock, false},
+		{ci, actionDelete, false},
+		{admin, actionDelete, true},
+		{admin, actionUpload, true},
+	}
+
+	for _, test := range tests {
+		if allowed := authz.Can(test.id, test.action, contentOid); allowed != test.allowed {
+			t.Errorf("expected %s doing %s to be %v, got %v", test.id.Role, test.action, test.allowed, allowed)
+		}
+	}
+
+	if _, err := parseRolePolicy("download"); err == nil {
+		t.Errorf("expected an entry without roles to be refused")
+	}
+}
+
+func TestPolicyRoles(t *testing.T) {
+	defer func(roles string) { Config.ActionRoles = roles }(Config.ActionRoles)
+	Config.ActionRoles = "download=user,reader; upload=user"
+
+	if err := validateRole("reader"); err != nil {
+		t.Fatalf("expected a role from the policy to be valid, got: %s", err)
+	}
+	if err := testMetaStore.CreateUser("mirror", "readonly1", "reader"); err != nil {
+		t.Fatalf("expected to create user, got: %s", err)
+	}
+	defer testMetaStore.DeleteUser("mirror")
+
+	server := httptest.NewServer(NewApp(testContentStore, testMetaStore))
+	defer server.Close()
+
+	request := func(method string, body *bytes.Buffer) int {
+		req, err := http.NewRequest(method, server.URL+"/user/repo/objects/"+contentOid, body)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("mirror", "readonly1")
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := request("PUT", bytes.NewBufferString(content)); status != 403 {
+		t.Fatalf("expected an upload by a read-only user to be denied, got %d", status)
+	}
+	if status := request("GET", &bytes.Buffer{}); status != 200 {
+		t.Fatalf("expected a download by a read-only user to be allowed, got %d", status)
+	}
+
+	Config.ActionRoles = ""
+	if err := validateRole("reader"); err == nil {
+		t.Fatalf("expected a role outside the policy to be invalid")
+	}
+}
+
+func TestMgmtAuthorizesLikeAdminAPI(t *testing.T) {
+	defer setupAdmin()()
+
+	if err := testMetaStore.CreateUser("saruman", "white123", roleAdmin); err != nil {
+		t.Fatalf("expected to create user, got: %s", err)
+	}
+	defer testMetaStore.DeleteUser("saruman")
+	token, err := testMetaStore.AddToken("saruman")
+	if err != nil {
+		t.Fatalf("expected to add token, got: %s", err)
+	}
+
+	request := func(user, pass string) int {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/mgmt/users", nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := request("saruman", "white123"); status != 200 {
+		t.Fatalf("expected a user with the admin role to be let in, got %d", status)
+	}
+	if status := request("saruman", token); status != 200 {
+		t.Fatalf("expected a token of an admin to be let in, got %d", status)
+	}
+	if status := request(testUser, testPass); status != 401 {
+		t.Fatalf("expected a user without the admin role to be refused, got %d", status)
+	}
+}
+
+type stubAuthenticator struct {
+	id  Identity
+	err error
+}
+
+func (s *stubAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	return s.id, s.err
+}
+
+// stubAuthorizer allows the actions in allow, except on the object deny, and
+// records what it was asked.
+type stubAuthorizer struct {
+	allow map[string]bool
+	deny  string
+	asked []string
+	oid   string
+}
+
+func (s *stubAuthorizer) Can(id Identity, action string, oid string) bool {
+	s.asked = append(s.asked, action)
+	s.oid = oid
+	return s.allow[action] && oid != s.deny
+}
+
+func newStubAuthServer(authn Authenticator, authz Authorizer) *httptest.Server {
+	app := NewApp(testContentStore, testMetaStore)
+	app.authenticator = authn
+	app.authorizer = authz
+	return httptest.NewServer(app)
+}
+
+func stubRequest(t *testing.T, server *httptest.Server, method, path, accept string, body *bytes.Buffer) *http.Response {
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	req, err := http.NewRequest(method, server.URL+path, body)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
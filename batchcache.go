@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// batchCache keeps the responses of recent batch requests, so a client
+// repeating an identical request, as CI runners do, is answered without
+// looking up every object again. A response is dropped once it's older than
+// ttl or any of its objects changes, and the least recently used ones once
+// there are more than max.
+type batchCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	byOid   map[string]map[string]bool
+
+	// gen counts invalidations. While responses are being computed the
+	// generation each oid last changed in is kept, so a response computed
+	// from state changed meanwhile isn't stored.
+	gen      uint64
+	inflight int
+	changed  map[string]uint64
+}
+
+type batchEntry struct {
+	key     string
+	oids    []string
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+func newBatchCache(ttl time.Duration, max int) *batchCache {
+	return &batchCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		byOid:   make(map[string]map[string]bool),
+		changed: make(map[string]uint64),
+	}
+}
+
+// batchCacheKey identifies a batch request by who makes it, to which repo,
+// with which credentials (as they are echoed in the response) and its body.
+func batchCacheKey(id Identity, authorization, path string, body []byte) string {
+	h := sha256.New()
+	for _, part := range []string{id.Name, id.Role, authorization, path} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the unexpired response cached for key.
+func (c *batchCache) get(key string) (*batchEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*batchEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// begin starts computing a response, returning the generation to pass to
+// done.
+func (c *batchCache) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight++
+	return c.gen
+}
+
+// done stores the response computed for key since start, unless one of its
+// objects changed meanwhile. body may be nil to store nothing.
+func (c *batchCache) done(key string, start uint64, oids []string, body []byte) *batchEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	defer func() {
+		if c.inflight--; c.inflight == 0 {
+			c.changed = make(map[string]uint64)
+		}
+	}()
+
+	e := &batchEntry{key: key, oids: oids, body: body, etag: responseETag(body), expires: time.Now().Add(c.ttl)}
+	if body == nil {
+		return e
+	}
+	for _, oid := range oids {
+		if c.changed[oid] > start {
+			return e
+		}
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for _, oid := range oids {
+		if c.byOid[oid] == nil {
+			c.byOid[oid] = make(map[string]bool)
+		}
+		c.byOid[oid][key] = true
+	}
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+	return e
+}
+
+// invalidate drops the responses involving oid.
+func (c *batchCache) invalidate(oid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if c.inflight > 0 {
+		c.changed[oid] = c.gen
+	}
+	for key := range c.byOid[oid] {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *batchCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*batchEntry)
+	delete(c.entries, e.key)
+	for _, oid := range e.oids {
+		delete(c.byOid[oid], e.key)
+		if len(c.byOid[oid]) == 0 {
+			delete(c.byOid, oid)
+		}
+	}
+}
+
+// contentChanged drops the cached batch responses involving oid, whose
+// content was removed or set aside without its meta changing.
+func (a *App) contentChanged(oid string) {
+	if a.batches != nil {
+		a.batches.invalidate(oid)
+	}
+}
+
+// responseETag returns a strong entity tag for a response body.
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchCache(t *testing.T) {
+	app := NewApp(testContentStore, testMetaStore)
+	app.batches = newBatchCache(time.Minute, 10)
+	testMetaStore.OnChange = app.batches.invalidate
+	defer func() { testMetaStore.OnChange = nil }()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	stored := putBulkObject(t, "object of a repeated batch", "repo")
+	defer removeMeta(stored.Oid)
+	defer testContentStore.Delete(stored)
+
+	data := "object uploaded between batches"
+	missing := &MetaObject{Oid: hex.EncodeToString(sha256Sum(data)), Size: int64(len(data))}
+	defer removeMeta(missing.Oid)
+	defer testContentStore.Delete(missing)
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":%d}]}`,
+		stored.Oid, stored.Size, missing.Oid, missing.Size)
+
+	hits := metrics.Get("lfs_batch_cache_hits_total")
+	first, etag := cachedBatch(t, server, body)
+	if first.Objects[1].Error == nil || first.Objects[1].Error.Code != 404 {
+		t.Fatalf("expected the missing object to be reported, got %+v", first.Objects[1])
+	}
+
+	second, again := cachedBatch(t, server, body)
+	if metrics.Get("lfs_batch_cache_hits_total") != hits+1 || again != etag {
+		t.Fatalf("expected the repeated batch to be served from the cache")
+	}
+	if second.Objects[0].Actions["download"] == nil {
+		t.Fatalf("expected the cached response to hold the download, got %+v", second.Objects[0])
+	}
+	if res := batchPost(t, server, body, etag); res.StatusCode != 304 {
+		t.Fatalf("expected status 304 for a known entity tag, got %d", res.StatusCode)
+	}
+
+	// Uploading one of the objects drops the cached response
+	if _, err := testMetaStore.Put(&RequestVars{Oid: missing.Oid, Size: missing.Size, User: testUser, Repo: "repo"}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if err := testContentStore.Put(missing, strings.NewReader(data)); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+	if err := testMetaStore.Update(missing); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	hits = metrics.Get("lfs_batch_cache_hits_total")
+	third, changed := cachedBatch(t, server, body)
+	if metrics.Get("lfs_batch_cache_hits_total") != hits || changed == etag {
+		t.Fatalf("expected the batch to be answered again after an upload")
+	}
+	if third.Objects[1].Error != nil || third.Objects[1].Actions["download"] == nil {
+		t.Fatalf("expected the uploaded object to be downloadable, got %+v", third.Objects[1])
+	}
+}
+
+func TestBatchCacheDropsQuarantinedObjects(t *testing.T) {
+	setup()
+	defer teardown()
+	defer func(v string) { Config.ScrubQuarantine = v }(Config.ScrubQuarantine)
+	Config.ScrubQuarantine = "true"
+
+	app := NewApp(contentStore, testMetaStore)
+	app.batches = newBatchCache(time.Minute, 10)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	meta := putBulkObject(t, "object found corrupt", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+	if err := contentStore.Put(meta, strings.NewReader("object found corrupt")); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, meta.Oid, meta.Size)
+	first, etag := cachedBatch(t, server, body)
+	if first.Objects[0].Actions["download"] == nil {
+		t.Fatalf("expected the object to be downloadable, got %+v", first.Objects[0])
+	}
+
+	app.flagCorrupt(meta)
+	hits := metrics.Get("lfs_batch_cache_hits_total")
+	if _, changed := cachedBatch(t, server, body); metrics.Get("lfs_batch_cache_hits_total") != hits || changed == etag {
+		t.Fatalf("expected the batch to be answered again once the object is quarantined")
+	}
+}
+
+func TestBatchBodyLimit(t *testing.T) {
+	defer func(v string) { Config.MaxBatchSize = v }(Config.MaxBatchSize)
+	Config.MaxBatchSize = "64"
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":1}]}`, contentOid)
+	res := batchPost(t, lfsServer, body, "")
+	res.Body.Close()
+	if res.StatusCode != 413 {
+		t.Fatalf("expected status 413 for a batch over the limit, got %d", res.StatusCode)
+	}
+
+	Config.MaxBatchSize = ""
+	res = batchPost(t, lfsServer, body, "")
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 within the limit, got %d", res.StatusCode)
+	}
+}
+
+func TestBatchCacheBounded(t *testing.T) {
+	c := newBatchCache(time.Minute, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		c.done(key, c.begin(), []string{"oid-" + key}, []byte(key))
+	}
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expected the least recently used entry to be dropped")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("expected the newest entry to be kept")
+	}
+
+	// A response computed while one of its objects changed isn't kept
+	start := c.begin()
+	c.invalidate("oid-d")
+	c.done("d", start, []string{"oid-d"}, []byte("d"))
+	if _, ok := c.get("d"); ok {
+		t.Fatalf("expected a response of changed objects not to be cached")
+	}
+
+	c = newBatchCache(time.Nanosecond, 2)
+	c.done("e", c.begin(), nil, []byte("e"))
+	time.Sleep(time.Millisecond)
+	if _, ok := c.get("e"); ok {
+		t.Fatalf("expected an expired entry not to be served")
+	}
+}
+
+func batchPost(t *testing.T, server *httptest.Server, body, etag string) *http.Response {
+	req, _ := http.NewRequest("POST", server.URL+"/user/repo/objects/batch", bytes.NewBufferString(body))
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
+
+func cachedBatch(t *testing.T, server *httptest.Server, body string) (*BatchResponse, string) {
+	res := batchPost(t, server, body, "")
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	var batch BatchResponse
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
+	}
+	return &batch, res.Header.Get("ETag")
+}
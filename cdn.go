@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cdnPather is implemented by stores whose files a CDN in front of them can
+// serve as they are.
+type cdnPather interface {
+	cdnPath(meta *MetaObject) (string, bool)
+}
+
+// cdnPath returns the location of the object relative to the base of the
+// store, with forward slashes. A store spread over several roots prefixes
+// the index of the object's root, so the CDN can tell them apart. Encrypted,
+// inline and zstd compressed objects, and objects not (or no longer) at
+// their current location, can't be served from the file and are left to the
+// server.
+func (s *ContentStore) cdnPath(meta *MetaObject) (string, bool) {
+	if meta.KeyID != "" || meta.Encoding == encodingZstd || s.inlined(meta) {
+		return "", false
+	}
+
+	path := s.path(meta)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(s.root(meta.Oid), path)
+	if err != nil {
+		return "", false
+	}
+	if len(s.Roots) > 0 {
+		rel = filepath.Join(strconv.Itoa(s.rootIndex(meta.Oid)), rel)
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// cdnLink returns the href of meta on the CDN, if one is configured and can
+// serve the object.
+func (a *App) cdnLink(meta *MetaObject) (string, bool) {
+	if Config.CDNURL == "" {
+		return "", false
+	}
+	p, ok := a.contentStore.(cdnPather)
+	if !ok {
+		return "", false
+	}
+	path, ok := p.cdnPath(meta)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimRight(Config.CDNURL, "/") + "/" + path, true
+}
+
+// redirectToCDN sends a download of meta to the CDN, returning false if it
+// has to be served directly instead. Ranges of compressed objects and named
+// downloads are served directly, as the CDN serves the file as it's stored.
+func (a *App) redirectToCDN(w http.ResponseWriter, r *http.Request, meta *MetaObject) bool {
+	if r.URL.Query().Get("filename") != "" {
+		return false
+	}
+	if r.Header.Get("Range") != "" && meta.Encoding != encodingIdentity {
+		return false
+	}
+	href, ok := a.cdnLink(meta)
+	if !ok {
+		return false
+	}
+
+	metrics.Add("lfs_cdn_redirects_total", 1)
+	if !resumed(r) {
+		a.downloadCounts.Add(meta.Oid, time.Now())
+	}
+	http.Redirect(w, r, newLink(href, "GET", nil).Href, http.StatusFound)
+	logRequest(r, http.StatusFound)
+	return true
+}
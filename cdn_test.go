@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatchDownloadFromCDN(t *testing.T) {
+	defer func(v string) { Config.CDNURL = v }(Config.CDNURL)
+	Config.CDNURL = "https://cdn.example.com/lfs/"
+
+	meta := putBulkObject(t, "content served by the cdn", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, meta.Oid, meta.Size)
+	download := batchRequest(t, bytes.NewBufferString(body)).Objects[0].Actions["download"]
+	if download == nil {
+		t.Fatalf("expected a download action")
+	}
+	if href := "https://cdn.example.com/lfs/" + transformKey(meta.Oid) + ".gz"; download.Href != href {
+		t.Fatalf("expected the download from %s, got %s", href, download.Href)
+	}
+	if _, ok := download.Header["Authorization"]; ok {
+		t.Fatalf("expected no credentials to be sent to the cdn")
+	}
+
+	defer func(v string) { Config.SigningKey = v }(Config.SigningKey)
+	Config.SigningKey = "cdn signing key"
+	download = batchRequest(t, bytes.NewBufferString(body)).Objects[0].Actions["download"]
+	if !strings.HasPrefix(download.Href, "https://cdn.example.com/lfs/") || !strings.Contains(download.Href, "signature=") || download.ExpiresAt == nil {
+		t.Fatalf("expected a signed cdn href, got %+v", download)
+	}
+}
+
+func TestGetContentRedirectsToCDN(t *testing.T) {
+	defer func(v string) { Config.CDNURL = v }(Config.CDNURL)
+	Config.CDNURL = "https://cdn.example.com"
+
+	meta := putBulkObject(t, "content redirected to the cdn", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	res := getObject(t, meta.Oid, "")
+	if res.StatusCode != 302 || res.Header.Get("Location") != "https://cdn.example.com/"+transformKey(meta.Oid)+".gz" {
+		t.Fatalf("expected a redirect to the cdn, got %d to %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	// The stored file is compressed, so its ranges aren't the object's
+	if res := getObject(t, meta.Oid, "bytes=2-"); res.StatusCode != 206 {
+		t.Fatalf("expected a range to be served directly, got %d", res.StatusCode)
+	}
+
+	Config.CDNURL = ""
+	if res := getObject(t, meta.Oid, ""); res.StatusCode != 200 {
+		t.Fatalf("expected the content to be served without a cdn, got %d", res.StatusCode)
+	}
+}
+
+func TestCDNPathOfRoots(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.Roots = []string{"content-store-test/disk0", "content-store-test/disk1", "content-store-test/disk2"}
+
+	data := "content on one of the roots"
+	sum := sha256.Sum256([]byte(data))
+	m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if err := contentStore.Put(m, strings.NewReader(data)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	path, ok := contentStore.cdnPath(m)
+	if want := fmt.Sprintf("%d/%s.gz", int(sum[0])%3, transformKey(m.Oid)); !ok || path != want {
+		t.Fatalf("expected the cdn path %s, got %q", want, path)
+	}
+}
+
+func getObject(t *testing.T, oid, rangeHdr string) *http.Response {
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+oid, nil)
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	if rangeHdr != "" {
+		req.Header.Set("Range", rangeHdr)
+	}
+	res, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	return res
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of TrustedProxies, parsed once at startup,
+// and trustedHeader the header they name the client in.
+var (
+	trustedProxies []*net.IPNet
+	trustedHeader  = "X-Forwarded-For"
+)
+
+// ClientIP returns the address of the client that made r, looking through the
+// proxies configured in TrustedProxies. Everything that treats clients by
+// their address uses it, so no two features can disagree about who a client
+// is.
+func ClientIP(r *http.Request) string {
+	return clientIP(r, trustedProxies, trustedHeader)
+}
+
+// clientIP returns the address of the client that made r. The peer address is
+// only trusted to forward for someone else if it is in trusted, in which case
+// the forwarded addresses of header, Forwarded or X-Forwarded-For, are
+// followed back, nearest first, to the first one that isn't.
+func clientIP(r *http.Request, trusted []*net.IPNet, header string) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	hops := forwardedFor(r, header)
+	for i := len(hops) - 1; i >= 0 && isTrusted(ip, trusted); i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		ip = hops[i]
+	}
+	return ip
+}
+
+// forwardedFor returns the addresses r was forwarded for according to header,
+// the client first. Addresses are unparsed, so an obfuscated or unknown hop
+// ends the chain.
+func forwardedFor(r *http.Request, header string) []string {
+	var hops []string
+
+	if header == "Forwarded" {
+		values := r.Header["Forwarded"]
+		if len(values) == 0 {
+			return nil
+		}
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = forwardedNode(strings.Trim(kv[1], `"`))
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+
+	for _, hop := range strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the port from a node of a Forwarded header, which is
+// either an IPv4 address or a bracketed IPv6 address, optionally with a port.
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return ""
+	}
+	if i := strings.Index(node, ":"); i >= 0 {
+		return node[:i]
+	}
+	return node
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	defer setTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8", "X-Forwarded-For")()
+
+	tests := []struct {
+		remote, header, forwarded, expected string
+	}{
+		// Direct connections
+		{"203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"[2001:db8::1]:1234", "", "", "2001:db8::1"},
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+
+		// An untrusted peer can't claim to forward for someone else
+		{"203.0.113.5:1234", "X-Forwarded-For", "198.51.100.7", "203.0.113.5"},
+		{"203.0.113.5:1234", "Forwarded", "for=198.51.100.7", "203.0.113.5"},
+
+		// Chains through trusted proxies
+		{"10.1.2.3:1234", "X-Forwarded-For", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "X-Forwarded-For", "198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"[fd00::2]:1234", "X-Forwarded-For", "2001:db8::7", "2001:db8::7"},
+		{"10.1.2.3:1234", "Forwarded", `for=198.51.100.7;proto=https, for="[fd00::3]:4711"`, "198.51.100.7"},
+		{"10.1.2.3:1234", "Forwarded", `For="198.51.100.7:80"`, "198.51.100.7"},
+
+		// Spoofed hops before the first untrusted address are ignored
+		{"10.1.2.3:1234", "X-Forwarded-For", "1.2.3.4, 198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "Forwarded", "for=1.2.3.4, for=198.51.100.7", "198.51.100.7"},
+
+		// Hops that aren't addresses end the chain
+		{"10.1.2.3:1234", "X-Forwarded-For", "garbage", "10.1.2.3"},
+		{"10.1.2.3:1234", "Forwarded", "for=1.2.3.4, for=_hidden", "10.1.2.3"},
+		{"10.1.2.3:1234", "Forwarded", "for=1.2.3.4, by=10.0.0.1", "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.header != "" {
+			r.Header.Set(test.header, test.forwarded)
+			trustedHeader = test.header
+		}
+
+		if ip := ClientIP(r); ip != test.expected {
+			t.Errorf("expected client IP %s for %s via %s %q, got %s", test.expected, test.remote, test.header, test.forwarded, ip)
+		}
+	}
+}
+
+func TestClientIPHeaders(t *testing.T) {
+	defer setTrustedProxies("10.0.0.0/8", "X-Forwarded-For")()
+
+	// Every X-Forwarded-For line counts, in order
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Add("X-Forwarded-For", "198.51.100.7")
+	r.Header.Add("X-Forwarded-For", "10.0.0.9")
+	if ip := ClientIP(r); ip != "198.51.100.7" {
+		t.Errorf("expected the hops of all lines to be followed, got %s", ip)
+	}
+
+	// Only the configured header is read, whatever the other one claims
+	r.Header.Set("Forwarded", "for=203.0.113.9")
+	if ip := ClientIP(r); ip != "198.51.100.7" {
+		t.Errorf("expected Forwarded to be ignored, got %s", ip)
+	}
+
+	trustedHeader = "Forwarded"
+	if ip := ClientIP(r); ip != "203.0.113.9" {
+		t.Errorf("expected Forwarded to be used, got %s", ip)
+	}
+	r.Header.Del("Forwarded")
+	if ip := ClientIP(r); ip != "10.1.2.3" {
+		t.Errorf("expected X-Forwarded-For to be ignored, got %s", ip)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	defer func(header string) { Config.TrustedProxyHeader = header }(Config.TrustedProxyHeader)
+
+	for value, expected := range map[string]string{"forwarded": "Forwarded", "X-Forwarded-For": "X-Forwarded-For"} {
+		Config.TrustedProxyHeader = value
+		if h, err := Config.ProxyHeader(); h != expected || err != nil {
+			t.Errorf("expected %s for %q, got %q: %v", expected, value, h, err)
+		}
+	}
+
+	Config.TrustedProxyHeader = "X-Real-IP"
+	if _, err := Config.ProxyHeader(); err == nil {
+		t.Errorf("expected an unsupported header to be refused")
+	}
+}
+
+// setTrustedProxies makes ClientIP trust proxies to name the client in
+// header, and returns a function restoring the previous ones.
+func setTrustedProxies(proxies, header string) func() {
+	previous, nets, previousHeader := Config.TrustedProxies, trustedProxies, trustedHeader
+	Config.TrustedProxies = proxies
+	trustedProxies, trustedHeader = Config.TrustedProxyNets(), header
+	return func() {
+		Config.TrustedProxies, trustedProxies, trustedHeader = previous, nets, previousHeader
+	}
+}
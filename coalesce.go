@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// downloadGroup coalesces concurrent downloads of the same object into a single
+// backend read. The first request spools the object and every concurrent
+// request for the same key reads from the spool as it grows. Objects up to
+// memoryLimit bytes are spooled in memory, larger ones to a temporary file in
+// dir.
+type downloadGroup struct {
+	dir         string
+	memoryLimit int64
+
+	mu      sync.Mutex
+	flights map[string]*downloadFlight
+}
+
+func newDownloadGroup(dir string, memoryLimit int64) *downloadGroup {
+	return &downloadGroup{dir: dir, memoryLimit: memoryLimit, flights: make(map[string]*downloadFlight)}
+}
+
+// spoolBuffer holds the bytes of a download read so far.
+type spoolBuffer interface {
+	io.ReaderAt
+	io.WriterAt
+	// Remove discards the bytes.
+	Remove()
+}
+
+// spoolFile spools a download to a temporary file. Its name ends in .tmp, so
+// one left behind by a crash is removed like those of interrupted uploads.
+type spoolFile struct {
+	*os.File
+}
+
+func (s *spoolFile) Remove() {
+	s.Close()
+	os.Remove(s.Name())
+}
+
+// memorySpool spools a small download in memory.
+type memorySpool struct {
+	mu  sync.RWMutex
+	buf []byte
+}
+
+func (s *memorySpool) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(s.buf)) {
+		if end > int64(cap(s.buf)) {
+			buf := make([]byte, end, 2*end)
+			copy(buf, s.buf)
+			s.buf = buf
+		}
+		s.buf = s.buf[:end]
+	}
+	return copy(s.buf[off:], p), nil
+}
+
+func (s *memorySpool) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memorySpool) Remove() {
+	s.mu.Lock()
+	s.buf = nil
+	s.mu.Unlock()
+}
+
+// newSpool returns the buffer a download of size bytes is spooled to.
+func (g *downloadGroup) newSpool(size int64) (spoolBuffer, error) {
+	if size <= g.memoryLimit {
+		return &memorySpool{buf: make([]byte, 0, size)}, nil
+	}
+	if err := os.MkdirAll(g.dir, 0750); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(g.dir, "lfs-download-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolFile{f}, nil
+}
+
+type downloadFlight struct {
+	group *downloadGroup
+	key   string
+	ready chan struct{}
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       spoolBuffer
+	size      int64
+	done      bool
+	abandoned bool
+	err       error
+	refs      int
+	cleanOnce sync.Once
+}
+
+// Get returns a reader for the object identified by key, of size bytes,
+// starting at fromByte. fetch opens the object from the backend and is only
+// called if no download of key is already in flight.
+func (g *downloadGroup) Get(key string, size, fromByte int64, fetch func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	g.mu.Lock()
+	f, joined := g.flights[key]
+	if joined {
+		f.mu.Lock()
+		f.refs++
+		f.mu.Unlock()
+	} else {
+		f = &downloadFlight{group: g, key: key, ready: make(chan struct{}), refs: 1}
+		f.cond = sync.NewCond(&f.mu)
+		g.flights[key] = f
+	}
+	g.mu.Unlock()
+
+	if joined {
+		metrics.Add("lfs_download_coalesced_total", 1)
+	} else {
+		f.start(size, fetch)
+	}
+
+	<-f.ready
+	if f.err != nil && f.buf == nil {
+		err := f.err
+		f.release()
+		return nil, err
+	}
+
+	return &flightReader{flight: f, offset: fromByte}, nil
+}
+
+// start opens the backend stream and begins spooling it in the background.
+func (f *downloadFlight) start(size int64, fetch func() (io.ReadCloser, error)) {
+	defer close(f.ready)
+
+	metrics.Add("lfs_download_backend_fetches_total", 1)
+
+	src, err := fetch()
+	if err == nil {
+		f.buf, err = f.group.newSpool(size)
+		if err != nil {
+			src.Close()
+		}
+	}
+
+	if err != nil {
+		f.mu.Lock()
+		f.err = err
+		f.done = true
+		f.mu.Unlock()
+		f.forget()
+		return
+	}
+
+	go f.spool(src)
+}
+
+func (f *downloadFlight) spool(src io.ReadCloser) {
+	defer src.Close()
+
+	buf := make([]byte, 32*1024)
+	var offset int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := f.buf.WriteAt(buf[:n], offset); werr != nil {
+				err = werr
+			}
+			offset += int64(n)
+		}
+
+		f.mu.Lock()
+		if n > 0 {
+			f.size = offset
+		}
+		if err != nil {
+			if err != io.EOF {
+				f.err = err
+			}
+			f.done = true
+		}
+		abandoned := f.abandoned
+		done := f.done
+		f.cond.Broadcast()
+		f.mu.Unlock()
+
+		if abandoned {
+			f.cleanup()
+			return
+		}
+		if done {
+			// Later requests start a fresh download, the file lives on
+			// until the readers of this one are finished.
+			f.forget()
+			f.mu.Lock()
+			refs := f.refs
+			f.mu.Unlock()
+			if refs == 0 {
+				f.cleanup()
+			}
+			return
+		}
+	}
+}
+
+// forget removes the flight from its group so new requests don't join it.
+func (f *downloadFlight) forget() {
+	f.group.mu.Lock()
+	if f.group.flights[f.key] == f {
+		delete(f.group.flights, f.key)
+	}
+	f.group.mu.Unlock()
+}
+
+// release drops a reader's reference. The last reader of a finished flight
+// removes the spool file, the last reader of an unfinished one stops it.
+func (f *downloadFlight) release() {
+	f.group.mu.Lock()
+	f.mu.Lock()
+	f.refs--
+	last := f.refs == 0
+	done := f.done
+	if last && !done {
+		f.abandoned = true
+		if f.group.flights[f.key] == f {
+			delete(f.group.flights, f.key)
+		}
+	}
+	f.mu.Unlock()
+	f.group.mu.Unlock()
+
+	if last && done {
+		f.cleanup()
+	}
+}
+
+func (f *downloadFlight) cleanup() {
+	f.cleanOnce.Do(func() {
+		if f.buf != nil {
+			f.buf.Remove()
+		}
+	})
+}
+
+// flightReader reads a spooled object, waiting for the spool to catch up.
+type flightReader struct {
+	flight *downloadFlight
+	offset int64
+	once   sync.Once
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+
+	f.mu.Lock()
+	for r.offset >= f.size && !f.done {
+		f.cond.Wait()
+	}
+	size, err := f.size, f.err
+	f.mu.Unlock()
+
+	if r.offset >= size {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if remaining := size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := f.buf.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *flightReader) Close() error {
+	r.once.Do(r.flight.release)
+	return nil
+}
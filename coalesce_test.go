@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloadGroupSharesOneFetch(t *testing.T) {
+	g := newDownloadGroup("lfs-coalesce-test", 0)
+	defer os.RemoveAll("lfs-coalesce-test")
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	gate := make(chan struct{})
+
+	var fetches int32
+	fetch := func() (io.ReadCloser, error) {
+		atomic.AddInt32(&fetches, 1)
+		return &gatedReader{Reader: bytes.NewReader(data), gate: gate}, nil
+	}
+
+	var readers []io.ReadCloser
+	for i := 0; i < 20; i++ {
+		r, err := g.Get(contentOid, int64(len(data)), 0, fetch)
+		if err != nil {
+			t.Fatalf("expected get to succeed, got: %s", err)
+		}
+		readers = append(readers, r)
+	}
+	close(gate)
+
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.ReadCloser) {
+			defer wg.Done()
+			defer r.Close()
+			by, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(by, data) {
+				t.Errorf("expected every reader to receive the full content, got %d bytes, %v", len(by), err)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected a single backend fetch, got %d", n)
+	}
+}
+
+func TestDownloadGroupRange(t *testing.T) {
+	g := newDownloadGroup("lfs-coalesce-test", 0)
+	defer os.RemoveAll("lfs-coalesce-test")
+
+	r, err := g.Get(contentOid, int64(len(content)), 5, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString(content)), nil
+	})
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != content[5:] {
+		t.Fatalf("expected content from byte 5, got %q", by)
+	}
+}
+
+func TestDownloadGroupSurvivesDisconnect(t *testing.T) {
+	g := newDownloadGroup("lfs-coalesce-test", 0)
+	defer os.RemoveAll("lfs-coalesce-test")
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+	gate := make(chan struct{})
+
+	fetch := func() (io.ReadCloser, error) {
+		return &gatedReader{Reader: bytes.NewReader(data), gate: gate}, nil
+	}
+
+	quitter, _ := g.Get(contentOid, int64(len(data)), 0, fetch)
+	stayer, _ := g.Get(contentOid, int64(len(data)), 0, fetch)
+	close(gate)
+
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(quitter, buf); err != nil {
+		t.Fatalf("expected partial read to succeed, got: %s", err)
+	}
+	quitter.Close()
+
+	by, err := ioutil.ReadAll(stayer)
+	if err != nil || !bytes.Equal(by, data) {
+		t.Fatalf("expected remaining reader to receive the full content, got %d bytes, %v", len(by), err)
+	}
+
+	name := stayer.(*flightReader).flight.buf.(*spoolFile).Name()
+	if filepath.Dir(name) != "lfs-coalesce-test" {
+		t.Fatalf("expected the spool file in the given directory, got %s", name)
+	}
+	stayer.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("expected spool file to be removed after the last reader closed")
+	}
+}
+
+func TestDownloadGroupSpoolsSmallObjectsInMemory(t *testing.T) {
+	g := newDownloadGroup("lfs-coalesce-test", int64(len(content)))
+
+	r, err := g.Get(contentOid, int64(len(content)), 0, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString(content)), nil
+	})
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	if _, ok := r.(*flightReader).flight.buf.(*memorySpool); !ok {
+		t.Fatalf("expected a small object to be spooled in memory")
+	}
+	if by, _ := ioutil.ReadAll(r); string(by) != content {
+		t.Fatalf("expected the content, got %q", by)
+	}
+}
+
+func TestDownloadGroupFetchError(t *testing.T) {
+	g := newDownloadGroup("lfs-coalesce-test", 0)
+	defer os.RemoveAll("lfs-coalesce-test")
+	boom := errors.New("boom")
+
+	_, err := g.Get(contentOid, int64(len(content)), 0, func() (io.ReadCloser, error) { return nil, boom })
+	if err != boom {
+		t.Fatalf("expected fetch error, got: %v", err)
+	}
+
+	// A failed fetch is not cached
+	r, err := g.Get(contentOid, int64(len(content)), 0, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString(content)), nil
+	})
+	if err != nil {
+		t.Fatalf("expected retry to succeed, got: %s", err)
+	}
+	r.Close()
+}
+
+// gatedReader blocks reads until gate is closed.
+type gatedReader struct {
+	io.Reader
+	gate chan struct{}
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	<-r.gate
+	return r.Reader.Read(p)
+}
+
+func (r *gatedReader) Close() error {
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressibleTypes are the response media types that compressResponse
+// encodes. Object content is never among them, so downloads are passed
+// through untouched.
+var compressibleTypes = []string{metaMediaType, "application/json"}
+
+// compressResponse wraps h so that JSON responses of at least minSize bytes are
+// gzip or deflate encoded, as negotiated through the Accept-Encoding header.
+func compressResponse(h http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, or
+// returns an empty string if neither is acceptable.
+func negotiateEncoding(header string) string {
+	accepted := acceptedEncodings(header)
+	for _, enc := range []string{"gzip", "deflate"} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings returns the encodings of an Accept-Encoding header,
+// mapped to false for those refused with q=0.
+func acceptedEncodings(header string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	return accepted
+}
+
+// brotliDownload returns true if the download r of meta is sent brotli
+// encoded. Object content is stored compressed, but in the encoding of the
+// store, so it's decompressed and encoded again on the way out; ranges are
+// always sent as stored bytes, and every other client gets the identity.
+func brotliDownload(r *http.Request, meta *MetaObject) bool {
+	return Config.IsBrotliDownloading() && r.Header.Get("Range") == "" &&
+		meta.Size <= Config.BrotliMaxBytes() && acceptedEncodings(r.Header.Get("Accept-Encoding"))["br"]
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response is compressible and large enough to be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	buf         []byte
+	decided     bool
+	passthrough bool
+	cw          io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	if !w.compressible() {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+
+	if w.decided {
+		if w.passthrough {
+			return w.ResponseWriter.Write(p)
+		}
+		return w.cw.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close flushes any buffered data, uncompressed if it never reached minSize.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written, let net/http send its default response
+			return nil
+		}
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.cw != nil {
+		return w.cw.Close()
+	}
+	return nil
+}
+
+// Flush sends what was written so far, so streamed responses aren't held up.
+// A response not decided on yet is sent uncompressed.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.WriteHeader(200)
+		}
+		if !w.decided {
+			w.decide(false)
+		}
+	}
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) compressible() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || w.status == 204 || w.status == 304 {
+		return false
+	}
+
+	mt := strings.TrimSpace(strings.Split(h.Get("Content-Type"), ";")[0])
+	for _, t := range compressibleTypes {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	w.passthrough = !compress
+
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+
+		if w.encoding == "gzip" {
+			w.cw = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.cw, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if compress {
+		_, err := w.cw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
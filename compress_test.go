@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                      "",
+		"gzip":                  "gzip",
+		"deflate, gzip":         "gzip",
+		"deflate":               "deflate",
+		"gzip;q=0, deflate":     "deflate",
+		"br":                    "",
+		"GZIP;q=0.5":            "gzip",
+		"identity, gzip;q=0.0":  "",
+		" gzip ; q=1 , deflate": "gzip",
+	}
+
+	for header, expected := range cases {
+		if enc := negotiateEncoding(header); enc != expected {
+			t.Errorf("expected %q for %q, got %q", expected, header, enc)
+		}
+	}
+}
+
+func TestLargeBatchResponseIsCompressed(t *testing.T) {
+	var objects []string
+	for i := 0; i < 100; i++ {
+		objects = append(objects, fmt.Sprintf(`{"oid":"%064x","size":%d}`, i, i))
+	}
+	body := fmt.Sprintf(`{"operation":"download","objects":[%s]}`, strings.Join(objects, ","))
+
+	res := compressedRequest(t, "POST", "/user/repo/objects/batch", metaMediaType, body)
+	if enc := res.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("expected gzip Content-Encoding, got %q", enc)
+	}
+
+	g, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("expected gzip body, got error: %s", err)
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(g).Decode(&batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
+	}
+	if len(batch.Objects) != 100 {
+		t.Fatalf("expected 100 objects, got %d", len(batch.Objects))
+	}
+}
+
+func TestSmallJSONResponseIsNotCompressed(t *testing.T) {
+	res := compressedRequest(t, "GET", "/user/repo/objects/"+contentOid, metaMediaType, "")
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("expected no Content-Encoding, got %q", enc)
+	}
+
+	var rep Representation
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		t.Fatalf("expected representation, got error: %s", err)
+	}
+}
+
+func TestObjectDownloadIsNotCompressed(t *testing.T) {
+	res := compressedRequest(t, "GET", "/user/repo/objects/"+contentOid, contentMediaType, "")
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("expected no Content-Encoding, got %q", enc)
+	}
+
+	by, _ := ioutil.ReadAll(res.Body)
+	if string(by) != content {
+		t.Fatalf("expected raw content, got %q", by)
+	}
+}
+
+func TestObjectDownloadIsBrotliEncoded(t *testing.T) {
+	defer func(v string) { Config.BrotliDownloads = v }(Config.BrotliDownloads)
+	defer func(v string) { Config.BrotliMaxSize = v }(Config.BrotliMaxSize)
+	Config.BrotliDownloads = "true"
+
+	download := func(accept, rng string) *http.Response {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Accept-Encoding", accept)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		return res
+	}
+
+	res := download("gzip, br", "")
+	if enc := res.Header.Get("Content-Encoding"); enc != "br" || res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected a brotli encoded download varying on Accept-Encoding, got %q", enc)
+	}
+	by, err := ioutil.ReadAll(brotli.NewReader(res.Body))
+	if err != nil || string(by) != content {
+		t.Fatalf("expected the brotli stream to decode to the content, got %q: %v", by, err)
+	}
+
+	// Ranges, clients refusing brotli and objects over the limit get the
+	// content as is
+	for _, c := range []struct{ accept, rng, want, max string }{
+		{"br", "bytes=10-", content[10:], ""},
+		{"gzip, br;q=0", "", content, ""},
+		{"br", "", content, strconv.FormatInt(contentSize-1, 10)},
+	} {
+		Config.BrotliMaxSize = c.max
+		res := download(c.accept, c.rng)
+		by, _ := ioutil.ReadAll(res.Body)
+		if enc := res.Header.Get("Content-Encoding"); enc != "" || string(by) != c.want {
+			t.Errorf("expected %q with range %q to be sent unencoded, got %q as %q", c.accept, c.rng, by, enc)
+		}
+	}
+}
+
+func compressedRequest(t *testing.T, method, path, accept, body string) *http.Response {
+	defer func(min string) { Config.CompressResponsesMinSize = min }(Config.CompressResponsesMinSize)
+	Config.CompressResponsesMinSize = "512"
+
+	req, err := http.NewRequest(method, lfsServer.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// Setting Accept-Encoding ourselves stops the transport from
+	// transparently decompressing the response.
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
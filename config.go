@@ -2,27 +2,141 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Configuration holds application configuration. Values will be pulled from
 // environment variables, prefixed by keyPrefix. Default values can be added
 // via tags.
 type Configuration struct {
-	Listen      string `config:"tcp://:8080"`
-	Host        string `config:"localhost:8080"`
-	MetaDB      string `config:"lfs.db"`
-	ContentPath string `config:"lfs-content"`
-	AdminUser   string `config:""`
-	AdminPass   string `config:""`
-	Cert        string `config:""`
-	Key         string `config:""`
-	Scheme      string `config:"http"`
-	Public      string `config:"public"`
-	UseTus      string `config:"false"`
-	TusHost     string `config:"localhost:1080"`
+	Listen                   string `config:"tcp://:8080"`
+	Host                     string `config:"localhost:8080"`
+	MetaDB                   string `config:"lfs.db"`
+	ContentPath              string `config:"lfs-content"`
+	AdminUser                string `config:""`
+	AdminPass                string `config:""`
+	Cert                     string `config:""`
+	Key                      string `config:""`
+	Scheme                   string `config:"http"`
+	Public                   string `config:"public"`
+	UseTus                   string `config:"false"`
+	TusHost                  string `config:"localhost:1080"`
+	ReplicaPath              string `config:""`
+	ReplicaRead              string `config:"false"`
+	DrainTimeout             string `config:"30s"`
+	SigningKey               string `config:""`
+	LinkLifetime             string `config:"15m"`
+	CompressMaxSize          string `config:"0"`
+	MinPasswordLength        string `config:"8"`
+	CompressResponses        string `config:"true"`
+	CompressResponsesMinSize string `config:"1024"`
+	CoalesceDownloads        string `config:"false"`
+	CoalesceMemorySize       string `config:"1048576"`
+	ContentLayout            string `config:"sharded"`
+	LegacyContentLayout      string `config:""`
+	MaxCompressionRatio      string `config:"0"`
+	FreeSpaceMargin          string `config:"104857600"`
+	SizeOptional             string `config:"false"`
+	Compression              string `config:"gzip"`
+	CompressionLevel         string `config:"0"`
+	UploadWait               string `config:"30s"`
+	ScrubRate                string `config:"0"`
+	ScrubInterval            string `config:"24h"`
+	ScrubQuarantine          string `config:"false"`
+	MaxRequestsPerIP         string `config:"0"`
+	MaxConnectionsPerIP      string `config:"0"`
+	TrustedProxies           string `config:""`
+	TrustedProxyHeader       string `config:"X-Forwarded-For"`
+	ObjectTTL                string `config:"0"`
+	ExpirySweepInterval      string `config:"1h"`
+	ExpirySweepJitter        string `config:"5m"`
+	ExpirySweepLimit         string `config:"1000"`
+	CORSOrigins              string `config:""`
+	CORSMethods              string `config:"GET,HEAD,POST,PUT,OPTIONS"`
+	CORSHeaders              string `config:"Accept,Authorization,Content-Type"`
+	CORSCredentials          string `config:"false"`
+	TempGracePeriod          string `config:"1h"`
+	RequestTimeout           string `config:"1h"`
+	UploadTimeout            string `config:""`
+	DownloadTimeout          string `config:""`
+	HeaderTimeout            string `config:"0"`
+	IdleTimeout              string `config:"0"`
+	MaxObjectSize            string `config:"0"`
+	EncryptionKeys           string `config:""`
+	EncryptionKeyFile        string `config:""`
+	ActionRoles              string `config:""`
+	UpstreamURL              string `config:""`
+	UpstreamUser             string `config:""`
+	UpstreamPass             string `config:""`
+	SkipCompression          string `config:""`
+	LogBufferSize            string `config:"1000"`
+	SizeClasses              string `config:""`
+	OIDCIssuer               string `config:""`
+	OIDCClientID             string `config:""`
+	OIDCClientSecret         string `config:""`
+	OIDCRedirectURL          string `config:""`
+	OIDCScopes               string `config:"openid profile email groups"`
+	OIDCAdminClaim           string `config:"groups"`
+	OIDCAdminValue           string `config:""`
+	OIDCSessionLifetime      string `config:"8h"`
+	VouchIntegrity           string `config:"false"`
+	IntegrityMaxAge          string `config:"24h"`
+	IntegrityMaxSize         string `config:"16777216"`
+	IntegrityBatchSize       string `config:"67108864"`
+	StatsInterval            string `config:"10s"`
+	DeleteGracePeriod        string `config:"0"`
+	LogSampling              string `config:""`
+	LogSamplingSlow          string `config:"1s"`
+	InlineMaxSize            string `config:"0"`
+	CDNURL                   string `config:""`
+	GCWorkers                string `config:"4"`
+	GCBatchSize              string `config:"1000"`
+	MaxTagsSize              string `config:"1024"`
+	CompressionBands         string `config:""`
+	VerifyWorkers            string `config:"4"`
+	BatchCacheTTL            string `config:"0"`
+	BatchCacheSize           string `config:"1000"`
+	MaxBatchSize             string `config:"10485760"`
+	SeedEmptyObject          string `config:"false"`
+	RehashRate               string `config:"10"`
+	ContentCacheSize         string `config:"0"`
+	ContentCacheMaxObject    string `config:"65536"`
+	FaultInjection           string `config:"false"`
+	UpstreamPurge            string `config:"false"`
+	UpstreamPurgeCheck       string `config:"1h"`
+	TusIdle                  string `config:"5m"`
+	UploadSlots              string `config:"0"`
+	UploadWeights            string `config:""`
+	UploadQueueWait          string `config:"1m"`
+	ContentRoots             string `config:""`
+	DownloadCounts           string `config:"false"`
+	DownloadCountDays        string `config:"0"`
+	DownloadCountInterval    string `config:"30s"`
+	StorageQuota             string `config:"0"`
+	NamespaceQuota           string `config:"0"`
+	QuotaReservation         string `config:"1h"`
+	DownloadRate             string `config:"0"`
+	DownloadRoleRates        string `config:""`
+	RekeyRate                string `config:"10"`
+	UploadTimeoutPerGB       string `config:"0"`
+	UploadIdleTimeout        string `config:"0"`
+	BrotliDownloads          string `config:"false"`
+	BrotliMaxSize            string `config:"16777216"`
+	LogOutput                string `config:"stdout"`
+	SyslogAddress            string `config:""`
+	SyslogFacility           string `config:"local0"`
+	SyslogTag                string `config:"lfs-test-server"`
+	DurabilityWebhook        string `config:""`
+	DurabilityWebhookSecret  string `config:""`
+	EntropySkip              string `config:"0"`
+	StorageEncodingHeader    string `config:"false"`
+	ContentBackend           string `config:"disk"`
 }
 
 func (c *Configuration) IsHTTPS() bool {
@@ -30,15 +144,641 @@ func (c *Configuration) IsHTTPS() bool {
 }
 
 func (c *Configuration) IsPublic() bool {
-	switch Config.Public {
-	case "1", "true", "TRUE":
-		return true
-	}
-	return false
+	return isTrue(Config.Public)
 }
 
 func (c *Configuration) IsUsingTus() bool {
-	switch Config.UseTus {
+	return isTrue(Config.UseTus)
+}
+
+// IsReplicating returns true if uploads are mirrored to a secondary content store.
+func (c *Configuration) IsReplicating() bool {
+	return Config.ReplicaPath != ""
+}
+
+// IsReadingFromReplica returns true if downloads fall back to the secondary
+// content store when the primary read fails.
+func (c *Configuration) IsReadingFromReplica() bool {
+	return c.IsReplicating() && isTrue(Config.ReplicaRead)
+}
+
+// ShutdownTimeout returns how long shutdown hooks may take to drain queued work.
+func (c *Configuration) ShutdownTimeout() time.Duration {
+	return parseDuration(Config.DrainTimeout, 30*time.Second)
+}
+
+// IsUsingOIDC returns true if admins log in through an OIDC provider.
+func (c *Configuration) IsUsingOIDC() bool {
+	return Config.OIDCIssuer != ""
+}
+
+// AdminSessionLifetime returns how long an admin stays logged in through OIDC.
+func (c *Configuration) AdminSessionLifetime() time.Duration {
+	return parseDuration(Config.OIDCSessionLifetime, 8*time.Hour)
+}
+
+// IsVouchingIntegrity returns true if download actions state that the server
+// verified the content.
+func (c *Configuration) IsVouchingIntegrity() bool {
+	return isTrue(Config.VouchIntegrity)
+}
+
+// IntegrityLifetime returns how long a verification of an object's content is
+// vouched for.
+func (c *Configuration) IntegrityLifetime() time.Duration {
+	return parseDuration(Config.IntegrityMaxAge, 24*time.Hour)
+}
+
+// IntegrityMaxBytes returns the largest object that is verified while
+// answering a batch request.
+func (c *Configuration) IntegrityMaxBytes() int64 {
+	return parseSize(Config.IntegrityMaxSize, 16<<20)
+}
+
+// IntegrityBatchBytes returns how many bytes are hashed at most while
+// answering one batch request.
+func (c *Configuration) IntegrityBatchBytes() int64 {
+	return parseSize(Config.IntegrityBatchSize, 64<<20)
+}
+
+// StatsFlushInterval returns how often lifetime counters are written to the
+// meta store, or 0 if they aren't kept.
+func (c *Configuration) StatsFlushInterval() time.Duration {
+	return parseDuration(Config.StatsInterval, 10*time.Second)
+}
+
+// LogSamplingSlowThreshold returns the duration from which requests are
+// always logged, or 0 if slow requests are sampled like the others.
+func (c *Configuration) LogSamplingSlowThreshold() time.Duration {
+	return parseDuration(Config.LogSamplingSlow, time.Second)
+}
+
+// InlineMaxBytes returns the largest object size kept in the meta store
+// rather than a file, or 0 if no objects are.
+func (c *Configuration) InlineMaxBytes() int64 {
+	return parseSize(Config.InlineMaxSize, 0)
+}
+
+// GCWorkerCount returns the number of shards of the content store the
+// garbage collector scans at once.
+func (c *Configuration) GCWorkerCount() int {
+	if n := int(parseSize(Config.GCWorkers, 4)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// GCBatch returns the number of oids the garbage collector looks up in the
+// meta store at once.
+func (c *Configuration) GCBatch() int {
+	if n := int(parseSize(Config.GCBatchSize, 1000)); n > 0 {
+		return n
+	}
+	return 1000
+}
+
+// MaxTagBytes returns the largest size of the tags of an object, encoded as
+// JSON.
+func (c *Configuration) MaxTagBytes() int64 {
+	return parseSize(Config.MaxTagsSize, 1024)
+}
+
+// VerifyWorkerCount returns the number of objects the verify command reads
+// at once.
+func (c *Configuration) VerifyWorkerCount() int {
+	if n := int(parseSize(Config.VerifyWorkers, 4)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// BatchCacheLifetime returns how long the response of a batch request is
+// reused for identical requests, or 0 if responses aren't cached.
+func (c *Configuration) BatchCacheLifetime() time.Duration {
+	return parseDuration(Config.BatchCacheTTL, 0)
+}
+
+// BatchCacheEntries returns the number of batch responses kept.
+func (c *Configuration) BatchCacheEntries() int {
+	if n := int(parseSize(Config.BatchCacheSize, 1000)); n > 0 {
+		return n
+	}
+	return 1000
+}
+
+// BatchBodyLimit returns the largest batch request body read, in bytes.
+func (c *Configuration) BatchBodyLimit() int64 {
+	if n := parseSize(Config.MaxBatchSize, 10<<20); n > 0 {
+		return n
+	}
+	return 10 << 20
+}
+
+// IsSeedingEmptyObject returns true if the object of empty content is stored
+// at startup.
+func (c *Configuration) IsSeedingEmptyObject() bool {
+	return isTrue(Config.SeedEmptyObject)
+}
+
+// RehashBytesPerSecond returns the throughput of rehash jobs that don't set
+// their own, or 0 if they aren't throttled. RehashRate is given in MB/s.
+func (c *Configuration) RehashBytesPerSecond() int64 {
+	r, err := strconv.ParseFloat(Config.RehashRate, 64)
+	if err != nil || r < 0 {
+		return 0
+	}
+	return int64(r * 1024 * 1024)
+}
+
+// ContentCacheBytes returns how many bytes of decompressed content are kept
+// in memory for downloads, or 0 if none are.
+func (c *Configuration) ContentCacheBytes() int64 {
+	return parseSize(Config.ContentCacheSize, 0)
+}
+
+// ContentCacheObjectBytes returns the largest object kept in the content
+// cache.
+func (c *Configuration) ContentCacheObjectBytes() int64 {
+	return parseSize(Config.ContentCacheMaxObject, 65536)
+}
+
+// IsInjectingFaults returns true if faults can be injected into the content
+// store through the admin API, which also takes a build with the chaos tag.
+func (c *Configuration) IsInjectingFaults() bool {
+	return isTrue(Config.FaultInjection)
+}
+
+// IsPurgingUpstreamGone returns true if mirrored objects are purged once
+// the upstream server reports them gone.
+func (c *Configuration) IsPurgingUpstreamGone() bool {
+	return isTrue(Config.UpstreamPurge)
+}
+
+// UpstreamPurgeInterval returns the pause between two sweeps asking
+// upstream about the mirrored objects.
+func (c *Configuration) UpstreamPurgeInterval() time.Duration {
+	return parseDuration(Config.UpstreamPurgeCheck, time.Hour)
+}
+
+// TusIdleTime returns how long a tus upload session has to receive no data
+// to be reported inactive.
+func (c *Configuration) TusIdleTime() time.Duration {
+	return parseDuration(Config.TusIdle, 5*time.Minute)
+}
+
+// UploadConcurrency returns how many uploads may be in progress at once, or
+// 0 if it isn't limited.
+func (c *Configuration) UploadConcurrency() int {
+	return int(parseSize(Config.UploadSlots, 0))
+}
+
+// UploadWeightPolicy returns the weights of roles in sharing the upload
+// slots.
+func (c *Configuration) UploadWeightPolicy() (map[string]float64, error) {
+	return parseUploadWeights(Config.UploadWeights)
+}
+
+// UploadQueueTime returns how long an upload waits for a slot before it's
+// refused.
+func (c *Configuration) UploadQueueTime() time.Duration {
+	return parseDuration(Config.UploadQueueWait, time.Minute)
+}
+
+// ContentRootPaths returns the base paths objects are spread over, or none
+// if they're all stored under ContentPath. ContentRoots is a comma
+// separated list.
+func (c *Configuration) ContentRootPaths() []string {
+	var roots []string
+	for _, p := range strings.Split(Config.ContentRoots, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			roots = append(roots, p)
+		}
+	}
+	return roots
+}
+
+// IsCountingDownloads returns true if the downloads of every object are
+// counted.
+func (c *Configuration) IsCountingDownloads() bool {
+	return isTrue(Config.DownloadCounts)
+}
+
+// DownloadCountDaysKept returns how many days of per-day download counts are
+// kept, or 0 to keep only the totals.
+func (c *Configuration) DownloadCountDaysKept() int {
+	return int(parseSize(Config.DownloadCountDays, 0))
+}
+
+// DownloadCountFlushInterval returns how often download counts are written
+// to the meta store.
+func (c *Configuration) DownloadCountFlushInterval() time.Duration {
+	if d := parseDuration(Config.DownloadCountInterval, 0); d > 0 {
+		return d
+	}
+	return 30 * time.Second
+}
+
+// StorageQuotaBytes returns how many bytes all objects together may take, or
+// 0 if there is no limit.
+func (c *Configuration) StorageQuotaBytes() int64 {
+	return parseSize(Config.StorageQuota, 0)
+}
+
+// NamespaceQuotaBytes returns how many bytes the objects the repos of one
+// namespace reference may take, or 0 if there is no limit.
+func (c *Configuration) NamespaceQuotaBytes() int64 {
+	return parseSize(Config.NamespaceQuota, 0)
+}
+
+// QuotaReservationLifetime returns how long an object a batch offered for
+// upload takes room in the quotas while its upload hasn't started.
+func (c *Configuration) QuotaReservationLifetime() time.Duration {
+	return parseDuration(Config.QuotaReservation, time.Hour)
+}
+
+// DownloadBytesPerSecond returns the rate the content of each download is
+// sent at, or 0 if downloads aren't throttled. DownloadRate is given in MB/s.
+func (c *Configuration) DownloadBytesPerSecond() int64 {
+	r, err := strconv.ParseFloat(Config.DownloadRate, 64)
+	if err != nil || r < 0 {
+		return 0
+	}
+	return int64(r * 1024 * 1024)
+}
+
+// DownloadRatePolicy returns the download rates of roles that have their
+// own, in bytes per second.
+func (c *Configuration) DownloadRatePolicy() (map[string]int64, error) {
+	return parseDownloadRates(Config.DownloadRoleRates)
+}
+
+// RekeyBytesPerSecond returns the throughput of rekey jobs that don't set
+// their own, or 0 if they aren't throttled. RekeyRate is given in MB/s.
+func (c *Configuration) RekeyBytesPerSecond() int64 {
+	r, err := strconv.ParseFloat(Config.RekeyRate, 64)
+	if err != nil || r < 0 {
+		return 0
+	}
+	return int64(r * 1024 * 1024)
+}
+
+// IsBrotliDownloading returns true if downloads of whole objects are brotli
+// encoded for clients accepting it.
+func (c *Configuration) IsBrotliDownloading() bool {
+	return isTrue(Config.BrotliDownloads)
+}
+
+// BrotliMaxBytes returns the size of the largest object brotli encoded on
+// download, as encoding is expensive.
+func (c *Configuration) BrotliMaxBytes() int64 {
+	return parseSize(Config.BrotliMaxSize, 16<<20)
+}
+
+// IsLoggingToStdout returns true if log entries are written to stdout, with
+// a LogOutput of stdout or both.
+func (c *Configuration) IsLoggingToStdout() bool {
+	return Config.LogOutput == "stdout" || Config.LogOutput == "both"
+}
+
+// IsLoggingToSyslog returns true if log entries are sent to syslog, with a
+// LogOutput of syslog or both.
+func (c *Configuration) IsLoggingToSyslog() bool {
+	return Config.LogOutput == "syslog" || Config.LogOutput == "both"
+}
+
+// IsNotifyingDurability returns true if a signed callback is posted to
+// DurabilityWebhook for every object durably stored.
+func (c *Configuration) IsNotifyingDurability() bool {
+	return Config.DurabilityWebhook != ""
+}
+
+// IsSigningLinks returns true if object hrefs carry an expiring signature.
+func (c *Configuration) IsSigningLinks() bool {
+	return Config.SigningKey != ""
+}
+
+// SignedLinkLifetime returns how long a signed object href remains valid.
+func (c *Configuration) SignedLinkLifetime() time.Duration {
+	return parseDuration(Config.LinkLifetime, 15*time.Minute)
+}
+
+// CompressionLimit returns the largest object size that is stored compressed,
+// or 0 if every object is compressed.
+func (c *Configuration) CompressionLimit() int64 {
+	return parseSize(Config.CompressMaxSize, 0)
+}
+
+// SkipCompressionTypes returns the lowercased file extensions and media types
+// of uploads stored uncompressed.
+func (c *Configuration) SkipCompressionTypes() []string {
+	var types []string
+	for _, t := range strings.Split(Config.SkipCompression, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// EntropySkipBits returns the entropy, in bits per byte, from which the
+// content of uploads is stored as is, or 0 to not measure it.
+func (c *Configuration) EntropySkipBits() float64 {
+	b, err := strconv.ParseFloat(Config.EntropySkip, 64)
+	if err != nil || b < 0 || b > 8 {
+		return 0
+	}
+	return b
+}
+
+// IsHonoringStorageEncoding returns true if uploads may choose the encoding
+// they are stored in with an X-Lfs-Storage-Encoding header.
+func (c *Configuration) IsHonoringStorageEncoding() bool {
+	return isTrue(Config.StorageEncodingHeader)
+}
+
+// LogBufferEntries returns how many recent log entries are kept for the admin
+// API, or 0 to keep none.
+func (c *Configuration) LogBufferEntries() int {
+	return int(parseSize(Config.LogBufferSize, 1000))
+}
+
+// CompressionLevelValue returns the compression level of new objects, or 0
+// for the default of the compression algorithm.
+func (c *Configuration) CompressionLevelValue() int {
+	return int(parseSize(Config.CompressionLevel, 0))
+}
+
+// CompressionRatioLimit returns the largest decompressed:compressed ratio a
+// stored object may have, or 0 if the ratio isn't checked.
+func (c *Configuration) CompressionRatioLimit() float64 {
+	r, err := strconv.ParseFloat(Config.MaxCompressionRatio, 64)
+	if err != nil || r < 0 {
+		return 0
+	}
+	return r
+}
+
+// ScrubBytesPerSecond returns the throughput of the background scrubber, or 0
+// if scrubbing is disabled. ScrubRate is given in MB/s.
+func (c *Configuration) ScrubBytesPerSecond() int64 {
+	r, err := strconv.ParseFloat(Config.ScrubRate, 64)
+	if err != nil || r < 0 {
+		return 0
+	}
+	return int64(r * 1024 * 1024)
+}
+
+// IsScrubbing returns true if objects are verified in the background.
+func (c *Configuration) IsScrubbing() bool {
+	return c.ScrubBytesPerSecond() > 0
+}
+
+// ScrubPause returns the pause between two scrubs of all objects.
+func (c *Configuration) ScrubPause() time.Duration {
+	return parseDuration(Config.ScrubInterval, 24*time.Hour)
+}
+
+// IsQuarantiningScrubFailures returns true if objects failing scrubbing are
+// set aside.
+func (c *Configuration) IsQuarantiningScrubFailures() bool {
+	return isTrue(Config.ScrubQuarantine)
+}
+
+// ObjectLifetime returns how long after upload objects expire, or 0 if they
+// don't.
+func (c *Configuration) ObjectLifetime() time.Duration {
+	return parseDuration(Config.ObjectTTL, 0)
+}
+
+// ExpirySweepPause returns the time between two expiry sweeps, or 0 if
+// expired objects aren't swept.
+func (c *Configuration) ExpirySweepPause() time.Duration {
+	return parseDuration(Config.ExpirySweepInterval, time.Hour)
+}
+
+// ExpirySweepSpread returns the largest random delay added to each pause
+// between expiry sweeps.
+func (c *Configuration) ExpirySweepSpread() time.Duration {
+	return parseDuration(Config.ExpirySweepJitter, 5*time.Minute)
+}
+
+// ExpirySweepMax returns how many objects an expiry sweep deletes at most,
+// or 0 if it isn't limited.
+func (c *Configuration) ExpirySweepMax() int {
+	return int(parseSize(Config.ExpirySweepLimit, 1000))
+}
+
+// DeleteGrace returns how long deleted objects can be restored before they are
+// removed, or 0 if deletes remove them at once.
+func (c *Configuration) DeleteGrace() time.Duration {
+	return parseDuration(Config.DeleteGracePeriod, 0)
+}
+
+// IsAllowingCORS returns true if browsers may call the API from other origins.
+func (c *Configuration) IsAllowingCORS() bool {
+	return strings.TrimSpace(Config.CORSOrigins) != ""
+}
+
+// CORS returns the policy for cross-origin requests made by browsers.
+func (c *Configuration) CORS() *corsPolicy {
+	var origins []string
+	for _, o := range strings.Split(Config.CORSOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return &corsPolicy{
+		Origins:     origins,
+		Methods:     Config.CORSMethods,
+		Headers:     Config.CORSHeaders,
+		Credentials: isTrue(Config.CORSCredentials),
+	}
+}
+
+// UploadDeadline returns how long an upload may take in total, or 0 if it
+// isn't limited. UploadTimeout overrides RequestTimeout.
+func (c *Configuration) UploadDeadline() time.Duration {
+	return routeTimeout(Config.UploadTimeout)
+}
+
+// UploadDeadlineFor returns how long an upload of size bytes may take, the
+// upload deadline plus UploadTimeoutPerGB for every GiB, so large objects get
+// the time they need while a stalled upload still ends. It returns 0 if
+// uploads aren't limited.
+func (c *Configuration) UploadDeadlineFor(size int64) time.Duration {
+	base := c.UploadDeadline()
+	if base <= 0 || size <= 0 {
+		return base
+	}
+	perGB := parseDuration(Config.UploadTimeoutPerGB, 0)
+	return base + time.Duration(float64(perGB)*float64(size)/(1<<30))
+}
+
+// UploadIdleTime returns how long an upload may send no data before it's
+// refused, or 0 if it isn't limited.
+func (c *Configuration) UploadIdleTime() time.Duration {
+	return parseDuration(Config.UploadIdleTimeout, 0)
+}
+
+// DownloadDeadline returns how long a download may take in total, or 0 if it
+// isn't limited. DownloadTimeout overrides RequestTimeout.
+func (c *Configuration) DownloadDeadline() time.Duration {
+	return routeTimeout(Config.DownloadTimeout)
+}
+
+// MaxObjectBytes is the largest object that may be uploaded, or 0 if there is
+// no limit.
+func (c *Configuration) MaxObjectBytes() int64 {
+	return parseSize(Config.MaxObjectSize, 0)
+}
+
+// IsEncrypting returns true if encryption keys are configured.
+func (c *Configuration) IsEncrypting() bool {
+	return Config.EncryptionKeys != "" || Config.EncryptionKeyFile != ""
+}
+
+// ActionPolicy returns the roles allowed to perform each action.
+func (c *Configuration) ActionPolicy() (rolePolicy, error) {
+	return parseRolePolicy(Config.ActionRoles)
+}
+
+// HeaderReadTimeout returns how long a connection may take to send the
+// headers of a request, or 0 if it isn't limited.
+func (c *Configuration) HeaderReadTimeout() time.Duration {
+	return parseDuration(Config.HeaderTimeout, 0)
+}
+
+// IdleConnTimeout returns how long a kept alive connection may wait for its
+// next request, or 0 if it isn't limited.
+func (c *Configuration) IdleConnTimeout() time.Duration {
+	return parseDuration(Config.IdleTimeout, 0)
+}
+
+func routeTimeout(v string) time.Duration {
+	if v == "" {
+		v = Config.RequestTimeout
+	}
+	return parseDuration(v, time.Hour)
+}
+
+// TempGrace returns how old a temporary upload file has to be before it is
+// considered left behind by a crash and removed.
+func (c *Configuration) TempGrace() time.Duration {
+	return parseDuration(Config.TempGracePeriod, time.Hour)
+}
+
+// RequestsPerIP returns how many requests a client IP may have in progress at
+// once, or 0 if it isn't limited.
+func (c *Configuration) RequestsPerIP() int {
+	return int(parseSize(Config.MaxRequestsPerIP, 0))
+}
+
+// ConnectionsPerIP returns how many connections a client IP may have open at
+// once, or 0 if it isn't limited.
+func (c *Configuration) ConnectionsPerIP() int {
+	return int(parseSize(Config.MaxConnectionsPerIP, 0))
+}
+
+// TrustedProxyNets returns the networks of proxies whose TrustedProxyHeader
+// is used to find the client IP. TrustedProxies is a comma separated list of
+// addresses and CIDR ranges; invalid entries are ignored.
+func (c *Configuration) TrustedProxyNets() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(Config.TrustedProxies, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// ProxyHeader returns the header trusted proxies name the client IP in,
+// Forwarded or X-Forwarded-For. Only that one is read: a proxy passes the
+// other one on as the client sent it, so clients could claim any address.
+func (c *Configuration) ProxyHeader() (string, error) {
+	switch h := http.CanonicalHeaderKey(Config.TrustedProxyHeader); h {
+	case "Forwarded", "X-Forwarded-For":
+		return h, nil
+	}
+	return "", fmt.Errorf("Trusted proxy header isn't Forwarded or X-Forwarded-For: %q", Config.TrustedProxyHeader)
+}
+
+// UploadRetryWait returns how long an upload waits for an upload of the same
+// object that is already in progress before it is refused with 409.
+func (c *Configuration) UploadRetryWait() time.Duration {
+	return parseDuration(Config.UploadWait, 30*time.Second)
+}
+
+// IsSizeOptional returns true if objects may be uploaded without declaring
+// their size.
+func (c *Configuration) IsSizeOptional() bool {
+	return isTrue(Config.SizeOptional)
+}
+
+// FreeSpaceReserve returns how many bytes of free space uploads must leave on
+// the content store's filesystem.
+func (c *Configuration) FreeSpaceReserve() int64 {
+	return parseSize(Config.FreeSpaceMargin, 100*1024*1024)
+}
+
+// IsCompressingResponses returns true if JSON API responses are compressed for
+// clients that accept it.
+func (c *Configuration) IsCompressingResponses() bool {
+	return isTrue(Config.CompressResponses)
+}
+
+// ResponseCompressionMinSize returns the smallest JSON response that is
+// compressed.
+func (c *Configuration) ResponseCompressionMinSize() int {
+	return int(parseSize(Config.CompressResponsesMinSize, 1024))
+}
+
+// IsCoalescingDownloads returns true if concurrent downloads of an object share
+// a single read from the content store.
+func (c *Configuration) IsCoalescingDownloads() bool {
+	return isTrue(Config.CoalesceDownloads)
+}
+
+// CoalesceMemoryLimit returns the largest coalesced download that is spooled
+// in memory rather than to a file.
+func (c *Configuration) CoalesceMemoryLimit() int64 {
+	return parseSize(Config.CoalesceMemorySize, 1<<20)
+}
+
+// PasswordMinLength returns the minimum length of new user passwords.
+func (c *Configuration) PasswordMinLength() int {
+	return int(parseSize(Config.MinPasswordLength, 8))
+}
+
+func parseSize(v string, def int64) int64 {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+func parseDuration(v string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
+}
+
+func isTrue(v string) bool {
+	switch v {
 	case "1", "true", "TRUE":
 		return true
 	}
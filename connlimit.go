@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connRejection is written to connections over the per-IP limit before they
+// are closed, as no request has been read from them to answer.
+const connRejection = "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 1\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// connLimitListener caps the connections a client IP may have open at once.
+// Connections from trusted proxies aren't counted, as they carry the requests
+// of many clients; those are limited per request by limitRequests instead.
+type connLimitListener struct {
+	net.Listener
+	max     int
+	trusted []*net.IPNet
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func limitConnections(l net.Listener, max int, trusted []*net.IPNet) *connLimitListener {
+	return &connLimitListener{Listener: l, max: max, trusted: trusted, open: make(map[string]int)}
+}
+
+// Accept returns the next connection within the limit. Connections over it
+// are refused with 429 in the background, so a client not reading the
+// response doesn't hold up others.
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || isTrusted(ip, l.trusted) {
+			return conn, nil
+		}
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, listener: l, ip: ip}, nil
+		}
+
+		metrics.Add("lfs_client_connections_rejected_total", 1)
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte(connRejection))
+			conn.Close()
+		}()
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	metrics.Add("lfs_client_connections", 1)
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+	metrics.Add("lfs_client_connections", -1)
+}
+
+type limitedConn struct {
+	net.Conn
+	listener *connLimitListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// cachedGetter is implemented by stores that can serve downloads from a
+// cache. Reads that have to see the stored content, like scrubbing, use Get.
+type cachedGetter interface {
+	GetCached(meta *MetaObject, fromByte int64) (io.ReadCloser, error)
+}
+
+// contentCache keeps the decompressed content of small objects in memory,
+// so hot objects are served without reading and decoding them every time.
+// Content never changes for an oid, so entries only go when the object is
+// deleted or the least recently used ones once there are more than maxBytes.
+type contentCache struct {
+	maxBytes  int64
+	maxObject int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type contentEntry struct {
+	oid  string
+	data []byte
+}
+
+func newContentCache(maxBytes, maxObject int64) *contentCache {
+	return &contentCache{
+		maxBytes:  maxBytes,
+		maxObject: maxObject,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// fits returns true if the content of meta is small enough to be cached.
+func (c *contentCache) fits(meta *MetaObject) bool {
+	return meta.Size > 0 && meta.Size <= c.maxObject && meta.Size <= c.maxBytes
+}
+
+func (c *contentCache) get(oid string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[oid]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*contentEntry).data, true
+}
+
+func (c *contentCache) add(oid string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[oid]; ok {
+		return
+	}
+	c.entries[oid] = c.lru.PushFront(&contentEntry{oid: oid, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.drop(c.lru.Back())
+	}
+}
+
+func (c *contentCache) remove(oid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[oid]; ok {
+		c.drop(el)
+	}
+}
+
+func (c *contentCache) drop(el *list.Element) {
+	e := c.lru.Remove(el).(*contentEntry)
+	delete(c.entries, e.oid)
+	c.size -= int64(len(e.data))
+}
+
+// GetCached is Get for downloads. Compressed objects small enough for the
+// cache are read whole on the first download and served from memory after.
+func (s *ContentStore) GetCached(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	if s.Cache == nil || meta.Encoding == encodingIdentity || meta.Encoding == encodingInline || !s.Cache.fits(meta) {
+		return s.Get(meta, fromByte)
+	}
+	if fromByte > meta.Size {
+		fromByte = meta.Size
+	}
+
+	data, ok := s.Cache.get(meta.Oid)
+	if ok {
+		metrics.Add("lfs_content_cache_hits_total", 1)
+		return ioutil.NopCloser(bytes.NewReader(data[fromByte:])), nil
+	}
+	metrics.Add("lfs_content_cache_misses_total", 1)
+
+	r, err := s.Get(meta, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(r, meta.Size+1))
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Content of another size isn't what the oid stands for, so it's left
+	// for the download to report
+	if int64(len(data)) != meta.Size {
+		return s.Get(meta, fromByte)
+	}
+
+	s.Cache.add(meta.Oid, data)
+	return ioutil.NopCloser(bytes.NewReader(data[fromByte:])), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.Cache = newContentCache(1024, 512)
+
+	data := "small object downloaded over and over"
+	m := &MetaObject{Oid: hex.EncodeToString(sha256Sum(data)), Size: int64(len(data))}
+	if err := contentStore.Put(m, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if m.Encoding != encodingGzip {
+		t.Fatalf("expected the object to be compressed, got %q", m.Encoding)
+	}
+
+	if got := readCached(t, m, 0); got != data {
+		t.Fatalf("expected the first download to return the content, got %q", got)
+	}
+
+	// The second download doesn't read the file
+	if err := os.Rename(contentStore.path(m), contentStore.path(m)+".moved"); err != nil {
+		t.Fatalf("expected to move the file away, got: %s", err)
+	}
+	hits := metrics.Get("lfs_content_cache_hits_total")
+	if got := readCached(t, m, 6); got != data[6:] {
+		t.Fatalf("expected the cached content from byte 6, got %q", got)
+	}
+	if metrics.Get("lfs_content_cache_hits_total") != hits+1 {
+		t.Fatalf("expected the download to be served from the cache")
+	}
+
+	os.Rename(contentStore.path(m)+".moved", contentStore.path(m))
+	if err := contentStore.Delete(m); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	if _, err := contentStore.GetCached(m, 0); err == nil {
+		t.Fatalf("expected a deleted object not to be served from the cache")
+	}
+}
+
+func TestContentCacheBounded(t *testing.T) {
+	c := newContentCache(10, 8)
+	if c.fits(&MetaObject{Size: 9}) {
+		t.Fatalf("expected objects over the object limit not to be cached")
+	}
+
+	c.add("a", []byte("aaaa"))
+	c.add("b", []byte("bbbb"))
+	c.get("a")
+	c.add("c", []byte("cccc"))
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("expected the least recently used entry to be dropped")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("expected the recently used entry to be kept")
+	}
+	if c.size != 8 {
+		t.Fatalf("expected 8 bytes to be cached, got %d", c.size)
+	}
+}
+
+func readCached(t *testing.T, m *MetaObject, fromByte int64) string {
+	r, err := contentStore.GetCached(m, fromByte)
+	if err != nil {
+		t.Fatalf("expected the download to succeed, got: %s", err)
+	}
+	defer r.Close()
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
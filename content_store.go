@@ -1,25 +1,377 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
+	"mime"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
-	errHashMismatch = errors.New("Content hash does not match OID")
-	errSizeMismatch = errors.New("Content size does not match")
+	errHashMismatch  = errors.New("Content hash does not match OID")
+	errSizeMismatch  = errors.New("Content size does not match")
+	errRatioExceeded = errors.New("Content compression ratio exceeds the limit")
+	errNoSpace       = errors.New("Not enough free space to store content")
+	errHashAlgo      = errors.New("Unsupported hash algorithm")
+	errCorruptObject = errors.New("Stored object can't be decompressed")
+	errUploadBusy    = errors.New("Object is already being written")
+)
+
+// Hash algorithms recorded in MetaObject.HashAlgo. sha256 objects are stored
+// where they always were, objects of other algorithms in a subtree named
+// after it, so oids of different algorithms never share a path.
+const (
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+)
+
+// hashAlgo returns the hash algorithm of the oid of the object.
+func (m *MetaObject) hashAlgo() string {
+	if m.HashAlgo == "" {
+		return hashSHA256
+	}
+	return m.HashAlgo
+}
+
+// hashSizes are the sizes in bytes of the hashes of each algorithm.
+var hashSizes = map[string]int{
+	hashSHA256: sha256.Size,
+	hashSHA512: sha512.Size,
+}
+
+func supportsHashAlgo(algo string) bool {
+	_, ok := hashSizes[algo]
+	return ok
+}
+
+// newObjectHash returns the hash content of meta is verified with.
+func newObjectHash(meta *MetaObject) (hash.Hash, error) {
+	switch meta.hashAlgo() {
+	case hashSHA256:
+		return sha256.New(), nil
+	case hashSHA512:
+		return sha512.New(), nil
+	}
+	return nil, errHashAlgo
+}
+
+// Storage encodings recorded in MetaObject.Encoding. Objects without an
+// encoding were written before it was recorded and are gzip compressed.
+// Inline objects are kept as is in the inline store of a ContentStore, or in a
+// file as identity objects are by stores without one, such as a replica.
+const (
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingIdentity = "identity"
+	encodingInline   = "inline"
 )
 
+// encodingSuffixes are appended to the path of objects in each encoding.
+var encodingSuffixes = map[string]string{
+	"":               ".gz",
+	encodingGzip:     ".gz",
+	encodingZstd:     ".zst",
+	encodingIdentity: "",
+	encodingInline:   "",
+}
+
+// parseStorageEncoding parses the storage encoding an upload asks for, gzip,
+// zstd or identity.
+func parseStorageEncoding(v string) (string, error) {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case encodingGzip, encodingZstd, encodingIdentity:
+		return v, nil
+	}
+	return "", fmt.Errorf("Unknown storage encoding: %q", v)
+}
+
+// objectStore is implemented by the places object content can be kept:
+// ContentStore on disk and MemoryStore in memory.
+type objectStore interface {
+	Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error)
+	Put(meta *MetaObject, r io.Reader) error
+	Exists(meta *MetaObject) bool
+	Delete(meta *MetaObject) error
+}
+
+// inlineStore keeps the content of small objects of a ContentStore in one
+// place rather than a file each. MetaStore implements it.
+type inlineStore interface {
+	GetInline(oid string) ([]byte, error)
+	PutInline(oid string, data []byte) error
+	DeleteInline(oid string) error
+}
+
+// roomChecker is implemented by stores that can tell ahead of time whether an
+// object will fit. Stores without it are assumed to always have room.
+type roomChecker interface {
+	HasRoom(meta *MetaObject, size int64) error
+}
+
 // ContentStore provides a simple file system based storage.
 type ContentStore struct {
 	basePath string
+
+	// Compression is the encoding new objects are compressed with, either
+	// encodingGzip (the default) or encodingZstd. Objects already stored keep
+	// the encoding they were written with.
+	Compression string
+
+	// CompressionLevel is passed to the compressor. 0 uses
+	// gzip.BestCompression for gzip and the default level for zstd.
+	CompressionLevel int
+
+	// CompressMaxSize is the largest object size that is compressed.
+	// Larger objects are stored as is. 0 compresses every object.
+	CompressMaxSize int64
+
+	// CompressionBands, if set, choose the encoding and level of new objects
+	// by their size in place of Compression, CompressionLevel and
+	// CompressMaxSize. An object goes into the first band it fits in, and
+	// objects of an unknown size into the last.
+	CompressionBands []CompressionBand
+
+	// SkipCompression lists the file extensions (".zip") and media types
+	// ("video/mp4", or "video/*" for all of them) of content not worth
+	// compressing. Objects whose upload hints at one of them are stored as
+	// is. The hint is the client's word, so only use it with clients that can
+	// be trusted to give it.
+	SkipCompression []string
+
+	// EntropySkip, if set, is the Shannon entropy in bits per byte at or
+	// above which the content of a new object is taken to be compressed
+	// already, and stored as is. It is measured on the first
+	// entropySampleSize bytes, and those of content random through and
+	// through come close to 8.
+	EntropySkip float64
+
+	// MaxCompressionRatio is the largest decompressed:compressed ratio of a
+	// compressed object. Put refuses to store objects above it and Get aborts
+	// reads that go over it, as the stored file is likely corrupt or has
+	// been tampered with. 0 disables the check.
+	MaxCompressionRatio float64
+
+	// FreeSpaceMargin is the free space, in bytes, that HasRoom keeps in
+	// reserve on top of the object itself.
+	FreeSpaceMargin int64
+
+	// FreeSpace reports the free bytes on the filesystem holding a path.
+	// Defaults to diskFree.
+	FreeSpace func(path string) (uint64, error)
+
+	// KeyFunc maps an oid to its location relative to the base path. The
+	// encoding suffix (".gz" for gzip, ".zst" for zstd) is appended to the result. Defaults
+	// to transformKey.
+	KeyFunc func(oid string) string
+
+	// LegacyKeyFunc, if set, is tried by Get and Exists when an object is
+	// missing from its KeyFunc location. It lets an existing store written
+	// with a different layout be served while it is migrated; objects are
+	// always written using KeyFunc. Mixing layouts long-term is discouraged
+	// as every miss costs an extra lookup.
+	LegacyKeyFunc func(oid string) string
+
+	// SizeClasses, if set, splits the store into a subtree of the base path
+	// per class, so each can be placed on storage suited to the size of its
+	// objects. An object goes into the first class it fits in. Objects are
+	// found by the size recorded in their metadata, so changing the classes
+	// of an existing store means moving its objects.
+	SizeClasses []SizeClass
+
+	// Roots, if set, spreads objects over several base paths in place of
+	// the base path, like one per disk, so their I/O is spread too. An
+	// object goes on the root given by the first byte of its oid modulo the
+	// number of roots, and is looked up there. Adding or removing a root
+	// moves most objects, which the store doesn't do itself; rebalanceStore
+	// does.
+	Roots []string
+
+	// Inline, if set, holds the content of objects stored inline. New
+	// objects of up to InlineMaxSize bytes, which would cost a file and its
+	// syscalls each, are written there as is, none if it's 0. Objects
+	// already stored stay where they were written, whatever the threshold.
+	// Objects aren't inlined when the store encrypts them.
+	Inline        inlineStore
+	InlineMaxSize int64
+
+	// Keys, if set, encrypts objects at rest when they are written. Objects
+	// stored unencrypted are still read, and copies of them are written
+	// unencrypted too.
+	Keys *Keyring
+
+	// Cache, if set, keeps the content of small compressed objects served
+	// through GetCached in memory.
+	Cache *contentCache
+
+	// TempGrace is how long a temporary file has to go unmodified before
+	// Put takes it as left behind by a crash and replaces it.
+	TempGrace time.Duration
+
+	// writing holds the temporary files of uploads in progress, so
+	// CleanTemp never removes them and no two Puts write the same one.
+	mu      sync.Mutex
+	writing map[string]bool
+}
+
+// SizeClass is a subtree of a ContentStore holding the objects of up to
+// MaxSize bytes. A MaxSize of 0 holds objects of any size.
+type SizeClass struct {
+	Name    string
+	MaxSize int64
+}
+
+// CompressionBand is how new objects of up to MaxSize bytes are stored: with
+// Encoding, which may be encodingIdentity to store them as is, at Level, 0
+// being the default of the encoding. A MaxSize of 0 holds objects of any
+// size.
+type CompressionBand struct {
+	MaxSize  int64
+	Encoding string
+	Level    int
+}
+
+// parseCompressionBands parses compression bands given as "encoding=maxsize"
+// pairs separated by commas, smallest first, such as
+// "none=4096,gzip:best=67108864,none". The encoding is none, gzip or zstd,
+// optionally followed by a level or "best". As with size classes the last
+// band may leave out the size, or else larger objects go in the last band.
+func parseCompressionBands(v string) ([]CompressionBand, error) {
+	var bands []CompressionBand
+	for _, b := range strings.Split(v, ",") {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+
+		parts := strings.SplitN(b, "=", 2)
+		setting := strings.SplitN(strings.TrimSpace(parts[0]), ":", 2)
+		var band CompressionBand
+		switch setting[0] {
+		case "none", encodingIdentity:
+			band.Encoding = encodingIdentity
+		case encodingGzip, encodingZstd:
+			band.Encoding = setting[0]
+		default:
+			return nil, fmt.Errorf("Unknown compression of compression band: %q", parts[0])
+		}
+
+		if len(setting) == 2 {
+			best := map[string]int{encodingGzip: gzip.BestCompression, encodingZstd: 19}
+			level, err := strconv.Atoi(setting[1])
+			switch {
+			case setting[1] == "best" && band.Encoding != encodingIdentity:
+				band.Level = best[band.Encoding]
+			case err != nil || level < 1 || level > best[band.Encoding]:
+				return nil, fmt.Errorf("Invalid level of compression band: %q", parts[0])
+			default:
+				band.Level = level
+			}
+		}
+
+		if len(parts) == 2 {
+			n, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("Invalid size of compression band %s: %s", parts[0], parts[1])
+			}
+			band.MaxSize = n
+		}
+
+		if len(bands) > 0 {
+			prev := bands[len(bands)-1]
+			if prev.MaxSize == 0 || (band.MaxSize != 0 && band.MaxSize <= prev.MaxSize) {
+				return nil, fmt.Errorf("Compression band %s has to be larger than the one before", b)
+			}
+		}
+		bands = append(bands, band)
+	}
+	return bands, nil
+}
+
+// compressionBand returns the band an object of size goes in, or false if
+// the store has no bands.
+func (s *ContentStore) compressionBand(size int64) (CompressionBand, bool) {
+	if len(s.CompressionBands) == 0 {
+		return CompressionBand{}, false
+	}
+	if size > 0 {
+		for _, b := range s.CompressionBands {
+			if b.MaxSize == 0 || size <= b.MaxSize {
+				return b, true
+			}
+		}
+	}
+	return s.CompressionBands[len(s.CompressionBands)-1], true
+}
+
+// parseSizeClasses parses size classes given as "name=maxsize" pairs
+// separated by commas, smallest first. The last class may leave out the size
+// to take every larger object, or else objects larger than every class go in
+// the last one.
+func parseSizeClasses(v string) ([]SizeClass, error) {
+	var classes []SizeClass
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+
+		parts := strings.SplitN(c, "=", 2)
+		class := SizeClass{Name: strings.TrimSpace(parts[0])}
+		if class.Name == "" || class.Name == "quarantine" || class.Name == "tmp" || strings.ContainsAny(class.Name, `/\.`) {
+			return nil, fmt.Errorf("Invalid size class name: %q", class.Name)
+		}
+		if len(parts) == 2 {
+			n, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("Invalid size of size class %s: %s", class.Name, parts[1])
+			}
+			class.MaxSize = n
+		}
+
+		if len(classes) > 0 {
+			prev := classes[len(classes)-1]
+			if prev.MaxSize == 0 || (class.MaxSize != 0 && class.MaxSize <= prev.MaxSize) {
+				return nil, fmt.Errorf("Size class %s has to be larger than %s", class.Name, prev.Name)
+			}
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// tempCleaner is implemented by stores that can remove the temporary files
+// left behind by interrupted uploads.
+type tempCleaner interface {
+	CleanTemp(grace time.Duration) (*TempCleanup, error)
+}
+
+// TempCleanup describes the temporary files found by CleanTemp.
+type TempCleanup struct {
+	Found   int   `json:"found"`
+	Removed int   `json:"removed"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// contentLayouts are the KeyFuncs that can be selected by name in the
+// configuration.
+var contentLayouts = map[string]func(oid string) string{
+	"sharded": transformKey,
+	"flat":    flatKey,
 }
 
 // NewContentStore creates a ContentStore at the base directory.
@@ -28,16 +380,25 @@ func NewContentStore(base string) (*ContentStore, error) {
 		return nil, err
 	}
 
-	return &ContentStore{base}, nil
+	return &ContentStore{basePath: base, KeyFunc: transformKey, FreeSpace: diskFree, TempGrace: time.Hour}, nil
 }
 
 type bothCloser struct {
 	f *os.File
-	g *gzip.Reader
+	g io.ReadCloser
+
+	compressed *countingReader
+	read       int64
+	maxRatio   float64
 }
 
 func (b *bothCloser) Read(p []byte) (int, error) {
-	return b.g.Read(p)
+	n, err := b.g.Read(p)
+	b.read += int64(n)
+	if exceedsRatio(b.read, b.compressed.n, b.maxRatio) {
+		return n, errRatioExceeded
+	}
+	return n, err
 }
 
 func (b *bothCloser) Close() error {
@@ -48,35 +409,129 @@ func (b *bothCloser) Close() error {
 	return err
 }
 
+// fileReader reads f through Reader, and closes f.
+type fileReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *fileReader) Close() error {
+	return r.f.Close()
+}
+
 // Get takes a Meta object and retreives the content from the store, returning
 // it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
 func (s *ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid)) + ".gz"
+	if s.inlined(meta) {
+		data, err := s.Inline.GetInline(meta.Oid)
+		if err != nil {
+			return nil, err
+		}
+		if fromByte > int64(len(data)) {
+			fromByte = int64(len(data))
+		}
+		return ioutil.NopCloser(bytes.NewReader(data[fromByte:])), nil
+	}
+
+	path := s.path(meta)
 
 	fmt.Printf("Get %q\n", path)
 
+	if _, err := os.Stat(path); os.IsNotExist(err) && s.LegacyKeyFunc != nil {
+		path = s.legacyPath(meta)
+	}
+	return s.open(path, meta, fromByte)
+}
+
+// open reads the content of meta from the file at path, starting at
+// fromByte.
+func (s *ContentStore) open(path string, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		fmt.Printf("failed to open %q %v\n", path, err)
 		return nil, err
 	}
-	g, err := gzip.NewReader(f)
+
+	var src io.Reader = f
+	if meta.KeyID != "" {
+		if s.Keys == nil {
+			f.Close()
+			return nil, errNoKeyring
+		}
+		if src, err = s.Keys.decrypter(f, meta.Oid); err != nil {
+			logger.Log(kv{"fn": "open", "path": path, "msg": "failed to decrypt", "err": err.Error()})
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if meta.Encoding == encodingIdentity || meta.Encoding == encodingInline {
+		if meta.KeyID != "" {
+			fr := &fileReader{Reader: src, f: f}
+			if fromByte > 0 {
+				_, err = io.CopyN(ioutil.Discard, fr, fromByte)
+			}
+			return fr, err
+		}
+		if fromByte > 0 {
+			if _, err := f.Seek(fromByte, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		return f, nil
+	}
+	cr := &countingReader{r: src}
+	g, err := newDecompressor(meta.Encoding, cr)
 	if err != nil {
-		fmt.Printf("file not gzip %s %v\n", path, err)
-		return nil, err
+		logger.Log(kv{"fn": "open", "path": path, "encoding": meta.Encoding, "err": err.Error()})
+		f.Close()
+		return nil, errCorruptObject
 	}
+	b := &bothCloser{f: f, g: g, compressed: cr, maxRatio: s.MaxCompressionRatio}
 	if fromByte > 0 {
-		_, err = io.CopyN(ioutil.Discard, g, fromByte)
-		if err != nil {
+		if _, err := io.CopyN(ioutil.Discard, b, fromByte); err != nil {
 			fmt.Printf("not enough bytes %s %v\n", path, err)
+			b.Close()
+			return nil, err
 		}
 	}
-	return &bothCloser{f, g}, err
+	return b, nil
 }
 
 // Put takes a Meta object and an io.Reader and writes the content to the store.
+// If meta has no encoding yet, Put chooses one, and unless meta is a copy it
+// encrypts unencrypted content if a key is configured, recording both in meta. Whatever the encoding, the size and hash are those of
+// the content as read from r. A declared size has to match, but an unknown one
+// (Size <= 0) is recorded in meta once the hash of the whole stream has been
+// verified. The caller is responsible for persisting them.
 func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid)) + ".gz"
+	if meta.Encoding == "" {
+		var sample []byte
+		if s.EntropySkip > 0 && meta.requested == "" {
+			// A read error is returned again by the first read of the copy
+			br := bufio.NewReaderSize(r, entropySampleSize)
+			sample, _ = br.Peek(entropySampleSize)
+			r = br
+		}
+		meta.Encoding = s.encodingFor(meta, sample)
+	}
+	if meta.KeyID == "" && s.Keys != nil && !meta.copy && meta.Encoding != encodingInline {
+		meta.KeyID = s.Keys.current
+	}
+	if meta.KeyID != "" && s.Keys == nil {
+		return errNoKeyring
+	}
+	if s.inlined(meta) {
+		return s.putInline(meta, r)
+	}
+
+	path := s.path(meta)
+	if meta.Size <= 0 && len(s.SizeClasses) > 0 {
+		// Unknown sizes are written where the largest objects go
+		last := s.SizeClasses[len(s.SizeClasses)-1]
+		path = filepath.Join(s.root(meta.Oid), last.Name, filepath.Base(path))
+	}
 	tmpPath := path + ".tmp"
 
 	dir := filepath.Dir(path)
@@ -84,16 +539,40 @@ func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
 		return err
 	}
 
-	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if !s.claimWriting(tmpPath) {
+		return errUploadBusy
+	}
+	defer s.setWriting(tmpPath, false)
+
+	file, err := s.createTemp(tmpPath)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(tmpPath)
 
-	g, _ := gzip.NewWriterLevel(file, gzip.BestCompression)
+	// Content is compressed, then encrypted, as ciphertext doesn't compress
+	var enc io.WriteCloser = nopWriteCloser{file}
+	if meta.KeyID != "" {
+		if enc, err = s.Keys.encrypter(file, meta.Oid); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	cw := &countingWriter{w: enc}
+	w, err := newCompressor(meta.Encoding, s.compressionLevel(meta), cw)
+	if err != nil {
+		file.Close()
+		return err
+	}
 
-	hash := sha256.New()
-	hw := io.MultiWriter(hash, g)
+	hw := io.MultiWriter(hash, w)
 
 	written, err := io.Copy(hw, r)
 	if err != nil {
@@ -101,37 +580,625 @@ func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
 		file.Close()
 		return err
 	}
-	if err := g.Close(); err != nil {
+	if err := w.Close(); err != nil {
 		fmt.Printf("failed to close %s %v\n", path, err)
 		file.Close()
 		return err
 	}
-	file.Close()
+	if err := enc.Close(); err != nil {
+		logger.Log(kv{"fn": "Put", "path": path, "msg": "failed to close the encrypter", "err": err.Error()})
+		file.Close()
+		return err
+	}
+	// The content has to be on disk before it's renamed into place, or a
+	// crash could leave an object reported stored without it
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	if written != meta.Size {
+	if meta.Size > 0 && written != meta.Size {
 		return errSizeMismatch
 	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if meta.Encoding != encodingIdentity && exceedsRatio(written, cw.n, s.MaxCompressionRatio) {
+		return errRatioExceeded
+	}
 
 	shaStr := hex.EncodeToString(hash.Sum(nil))
 	if shaStr != meta.Oid {
 		return errHashMismatch
 	}
 
-	if err := os.Rename(tmpPath, path); err != nil {
+	// The size class of an object of unknown size is only known now
+	if meta.Size <= 0 && len(s.SizeClasses) > 0 {
+		sized := *meta
+		sized.Size = written
+		path = s.path(&sized)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			return err
+		}
+	}
+
+	if err := moveFile(tmpPath, path); err != nil {
 		return err
 	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if meta.Size <= 0 {
+		meta.Size = written
+	}
+	meta.StoredSize = info.Size()
 	return nil
 }
 
+// inlined returns true if the content of meta is kept in the inline store.
+func (s *ContentStore) inlined(meta *MetaObject) bool {
+	return meta.Encoding == encodingInline && s.Inline != nil
+}
+
+// putInline verifies the content of an inline object and stores it.
+func (s *ContentStore) putInline(meta *MetaObject, r io.Reader) error {
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return err
+	}
+
+	// One byte more than the object tells an overlong upload apart
+	data, err := ioutil.ReadAll(io.LimitReader(io.TeeReader(r, hash), meta.Size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != meta.Size {
+		return errSizeMismatch
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+	meta.StoredSize = meta.Size
+	return s.Inline.PutInline(meta.Oid, data)
+}
+
+// moveFile renames from to to, copying it if they are on different
+// filesystems, as size classes may be.
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil || filepath.Dir(from) == filepath.Dir(to) {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := to + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, to)
+}
+
 // Exists returns true if the object exists in the content store.
 func (s *ContentStore) Exists(meta *MetaObject) bool {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid)) + ".gz"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if s.inlined(meta) {
+		_, err := s.Inline.GetInline(meta.Oid)
+		return err == nil
+	}
+	if _, err := os.Stat(s.path(meta)); os.IsNotExist(err) {
+		if s.LegacyKeyFunc == nil {
+			return false
+		}
+		if _, err := os.Stat(s.legacyPath(meta)); os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete removes the content of meta from the store. Deleting an object that
+// isn't stored is not an error.
+func (s *ContentStore) Delete(meta *MetaObject) error {
+	if meta.retained(time.Now()) {
+		return errRetained
+	}
+	if s.Cache != nil {
+		s.Cache.remove(meta.Oid)
+	}
+	if s.inlined(meta) {
+		return s.Inline.DeleteInline(meta.Oid)
+	}
+
+	paths := []string{s.path(meta)}
+	if s.LegacyKeyFunc != nil {
+		paths = append(paths, s.legacyPath(meta))
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the content of meta into the quarantine directory of the
+// store, where it is kept for inspection but no longer served.
+func (s *ContentStore) Quarantine(meta *MetaObject) error {
+	if s.Cache != nil {
+		s.Cache.remove(meta.Oid)
+	}
+	path := s.path(meta)
+	if _, err := os.Stat(path); os.IsNotExist(err) && s.LegacyKeyFunc != nil {
+		path = s.legacyPath(meta)
+	}
+
+	dir := filepath.Join(s.root(meta.Oid), "quarantine")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	// Inline content is written out for inspection like any other
+	if s.inlined(meta) {
+		data, err := s.Inline.GetInline(meta.Oid)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, meta.Oid), data, 0640); err != nil {
+			return err
+		}
+		return s.Inline.DeleteInline(meta.Oid)
+	}
+
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+// CleanTemp removes the temporary files of uploads that were interrupted by a
+// crash, anywhere under the base path. Only files last modified more than
+// grace ago are removed, and never those of uploads in progress.
+func (s *ContentStore) CleanTemp(grace time.Duration) (*TempCleanup, error) {
+	res := &TempCleanup{}
+	cutoff := time.Now().Add(-grace)
+
+	// Size classes are walked on their own, as they may be links to other
+	// filesystems, which Walk doesn't follow
+	classes := make(map[string]bool)
+	var roots []string
+	for _, base := range s.roots() {
+		roots = append(roots, base)
+		for _, c := range s.SizeClasses {
+			dir := filepath.Join(base, c.Name)
+			classes[dir] = true
+			roots = append(roots, dir+string(filepath.Separator))
+		}
+	}
+
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && classes[path] {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		res.Found++
+		if !info.ModTime().Before(cutoff) || s.isWriting(path) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		res.Removed++
+		res.Bytes += info.Size()
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := filepath.Walk(root, walk); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (s *ContentStore) setWriting(path string, writing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !writing {
+		delete(s.writing, path)
+		return
+	}
+	if s.writing == nil {
+		s.writing = make(map[string]bool)
+	}
+	s.writing[path] = true
+}
+
+// claimWriting marks path as being written, unless it already is.
+func (s *ContentStore) claimWriting(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writing[path] {
 		return false
 	}
+	if s.writing == nil {
+		s.writing = make(map[string]bool)
+	}
+	s.writing[path] = true
 	return true
 }
 
+// createTemp creates the temporary file an upload is written to. A file that
+// is already there is another process writing the object, and answered with
+// errUploadBusy, unless it wasn't modified for TempGrace, in which case it's
+// taken as left behind by a crash and replaced.
+func (s *ContentStore) createTemp(path string) (*os.File, error) {
+	const flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+
+	file, err := os.OpenFile(path, flags, 0640)
+	if !os.IsExist(err) {
+		return file, err
+	}
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < s.TempGrace {
+		return nil, errUploadBusy
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	logger.Log(kv{"fn": "createTemp", "path": path, "msg": "replaced a stale temporary file"})
+	file, err = os.OpenFile(path, flags, 0640)
+	if os.IsExist(err) {
+		return nil, errUploadBusy
+	}
+	return file, err
+}
+
+func (s *ContentStore) isWriting(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writing[path]
+}
+
+// HasRoom returns errNoSpace if storing size bytes of meta would leave less
+// than FreeSpaceMargin bytes free. size is the declared size, or the length of
+// an upload of unknown size, as compression can't be predicted. If free space
+// can't be determined the check passes.
+func (s *ContentStore) HasRoom(meta *MetaObject, size int64) error {
+	if s.FreeSpace == nil {
+		return nil
+	}
+
+	class := s.sizeClass(meta.Size)
+	if meta.Size <= 0 && len(s.SizeClasses) > 0 {
+		// Unknown sizes are written where the largest objects go
+		class = s.SizeClasses[len(s.SizeClasses)-1].Name
+	}
+	free, err := s.FreeSpace(filepath.Join(s.root(meta.Oid), class))
+	if err != nil {
+		return nil
+	}
+
+	if size < 0 {
+		size = 0
+	}
+	if uint64(size)+uint64(s.FreeSpaceMargin) > free {
+		return errNoSpace
+	}
+	return nil
+}
+
+// entropySampleSize is the most content whose entropy is measured, and
+// entropyMinSample the least, as a few bytes say little about the rest.
+const (
+	entropySampleSize = 64 << 10
+	entropyMinSample  = 1 << 10
+)
+
+// encodingFor decides how a new object is stored, given sample, the start of
+// its content if the entropy of it is to be measured. An encoding the upload
+// asked for goes before the rest; otherwise, by size, objects are inlined,
+// stored as is or put in their compression band, and those hinted at or
+// sampled as compressed already are stored as is.
+func (s *ContentStore) encodingFor(meta *MetaObject, sample []byte) string {
+	if meta.requested != "" {
+		return meta.requested
+	}
+	if s.Inline != nil && s.Keys == nil && meta.Size > 0 && meta.Size <= s.InlineMaxSize {
+		return encodingInline
+	}
+	band, banded := s.compressionBand(meta.Size)
+	if !banded && s.CompressMaxSize > 0 && meta.Size > s.CompressMaxSize {
+		return encodingIdentity
+	}
+	if skipsCompression(s.SkipCompression, meta.hint) {
+		return encodingIdentity
+	}
+	if s.EntropySkip > 0 && len(sample) >= entropyMinSample && entropy(sample) >= s.EntropySkip {
+		return encodingIdentity
+	}
+	if banded {
+		return band.Encoding
+	}
+	if s.Compression != "" {
+		return s.Compression
+	}
+	return encodingGzip
+}
+
+// compressionLevel returns the level a new object is compressed at, that of
+// its band if it's stored in the encoding of the band.
+func (s *ContentStore) compressionLevel(meta *MetaObject) int {
+	if band, ok := s.compressionBand(meta.Size); ok {
+		if band.Encoding == meta.Encoding {
+			return band.Level
+		}
+		return 0
+	}
+	return s.CompressionLevel
+}
+
+// skipsCompression returns true if hint, a file name or media type, matches
+// one of the extensions or media types in skip.
+func skipsCompression(skip []string, hint string) bool {
+	if hint == "" {
+		return false
+	}
+	hint = strings.ToLower(hint)
+	if mediaType, _, err := mime.ParseMediaType(hint); err == nil && strings.Contains(mediaType, "/") {
+		hint = mediaType
+	}
+
+	for _, s := range skip {
+		switch {
+		case strings.HasPrefix(s, "."):
+			if strings.HasSuffix(hint, s) {
+				return true
+			}
+		case strings.HasSuffix(s, "/*"):
+			if strings.HasPrefix(hint, s[:len(s)-1]) {
+				return true
+			}
+		case s == hint:
+			return true
+		}
+	}
+	return false
+}
+
+// entropy returns the Shannon entropy of p in bits per byte, from 0 for a
+// single repeated byte to 8 for every byte value as frequent as the others.
+func entropy(p []byte) float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var h float64
+	n := float64(len(p))
+	for _, count := range counts {
+		if count > 0 {
+			f := float64(count) / n
+			h -= f * math.Log2(f)
+		}
+	}
+	return h
+}
+
+// newCompressor returns a writer encoding to w. A level of 0 picks the
+// default for the encoding.
+func newCompressor(encoding string, level int, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingIdentity, encodingInline:
+		return nopWriteCloser{w}, nil
+	case encodingZstd:
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case "", encodingGzip:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("Unknown encoding: %s", encoding)
+}
+
+// newDecompressor returns a reader decoding compressed content from r.
+func newDecompressor(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "", encodingGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("Unknown encoding: %s", encoding)
+}
+
+// path returns the location of the object, which depends on its encoding.
+func (s *ContentStore) path(meta *MetaObject) string {
+	key := transformKey
+	if s.KeyFunc != nil {
+		key = s.KeyFunc
+	}
+	return s.pathFor(key, meta)
+}
+
+func (s *ContentStore) legacyPath(meta *MetaObject) string {
+	return s.pathFor(s.LegacyKeyFunc, meta)
+}
+
+func (s *ContentStore) pathFor(key func(string) string, meta *MetaObject) string {
+	algo := ""
+	if meta.hashAlgo() != hashSHA256 {
+		algo = meta.hashAlgo()
+	}
+	return filepath.Join(s.root(meta.Oid), s.sizeClass(meta.Size), algo, key(meta.Oid)) + encodingSuffixes[meta.Encoding]
+}
+
+// roots returns the base paths objects are stored under.
+func (s *ContentStore) roots() []string {
+	if len(s.Roots) > 0 {
+		return s.Roots
+	}
+	return []string{s.basePath}
+}
+
+// root returns the base path the object of oid is stored under.
+func (s *ContentStore) root(oid string) string {
+	if len(s.Roots) == 0 {
+		return s.basePath
+	}
+	return s.Roots[s.rootIndex(oid)]
+}
+
+// rootIndex returns the index in Roots of the root the object of oid is
+// stored under. Roots must be set.
+func (s *ContentStore) rootIndex(oid string) int {
+	if len(oid) < 2 {
+		return 0
+	}
+	b, err := hex.DecodeString(oid[:2])
+	if err != nil {
+		return 0
+	}
+	return int(b[0]) % len(s.Roots)
+}
+
+// strayObjects returns true if the store is spread over Roots while its base
+// path still holds object files, which were stored before the roots were
+// configured and aren't looked up there any more. Temporary and quarantined
+// files, and roots inside the base path, aren't objects.
+func (s *ContentStore) strayObjects() (bool, error) {
+	if len(s.Roots) == 0 {
+		return false, nil
+	}
+	roots := make(map[string]bool)
+	for _, root := range s.Roots {
+		roots[filepath.Clean(root)] = true
+	}
+
+	found := false
+	err := filepath.Walk(s.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path != s.basePath && (roots[filepath.Clean(path)] || info.Name() == "quarantine") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		found = true
+		return io.EOF
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	return found, err
+}
+
+// sizeClass returns the subtree of the store objects of size go in, or an
+// empty string if the store isn't split into size classes.
+func (s *ContentStore) sizeClass(size int64) string {
+	for _, c := range s.SizeClasses {
+		if c.MaxSize == 0 || size <= c.MaxSize {
+			return c.Name
+		}
+	}
+	if len(s.SizeClasses) > 0 {
+		return s.SizeClasses[len(s.SizeClasses)-1].Name
+	}
+	return ""
+}
+
+// exceedsRatio returns true if decompressed bytes produced from compressed
+// bytes go over maxRatio. A maxRatio of 0 never exceeds.
+func exceedsRatio(decompressed, compressed int64, maxRatio float64) bool {
+	if maxRatio <= 0 || compressed == 0 {
+		return false
+	}
+	return float64(decompressed) > maxRatio*float64(compressed)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// flatKey stores every object directly in the base path.
+func flatKey(key string) string {
+	return key
+}
+
 func transformKey(key string) string {
 	if len(key) < 5 {
 		return key
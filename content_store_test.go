@@ -2,10 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var contentStore *ContentStore
@@ -25,7 +35,7 @@ func TestContentStorePut(t *testing.T) {
 		t.Fatalf("expected put to succeed, got: %s", err)
 	}
 
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.gz"
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		t.Fatalf("expected content to exist after putting")
 	}
@@ -46,7 +56,7 @@ func TestContentStorePutHashMismatch(t *testing.T) {
 		t.Fatal("expected put with bogus content to fail")
 	}
 
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.gz"
 	if _, err := os.Stat(path); err == nil {
 		t.Fatalf("expected content to not exist after putting bogus content")
 	}
@@ -67,12 +77,68 @@ func TestContentStorePutSizeMismatch(t *testing.T) {
 		t.Fatal("expected put with bogus size to fail")
 	}
 
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.gz"
 	if _, err := os.Stat(path); err == nil {
 		t.Fatalf("expected content to not exist after putting bogus size")
 	}
 }
 
+func TestContentStorePutUnknownSize(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put without a size to succeed, got: %s", err)
+	}
+
+	if m.Size != 12 {
+		t.Fatalf("expected the written size to be recorded, got %d", m.Size)
+	}
+
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected content to exist")
+	}
+}
+
+func TestContentStorePutDeclaredSizeMismatch(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 14,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != errSizeMismatch {
+		t.Fatalf("expected a declared size to still be checked, got: %v", err)
+	}
+}
+
+func TestContentStorePutUnknownSizeHashMismatch(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("other content"))); err != errHashMismatch {
+		t.Fatalf("expected the hash to be verified without a size, got: %v", err)
+	}
+
+	if m.Size != 0 {
+		t.Fatalf("expected no size to be recorded for rejected content, got %d", m.Size)
+	}
+
+	if contentStore.Exists(m) {
+		t.Fatalf("expected rejected content not to be stored")
+	}
+}
+
 func TestContentStoreGet(t *testing.T) {
 	setup()
 	defer teardown()
@@ -163,6 +229,1091 @@ func TestContentStoreExists(t *testing.T) {
 	}
 }
 
+func TestContentStorePutAboveCompressMaxSize(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.CompressMaxSize = 11
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if m.Encoding != encodingIdentity {
+		t.Fatalf("expected identity encoding, got: %s", m.Encoding)
+	}
+
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected uncompressed content to exist, got: %s", err)
+	}
+	if string(by) != "test content" {
+		t.Fatalf("expected content to be stored as is, got: %q", by)
+	}
+
+	r, err := contentStore.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ = ioutil.ReadAll(r)
+	if string(by) != "content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStorePutSkipCompression(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.SkipCompression = []string{".zip", "image/*"}
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+		hint: "Archive.ZIP",
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if m.Encoding != encodingIdentity {
+		t.Fatalf("expected identity encoding, got: %s", m.Encoding)
+	}
+
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	by, err := ioutil.ReadFile(path)
+	if err != nil || string(by) != "test content" {
+		t.Fatalf("expected content to be stored as is, got: %q, %v", by, err)
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ = ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+
+	// Uncompressed content is verified all the same
+	bad := &MetaObject{Oid: m.Oid, Size: 12, hint: "image/png"}
+	if err := contentStore.Put(bad, bytes.NewBuffer([]byte("bogus conten"))); err != errHashMismatch {
+		t.Fatalf("expected a hash mismatch, got: %v", err)
+	}
+}
+
+func TestSkipsCompression(t *testing.T) {
+	skip := []string{".zip", ".tar.gz", "video/mp4", "image/*"}
+
+	tests := []struct {
+		hint     string
+		expected bool
+	}{
+		{"", false},
+		{"release.zip", true},
+		{"RELEASE.ZIP", true},
+		{"backup.tar.gz", true},
+		{"notes.txt", false},
+		{"zip", false},
+		{"video/mp4", true},
+		{"Video/MP4; codecs=avc1", true},
+		{"video/webm", false},
+		{"image/png", true},
+		{"text/plain", false},
+	}
+
+	for _, test := range tests {
+		if got := skipsCompression(skip, test.hint); got != test.expected {
+			t.Errorf("expected skipping compression of %q to be %v", test.hint, test.expected)
+		}
+	}
+}
+
+func TestContentStoreEncodingsRoundTrip(t *testing.T) {
+	setup()
+	defer teardown()
+
+	data := strings.Repeat("content stored in each encoding ", 100)
+	oid := hex.EncodeToString(sha256Sum(data))
+
+	for _, enc := range []string{encodingGzip, encodingZstd, encodingIdentity} {
+		m := &MetaObject{Oid: oid, Size: int64(len(data)), requested: enc}
+		if err := contentStore.Put(m, bytes.NewBufferString(data)); err != nil {
+			t.Fatalf("expected put in %s to succeed, got: %s", enc, err)
+		}
+		if m.Encoding != enc {
+			t.Fatalf("expected the requested encoding %s, got: %s", enc, m.Encoding)
+		}
+		if info, err := os.Stat(contentStore.path(m)); err != nil || info.Size() != m.StoredSize {
+			t.Fatalf("expected %s content of %d bytes at its path, got: %v", enc, m.StoredSize, err)
+		}
+		if enc != encodingIdentity && m.StoredSize >= m.Size {
+			t.Errorf("expected %s content to be compressed, stored %d of %d bytes", enc, m.StoredSize, m.Size)
+		}
+
+		r, err := contentStore.Get(m, 5)
+		if err != nil {
+			t.Fatalf("expected get in %s to succeed, got: %s", enc, err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(by) != data[5:] {
+			t.Fatalf("expected to read the %s content from byte 5, got: %q", enc, by)
+		}
+
+		// The hash and size are those of the content, not of what is stored
+		bad := &MetaObject{Oid: oid, Size: int64(len(data)), requested: enc}
+		if err := contentStore.Put(bad, bytes.NewBufferString(strings.ToUpper(data))); err != errHashMismatch {
+			t.Errorf("expected a hash mismatch in %s, got: %v", enc, err)
+		}
+		short := &MetaObject{Oid: oid, Size: int64(len(data)) + 1, requested: enc}
+		if err := contentStore.Put(short, bytes.NewBufferString(data)); err != errSizeMismatch {
+			t.Errorf("expected a size mismatch in %s, got: %v", enc, err)
+		}
+	}
+
+	// Records from before the encoding was recorded are gzip
+	old := &MetaObject{Oid: oid, Size: int64(len(data))}
+	r, err := contentStore.Get(old, 0)
+	if err != nil {
+		t.Fatalf("expected get without an encoding to succeed, got: %s", err)
+	}
+	defer r.Close()
+	if by, _ := ioutil.ReadAll(r); string(by) != data {
+		t.Fatalf("expected to read the gzip content, got: %q", by)
+	}
+}
+
+func TestContentStorePutSamplesEntropy(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.EntropySkip = 7.5
+
+	random := make([]byte, 2*entropySampleSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("compressible text ", 10000))
+
+	for _, test := range []struct {
+		data     []byte
+		expected string
+	}{
+		{random, encodingIdentity},
+		{text, encodingGzip},
+	} {
+		m := &MetaObject{Oid: hex.EncodeToString(sha256Sum(string(test.data))), Size: int64(len(test.data))}
+		if err := contentStore.Put(m, bytes.NewReader(test.data)); err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+		if m.Encoding != test.expected {
+			t.Fatalf("expected the %s encoding, got: %s", test.expected, m.Encoding)
+		}
+
+		// The sampled start of the content is stored with the rest
+		if err := verifyObject(contentStore, m, nil, nil); err != nil {
+			t.Fatalf("expected the sampled object to verify, got: %s", err)
+		}
+	}
+}
+
+func TestEncodingFor(t *testing.T) {
+	random := make([]byte, entropyMinSample)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("a", entropyMinSample))
+
+	plain := &ContentStore{}
+	capped := &ContentStore{Compression: encodingZstd, CompressMaxSize: 1000}
+	policy := &ContentStore{
+		Inline:           &MetaStore{},
+		InlineMaxSize:    10,
+		SkipCompression:  []string{".zip", "video/*"},
+		EntropySkip:      7.5,
+		CompressionBands: []CompressionBand{{MaxSize: 100, Encoding: encodingIdentity}, {MaxSize: 1 << 20, Encoding: encodingZstd}, {Encoding: encodingGzip}},
+	}
+
+	tests := []struct {
+		store    *ContentStore
+		meta     *MetaObject
+		sample   []byte
+		expected string
+	}{
+		{plain, &MetaObject{Size: 10}, nil, encodingGzip},
+		{plain, &MetaObject{Size: 10, requested: encodingZstd}, nil, encodingZstd},
+		{capped, &MetaObject{Size: 1000}, nil, encodingZstd},
+		{capped, &MetaObject{Size: 1001}, nil, encodingIdentity},
+		{capped, &MetaObject{Size: 1001, requested: encodingGzip}, nil, encodingGzip},
+		{policy, &MetaObject{Size: 10}, nil, encodingInline},
+		{policy, &MetaObject{Size: 10, requested: encodingGzip}, nil, encodingGzip},
+		{policy, &MetaObject{Size: 100}, nil, encodingIdentity},
+		{policy, &MetaObject{Size: 1000}, text, encodingZstd},
+		{policy, &MetaObject{Size: 1000, hint: "release.zip"}, text, encodingIdentity},
+		{policy, &MetaObject{Size: 1000, hint: "video/mp4"}, nil, encodingIdentity},
+		{policy, &MetaObject{Size: 1000}, random, encodingIdentity},
+		{policy, &MetaObject{Size: 1000}, random[:entropyMinSample-1], encodingZstd},
+		{policy, &MetaObject{Size: 1000, requested: encodingZstd}, random, encodingZstd},
+		{policy, &MetaObject{Size: 2 << 20}, text, encodingGzip},
+	}
+
+	for i, test := range tests {
+		if got := test.store.encodingFor(test.meta, test.sample); got != test.expected {
+			t.Errorf("%d: expected the %s encoding, got: %s", i, test.expected, got)
+		}
+	}
+
+	if h := entropy(text); h != 0 {
+		t.Errorf("expected a repeated byte to have no entropy, got %f", h)
+	}
+	if h := entropy(random); h < 7.5 {
+		t.Errorf("expected random bytes to have an entropy close to 8, got %f", h)
+	}
+}
+
+func TestContentStorePutAtCompressMaxSize(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.CompressMaxSize = 12
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if m.Encoding != encodingGzip {
+		t.Fatalf("expected gzip encoding, got: %s", m.Encoding)
+	}
+
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.gz"
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected compressed content to exist, got: %s", err)
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStoreKeyFunc(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.KeyFunc = flatKey
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	path := "content-store-test/6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.gz"
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected content to be stored in the flat layout, got: %s", err)
+	}
+
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected content to exist")
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStoreLegacyKeyFunc(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	// Write the object with the flat layout, then read it back through a
+	// store using the default layout.
+	contentStore.KeyFunc = flatKey
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	contentStore.KeyFunc = transformKey
+
+	if contentStore.Exists(m) {
+		t.Fatalf("expected content to be missing without the legacy layout")
+	}
+
+	contentStore.LegacyKeyFunc = flatKey
+
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected content to be found in the legacy layout")
+	}
+
+	r, err := contentStore.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStoreGetRatioExceeded(t *testing.T) {
+	setup()
+	defer teardown()
+
+	// A megabyte of zeros compresses roughly 1000:1, far above what stored
+	// objects are expected to reach.
+	zeros := make([]byte, 1<<20)
+	sum := sha256.Sum256(zeros)
+	m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(zeros))}
+
+	var buf bytes.Buffer
+	g := gzip.NewWriter(&buf)
+	g.Write(zeros)
+	g.Close()
+
+	path := contentStore.path(m)
+	os.MkdirAll(filepath.Dir(path), 0750)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatalf("expected to plant crafted object, got: %s", err)
+	}
+
+	contentStore.MaxCompressionRatio = 100
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to open the object, got: %s", err)
+	}
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); err != errRatioExceeded {
+		t.Fatalf("expected ratio error, got: %v", err)
+	}
+}
+
+func TestContentStorePutRatioExceeded(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.MaxCompressionRatio = 100
+
+	zeros := make([]byte, 1<<20)
+	sum := sha256.Sum256(zeros)
+	m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(zeros))}
+
+	if err := contentStore.Put(m, bytes.NewReader(zeros)); err != errRatioExceeded {
+		t.Fatalf("expected ratio error, got: %v", err)
+	}
+
+	if contentStore.Exists(m) {
+		t.Fatalf("expected object not to be stored")
+	}
+}
+
+func TestContentStoreRatioWithinLimit(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.MaxCompressionRatio = 100
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, err := ioutil.ReadAll(r)
+	if err != nil || string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s %v", string(by), err)
+	}
+}
+
+func TestContentStoreHasRoom(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.FreeSpaceMargin = 100
+	contentStore.FreeSpace = func(string) (uint64, error) { return 1000, nil }
+
+	if err := contentStore.HasRoom(&MetaObject{Size: 900}, 900); err != nil {
+		t.Fatalf("expected an object leaving the margin free to fit, got: %s", err)
+	}
+
+	if err := contentStore.HasRoom(&MetaObject{Size: 901}, 901); err != errNoSpace {
+		t.Fatalf("expected an object eating into the margin to be refused, got: %v", err)
+	}
+
+	// An upload of unknown size is checked by its length
+	if err := contentStore.HasRoom(&MetaObject{}, 901); err != errNoSpace {
+		t.Fatalf("expected an upload of unknown size eating into the margin to be refused, got: %v", err)
+	}
+
+	contentStore.FreeSpace = func(string) (uint64, error) { return 0, errors.New("statfs failed") }
+
+	if err := contentStore.HasRoom(&MetaObject{Size: 901}, 901); err != nil {
+		t.Fatalf("expected the check to be skipped when free space is unknown, got: %s", err)
+	}
+}
+
+func TestContentStoreDiskFree(t *testing.T) {
+	setup()
+	defer teardown()
+
+	if _, err := contentStore.FreeSpace(contentStore.basePath); err != nil {
+		t.Fatalf("expected free space of the content path, got: %s", err)
+	}
+}
+
+func TestContentStoreZstd(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.Compression = encodingZstd
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if m.Encoding != encodingZstd {
+		t.Fatalf("expected zstd encoding to be recorded, got %q", m.Encoding)
+	}
+
+	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72.zst"
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected content to be stored with the zstd suffix, got: %s", err)
+	}
+
+	r, err := contentStore.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStoreMixedCodecs(t *testing.T) {
+	setup()
+	defer teardown()
+
+	gz := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+	if err := contentStore.Put(gz, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected gzip put to succeed, got: %s", err)
+	}
+
+	// Switching the algorithm leaves existing objects readable
+	contentStore.Compression = encodingZstd
+	contentStore.CompressionLevel = 19
+
+	by := []byte("other content")
+	sum := sha256.Sum256(by)
+	zs := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(by))}
+	if err := contentStore.Put(zs, bytes.NewReader(by)); err != nil {
+		t.Fatalf("expected zstd put to succeed, got: %s", err)
+	}
+
+	for _, tc := range []struct {
+		meta    *MetaObject
+		content string
+	}{{gz, "test content"}, {zs, "other content"}} {
+		r, err := contentStore.Get(tc.meta, 0)
+		if err != nil {
+			t.Fatalf("expected get of %s object to succeed, got: %s", tc.meta.Encoding, err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(got) != tc.content {
+			t.Fatalf("expected %s object to contain %q, got %q", tc.meta.Encoding, tc.content, got)
+		}
+	}
+}
+
+func TestContentStoreCleanTemp(t *testing.T) {
+	setup()
+	defer teardown()
+
+	stale := plantTemp(t, "content-store-test/6a/e8/stale.gz.tmp", 2*time.Hour)
+	fresh := plantTemp(t, "content-store-test/6a/e8/fresh.gz.tmp", time.Minute)
+	writing := plantTemp(t, "content-store-test/f9/7e/writing.gz.tmp", 2*time.Hour)
+	object := plantTemp(t, "content-store-test/f9/7e/object.gz", 2*time.Hour)
+
+	// An upload in progress can be slower than the grace period
+	contentStore.setWriting(writing, true)
+	defer contentStore.setWriting(writing, false)
+
+	res, err := contentStore.CleanTemp(time.Hour)
+	if err != nil {
+		t.Fatalf("expected clean to succeed, got: %s", err)
+	}
+	if res.Found != 3 || res.Removed != 1 || res.Bytes != int64(len("partial upload")) {
+		t.Fatalf("expected one of three temporary files to be removed, got %+v", res)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file to be removed")
+	}
+	for _, path := range []string{fresh, writing, object} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept, got: %s", path, err)
+		}
+	}
+}
+
+func TestContentStorePutBusy(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	tmp := contentStore.path(m) + ".tmp"
+
+	// Another Put of this store
+	contentStore.setWriting(tmp, true)
+	if err := contentStore.Put(m, bytes.NewBufferString(content)); err != errUploadBusy {
+		t.Fatalf("expected a concurrent put to be refused, got: %v", err)
+	}
+	contentStore.setWriting(tmp, false)
+
+	// Another process, writing to the file within the grace period
+	plantTemp(t, tmp, time.Minute)
+	if err := contentStore.Put(m, bytes.NewBufferString(content)); err != errUploadBusy {
+		t.Fatalf("expected a put over a recent temporary file to be refused, got: %v", err)
+	}
+	if by, err := ioutil.ReadFile(tmp); err != nil || string(by) != "partial upload" {
+		t.Fatalf("expected the other upload to be left alone, got %q: %v", by, err)
+	}
+	if contentStore.Exists(m) {
+		t.Fatalf("expected nothing to be stored")
+	}
+}
+
+func TestContentStorePutStaleTemp(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	tmp := plantTemp(t, contentStore.path(m)+".tmp", 2*time.Hour)
+
+	if err := contentStore.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected a put over a stale temporary file to succeed, got: %s", err)
+	}
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected the object to be stored")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale temporary file to be gone, got: %v", err)
+	}
+}
+
+func TestContentStoreHashAlgos(t *testing.T) {
+	setup()
+	defer teardown()
+
+	content := "content under two algorithms"
+	sum256 := sha256.Sum256([]byte(content))
+	sum512 := sha512.Sum512([]byte(content))
+	old := &MetaObject{Oid: hex.EncodeToString(sum256[:]), Size: int64(len(content))}
+	newer := &MetaObject{Oid: hex.EncodeToString(sum512[:]), Size: int64(len(content)), HashAlgo: hashSHA512}
+
+	// Both oids map to the same key, so only the algorithm keeps them apart
+	contentStore.KeyFunc = func(oid string) string { return "object" }
+
+	if err := contentStore.Put(old, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected sha256 put to succeed, got: %s", err)
+	}
+	if contentStore.Exists(newer) {
+		t.Fatalf("expected the sha512 object not to resolve to the sha256 one")
+	}
+	if err := contentStore.Put(newer, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected sha512 put to succeed, got: %s", err)
+	}
+
+	if _, err := os.Stat("content-store-test/object.gz"); err != nil {
+		t.Fatalf("expected sha256 objects where they always were, got: %s", err)
+	}
+	if _, err := os.Stat("content-store-test/sha512/object.gz"); err != nil {
+		t.Fatalf("expected sha512 objects in their own subtree, got: %s", err)
+	}
+
+	if err := contentStore.Delete(old); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	if contentStore.Exists(old) || !contentStore.Exists(newer) {
+		t.Fatalf("expected only the sha256 object to be gone")
+	}
+	r, err := contentStore.Get(newer, 0)
+	if err != nil {
+		t.Fatalf("expected sha512 get to succeed, got: %s", err)
+	}
+	by, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(by) != content {
+		t.Fatalf("expected to read content, got: %s", by)
+	}
+
+	// Content is verified with the algorithm of the object
+	wrong := &MetaObject{Oid: old.Oid, Size: old.Size, HashAlgo: hashSHA512}
+	if err := contentStore.Put(wrong, bytes.NewBufferString(content)); err != errHashMismatch {
+		t.Fatalf("expected a hash mismatch for a sha256 oid hashed with sha512, got: %v", err)
+	}
+	unknown := &MetaObject{Oid: old.Oid, Size: old.Size, HashAlgo: "md5"}
+	if err := contentStore.Put(unknown, bytes.NewBufferString(content)); err != errHashAlgo {
+		t.Fatalf("expected an unsupported algorithm to be refused, got: %v", err)
+	}
+}
+
+func TestContentStoreInline(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupDumpStore(t, "lfs-inline-test.db")
+	defer teardownDumpStore(meta, "lfs-inline-test.db")
+	contentStore.Inline, contentStore.InlineMaxSize = meta, 8
+
+	small := "tiny bit"
+	sum := sha256.Sum256([]byte(small))
+	tiny := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(small))}
+	large := &MetaObject{Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72", Size: 12}
+
+	if err := contentStore.Put(tiny, bytes.NewBufferString(small)); err != nil {
+		t.Fatalf("expected inline put to succeed, got: %s", err)
+	}
+	if err := contentStore.Put(large, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected file put to succeed, got: %s", err)
+	}
+	if tiny.Encoding != encodingInline || large.Encoding == encodingInline {
+		t.Fatalf("expected only the small object to be inline, got %q and %q", tiny.Encoding, large.Encoding)
+	}
+
+	if _, err := os.Stat(contentStore.path(tiny)); !os.IsNotExist(err) {
+		t.Fatalf("expected no file for the inline object, got: %v", err)
+	}
+	if _, err := os.Stat(contentStore.path(large)); err != nil {
+		t.Fatalf("expected a file for the large object, got: %s", err)
+	}
+
+	for _, o := range []struct {
+		meta    *MetaObject
+		content string
+	}{{tiny, small}, {large, "test content"}} {
+		if !contentStore.Exists(o.meta) {
+			t.Fatalf("expected %s to exist", o.meta.Encoding)
+		}
+		r, err := contentStore.Get(o.meta, 2)
+		if err != nil {
+			t.Fatalf("expected %s get to succeed, got: %s", o.meta.Encoding, err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(by) != o.content[2:] {
+			t.Fatalf("expected %s content from byte 2, got: %q", o.meta.Encoding, by)
+		}
+
+		if err := contentStore.Delete(o.meta); err != nil {
+			t.Fatalf("expected %s delete to succeed, got: %s", o.meta.Encoding, err)
+		}
+		if contentStore.Exists(o.meta) {
+			t.Fatalf("expected %s to be deleted", o.meta.Encoding)
+		}
+	}
+
+	// Inline content is verified like files are
+	bad := &MetaObject{Oid: tiny.Oid, Size: tiny.Size}
+	if err := contentStore.Put(bad, bytes.NewBufferString("tiny BIT")); err != errHashMismatch {
+		t.Fatalf("expected a hash mismatch, got: %v", err)
+	}
+	long := &MetaObject{Oid: tiny.Oid, Size: tiny.Size}
+	if err := contentStore.Put(long, bytes.NewBufferString(small+"!")); err != errSizeMismatch {
+		t.Fatalf("expected a size mismatch, got: %v", err)
+	}
+	if contentStore.Exists(bad) {
+		t.Fatalf("expected failed puts to store nothing")
+	}
+}
+
+func TestContentStoreGetCorrupt(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := &MetaObject{Oid: "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72", Size: 12, Encoding: encodingGzip}
+	path := contentStore.path(meta)
+	os.MkdirAll(filepath.Dir(path), 0750)
+	if err := ioutil.WriteFile(path, []byte("test content"), 0640); err != nil {
+		t.Fatalf("expected to plant a file, got: %s", err)
+	}
+
+	before := openFiles(t)
+	for i := 0; i < 100; i++ {
+		if r, err := contentStore.Get(meta, 0); err != errCorruptObject {
+			if r != nil {
+				r.Close()
+			}
+			t.Fatalf("expected a corrupt object error, got: %v", err)
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Fatalf("expected no descriptors to leak, went from %d to %d open files", before, after)
+	}
+}
+
+// openFiles returns the number of files the test has open.
+func openFiles(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files can't be counted here")
+	}
+	return len(fds)
+}
+
+func TestContentStoreSizeClasses(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.SizeClasses = []SizeClass{{"small", 12}, {"large", 0}}
+
+	for _, test := range []struct {
+		content, class string
+		size           int64
+	}{
+		{"test content", "small", 12},
+		{"larger test content", "large", 19},
+		{"test content", "small", 0},
+		{"larger test content", "large", 0},
+	} {
+		sum := sha256.Sum256([]byte(test.content))
+		m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: test.size}
+		if err := contentStore.Put(m, strings.NewReader(test.content)); err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+
+		path := filepath.Join("content-store-test", test.class, transformKey(m.Oid)+".gz")
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %q of size %d to be stored in %s, got: %s", test.content, test.size, test.class, err)
+		}
+
+		r, err := contentStore.Get(m, 0)
+		if err != nil {
+			t.Fatalf("expected get to succeed, got: %s", err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(by) != test.content {
+			t.Fatalf("expected to read %q, got: %q", test.content, by)
+		}
+
+		if err := contentStore.Delete(m); err != nil || contentStore.Exists(m) {
+			t.Fatalf("expected the object to be deleted, got: %v", err)
+		}
+	}
+}
+
+func TestContentStoreCleanTempSizeClasses(t *testing.T) {
+	setup()
+	defer teardown()
+	defer os.RemoveAll("content-store-test-large")
+
+	// A class can live elsewhere
+	if err := os.MkdirAll("content-store-test-large", 0750); err != nil {
+		t.Fatalf("expected to create directory, got: %s", err)
+	}
+	target, _ := filepath.Abs("content-store-test-large")
+	if err := os.Symlink(target, filepath.Join("content-store-test", "large")); err != nil {
+		t.Skipf("symlinks unsupported: %s", err)
+	}
+	contentStore.SizeClasses = []SizeClass{{"small", 1024}, {"large", 0}}
+
+	small := plantTemp(t, "content-store-test/small/6a/e8/stale.gz.tmp", 2*time.Hour)
+	large := plantTemp(t, "content-store-test-large/f9/7e/stale.gz.tmp", 2*time.Hour)
+	plantTemp(t, "content-store-test/stale.gz.tmp", 2*time.Hour)
+
+	res, err := contentStore.CleanTemp(time.Hour)
+	if err != nil {
+		t.Fatalf("expected clean to succeed, got: %s", err)
+	}
+	if res.Found != 3 || res.Removed != 3 {
+		t.Fatalf("expected the temporary files of every class to be removed, got %+v", res)
+	}
+	for _, path := range []string{small, large} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", path)
+		}
+	}
+}
+
+func TestContentStoreRoots(t *testing.T) {
+	setup()
+	defer teardown()
+
+	roots := []string{"content-store-test/disk0", "content-store-test/disk1", "content-store-test/disk2"}
+	contentStore.Roots = roots
+
+	used := make(map[string]bool)
+	for i := 0; i < 12; i++ {
+		data := fmt.Sprintf("object %d spread over the roots", i)
+		sum := sha256.Sum256([]byte(data))
+		m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		if err := contentStore.Put(m, strings.NewReader(data)); err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+
+		root := roots[int(sum[0])%len(roots)]
+		used[root] = true
+		for _, r := range roots {
+			_, err := os.Stat(filepath.Join(r, transformKey(m.Oid)+".gz"))
+			if r == root && err != nil {
+				t.Fatalf("expected %s to be stored on %s, got: %s", m.Oid, root, err)
+			}
+			if r != root && err == nil {
+				t.Fatalf("expected %s to only be stored on %s, found it on %s", m.Oid, root, r)
+			}
+		}
+
+		if !contentStore.Exists(m) {
+			t.Fatalf("expected %s to exist", m.Oid)
+		}
+		r, err := contentStore.Get(m, 0)
+		if err != nil {
+			t.Fatalf("expected get to succeed, got: %s", err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(by) != data {
+			t.Fatalf("expected to read %q, got: %q", data, by)
+		}
+		if err := contentStore.Delete(m); err != nil || contentStore.Exists(m) {
+			t.Fatalf("expected %s to be deleted, got: %v", m.Oid, err)
+		}
+	}
+	if len(used) != len(roots) {
+		t.Fatalf("expected the objects to be spread over every root, got %v", used)
+	}
+}
+
+func TestContentStoreStrayObjects(t *testing.T) {
+	setup()
+	defer teardown()
+
+	data := "object stored before the roots"
+	sum := sha256.Sum256([]byte(data))
+	m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if err := contentStore.Put(m, strings.NewReader(data)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if stray, err := contentStore.strayObjects(); err != nil || stray {
+		t.Fatalf("expected no stray objects without roots, got %v: %v", stray, err)
+	}
+
+	contentStore.Roots = []string{"content-store-test/disk0", "content-store-test/disk1"}
+	if stray, err := contentStore.strayObjects(); err != nil || !stray {
+		t.Fatalf("expected the object under the base path to be found, got %v: %v", stray, err)
+	}
+
+	// Once moved onto its root nothing is left behind
+	from, err := NewContentStore("content-store-test")
+	if err != nil {
+		t.Fatalf("expected the store to open, got: %s", err)
+	}
+	if _, err := rebalanceObject(from, contentStore, m); err != nil {
+		t.Fatalf("expected the object to be moved, got: %s", err)
+	}
+	if stray, err := contentStore.strayObjects(); err != nil || stray {
+		t.Fatalf("expected no stray objects once moved onto the roots, got %v: %v", stray, err)
+	}
+}
+
+func TestContentStoreCompressionBands(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.CompressionBands = []CompressionBand{
+		{MaxSize: 16, Encoding: encodingIdentity},
+		{MaxSize: 64, Encoding: encodingGzip, Level: 1},
+		{Encoding: encodingZstd, Level: 19},
+	}
+
+	for _, o := range []struct {
+		data     string
+		size     int64
+		encoding string
+	}{
+		{"tiny object", 11, encodingIdentity},
+		{"medium object compressed with gzip", 34, encodingGzip},
+		{strings.Repeat("large object compressed with zstd ", 4), 136, encodingZstd},
+		{"object of an unknown size", 0, encodingZstd},
+	} {
+		sum := sha256.Sum256([]byte(o.data))
+		meta := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: o.size}
+		if err := contentStore.Put(meta, bytes.NewBufferString(o.data)); err != nil {
+			t.Fatalf("expected put of %q to succeed, got: %s", o.data, err)
+		}
+		if meta.Encoding != o.encoding {
+			t.Fatalf("expected %q to be stored as %s, got %s", o.data, o.encoding, meta.Encoding)
+		}
+
+		r, err := contentStore.Get(meta, 0)
+		if err != nil {
+			t.Fatalf("expected get of %q to succeed, got: %s", o.data, err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(by) != o.data {
+			t.Fatalf("expected %q to round trip, got %q", o.data, by)
+		}
+	}
+}
+
+func TestParseCompressionBands(t *testing.T) {
+	bands, err := parseCompressionBands("none=4096, gzip:best=67108864, zstd:3=134217728, none")
+	if err != nil {
+		t.Fatalf("expected compression bands to parse, got: %s", err)
+	}
+	expected := []CompressionBand{
+		{4096, encodingIdentity, 0},
+		{67108864, encodingGzip, gzip.BestCompression},
+		{134217728, encodingZstd, 3},
+		{0, encodingIdentity, 0},
+	}
+	if !reflect.DeepEqual(bands, expected) {
+		t.Fatalf("expected %v, got %v", expected, bands)
+	}
+	if bands, err := parseCompressionBands(""); err != nil || bands != nil {
+		t.Fatalf("expected no bands, got %v: %v", bands, err)
+	}
+
+	for _, v := range []string{"gzip=1024,none=10", "none,gzip=10", "brotli=10", "none:9=10", "gzip:10=10", "zstd:fast", "gzip=big"} {
+		if _, err := parseCompressionBands(v); err == nil {
+			t.Errorf("expected %q to be refused", v)
+		}
+	}
+}
+
+func TestParseSizeClasses(t *testing.T) {
+	classes, err := parseSizeClasses("small=1024, medium=1048576, large")
+	if err != nil {
+		t.Fatalf("expected size classes to parse, got: %s", err)
+	}
+	expected := []SizeClass{{"small", 1024}, {"medium", 1048576}, {"large", 0}}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Fatalf("expected %v, got %v", expected, classes)
+	}
+
+	for _, v := range []string{"small=1024,tiny=10", "large,small=10", "=10", "../up=10", "quarantine", "small=big"} {
+		if _, err := parseSizeClasses(v); err == nil {
+			t.Errorf("expected %q to be refused", v)
+		}
+	}
+}
+
+// plantTemp writes a file at path last modified age ago, returning its path.
+func plantTemp(t *testing.T, path string, age time.Duration) string {
+	path = filepath.FromSlash(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatalf("expected to create directory, got: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("partial upload"), 0640); err != nil {
+		t.Fatalf("expected to write file, got: %s", err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("expected to set file time, got: %s", err)
+	}
+	return path
+}
+
+func BenchmarkContentStorePut(b *testing.B) {
+	data := benchmarkContent()
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+
+	for _, bc := range []struct {
+		name        string
+		compression string
+		level       int
+	}{
+		{"gzip-best", encodingGzip, 0},
+		{"zstd-fastest", encodingZstd, 1},
+		{"zstd-default", encodingZstd, 3},
+		{"zstd-best", encodingZstd, 19},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			setup()
+			defer teardown()
+
+			contentStore.Compression = bc.compression
+			contentStore.CompressionLevel = bc.level
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := &MetaObject{Oid: oid, Size: int64(len(data))}
+				if err := contentStore.Put(m, bytes.NewReader(data)); err != nil {
+					b.Fatalf("expected put to succeed, got: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkContent returns a megabyte of moderately compressible text.
+func benchmarkContent() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1<<20; i++ {
+		fmt.Fprintf(&buf, "line %d of the benchmark object, value %x\n", i, i*7919)
+	}
+	return buf.Bytes()[:1<<20]
+}
+
 func setup() {
 	store, err := NewContentStore("content-store-test")
 	if err != nil {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPolicy describes which cross-origin requests browsers may make.
+type corsPolicy struct {
+	// Origins are the allowed origins. "*" allows any origin, and a "*" in
+	// place of the leftmost host label, as in "https://*.example.com", allows
+	// any subdomain.
+	Origins     []string
+	Methods     string
+	Headers     string
+	Credentials bool
+}
+
+// allowCORS wraps h so that requests from an origin allowed by p get the
+// Access-Control-* headers browsers need. Preflight requests are answered
+// directly, before authentication, as browsers send them without credentials.
+func allowCORS(h http.Handler, p *corsPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !p.allows(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.Credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", p.Methods)
+			w.Header().Set("Access-Control-Allow-Headers", p.Headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(204)
+			logRequest(r, 204)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allows returns true if origin may make cross-origin requests. With
+// credentials allowed, "*" matches nothing, so no site a user visits can act
+// with their credentials unless it is listed.
+func (p *corsPolicy) allows(origin string) bool {
+	for _, o := range p.Origins {
+		switch {
+		case o == "*":
+			if !p.Credentials {
+				return true
+			}
+		case strings.Contains(o, "://*."):
+			i := strings.Index(o, "*")
+			prefix, suffix := o[:i], o[i+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				len(origin) > len(prefix)+len(suffix) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@") {
+				return true
+			}
+		case strings.EqualFold(o, origin):
+			return true
+		}
+	}
+	return false
+}
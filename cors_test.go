@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins string) { Config.CORSOrigins = origins }(Config.CORSOrigins)
+	Config.CORSOrigins = "https://app.example.com"
+
+	for _, path := range []string{"/user/repo/objects/batch", "/user/repo/objects/" + contentOid, "/user/repo/locks"} {
+		req, err := http.NewRequest("OPTIONS", lfsServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		// Preflights carry no credentials, so they must not reach auth
+		if res.StatusCode != 204 {
+			t.Fatalf("expected preflight of %s to return 204, got %d", path, res.StatusCode)
+		}
+		if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+			t.Fatalf("expected the origin to be allowed, got %q", origin)
+		}
+		if methods := res.Header.Get("Access-Control-Allow-Methods"); methods != Config.CORSMethods {
+			t.Fatalf("expected the configured methods, got %q", methods)
+		}
+		if headers := res.Header.Get("Access-Control-Allow-Headers"); headers != Config.CORSHeaders {
+			t.Fatalf("expected the configured headers, got %q", headers)
+		}
+	}
+}
+
+func TestCORSGet(t *testing.T) {
+	defer func(origins string) { Config.CORSOrigins = origins }(Config.CORSOrigins)
+	Config.CORSOrigins = "https://app.example.com"
+
+	get := func(origin string) *http.Response {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Origin", origin)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("https://app.example.com")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Fatalf("expected the origin to be allowed, got %q", origin)
+	}
+	if res.Header.Get("Vary") == "" {
+		t.Fatalf("expected the response to vary by origin")
+	}
+
+	res = get("https://evil.example.org")
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Fatalf("expected another origin not to be allowed, got %q", origin)
+	}
+
+	// Disabled by default
+	Config.CORSOrigins = ""
+	res = get("https://app.example.com")
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Fatalf("expected CORS to be disabled, got %q", origin)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		credentials bool
+		origin      string
+		allowed     bool
+	}{
+		{[]string{"https://app.example.com"}, false, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, false, "http://app.example.com", false},
+		{[]string{"*"}, false, "https://anything.example.org", true},
+		{[]string{"*"}, true, "https://anything.example.org", false},
+		{[]string{"https://*.example.com"}, true, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, false, "https://example.com", false},
+		{[]string{"https://*.example.com"}, false, "https://evil.org/.example.com", false},
+		{[]string{"https://*.example.com"}, false, "https://evilexample.com", false},
+	}
+
+	for _, test := range tests {
+		p := &corsPolicy{Origins: test.origins, Credentials: test.credentials}
+		if allowed := p.allows(test.origin); allowed != test.allowed {
+			t.Errorf("expected %v for %s with %v (credentials %v), got %v", test.allowed, test.origin, test.origins, test.credentials, allowed)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Discovery describes the server to tools configuring themselves, with what
+// they need to know to talk to it and nothing secret.
+type Discovery struct {
+	Version string `json:"version"`
+	// APIBase is the URL the LFS API is served from. Repos are under
+	// RepoURL, with {user} and {repo} filled in.
+	APIBase    string              `json:"api_base"`
+	RepoURL    string              `json:"repo_url"`
+	Operations []string            `json:"operations"`
+	Transfers  map[string][]string `json:"transfers"`
+	HashAlgos  []string            `json:"hash_algos"`
+	// Auth are the ways requests to the API can authenticate, and AdminAuth
+	// those of the admin API.
+	Auth      []string `json:"auth"`
+	AdminAuth []string `json:"admin_auth"`
+}
+
+// serverURL returns the URL the server is reached at, without a path.
+func serverURL() string {
+	if Config.IsHTTPS() {
+		return fmt.Sprintf("%s://%s", Config.Scheme, Config.Host)
+	}
+	return fmt.Sprintf("http://%s", Config.Host)
+}
+
+func discovery() *Discovery {
+	d := &Discovery{
+		Version:    version,
+		APIBase:    serverURL(),
+		RepoURL:    serverURL() + "/{user}/{repo}",
+		Operations: []string{"download", "upload", "verify", "locks"},
+		Transfers: map[string][]string{
+			"download": serverTransfers("download"),
+			"upload":   serverTransfers("upload"),
+		},
+		// Access tokens are sent as the password of basic auth
+		Auth:      []string{"basic"},
+		AdminAuth: []string{"basic"},
+	}
+	for algo := range hashSizes {
+		d.HashAlgos = append(d.HashAlgos, algo)
+	}
+	sort.Strings(d.HashAlgos)
+
+	if Config.IsSigningLinks() {
+		d.Auth = append(d.Auth, "signed_link")
+	}
+	if Config.IsPublic() {
+		d.Auth = append(d.Auth, "anonymous")
+	}
+	if Config.IsUsingOIDC() {
+		d.AdminAuth = append(d.AdminAuth, "oidc")
+	}
+	return d
+}
+
+// DiscoveryHandler serves the discovery document. It needs no credentials,
+// as it's what clients read to find out how to authenticate.
+func (a *App) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discovery())
+	logRequest(r, 200)
+}
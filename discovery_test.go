@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiscovery(t *testing.T) {
+	defer func(v string) { Config.SigningKey = v }(Config.SigningKey)
+	defer func(v string) { Config.OIDCIssuer = v }(Config.OIDCIssuer)
+	Config.SigningKey = "secret signing key"
+	Config.OIDCIssuer = "https://issuer.example.com"
+
+	for _, accept := range []string{"", metaMediaType} {
+		path := "/.well-known/lfs"
+		if accept != "" {
+			path = "/"
+		}
+		res, err := api("GET", path, accept, "", "", nil)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 without credentials for %s, got %d", path, res.StatusCode)
+		}
+
+		var d Discovery
+		if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+			t.Fatalf("expected a discovery document, got: %s", err)
+		}
+		res.Body.Close()
+		if d.APIBase != "http://"+Config.Host || d.RepoURL != d.APIBase+"/{user}/{repo}" {
+			t.Errorf("expected the configured API base, got %q and %q", d.APIBase, d.RepoURL)
+		}
+		if len(d.Auth) != 2 || d.Auth[0] != "basic" || d.Auth[1] != "signed_link" {
+			t.Errorf("expected basic auth and signed links, got %v", d.Auth)
+		}
+		if len(d.AdminAuth) != 2 || d.AdminAuth[1] != "oidc" {
+			t.Errorf("expected OIDC for admins, got %v", d.AdminAuth)
+		}
+	}
+}
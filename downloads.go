@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dayFormat is how the days of per-day download counts are written, as UTC
+// dates.
+const dayFormat = "2006-01-02"
+
+// DownloadCount is how often an object was downloaded, in total and, when
+// per-day counts are kept, on each of the last days, by UTC date.
+type DownloadCount struct {
+	Oid   string           `json:"oid"`
+	Total int64            `json:"total"`
+	Days  map[string]int64 `json:"days,omitempty"`
+}
+
+// since returns the downloads counted on day and later.
+func (d *DownloadCount) since(day string) int64 {
+	var n int64
+	for date, count := range d.Days {
+		if date >= day {
+			n += count
+		}
+	}
+	return n
+}
+
+func (d *DownloadCount) add(day string, n int64, days int) {
+	d.Total += n
+	if days <= 0 {
+		return
+	}
+	if d.Days == nil {
+		d.Days = make(map[string]int64)
+	}
+	d.Days[day] += n
+}
+
+// prune drops the per-day counts of days before first.
+func (d *DownloadCount) prune(first string) {
+	for date := range d.Days {
+		if date < first {
+			delete(d.Days, date)
+		}
+	}
+	if len(d.Days) == 0 {
+		d.Days = nil
+	}
+}
+
+// rangeStart matches the first byte of a Range header.
+var rangeStart = regexp.MustCompile(`^bytes=(\d+)-`)
+
+// resumed returns true if r asks for the content from past its first byte,
+// as a client resuming a download does. The download was counted when it
+// started, so it isn't counted again.
+func resumed(r *http.Request) bool {
+	match := rangeStart.FindStringSubmatch(r.Header.Get("Range"))
+	if match == nil {
+		return false
+	}
+	from, _ := strconv.ParseInt(match[1], 10, 64)
+	return from > 0
+}
+
+// downloadKey is what pending downloads are counted by, so downloads before
+// and after midnight go to their own day.
+type downloadKey struct {
+	oid string
+	day string
+}
+
+// DownloadCounter counts the downloads of every object. Like LifetimeStats it
+// gathers counts in memory and writes them to the meta store every Interval,
+// so a download never waits on a write, and a crash loses at most the counts
+// since the last write.
+type DownloadCounter struct {
+	meta *MetaStore
+
+	// Interval is how often counts are written to the meta store.
+	Interval time.Duration
+	// Days is how many days of per-day counts are kept, today included. 0
+	// keeps only the totals.
+	Days int
+
+	mu      sync.Mutex
+	pending map[downloadKey]int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewDownloadCounter creates a DownloadCounter writing to meta. Call Start to
+// write counts periodically.
+func NewDownloadCounter(meta *MetaStore, interval time.Duration, days int) *DownloadCounter {
+	return &DownloadCounter{meta: meta, Interval: interval, Days: days, pending: make(map[downloadKey]int64)}
+}
+
+// Start launches the background writer.
+func (c *DownloadCounter) Start() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.Flush(time.Now()); err != nil {
+					logger.Log(kv{"fn": "downloads", "err": err.Error()})
+				}
+			}
+		}
+	}()
+}
+
+// Add counts a download of oid at now. It does nothing on a nil
+// DownloadCounter, so callers needn't check whether downloads are counted.
+func (c *DownloadCounter) Add(oid string, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.pending[downloadKey{oid, now.UTC().Format(dayFormat)}]++
+	c.mu.Unlock()
+}
+
+// Flush writes the counts gathered since the last write, dropping per-day
+// counts too old to be kept as of now.
+func (c *DownloadCounter) Flush(now time.Time) error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[downloadKey]int64)
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := c.meta.AddDownloads(pending, c.Days, c.firstDay(now)); err != nil {
+		// Keep the counts for the next try
+		c.mu.Lock()
+		for key, n := range pending {
+			c.pending[key] += n
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// firstDay returns the oldest day per-day counts are kept for as of now.
+func (c *DownloadCounter) firstDay(now time.Time) string {
+	return now.UTC().AddDate(0, 0, 1-c.Days).Format(dayFormat)
+}
+
+// Count returns the downloads of oid, including those not written yet.
+func (c *DownloadCounter) Count(oid string) (*DownloadCount, error) {
+	count, err := c.meta.Downloads(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, n := range c.pending {
+		if key.oid == oid {
+			count.add(key.day, n, c.Days)
+		}
+	}
+	return count, nil
+}
+
+// Top returns the limit most downloaded objects that are still stored, most
+// downloaded first. With days above 0 only the downloads of the last days
+// count, which needs per-day counts to be kept.
+func (c *DownloadCounter) Top(limit, days int, now time.Time) ([]*DownloadCount, error) {
+	// Pending counts are written first, which is cheaper than telling
+	// which of their objects are still stored
+	if err := c.Flush(now); err != nil {
+		return nil, err
+	}
+	counts, err := c.meta.AllDownloads()
+	if err != nil {
+		return nil, err
+	}
+
+	first := ""
+	if days > 0 {
+		first = now.UTC().AddDate(0, 0, 1-days).Format(dayFormat)
+	}
+	downloads := func(d *DownloadCount) int64 {
+		if days > 0 {
+			return d.since(first)
+		}
+		return d.Total
+	}
+
+	top := make([]*DownloadCount, 0, len(counts))
+	for _, count := range counts {
+		if downloads(count) > 0 {
+			top = append(top, count)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if a, b := downloads(top[i]), downloads(top[j]); a != b {
+			return a > b
+		}
+		return top[i].Oid < top[j].Oid
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
+
+// Drain stops the background writer and writes the remaining counts. It is
+// meant to be registered as a shutdown hook.
+func (c *DownloadCounter) Drain(ctx context.Context) error {
+	if c.stop != nil {
+		close(c.stop)
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return c.Flush(time.Now())
+}
+
+// adminTopDownloadsHandler lists the most downloaded objects. limit, 10 by
+// default, is how many, and days, if set, the number of days whose downloads
+// count.
+func (a *App) adminTopDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.downloadCounts == nil {
+		writeAdminError(w, r, 404, "Downloads aren't counted")
+		return
+	}
+
+	limit, days := 10, 0
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeAdminError(w, r, 400, "Invalid limit: "+v)
+			return
+		}
+		limit = n
+	}
+	if v := r.FormValue("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > a.downloadCounts.Days {
+			writeAdminError(w, r, 400, "Invalid days, downloads are counted per day for "+strconv.Itoa(a.downloadCounts.Days)+" days: "+v)
+			return
+		}
+		days = n
+	}
+
+	top, err := a.downloadCounts.Top(limit, days, time.Now())
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	writeAdminJSON(w, r, 200, top)
+}
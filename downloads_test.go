@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDownloadCounter(t *testing.T) {
+	os.Remove("lfs-downloads-test.db")
+	defer os.Remove("lfs-downloads-test.db")
+
+	meta, err := NewMetaStore("lfs-downloads-test.db")
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	defer meta.Close()
+	if _, err := meta.Put(&RequestVars{Oid: contentOid, Size: contentSize}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+
+	c := NewDownloadCounter(meta, time.Hour, 2)
+	day1 := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Minute)
+	c.Add(contentOid, day1)
+	c.Add(contentOid, day1)
+	c.Add(contentOid, day2)
+
+	// Counts are written in batches, not as they come in
+	if stored, _ := meta.Downloads(contentOid); stored.Total != 0 {
+		t.Fatalf("expected nothing to be written before a flush, got %+v", stored)
+	}
+	if count, _ := c.Count(contentOid); count.Total != 3 || count.Days["2026-03-01"] != 2 || count.Days["2026-03-02"] != 1 {
+		t.Fatalf("expected unwritten counts to be included, got %+v", count)
+	}
+
+	if err := c.Flush(day2); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+	c.Add(contentOid, day2.AddDate(0, 0, 1))
+	if err := c.Flush(day2.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+
+	// Only the last two days are kept apart from the total
+	stored, err := meta.Downloads(contentOid)
+	if err != nil || stored.Total != 4 || len(stored.Days) != 2 || stored.Days["2026-03-02"] != 1 || stored.Days["2026-03-03"] != 1 {
+		t.Fatalf("expected the total and the counts of two days, got %+v: %v", stored, err)
+	}
+
+	// The counts go with the object, pending ones included
+	c.Add(contentOid, day2.AddDate(0, 0, 1))
+	if err := meta.Delete(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	if err := c.Flush(day2.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+	if stored, err := meta.Downloads(contentOid); err != nil || stored.Total != 0 {
+		t.Fatalf("expected the counts to be deleted with the object, got %+v: %v", stored, err)
+	}
+}
+
+func TestDownloadCountsResumesAndCDN(t *testing.T) {
+	app := NewApp(testContentStore, testMetaStore)
+	app.downloadCounts = NewDownloadCounter(testMetaStore, time.Hour, 7)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	meta := putBulkObject(t, "download resumed and redirected", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	get := func(rangeHdr string) int {
+		req, err := http.NewRequest("GET", server.URL+"/user/repo/objects/"+meta.Oid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		if rangeHdr != "" {
+			req.Header.Set("Range", rangeHdr)
+		}
+		res, err := noRedirects.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A download, its resume and a range from the start
+	for _, rangeHdr := range []string{"", "bytes=5-", "bytes=0-"} {
+		get(rangeHdr)
+	}
+	if count, _ := app.downloadCounts.Count(meta.Oid); count.Total != 2 {
+		t.Fatalf("expected the resumed download not to be counted, got %+v", count)
+	}
+
+	defer func(v string) { Config.CDNURL = v }(Config.CDNURL)
+	Config.CDNURL = "https://cdn.example.com"
+	if status := get(""); status != 302 {
+		t.Fatalf("expected a redirect to the cdn, got %d", status)
+	}
+	if count, _ := app.downloadCounts.Count(meta.Oid); count.Total != 3 {
+		t.Fatalf("expected the download redirected to the cdn to be counted, got %+v", count)
+	}
+}
+
+func TestDownloadCountsOrder(t *testing.T) {
+	defer setupAdmin()()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.downloadCounts = NewDownloadCounter(testMetaStore, time.Hour, 7)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	var oids []string
+	for i := 0; i < 3; i++ {
+		meta := putBulkObject(t, fmt.Sprintf("downloaded object %d", i), "repo")
+		defer removeMeta(meta.Oid)
+		defer testContentStore.Delete(meta)
+		oids = append(oids, meta.Oid)
+	}
+
+	get := func(path, user, pass string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", contentMediaType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		return res
+	}
+
+	// The second object is downloaded most, the first never
+	for i, n := range []int{0, 3, 0} {
+		for j := 0; j < n; j++ {
+			res := get("/user/repo/objects/"+oids[i], testUser, testPass)
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Fatalf("expected status 200, got %d", res.StatusCode)
+			}
+		}
+	}
+	// Some counts written, some pending
+	if err := app.downloadCounts.Flush(time.Now()); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+	for _, oid := range []string{oids[1], oids[2]} {
+		res := get("/user/repo/objects/"+oid, testUser, testPass)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	res := get("/user/repo/objects/"+oids[1]+"/meta", testUser, testPass)
+	var attrs struct {
+		Downloads *DownloadCount `json:"downloads"`
+	}
+	json.NewDecoder(res.Body).Decode(&attrs)
+	res.Body.Close()
+	if attrs.Downloads == nil || attrs.Downloads.Total != 4 {
+		t.Fatalf("expected the meta endpoint to show 4 downloads, got %+v", attrs.Downloads)
+	}
+
+	res = get("/admin/objects/downloads?limit=2&days=1", testAdminUser, testAdminPass)
+	var top []*DownloadCount
+	json.NewDecoder(res.Body).Decode(&top)
+	res.Body.Close()
+	if res.StatusCode != 200 || len(top) != 2 || top[0].Oid != oids[1] || top[0].Total != 4 || top[1].Oid != oids[2] || top[1].Total != 1 {
+		t.Fatalf("expected the most downloaded objects in order, got status %d: %+v", res.StatusCode, top)
+	}
+
+	if res := get("/admin/objects/downloads?days=8", testAdminUser, testAdminPass); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for more days than kept, got %d", res.StatusCode)
+	}
+	if res := adminAPI(t, "GET", "/admin/objects/downloads", ""); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 without download counts, got %d", res.StatusCode)
+	}
+}
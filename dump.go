@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dumpVersion is the version of the dump format written by Export.
+const dumpVersion = 1
+
+// importBatchSize is how many records Import writes per transaction.
+const importBatchSize = 500
+
+// Dump record types.
+const (
+	dumpHeader     = "dump"
+	dumpObject     = "object"
+	dumpDownloads  = "downloads"
+	dumpUser       = "user"
+	dumpToken      = "token"
+	dumpLock       = "lock"
+	dumpStat       = "stat"
+	dumpDurability = "durability"
+)
+
+var errDumpHeader = errors.New("Dump doesn't start with a supported header")
+
+// dumpRecord is one line of a meta store dump. Type says which of the other
+// fields is set.
+type dumpRecord struct {
+	Type    string       `json:"type"`
+	Version int          `json:"version,omitempty"`
+	Object  *MetaObject  `json:"object,omitempty"`
+	User    *dumpedUser  `json:"user,omitempty"`
+	Token   *dumpedToken `json:"token,omitempty"`
+	Repo    string       `json:"repo,omitempty"`
+	Lock    *Lock        `json:"lock,omitempty"`
+	// Content is the content of an inline object, which is kept in the
+	// meta store and so dumped with it.
+	Content []byte `json:"content,omitempty"`
+
+	Downloads  *DownloadCount   `json:"downloads,omitempty"`
+	Stat       *dumpedStat      `json:"stat,omitempty"`
+	Durability *DurabilityEvent `json:"durability,omitempty"`
+}
+
+// dumpedUser is a user as written to a dump. Users created before passwords
+// were hashed are dumped with a hash of their password. Dumps written before
+// that carry the Password itself, which is hashed on import.
+type dumpedUser struct {
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Hash     string `json:"hash,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// dumpedToken is an access token as written to a dump. Only the hash of the
+// token is stored, so that is all that's dumped.
+type dumpedToken struct {
+	Key     string    `json:"key"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+// dumpedStat is one of the lifetime counters recorded by AddStats.
+type dumpedStat struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// Export writes all objects, download counts, users, tokens, locks, lifetime
+// counters and undelivered durability events to w as newline delimited JSON,
+// one record per line after a header. Records are written as they are read
+// from a single consistent snapshot, so the store is never held in memory.
+// Usage totals aren't written, as they are counted again from the objects
+// imported. It returns the number of records written.
+func (s *MetaStore) Export(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+
+	write := func(rec *dumpRecord) error {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if err := write(&dumpRecord{Type: dumpHeader, Version: dumpVersion}); err != nil {
+			return err
+		}
+
+		err := tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			if _, err := decodeMeta(v, &meta); err != nil {
+				return fmt.Errorf("Object %s: %s", k, err)
+			}
+			rec := &dumpRecord{Type: dumpObject, Object: &meta}
+			if meta.Encoding == encodingInline {
+				rec.Content = tx.Bucket(inlineBucket).Get(k)
+			}
+			return write(rec)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(downloadsBucket).ForEach(func(k, v []byte) error {
+			var count DownloadCount
+			if err := json.Unmarshal(v, &count); err != nil {
+				return fmt.Errorf("Downloads of %s: %s", k, err)
+			}
+			return write(&dumpRecord{Type: dumpDownloads, Downloads: &count})
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			rec := decodeUserRecord(v)
+			u := &dumpedUser{Name: string(k), Role: rec.Role, Hash: rec.Hash}
+			if rec.Hash == "" {
+				// Users from before passwords were hashed keep
+				// their password in the clear, which the dump
+				// shouldn't
+				value, err := newUserRecord(string(v), rec.Role)
+				if err != nil {
+					return err
+				}
+				u.Hash = decodeUserRecord(value).Hash
+			}
+			return write(&dumpRecord{Type: dumpUser, User: u})
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			var rec tokenRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("Token of %s: %s", rec.User, err)
+			}
+			return write(&dumpRecord{Type: dumpToken, Token: &dumpedToken{Key: string(k), User: rec.User, Created: rec.Created}})
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(locksBucket).ForEach(func(k, v []byte) error {
+			var locks []Lock
+			if err := json.Unmarshal(v, &locks); err != nil {
+				return fmt.Errorf("Locks of %s: %s", k, err)
+			}
+			for i := range locks {
+				if err := write(&dumpRecord{Type: dumpLock, Repo: string(k), Lock: &locks[i]}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(statsBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return nil
+			}
+			return write(&dumpRecord{Type: dumpStat, Stat: &dumpedStat{Name: string(k), Value: int64(binary.BigEndian.Uint64(v))}})
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(durabilityBucket).ForEach(func(k, v []byte) error {
+			var e DurabilityEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("Durability event %x: %s", k, err)
+			}
+			return write(&dumpRecord{Type: dumpDurability, Durability: &e})
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// Import reads a dump written by Export from r and stores its records,
+// replacing records with the same key. Importing a dump again has no further
+// effect, so an interrupted import can simply be run again. Each record is
+// validated, and the import stops at the first invalid one; the records
+// before it are kept. It returns the number of records imported.
+func (s *MetaStore) Import(r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header dumpRecord
+	if err := dec.Decode(&header); err != nil || header.Type != dumpHeader || header.Version != dumpVersion {
+		return 0, errDumpHeader
+	}
+
+	n, line := 0, 1
+	batch := make([]*dumpRecord, 0, importBatchSize)
+	for {
+		var rec dumpRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err == nil {
+			err = rec.validate()
+		}
+		if err != nil {
+			if cerr := s.importBatch(batch); cerr != nil {
+				return n, cerr
+			}
+			return n + len(batch), fmt.Errorf("Line %d: %s", line, err)
+		}
+
+		batch = append(batch, &rec)
+		if len(batch) == importBatchSize {
+			if err := s.importBatch(batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	if err := s.importBatch(batch); err != nil {
+		return n, err
+	}
+	return n + len(batch), nil
+}
+
+func (s *MetaStore) importBatch(batch []*dumpRecord) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, rec := range batch {
+			if err := importRecord(tx, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func importRecord(tx *bolt.Tx, rec *dumpRecord) error {
+	switch rec.Type {
+	case dumpObject:
+		if rec.Content != nil {
+			if err := tx.Bucket(inlineBucket).Put([]byte(rec.Object.Oid), rec.Content); err != nil {
+				return err
+			}
+		}
+
+		bucket := tx.Bucket(objectsBucket)
+		old := bucket.Get([]byte(rec.Object.Oid))
+		if old != nil {
+			// A retention can only be extended, so one set since the
+			// dump was written is kept
+			var stored MetaObject
+			if _, err := decodeMeta(old, &stored); err != nil {
+				return err
+			}
+			if stored.RetainUntil != nil && (rec.Object.RetainUntil == nil || stored.RetainUntil.After(*rec.Object.RetainUntil)) {
+				rec.Object.RetainUntil = stored.RetainUntil
+			}
+		}
+		return putMeta(bucket, rec.Object)
+
+	case dumpDownloads:
+		value, err := json.Marshal(rec.Downloads)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(downloadsBucket).Put([]byte(rec.Downloads.Oid), value)
+
+	case dumpUser:
+		u := rec.User
+		value, err := json.Marshal(&userRecord{Hash: u.Hash, Role: u.Role})
+		if u.Hash == "" {
+			value, err = newUserRecord(u.Password, u.Role)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).Put([]byte(u.Name), value)
+
+	case dumpToken:
+		value, err := json.Marshal(&tokenRecord{User: rec.Token.User, Created: rec.Token.Created})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(tokensBucket).Put([]byte(rec.Token.Key), value)
+
+	case dumpLock:
+		bucket := tx.Bucket(locksBucket)
+
+		var locks []Lock
+		if data := bucket.Get([]byte(rec.Repo)); data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+
+		// Replace a lock with the same id, so importing twice doesn't
+		// duplicate it
+		replaced := false
+		for i := range locks {
+			if locks[i].Id == rec.Lock.Id {
+				locks[i], replaced = *rec.Lock, true
+			}
+		}
+		if !replaced {
+			locks = append(locks, *rec.Lock)
+		}
+		sort.Sort(LocksByCreatedAt(locks))
+
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(rec.Repo), data)
+
+	case dumpStat:
+		var value [8]byte
+		binary.BigEndian.PutUint64(value[:], uint64(rec.Stat.Value))
+		return tx.Bucket(statsBucket).Put([]byte(rec.Stat.Name), value[:])
+
+	case dumpDurability:
+		bucket := tx.Bucket(durabilityBucket)
+		value, err := json.Marshal(rec.Durability)
+		if err != nil {
+			return err
+		}
+
+		// Events are queued under a sequence of their own, so one
+		// already queued isn't queued again
+		queued := false
+		err = bucket.ForEach(func(k, v []byte) error {
+			queued = queued || bytes.Equal(v, value)
+			return nil
+		})
+		if err != nil || queued {
+			return err
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		return bucket.Put(key[:], value)
+	}
+	return nil
+}
+
+// validate checks that the record can be imported.
+func (rec *dumpRecord) validate() error {
+	switch rec.Type {
+	case dumpObject:
+		if rec.Object == nil {
+			return errors.New("Object record without an object")
+		}
+		if !supportsHashAlgo(rec.Object.hashAlgo()) {
+			return fmt.Errorf("Invalid hash algorithm of %s: %q", rec.Object.Oid, rec.Object.HashAlgo)
+		}
+		if b, err := hex.DecodeString(rec.Object.Oid); err != nil || len(b) != hashSizes[rec.Object.hashAlgo()] {
+			return fmt.Errorf("Invalid oid: %q", rec.Object.Oid)
+		}
+		if rec.Object.Size < 0 {
+			return fmt.Errorf("Invalid size of %s: %d", rec.Object.Oid, rec.Object.Size)
+		}
+		if _, ok := encodingSuffixes[rec.Object.Encoding]; !ok {
+			return fmt.Errorf("Invalid encoding of %s: %q", rec.Object.Oid, rec.Object.Encoding)
+		}
+		if rec.Content != nil && rec.Object.Encoding != encodingInline {
+			return fmt.Errorf("Content of %s, which isn't inline", rec.Object.Oid)
+		}
+
+	case dumpDownloads:
+		if rec.Downloads == nil || rec.Downloads.Oid == "" {
+			return errors.New("Downloads record without an oid")
+		}
+
+	case dumpUser:
+		if rec.User == nil || rec.User.Name == "" {
+			return errors.New("User record without a name")
+		}
+		if err := validateRole(rec.User.Role); err != nil {
+			return err
+		}
+		if rec.User.Hash != "" {
+			if _, err := bcrypt.Cost([]byte(rec.User.Hash)); err != nil {
+				return fmt.Errorf("Invalid password hash of %s", rec.User.Name)
+			}
+		} else if rec.User.Password == "" {
+			return fmt.Errorf("User %s has no password", rec.User.Name)
+		}
+
+	case dumpToken:
+		if rec.Token == nil || rec.Token.User == "" {
+			return errors.New("Token record without a user")
+		}
+		if b, err := hex.DecodeString(rec.Token.Key); err != nil || len(b) != 32 {
+			return fmt.Errorf("Invalid token key of %s", rec.Token.User)
+		}
+
+	case dumpLock:
+		if rec.Repo == "" || rec.Lock == nil || rec.Lock.Id == "" || rec.Lock.Path == "" {
+			return errors.New("Lock record without a repo, id or path")
+		}
+
+	case dumpStat:
+		if rec.Stat == nil || rec.Stat.Name == "" {
+			return errors.New("Stat record without a name")
+		}
+
+	case dumpDurability:
+		if rec.Durability == nil || rec.Durability.Oid == "" {
+			return errors.New("Durability record without an oid")
+		}
+
+	default:
+		return fmt.Errorf("Unknown record type: %q", rec.Type)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	src := setupDumpStore(t, "lfs-dump-src.db")
+	defer teardownDumpStore(src, "lfs-dump-src.db")
+
+	const objects = 600
+	for i := 0; i < objects; i++ {
+		oid := hex.EncodeToString(sha256Sum(fmt.Sprintf("object %d", i)))
+		rv := &RequestVars{User: "user", Repo: fmt.Sprintf("repo%d", i%3), Oid: oid, Size: int64(i + 1)}
+		meta, err := src.Put(rv)
+		if err != nil {
+			t.Fatalf("expected meta put to succeed, got: %s", err)
+		}
+		if i%100 == 0 {
+			meta.Pending = false
+			if err := src.Update(meta); err != nil {
+				t.Fatalf("expected meta update to succeed, got: %s", err)
+			}
+		}
+	}
+	oid := hex.EncodeToString(sha256Sum("object 0"))
+	if err := src.AddDownloads(map[downloadKey]int64{{oid: oid, day: "2020-01-01"}: 3}, 7, "2019-12-25"); err != nil {
+		t.Fatalf("expected to add downloads, got: %s", err)
+	}
+	if err := src.AddStats(map[string]int64{"lfs_uploads_total": 42}); err != nil {
+		t.Fatalf("expected to add stats, got: %s", err)
+	}
+	if err := src.AddDurabilityEvent(&DurabilityEvent{Oid: oid, Size: 1}); err != nil {
+		t.Fatalf("expected to add a durability event, got: %s", err)
+	}
+	// Users from before passwords were hashed have them in the clear
+	err := src.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte("sam"), []byte("gamgee1"))
+	})
+	if err != nil {
+		t.Fatalf("expected to add a legacy user, got: %s", err)
+	}
+	if err := src.CreateUser("frodo", "baggins1", roleAdmin); err != nil {
+		t.Fatalf("expected to create user, got: %s", err)
+	}
+	token, err := src.AddToken("frodo")
+	if err != nil {
+		t.Fatalf("expected to add token, got: %s", err)
+	}
+	if err := src.AddLocks("user/repo0", NewTestLock(lockId, lockPath, "frodo")); err != nil {
+		t.Fatalf("expected to add lock, got: %s", err)
+	}
+
+	var dump bytes.Buffer
+	n, err := src.Export(&dump)
+	if err != nil {
+		t.Fatalf("expected export to succeed, got: %s", err)
+	}
+	const records = objects + 7
+	if n != 1+records {
+		t.Fatalf("expected a header and %d records, got %d", records, n)
+	}
+	if strings.Contains(dump.String(), "gamgee1") {
+		t.Fatalf("expected the dump not to hold a password in the clear")
+	}
+
+	dst := setupDumpStore(t, "lfs-dump-dst.db")
+	defer teardownDumpStore(dst, "lfs-dump-dst.db")
+
+	// Importing twice, as when retrying an interrupted import, changes nothing
+	for i := 0; i < 2; i++ {
+		if n, err := dst.Import(bytes.NewReader(dump.Bytes())); err != nil || n != records {
+			t.Fatalf("expected import to store %d records, got %d: %v", records, n, err)
+		}
+	}
+
+	var again bytes.Buffer
+	if _, err := dst.Export(&again); err != nil {
+		t.Fatalf("expected export to succeed, got: %s", err)
+	}
+	if !bytes.Equal(dump.Bytes(), again.Bytes()) {
+		t.Fatalf("expected the imported store to export the same dump")
+	}
+
+	meta, err := dst.UnsafeGet(&RequestVars{Oid: hex.EncodeToString(sha256Sum("object 4"))})
+	if err != nil || meta.Size != 5 || len(meta.Repos) != 1 || meta.Repos[0] != "user/repo1" {
+		t.Fatalf("expected the object and its references to be imported, got %+v: %v", meta, err)
+	}
+
+	if _, ok := dst.Authenticate("frodo", "baggins1"); !ok {
+		t.Fatalf("expected the imported user's password to work")
+	}
+	if _, ok := dst.Authenticate("frodo", token); !ok {
+		t.Fatalf("expected the imported token to work")
+	}
+	if _, ok := dst.Authenticate("sam", "gamgee1"); !ok {
+		t.Fatalf("expected the imported legacy user's password to work")
+	}
+
+	srcTotal, _, _ := src.StoredUsage("", nil)
+	if total, inUser, err := dst.StoredUsage("user", nil); err != nil || total != srcTotal || inUser != srcTotal {
+		t.Fatalf("expected the usage of the imported objects to be %d, got %d and %d: %v", srcTotal, total, inUser, err)
+	}
+	if count, err := dst.Downloads(oid); err != nil || count.Total != 3 {
+		t.Fatalf("expected the download count to be imported, got %+v: %v", count, err)
+	}
+	if stats, err := dst.Stats(); err != nil || stats["lfs_uploads_total"] != 42 {
+		t.Fatalf("expected the stats to be imported, got %v: %v", stats, err)
+	}
+	if events, err := dst.DurabilityEvents(); err != nil || len(events) != 1 || events[0].Oid != oid {
+		t.Fatalf("expected the durability event to be imported once, got %v: %v", events, err)
+	}
+
+	locks, err := dst.Locks("user/repo0")
+	if err != nil || len(locks) != 1 || locks[0].Id != lockId {
+		t.Fatalf("expected the lock to be imported once, got %v: %v", locks, err)
+	}
+}
+
+func TestDumpImportInvalid(t *testing.T) {
+	dst := setupDumpStore(t, "lfs-dump-dst.db")
+	defer teardownDumpStore(dst, "lfs-dump-dst.db")
+
+	dump := strings.Join([]string{
+		`{"type":"dump","version":1}`,
+		`{"type":"object","object":{"oid":"` + contentOid + `","size":18}}`,
+		`{"type":"object","object":{"oid":"not an oid","size":18}}`,
+		`{"type":"object","object":{"oid":"` + nonExistingOid + `","size":18}}`,
+	}, "\n")
+
+	n, err := dst.Import(strings.NewReader(dump))
+	if err == nil || !strings.Contains(err.Error(), "Line 3") {
+		t.Fatalf("expected the invalid line to be reported, got: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the record before the invalid one to be imported, got %d", n)
+	}
+
+	if _, err := dst.UnsafeGet(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected the valid object to be imported, got: %s", err)
+	}
+	if _, err := dst.UnsafeGet(&RequestVars{Oid: nonExistingOid}); err != errObjectNotFound {
+		t.Fatalf("expected the import to stop at the invalid record, got: %v", err)
+	}
+
+	if _, err := dst.Import(strings.NewReader(`{"type":"object"}`)); err != errDumpHeader {
+		t.Fatalf("expected a dump without header to be refused, got: %v", err)
+	}
+}
+
+func TestDumpImportKeepsLongerRetention(t *testing.T) {
+	src := setupDumpStore(t, "lfs-dump-src.db")
+	defer teardownDumpStore(src, "lfs-dump-src.db")
+
+	oid := hex.EncodeToString(sha256Sum("retained object"))
+	if _, err := src.Put(&RequestVars{Oid: oid, Size: 15}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if _, err := src.SetRetention(oid, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("expected to set the retention, got: %s", err)
+	}
+
+	var dump bytes.Buffer
+	if _, err := src.Export(&dump); err != nil {
+		t.Fatalf("expected export to succeed, got: %s", err)
+	}
+
+	dst := setupDumpStore(t, "lfs-dump-dst.db")
+	defer teardownDumpStore(dst, "lfs-dump-dst.db")
+	if _, err := dst.Import(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("expected import to succeed, got: %s", err)
+	}
+	later, err := dst.SetRetention(oid, time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("expected to extend the retention, got: %s", err)
+	}
+
+	if _, err := dst.Import(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("expected import to succeed, got: %s", err)
+	}
+	meta, err := dst.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil || meta.RetainUntil == nil || !meta.RetainUntil.Equal(*later.RetainUntil) {
+		t.Fatalf("expected the longer retention to be kept, got %+v: %v", meta, err)
+	}
+}
+
+func TestDumpImportHashAlgos(t *testing.T) {
+	dst := setupDumpStore(t, "lfs-dump-dst.db")
+	defer teardownDumpStore(dst, "lfs-dump-dst.db")
+
+	sha512Oid := strings.Repeat("ab", 64)
+	dump := strings.Join([]string{
+		`{"type":"dump","version":1}`,
+		`{"type":"object","object":{"oid":"` + sha512Oid + `","size":18,"hash_algo":"sha512"}}`,
+		`{"type":"object","object":{"oid":"` + sha512Oid + `","size":18}}`,
+	}, "\n")
+
+	n, err := dst.Import(strings.NewReader(dump))
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "Line 3") {
+		t.Fatalf("expected only the sha512 oid of a sha512 object to be imported, got %d: %v", n, err)
+	}
+	if meta, err := dst.UnsafeGet(&RequestVars{Oid: sha512Oid}); err != nil || meta.HashAlgo != hashSHA512 {
+		t.Fatalf("expected the sha512 object to be imported, got %+v: %v", meta, err)
+	}
+}
+
+func TestDumpInlineContent(t *testing.T) {
+	src := setupDumpStore(t, "lfs-dump-src.db")
+	defer teardownDumpStore(src, "lfs-dump-src.db")
+
+	oid := hex.EncodeToString(sha256Sum("inline object"))
+	meta, err := src.Put(&RequestVars{Oid: oid, Size: 13})
+	if err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	meta.Encoding = encodingInline
+	if err := src.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	if err := src.PutInline(oid, []byte("inline object")); err != nil {
+		t.Fatalf("expected inline put to succeed, got: %s", err)
+	}
+
+	var dump bytes.Buffer
+	if _, err := src.Export(&dump); err != nil {
+		t.Fatalf("expected export to succeed, got: %s", err)
+	}
+
+	dst := setupDumpStore(t, "lfs-dump-dst.db")
+	defer teardownDumpStore(dst, "lfs-dump-dst.db")
+	if _, err := dst.Import(&dump); err != nil {
+		t.Fatalf("expected import to succeed, got: %s", err)
+	}
+	if data, err := dst.GetInline(oid); err != nil || string(data) != "inline object" {
+		t.Fatalf("expected the inline content to be imported, got %q: %v", data, err)
+	}
+
+	invalid := `{"type":"dump","version":1}` + "\n" + `{"type":"object","object":{"oid":"` + oid + `","size":13},"content":"aW5saW5l"}`
+	if _, err := dst.Import(strings.NewReader(invalid)); err == nil {
+		t.Fatalf("expected content of an object that isn't inline to be refused")
+	}
+}
+
+func sha256Sum(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+func setupDumpStore(t *testing.T, file string) *MetaStore {
+	os.Remove(file)
+	store, err := NewMetaStore(file)
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	return store
+}
+
+func teardownDumpStore(store *MetaStore, file string) {
+	store.Close()
+	os.Remove(file)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	durabilityMaxAttempts = 6
+	durabilityBaseBackoff = time.Second
+	durabilityMaxBackoff  = time.Minute
+)
+
+// durabilitySignatureHeader carries the signature of a DurabilityEvent, as
+// "sha256=" followed by the hex HMAC-SHA256 of the body under the secret.
+const durabilitySignatureHeader = "X-Lfs-Signature"
+
+// DurabilityEvent is what the durability webhook is sent for an object once
+// its content is written and recorded, and replicated if replication is
+// enabled. SentAt is when it was sent, set on every attempt, so receivers
+// can refuse a signed callback replayed later.
+type DurabilityEvent struct {
+	Oid        string     `json:"oid"`
+	Size       int64      `json:"size"`
+	Replicated bool       `json:"replicated"`
+	StoredAt   time.Time  `json:"stored_at"`
+	SentAt     *time.Time `json:"sent_at,omitempty"`
+
+	// seq is the key of the event in the meta store.
+	seq uint64
+}
+
+// DurabilityHook posts a signed DurabilityEvent to URL for every object
+// durably stored, from a worker of its own, so uploads never wait for it and
+// an upload response is no promise it was sent. Events are kept in the meta
+// store until they are delivered, so those still queued at a shutdown or
+// crash are sent after the restart, and a receiver may get one twice.
+// Deliveries that fail or get anything but a 2xx answer are retried with
+// backoff.
+type DurabilityHook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+
+	// MaxAttempts is the number of times a delivery is tried before giving
+	// up.
+	MaxAttempts int
+	// BaseBackoff is the delay after the first failure, doubled on each retry.
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	meta *MetaStore
+
+	mu      sync.Mutex
+	queue   []*DurabilityEvent
+	signal  chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+// NewDurabilityHook creates a DurabilityHook posting to url, signing with
+// secret, that keeps its queue in meta. Call Start to begin delivering.
+func NewDurabilityHook(meta *MetaStore, url, secret string) *DurabilityHook {
+	return &DurabilityHook{
+		meta:        meta,
+		URL:         url,
+		Secret:      secret,
+		Client:      &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts: durabilityMaxAttempts,
+		BaseBackoff: durabilityBaseBackoff,
+		MaxBackoff:  durabilityMaxBackoff,
+		signal:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start loads the events left undelivered from the meta store and launches
+// the background worker.
+func (h *DurabilityHook) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.started {
+		return nil
+	}
+
+	// Events notified before are in the meta store too
+	queue, err := h.meta.DurabilityEvents()
+	if err != nil {
+		return err
+	}
+	h.queue = queue
+
+	h.started = true
+	h.wg.Add(1)
+	go h.run()
+	return nil
+}
+
+// Stop signals the worker to exit and waits for it. Events still queued are
+// delivered once the hook is started again.
+func (h *DurabilityHook) Stop() {
+	h.mu.Lock()
+	if !h.started {
+		h.mu.Unlock()
+		return
+	}
+	h.started = false
+	h.mu.Unlock()
+
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// Drain waits for the queue to empty, or for ctx to be done, and then stops
+// the worker.
+func (h *DurabilityHook) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for h.Backlog() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			h.Stop()
+			logger.Log(kv{"fn": "Drain", "msg": "durability webhook queue not drained", "backlog": h.Backlog()})
+			return ctx.Err()
+		}
+	}
+
+	h.Stop()
+	return nil
+}
+
+// Notify schedules the event of meta, durably stored, replicated or not.
+func (h *DurabilityHook) Notify(meta *MetaObject, replicated bool) {
+	e := &DurabilityEvent{Oid: meta.Oid, Size: meta.Size, Replicated: replicated, StoredAt: time.Now().UTC()}
+
+	// Kept in memory only if it can't be saved, as it's still to be sent
+	h.mu.Lock()
+	if err := h.meta.AddDurabilityEvent(e); err != nil {
+		logger.Log(kv{"fn": "durabilityHook", "oid": e.Oid, "err": err.Error()})
+	}
+	h.queue = append(h.queue, e)
+	h.mu.Unlock()
+
+	select {
+	case h.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Backlog returns the number of events waiting to be delivered.
+func (h *DurabilityHook) Backlog() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.queue)
+}
+
+func (h *DurabilityHook) run() {
+	defer h.wg.Done()
+
+	for {
+		h.mu.Lock()
+		var e *DurabilityEvent
+		if len(h.queue) > 0 {
+			e = h.queue[0]
+		}
+		h.mu.Unlock()
+
+		if e == nil {
+			select {
+			case <-h.signal:
+				continue
+			case <-h.stop:
+				return
+			}
+		}
+
+		if !h.deliver(e) {
+			return
+		}
+		if e.seq > 0 {
+			if err := h.meta.DeleteDurabilityEvent(e); err != nil {
+				logger.Log(kv{"fn": "durabilityHook", "oid": e.Oid, "err": err.Error()})
+			}
+		}
+
+		h.mu.Lock()
+		h.queue = h.queue[1:]
+		h.mu.Unlock()
+	}
+}
+
+// deliver posts a single event, retrying with exponential backoff. It returns
+// false if the hook was stopped while waiting to retry.
+func (h *DurabilityHook) deliver(e *DurabilityEvent) bool {
+	backoff := h.BaseBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := h.post(e)
+		if err == nil {
+			metrics.Add("lfs_durability_webhooks_total", 1)
+			return true
+		}
+
+		logger.Log(kv{"fn": "durabilityHook", "oid": e.Oid, "attempt": attempt, "err": err})
+		metrics.Add("lfs_durability_webhook_failures_total", 1)
+
+		if attempt >= h.MaxAttempts {
+			metrics.Add("lfs_durability_webhooks_abandoned_total", 1)
+			return true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-h.stop:
+			return false
+		}
+
+		backoff *= 2
+		if backoff > h.MaxBackoff {
+			backoff = h.MaxBackoff
+		}
+	}
+}
+
+func (h *DurabilityHook) post(e *DurabilityEvent) error {
+	sent := *e
+	now := time.Now().UTC()
+	sent.SentAt = &now
+	body, err := json.Marshal(&sent)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(durabilitySignatureHeader, durabilitySignature(h.Secret, body))
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Webhook answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// durabilitySignature returns the signature of a durability webhook body.
+func durabilitySignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// stored hands an upload, once its content is written and recorded, to the
+// replicator, and to the durability webhook. With replication the webhook
+// waits for the object to be replicated, which the replicator reports.
+func (a *App) stored(meta *MetaObject) {
+	if a.replicator != nil {
+		a.replicator.Enqueue(meta)
+	} else if a.durability != nil {
+		a.durability.Notify(meta, false)
+	}
+}
+
+// replicated reports an object copied by the replicator to the durability
+// webhook. Objects fetched from upstream weren't uploaded, so they aren't.
+func (a *App) replicated(meta *MetaObject) {
+	if a.durability != nil && !meta.Mirrored {
+		a.durability.Notify(meta, true)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurabilityWebhookIsSigned(t *testing.T) {
+	receiver, events := durabilityReceiver(t, "durability secret")
+	defer receiver.Close()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.durability = NewDurabilityHook(testMetaStore, receiver.URL, "durability secret")
+	app.durability.Start()
+	defer app.durability.Stop()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	meta := uploadDurable(t, server, "object reported durable")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+	e := waitForDurability(t, events)
+	if e.Oid != meta.Oid || e.Size != meta.Size || e.Replicated {
+		t.Fatalf("expected the event of the unreplicated upload, got %+v", e)
+	}
+
+	// A callback signed under another secret doesn't verify
+	other := NewDurabilityHook(testMetaStore, receiver.URL, "not the secret")
+	if err := other.post(e); err == nil {
+		t.Fatalf("expected a callback with the wrong signature to be refused")
+	}
+}
+
+func TestDurabilityWebhookWaitsForReplication(t *testing.T) {
+	receiver, events := durabilityReceiver(t, "durability secret")
+	defer receiver.Close()
+
+	// The replica holds every copy until released
+	release := make(chan struct{})
+	secondary := NewMemoryStore()
+	secondary.Hook = func(op string, meta *MetaObject) error {
+		if op == memoryPut {
+			<-release
+		}
+		return nil
+	}
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.durability = NewDurabilityHook(testMetaStore, receiver.URL, "durability secret")
+	app.durability.Start()
+	defer app.durability.Stop()
+	app.replicator = NewReplicator(testContentStore, secondary)
+	app.replicator.Replicated = app.replicated
+	app.replicator.Start()
+	defer app.replicator.Stop()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	meta := uploadDurable(t, server, "object reported once replicated")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	select {
+	case e := <-events:
+		t.Fatalf("expected no callback before the object is replicated, got %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	e := waitForDurability(t, events)
+	if e.Oid != meta.Oid || e.Size != meta.Size || !e.Replicated {
+		t.Fatalf("expected the event of the replicated upload, got %+v", e)
+	}
+	if !secondary.Exists(meta) {
+		t.Fatalf("expected the object to be replicated before its callback")
+	}
+}
+
+func TestDurabilityWebhookSurvivesRestart(t *testing.T) {
+	receiver, events := durabilityReceiver(t, "durability secret")
+	defer receiver.Close()
+
+	// Queued by a hook stopped before it could deliver it
+	meta := &MetaObject{Oid: hex.EncodeToString(sha256Sum("object stored before a restart")), Size: 30}
+	stopped := NewDurabilityHook(testMetaStore, receiver.URL, "durability secret")
+	stopped.Notify(meta, false)
+	stopped.Stop()
+
+	hook := NewDurabilityHook(testMetaStore, receiver.URL, "durability secret")
+	if err := hook.Start(); err != nil {
+		t.Fatalf("expected the hook to start, got: %s", err)
+	}
+	defer hook.Stop()
+	e := waitForDurability(t, events)
+	if e.Oid != meta.Oid || e.SentAt == nil || time.Since(*e.SentAt) > time.Minute {
+		t.Fatalf("expected the event queued before the restart, sent just now, got %+v", e)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pending, err := testMetaStore.DurabilityEvents()
+		if err != nil {
+			t.Fatalf("expected the pending events, got: %s", err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the delivered event to be removed, got %+v", pending)
+		}
+	}
+}
+
+// durabilityReceiver returns a server receiving durability callbacks, which
+// refuses those not signed under secret and sends the others on events.
+func durabilityReceiver(t *testing.T, secret string) (*httptest.Server, chan *DurabilityEvent) {
+	events := make(chan *DurabilityEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(durabilitySignatureHeader) != durabilitySignature(secret, body) {
+			w.WriteHeader(403)
+			return
+		}
+		e := &DurabilityEvent{}
+		if err := json.Unmarshal(body, e); err != nil {
+			t.Errorf("expected a durability event, got: %s", err)
+			w.WriteHeader(400)
+			return
+		}
+		events <- e
+	}))
+	return server, events
+}
+
+func waitForDurability(t *testing.T, events chan *DurabilityEvent) *DurabilityEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the durability callback")
+		return nil
+	}
+}
+
+func uploadDurable(t *testing.T, server *httptest.Server, data string) *MetaObject {
+	meta, err := testMetaStore.Put(&RequestVars{Oid: hex.EncodeToString(sha256Sum(data)), Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+
+	req, err := http.NewRequest("PUT", server.URL+"/user/repo/objects/"+meta.Oid, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected the upload to succeed, got %d", res.StatusCode)
+	}
+	return meta
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDownloadRates parses the download rates of roles given as
+// "role=rate" entries separated by commas, in MB/s like DownloadRate. A
+// rate of 0 leaves downloads of the role unthrottled.
+func parseDownloadRates(v string) (map[string]int64, error) {
+	rates := make(map[string]int64)
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Download rate isn't given as role=rate: %q", entry)
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || r < 0 {
+			return nil, fmt.Errorf("Invalid download rate of role %s: %s", parts[0], parts[1])
+		}
+		rates[strings.TrimSpace(parts[0])] = int64(r * 1024 * 1024)
+	}
+	return rates, nil
+}
+
+// downloadRate returns the bytes per second the content of a download is
+// sent at, that of the requester's role if it has its own, or 0 if it isn't
+// throttled.
+func (a *App) downloadRate(r *http.Request) int64 {
+	if rate, ok := a.downloadRates[identity(r).Role]; ok {
+		return rate
+	}
+	return Config.DownloadBytesPerSecond()
+}
+
+// Info tells an authenticated client what applies to its own requests.
+type Info struct {
+	Version string `json:"version"`
+	// DownloadRate is the bytes per second downloads of the client are sent
+	// at, or 0 if they aren't throttled.
+	DownloadRate int64 `json:"download_rate"`
+}
+
+// InfoHandler serves the Info of the requester. Unlike the discovery
+// document it needs credentials, as rates differ by role.
+func (a *App) InfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&Info{Version: version, DownloadRate: a.downloadRate(r)})
+	logRequest(r, 200)
+}
+
+// throttleDownload returns content paced to the download rate of r. Each
+// download is paced on its own, after the range is applied, and as the
+// decompressed bytes sent. Waiting for the rate ends with ctx.
+func (a *App) throttleDownload(ctx context.Context, r *http.Request, content io.Reader) io.Reader {
+	rate := a.downloadRate(r)
+	if rate <= 0 {
+		return content
+	}
+	return &throttledReader{r: content, limit: newThrottle(rate), ctx: ctx}
+}
+
+// downloadDeadline returns how long a download of size bytes through r may
+// take: the download deadline, plus the time sending size bytes takes at the
+// download rate of r if it's throttled, so a throttled download of a large
+// object isn't cut off by the pace it is held to. It returns 0 if downloads
+// aren't limited.
+func (a *App) downloadDeadline(r *http.Request, size int64) time.Duration {
+	base := Config.DownloadDeadline()
+	rate := a.downloadRate(r)
+	if base <= 0 || rate <= 0 || size <= 0 {
+		return base
+	}
+	return base + time.Duration(float64(size)/float64(rate)*float64(time.Second))
+}
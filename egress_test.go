@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseDownloadRates(t *testing.T) {
+	rates, err := parseDownloadRates(" admin=0, ci=0.5 ")
+	if err != nil || len(rates) != 2 || rates["admin"] != 0 || rates["ci"] != 512*1024 {
+		t.Fatalf("expected the rates of admin and ci, got %v: %v", rates, err)
+	}
+	for _, v := range []string{"admin", "=2", "ci=-1", "ci=x"} {
+		if _, err := parseDownloadRates(v); err == nil {
+			t.Errorf("expected %q to be invalid", v)
+		}
+	}
+}
+
+func TestDownloadThrottled(t *testing.T) {
+	defer func(v string) { Config.DownloadRate = v }(Config.DownloadRate)
+	defer func(v string) { Config.DownloadRoleRates = v }(Config.DownloadRoleRates)
+	// About 100 bytes per second, so the content takes over 150ms
+	Config.DownloadRate = "0.0001"
+
+	download := func(server *httptest.Server, rng string) (time.Duration, string) {
+		req, err := http.NewRequest("GET", server.URL+"/user/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+
+		start := time.Now()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("expected response to contain content, got error: %s", err)
+		}
+		return time.Since(start), string(by)
+	}
+
+	if info := downloadInfo(t, lfsServer, testUser, testPass); info.DownloadRate != 104 {
+		t.Fatalf("expected the download rate to be published, got %d", info.DownloadRate)
+	}
+	if res, _ := http.Get(lfsServer.URL + "/info"); res.StatusCode != 401 {
+		t.Fatalf("expected the rate not to be shown without credentials, got %d", res.StatusCode)
+	}
+	if d, by := download(lfsServer, ""); by != content || d < 150*time.Millisecond {
+		t.Fatalf("expected the content to take at least 150ms, got %q in %s", by, d)
+	}
+	if d, by := download(lfsServer, "bytes=10-"); by != content[10:] || d < 60*time.Millisecond {
+		t.Fatalf("expected the range to be throttled, got %q in %s", by, d)
+	}
+
+	// Roles with a rate of 0 aren't throttled
+	Config.DownloadRoleRates = roleUser + "=0"
+	trusted := httptest.NewServer(NewApp(testContentStore, testMetaStore))
+	defer trusted.Close()
+	if d, by := download(trusted, ""); by != content || d >= 150*time.Millisecond {
+		t.Fatalf("expected the content unthrottled, got %q in %s", by, d)
+	}
+	if info := downloadInfo(t, trusted, testUser, testPass); info.DownloadRate != 0 {
+		t.Fatalf("expected the role's own rate to be published, got %d", info.DownloadRate)
+	}
+}
+
+func downloadInfo(t *testing.T, server *httptest.Server, user, pass string) *Info {
+	req, _ := http.NewRequest("GET", server.URL+"/info", nil)
+	req.SetBasicAuth(user, pass)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var info Info
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatalf("expected info, got: %s", err)
+	}
+	return &info
+}
+
+func TestDownloadDeadlineScalesWithRate(t *testing.T) {
+	defer func(v string) { Config.DownloadRate = v }(Config.DownloadRate)
+	defer func(v string) { Config.DownloadTimeout = v }(Config.DownloadTimeout)
+	// The content takes over 150ms at about 100 bytes per second, longer
+	// than the deadline alone
+	Config.DownloadRate = "0.0001"
+	Config.DownloadTimeout = "50ms"
+
+	req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	defer res.Body.Close()
+	if by, err := ioutil.ReadAll(res.Body); err != nil || string(by) != content {
+		t.Fatalf("expected the throttled download to complete, got %q: %v", by, err)
+	}
+}
+
+func TestThrottleWaitEndsWithContext(t *testing.T) {
+	limit := newThrottle(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// 100 bytes at 10 bytes per second would take 10s
+	start := time.Now()
+	if err := limit.waitContext(ctx, 100); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the context, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the wait to end at the deadline, took %s", d)
+	}
+}
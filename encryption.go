@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// encryptedMagic starts every encrypted object file.
+var encryptedMagic = []byte("LFSE\x01")
+
+// encryptedChunkSize is how much plaintext is sealed at a time, so objects are
+// encrypted and decrypted as a stream.
+const encryptedChunkSize = 64 * 1024
+
+var (
+	errNoKeyring     = errors.New("Object is encrypted but no encryption keys are configured")
+	errUnknownKey    = errors.New("Object is encrypted with an unknown key")
+	errEncryptedFile = errors.New("Encrypted object is corrupt or was encrypted with another key")
+)
+
+// Keyring holds the master keys objects are encrypted with. Each object gets
+// a random data key, which is stored in the object's header wrapped with the
+// current master key. The other keys are only used to read objects written
+// before the current key was introduced.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// parseKeyring parses keys given as "id:hex" pairs separated by commas or
+// whitespace, each key being 32 bytes for AES-256. The first key is current.
+func parseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, fmt.Errorf("Encryption key isn't given as id:hex: %q", field)
+		}
+		id := parts[0]
+
+		key, err := hex.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Encryption key %s isn't 32 hex encoded bytes", id)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("Encryption key %s is given twice", id)
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+
+	if k.current == "" {
+		return nil, errors.New("No encryption keys given")
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypter returns a writer encrypting to w with a new data key wrapped by
+// the current master key. The data key is bound to oid, so the file of one
+// object can't be passed off as another's. Close must be called to write the
+// final chunk.
+func (k *Keyring) encrypter(w io.Writer, oid string) (io.WriteCloser, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	master := k.keys[k.current]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, encryptedMagic...)
+	header = append(header, byte(len(k.current)))
+	header = append(header, k.current...)
+	header = append(header, nonce...)
+	header = master.Seal(header, nonce, dataKey, []byte(oid))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+// decrypter returns a reader decrypting the object oid from r, using the
+// master key named in its header.
+func (k *Keyring) decrypter(r io.Reader, oid string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	prefix := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(br, prefix); err != nil || string(prefix[:len(encryptedMagic)]) != string(encryptedMagic) {
+		return nil, errEncryptedFile
+	}
+	id := make([]byte, prefix[len(encryptedMagic)])
+	if _, err := io.ReadFull(br, id); err != nil {
+		return nil, errEncryptedFile
+	}
+
+	master, ok := k.keys[string(id)]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	nonce := make([]byte, master.NonceSize())
+	wrapped := make([]byte, 32+master.Overhead())
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, errEncryptedFile
+	}
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return nil, errEncryptedFile
+	}
+
+	dataKey, err := master.Open(nil, nonce, wrapped, []byte(oid))
+	if err != nil {
+		return nil, errEncryptedFile
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, chunk: make([]byte, encryptedChunkSize+aead.Overhead())}, nil
+}
+
+// chunkNonce is the nonce of chunk n. Data keys are never reused, so a
+// counter is enough; the last byte marks the final chunk so that a truncated
+// file fails to decrypt instead of reading as a shorter object.
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, as the last
+		// chunk has to be sealed as such
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptedChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if _, err := e.w.Write(e.aead.Seal(nil, chunkNonce(e.n, last), e.buf, nil)); err != nil {
+		return err
+	}
+	e.n++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte
+	plain []byte
+	n     uint64
+	done  bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errEncryptedFile
+		}
+		return err
+	}
+
+	// The last chunk is the one nothing follows
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(nil, chunkNonce(d.n, last), d.chunk[:n], nil)
+	if err != nil {
+		return errEncryptedFile
+	}
+	d.n++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+)
+
+func TestContentStoreEncrypted(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+
+	// Several chunks, the last one partial
+	content := benchmarkContent()[:3*encryptedChunkSize+100]
+
+	for _, limit := range []int64{0, 1} {
+		contentStore.CompressMaxSize = limit
+		m := encryptedObject(t, content)
+		if m.KeyID != "k1" {
+			t.Fatalf("expected the key id to be recorded, got %q", m.KeyID)
+		}
+
+		raw, err := ioutil.ReadFile(contentStore.path(m))
+		if err != nil {
+			t.Fatalf("expected the object to be stored, got: %s", err)
+		}
+		if bytes.Contains(raw, content[:64]) {
+			t.Fatalf("expected the %s object to be stored encrypted", m.Encoding)
+		}
+
+		for _, from := range []int64{0, encryptedChunkSize + 10} {
+			if got := readObject(t, m, from); !bytes.Equal(got, content[from:]) {
+				t.Fatalf("expected to read the %s object from byte %d, got %d bytes", m.Encoding, from, len(got))
+			}
+		}
+		contentStore.Delete(m)
+	}
+}
+
+func TestContentStoreEncryptedWrongKey(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.KeyFunc = flatKey
+	contentStore.Keys = mustKeyring(t, testKey1)
+	m := encryptedObject(t, []byte("secret content"))
+
+	// Same id, other key
+	contentStore.Keys = mustKeyring(t, "k1:"+strings.Repeat("ff", 32))
+	if _, err := contentStore.Get(m, 0); err != errEncryptedFile {
+		t.Fatalf("expected a read with the wrong key to fail, got: %v", err)
+	}
+
+	contentStore.Keys = mustKeyring(t, testKey2)
+	if _, err := contentStore.Get(m, 0); err != errUnknownKey {
+		t.Fatalf("expected a read without the key to fail, got: %v", err)
+	}
+
+	contentStore.Keys = nil
+	if _, err := contentStore.Get(m, 0); err != errNoKeyring {
+		t.Fatalf("expected a read without keys to fail, got: %v", err)
+	}
+
+	// The data key is bound to the object
+	contentStore.Keys = mustKeyring(t, testKey1)
+	other := *m
+	other.Oid = strings.Repeat("c", 64)
+	if err := os.Rename(contentStore.path(m), contentStore.path(&other)); err != nil {
+		t.Fatalf("expected to move the object, got: %s", err)
+	}
+	if _, err := contentStore.Get(&other, 0); err != errEncryptedFile {
+		t.Fatalf("expected a read of another object's file to fail, got: %v", err)
+	}
+}
+
+func TestContentStoreEncryptedTruncated(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+	contentStore.CompressMaxSize = 1
+	content := benchmarkContent()[:2*encryptedChunkSize+100]
+	m := encryptedObject(t, content)
+
+	// Cut off the last chunk, so the file ends on a full chunk
+	path := contentStore.path(m)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the object to be stored, got: %s", err)
+	}
+	if err := os.Truncate(path, info.Size()-100-16); err != nil {
+		t.Fatalf("expected to truncate the object, got: %s", err)
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != errEncryptedFile {
+		t.Fatalf("expected reading a truncated object to fail, got: %v", err)
+	}
+}
+
+func TestContentStoreEncryptionKeyRotation(t *testing.T) {
+	setup()
+	defer teardown()
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+	old := encryptedObject(t, []byte("old content"))
+
+	contentStore.Keys = mustKeyring(t, testKey2+","+testKey1)
+	m := encryptedObject(t, []byte("new content"))
+	if m.KeyID != "k2" {
+		t.Fatalf("expected new objects to use the new key, got %q", m.KeyID)
+	}
+
+	if got := readObject(t, old, 0); string(got) != "old content" {
+		t.Fatalf("expected the old object to stay readable, got %q", got)
+	}
+	if got := readObject(t, m, 0); string(got) != "new content" {
+		t.Fatalf("expected the new object to be readable, got %q", got)
+	}
+
+	// Objects stored unencrypted stay readable too
+	contentStore.Keys = nil
+	plain := encryptedObject(t, []byte("plain content"))
+	contentStore.Keys = mustKeyring(t, testKey2)
+	if plain.KeyID != "" {
+		t.Fatalf("expected no key id without keys, got %q", plain.KeyID)
+	}
+	if got := readObject(t, plain, 0); string(got) != "plain content" {
+		t.Fatalf("expected the unencrypted object to stay readable, got %q", got)
+	}
+
+	// A copy keeps the encryption meta records, an upload is encrypted
+	// whatever encoding is already recorded
+	copied := *plain
+	copied.copy = true
+	if err := contentStore.Put(&copied, strings.NewReader("plain content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if copied.KeyID != "" {
+		t.Fatalf("expected a copy to stay unencrypted, got %q", copied.KeyID)
+	}
+	if err := contentStore.Put(plain, strings.NewReader("plain content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if plain.KeyID != "k2" {
+		t.Fatalf("expected an upload to be encrypted, got %q", plain.KeyID)
+	}
+	if got := readObject(t, plain, 0); string(got) != "plain content" {
+		t.Fatalf("expected the encrypted object to be readable, got %q", got)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	k, err := parseKeyring(testKey1 + ",\n" + testKey2 + "\n")
+	if err != nil || k.current != "k1" || len(k.keys) != 2 {
+		t.Fatalf("expected two keys with k1 current, got %+v: %v", k, err)
+	}
+
+	for _, keys := range []string{"", "k1", "k1:abcd", ":" + strings.Repeat("00", 32), testKey1 + "," + testKey1} {
+		if _, err := parseKeyring(keys); err == nil {
+			t.Errorf("expected %q to be refused", keys)
+		}
+	}
+}
+
+func mustKeyring(t *testing.T, keys string) *Keyring {
+	k, err := parseKeyring(keys)
+	if err != nil {
+		t.Fatalf("expected keys to parse, got: %s", err)
+	}
+	return k
+}
+
+// encryptedObject puts content in contentStore and returns its meta.
+func encryptedObject(t *testing.T, content []byte) *MetaObject {
+	sum := sha256.Sum256(content)
+	m := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	if err := contentStore.Put(m, bytes.NewReader(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	return m
+}
+
+func readObject(t *testing.T, m *MetaObject, from int64) []byte {
+	r, err := contentStore.Get(m, from)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("expected to read the object, got: %s", err)
+	}
+	return by
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Expirer periodically deletes objects whose expiry time has passed, and soft
+// deleted objects whose grace period has. Each
+// pause between sweeps gets a random jitter, so servers started together
+// don't all delete at the same moment, and a sweep deletes at most Limit
+// objects, so a large backlog is worked off over several sweeps.
+type Expirer struct {
+	// Interval is the pause between two sweeps. A sweep never runs if it
+	// is 0.
+	Interval time.Duration
+	// Jitter is the largest random delay added to each pause.
+	Jitter time.Duration
+	// Limit is how many objects a sweep deletes at most, 0 means no limit.
+	Limit int
+	// DeleteGrace is how long soft deleted objects are kept for restoring.
+	DeleteGrace time.Duration
+	// Replicator, if set, also has expired objects deleted from its
+	// secondary store.
+	Replicator *Replicator
+	// Uploads, if set, are claimed for each object deleted, so an upload of
+	// it can't find its content about to be deleted and keep its meta.
+	Uploads *uploadTracker
+
+	meta  *MetaStore
+	store objectStore
+	now   func() time.Time
+
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+	mu      sync.Mutex
+}
+
+// expirySummary describes the outcome of a sweep.
+type expirySummary struct {
+	Scanned int
+	Deleted int
+	Reaped  int
+	Freed   int64
+}
+
+// NewExpirer creates an Expirer deleting the expired objects of meta from
+// store. Call Start to begin sweeping.
+func NewExpirer(meta *MetaStore, store objectStore) *Expirer {
+	return &Expirer{
+		Interval: time.Hour,
+		meta:     meta,
+		store:    store,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start launches the background worker, unless sweeping is disabled.
+func (e *Expirer) Start() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.started || e.Interval <= 0 {
+		return
+	}
+	e.started = true
+	e.wg.Add(1)
+	go e.run()
+}
+
+// Stop signals the worker to exit after the current sweep and waits for it,
+// or for ctx to expire.
+func (e *Expirer) Stop(ctx context.Context) error {
+	e.mu.Lock()
+	started := e.started
+	e.started = false
+	e.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	close(e.stop)
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Expirer) run() {
+	defer e.wg.Done()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(e.pause()):
+		}
+
+		summary, err := e.sweep(e.now())
+		if err != nil {
+			logger.Log(kv{"fn": "expire", "err": err.Error()})
+		}
+		logger.Log(kv{"fn": "expire", "scanned": summary.Scanned, "deleted": summary.Deleted, "reaped": summary.Reaped, "freed": summary.Freed})
+	}
+}
+
+func (e *Expirer) pause() time.Duration {
+	if e.Jitter <= 0 {
+		return e.Interval
+	}
+	return e.Interval + time.Duration(rand.Int63n(int64(e.Jitter)))
+}
+
+// sweep deletes the objects that expired before now, and those soft deleted
+// longer than DeleteGrace ago, up to Limit of them.
+func (e *Expirer) sweep(now time.Time) (expirySummary, error) {
+	var summary expirySummary
+
+	after := ""
+	for e.Limit <= 0 || summary.Deleted+summary.Reaped < e.Limit {
+		meta, err := e.meta.NextObject(after)
+		if err != nil {
+			return summary, err
+		}
+		if meta == nil {
+			break
+		}
+		after = meta.Oid
+		summary.Scanned++
+
+		// A soft deleted object is kept for its grace period, expired or not
+		switch {
+		case meta.DeletedAt != nil:
+			if !meta.deletedBefore(now.Add(-e.DeleteGrace)) {
+				continue
+			}
+		case !meta.expired(now):
+			continue
+		}
+
+		meta, reaped := e.remove(meta, now)
+		if meta == nil {
+			continue
+		}
+		if reaped {
+			summary.Reaped++
+		} else {
+			summary.Deleted++
+		}
+		summary.Freed += meta.Size
+	}
+
+	metrics.Add("lfs_expired_objects_total", int64(summary.Deleted))
+	metrics.Add("lfs_reaped_objects_total", int64(summary.Reaped))
+	metrics.Add("lfs_expired_bytes_total", summary.Freed)
+	return summary, nil
+}
+
+// remove deletes the object meta, expired or soft deleted longer than
+// DeleteGrace before now, along with its content. It returns the object
+// deleted and whether it was reaped, or nil if it was left, for instance
+// because it's being uploaded.
+func (e *Expirer) remove(meta *MetaObject, now time.Time) (*MetaObject, bool) {
+	if e.Uploads != nil {
+		if claimed, _ := e.Uploads.claim(meta.Oid, 0); !claimed {
+			return nil, false
+		}
+		defer e.Uploads.finish(meta.Oid)
+	}
+
+	var deleted, reaped bool
+	var err error
+	oid := meta.Oid
+	if meta.DeletedAt != nil {
+		meta, reaped, err = e.meta.Reap(oid, now.Add(-e.DeleteGrace))
+	} else {
+		meta, deleted, err = e.meta.Expire(oid, now)
+	}
+	if err != nil {
+		logger.Log(kv{"fn": "expire", "oid": oid, "err": err.Error()})
+		return nil, false
+	}
+	if !deleted && !reaped {
+		return nil, false
+	}
+
+	// The meta information is gone, so content left behind by a failure
+	// here is unreachable rather than corrupt.
+	if err := e.store.Delete(meta); err != nil {
+		logger.Log(kv{"fn": "expire", "oid": meta.Oid, "err": err.Error()})
+	}
+	if e.Replicator != nil {
+		if err := e.Replicator.Delete(meta); err != nil {
+			logger.Log(kv{"fn": "expire", "oid": meta.Oid, "err": err.Error()})
+		}
+	}
+	return meta, reaped
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpirySweepLimit(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		putExpiringObject(t, meta, store, fmt.Sprintf("expired object %d", i), &past)
+	}
+	kept := putExpiringObject(t, meta, store, "unexpiring object", nil)
+
+	e := NewExpirer(meta, store)
+	e.Limit = 2
+
+	for i, expected := range []int{2, 2, 1, 0} {
+		summary, err := e.sweep(time.Now())
+		if err != nil {
+			t.Fatalf("expected sweep to succeed, got: %s", err)
+		}
+		if summary.Deleted != expected {
+			t.Fatalf("expected sweep %d to delete %d objects, deleted %d", i, expected, summary.Deleted)
+		}
+		if summary.Freed != int64(expected*len("expired object 0")) {
+			t.Fatalf("expected sweep %d to free %d objects worth of bytes, got %d", i, expected, summary.Freed)
+		}
+	}
+
+	if _, err := meta.UnsafeGet(&RequestVars{Oid: kept.Oid}); err != nil || !store.Exists(kept) {
+		t.Fatalf("expected the unexpiring object to be kept")
+	}
+}
+
+func TestExpirySweepKeepsUnexpired(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+
+	future := time.Now().Add(time.Hour)
+	m := putExpiringObject(t, meta, store, "later object", &future)
+
+	summary, err := NewExpirer(meta, store).sweep(time.Now())
+	if err != nil {
+		t.Fatalf("expected sweep to succeed, got: %s", err)
+	}
+	if summary.Scanned != 1 || summary.Deleted != 0 || !store.Exists(m) {
+		t.Fatalf("expected the object to be kept until it expires, got %+v", summary)
+	}
+}
+
+func TestExpirySweepSkipsPinned(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+
+	past := time.Now().Add(-time.Hour)
+	m := putExpiringObject(t, meta, store, "pinned object", &past)
+	if _, err := meta.SetPinned(m.Oid, true); err != nil {
+		t.Fatalf("expected pin to succeed, got: %s", err)
+	}
+
+	// Updates, as on a new upload, keep the pin
+	if err := meta.Update(m); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	e := NewExpirer(meta, store)
+	if summary, _ := e.sweep(time.Now()); summary.Deleted != 0 || !store.Exists(m) {
+		t.Fatalf("expected the pinned object to survive expiry")
+	}
+
+	if _, err := meta.SetPinned(m.Oid, false); err != nil {
+		t.Fatalf("expected unpin to succeed, got: %s", err)
+	}
+	if summary, _ := e.sweep(time.Now()); summary.Deleted != 1 || store.Exists(m) {
+		t.Fatalf("expected the unpinned object to expire")
+	}
+}
+
+func TestExpirySweepDisabled(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	m := putExpiringObject(t, meta, store, "expired object", &past)
+
+	e := NewExpirer(meta, store)
+	e.now = func() time.Time { return now }
+	e.Interval = 0
+	e.Start()
+	time.Sleep(50 * time.Millisecond)
+	e.Stop(context.Background())
+
+	if !store.Exists(m) {
+		t.Fatalf("expected a disabled sweep not to delete objects")
+	}
+
+	e = NewExpirer(meta, store)
+	e.now = func() time.Time { return now }
+	e.Interval = 10 * time.Millisecond
+	e.Start()
+	time.Sleep(100 * time.Millisecond)
+	e.Stop(context.Background())
+
+	if store.Exists(m) {
+		t.Fatalf("expected an enabled sweep to delete the expired object")
+	}
+}
+
+func TestExpirySweepSkipsObjectsBeingUploaded(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+
+	past := time.Now().Add(-time.Hour)
+	m := putExpiringObject(t, meta, store, "expired object", &past)
+
+	e := NewExpirer(meta, store)
+	e.Uploads = newUploadTracker()
+	if claimed, _ := e.Uploads.claim(m.Oid, 0); !claimed {
+		t.Fatalf("expected to claim the upload")
+	}
+
+	if summary, _ := e.sweep(time.Now()); summary.Deleted != 0 || !store.Exists(m) {
+		t.Fatalf("expected an object being uploaded to be kept, got %+v", summary)
+	}
+	if _, err := meta.UnsafeGet(&RequestVars{Oid: m.Oid}); err != nil {
+		t.Fatalf("expected the meta of an object being uploaded to be kept, got: %s", err)
+	}
+
+	e.Uploads.finish(m.Oid)
+	if summary, _ := e.sweep(time.Now()); summary.Deleted != 1 || store.Exists(m) {
+		t.Fatalf("expected the object to be deleted once uploaded, got %+v", summary)
+	}
+}
+
+func putExpiringObject(t *testing.T, meta *MetaStore, store objectStore, data string, expires *time.Time) *MetaObject {
+	m := putScrubObject(t, meta, store, data)
+	m.ExpiresAt = expires
+	if err := meta.Update(m); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	return m
+}
+
+func TestExpirySweepReapsSoftDeleted(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+	meta.SoftDelete = true
+
+	m := putExpiringObject(t, meta, store, "soft deleted object", nil)
+	if _, deleted, err := meta.Release(m.Oid, ""); err != nil || !deleted {
+		t.Fatalf("expected the object to be deleted, got %v", err)
+	}
+
+	e := NewExpirer(meta, store)
+	e.DeleteGrace = time.Hour
+
+	// Within the grace period the content is kept for a restore
+	if summary, _ := e.sweep(time.Now()); summary.Reaped != 0 || !store.Exists(m) {
+		t.Fatalf("expected the object to be kept within the grace period, got %+v", summary)
+	}
+
+	summary, err := e.sweep(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("expected sweep to succeed, got: %s", err)
+	}
+	if summary.Reaped != 1 || summary.Deleted != 0 || summary.Freed != m.Size || store.Exists(m) {
+		t.Fatalf("expected the object to be reaped after the grace period, got %+v", summary)
+	}
+	if next, _ := meta.NextObject(""); next != nil {
+		t.Fatalf("expected the meta information to be reaped, got %+v", next)
+	}
+}
+
+func TestExpirySweepKeepsExpiredSoftDeleted(t *testing.T) {
+	meta, store := setupScrubMeta(t), NewMemoryStore()
+	defer teardownScrubMeta(meta)
+	meta.SoftDelete = true
+
+	expired := time.Now().Add(-time.Minute)
+	m := putExpiringObject(t, meta, store, "expired and soft deleted object", &expired)
+	if _, deleted, err := meta.Release(m.Oid, ""); err != nil || !deleted {
+		t.Fatalf("expected the object to be deleted, got %v", err)
+	}
+
+	e := NewExpirer(meta, store)
+	e.DeleteGrace = time.Hour
+
+	// Expiring doesn't cut the grace period short
+	if summary, _ := e.sweep(time.Now()); summary.Deleted != 0 || summary.Reaped != 0 || !store.Exists(m) {
+		t.Fatalf("expected the object to be kept within the grace period, got %+v", summary)
+	}
+	if _, deleted, err := meta.Expire(m.Oid, time.Now()); err != nil || deleted {
+		t.Fatalf("expected Expire to leave the soft deleted object, got deleted=%v err=%v", deleted, err)
+	}
+
+	if summary, _ := e.sweep(time.Now().Add(2 * time.Hour)); summary.Reaped != 1 || store.Exists(m) {
+		t.Fatalf("expected the object to be reaped after the grace period, got %+v", summary)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseUploadWeights parses the upload weights of roles given as
+// "role=weight" entries separated by commas. Roles that aren't listed have a
+// weight of 1.
+func parseUploadWeights(v string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Upload weight isn't given as role=weight: %q", entry)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("Invalid upload weight of role %s: %s", parts[0], parts[1])
+		}
+		weights[strings.TrimSpace(parts[0])] = w
+	}
+	return weights, nil
+}
+
+// fairQueue shares a limited number of upload slots between users. A user
+// waiting for a slot gets the next one that frees up if it holds the fewest
+// slots for its weight of all waiting users, so one user's large batch
+// doesn't starve the others, and with weights 2 and 1 two users contending
+// end up holding slots 2 to 1. Ties go to whoever waited longest.
+type fairQueue struct {
+	slots int
+
+	mu       sync.Mutex
+	active   int
+	inflight map[string]int
+	waiting  []*fairWaiter
+}
+
+type fairWaiter struct {
+	user    string
+	weight  float64
+	granted chan struct{}
+}
+
+func newFairQueue(slots int) *fairQueue {
+	return &fairQueue{slots: slots, inflight: make(map[string]int)}
+}
+
+// acquire waits up to wait for a slot for user. It returns false if none was
+// granted in time, or before done was closed. A granted slot is freed with
+// release.
+func (q *fairQueue) acquire(user string, weight float64, wait time.Duration, done <-chan struct{}) bool {
+	w := &fairWaiter{user: user, weight: weight, granted: make(chan struct{})}
+
+	q.mu.Lock()
+	q.waiting = append(q.waiting, w)
+	q.dispatch()
+	q.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-w.granted:
+		return true
+	case <-timer.C:
+	case <-done:
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, o := range q.waiting {
+		if o == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return false
+		}
+	}
+	// Granted just as the wait ended
+	return true
+}
+
+// release frees a slot of user.
+func (q *fairQueue) release(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(user)
+}
+
+func (q *fairQueue) releaseLocked(user string) {
+	q.active--
+	if q.inflight[user]--; q.inflight[user] <= 0 {
+		delete(q.inflight, user)
+	}
+	q.dispatch()
+}
+
+// dispatch grants free slots to the waiting users with the fewest slots for
+// their weight.
+func (q *fairQueue) dispatch() {
+	for q.active < q.slots && len(q.waiting) > 0 {
+		next := 0
+		for i, w := range q.waiting {
+			if float64(q.inflight[w.user])/w.weight < float64(q.inflight[q.waiting[next].user])/q.waiting[next].weight {
+				next = i
+			}
+		}
+
+		w := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.active++
+		q.inflight[w.user]++
+		close(w.granted)
+	}
+	metrics.Set("lfs_upload_slots_active", int64(q.active))
+	metrics.Set("lfs_upload_slots_waiting", int64(len(q.waiting)))
+}
+
+// queueUploads wraps h so it only runs once the client got an upload slot,
+// answering 503 if it waited for one too long. Clients are told apart by
+// user, and by IP for those without one, like signed links.
+func (a *App) queueUploads(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.uploadQueue == nil {
+			h(w, r)
+			return
+		}
+
+		id := identity(r)
+		user := "user:" + id.Name
+		if id.Name == "" {
+			user = "ip:" + ClientIP(r)
+		}
+		weight := 1.0
+		if v, ok := a.uploadWeights[id.Role]; ok {
+			weight = v
+		}
+
+		wait := Config.UploadQueueTime()
+		if !a.uploadQueue.acquire(user, weight, wait, r.Context().Done()) {
+			metrics.Add("lfs_upload_slots_rejected_total", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+			writeStatus(w, r, 503)
+			return
+		}
+		defer a.uploadQueue.release(user)
+
+		h(w, r)
+	}
+}
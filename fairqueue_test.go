@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseUploadWeights(t *testing.T) {
+	weights, err := parseUploadWeights(" user=4, ci=0.5 ")
+	if err != nil || len(weights) != 2 || weights["user"] != 4 || weights["ci"] != 0.5 {
+		t.Fatalf("expected the weights of user and ci, got %v: %v", weights, err)
+	}
+	for _, v := range []string{"user", "user=0", "=2", "ci=-1", "ci=x"} {
+		if _, err := parseUploadWeights(v); err == nil {
+			t.Errorf("expected %q to be invalid", v)
+		}
+	}
+}
+
+// queueWaiters has each of users wait for a slot in turn, sending its name
+// to granted once it gets one.
+func queueWaiters(t *testing.T, q *fairQueue, granted chan string, weights map[string]float64, users ...string) {
+	for _, user := range users {
+		q.mu.Lock()
+		waiting := len(q.waiting)
+		q.mu.Unlock()
+
+		go func(user string) {
+			if q.acquire(user, weights[user], time.Minute, nil) {
+				granted <- user
+			}
+		}(user)
+
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			q.mu.Lock()
+			queued := len(q.waiting) > waiting
+			q.mu.Unlock()
+			if queued {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s to wait for a slot", user)
+			}
+		}
+	}
+}
+
+func nextGranted(t *testing.T, granted chan string) string {
+	select {
+	case user := <-granted:
+		return user
+	case <-time.After(time.Second):
+		t.Fatalf("expected a slot to be granted")
+	}
+	return ""
+}
+
+func TestFairQueueSharesSlots(t *testing.T) {
+	q := newFairQueue(2)
+	granted := make(chan string, 10)
+	weights := map[string]float64{"frodo": 1, "sam": 1}
+
+	// frodo's large batch takes both slots and queues up, before sam comes
+	q.acquire("frodo", 1, 0, nil)
+	q.acquire("frodo", 1, 0, nil)
+	queueWaiters(t, q, granted, weights, "frodo", "frodo", "frodo", "frodo", "sam", "sam")
+
+	var order []string
+	for _, user := range []string{"frodo", "frodo", "sam", "frodo"} {
+		q.release(user)
+		order = append(order, nextGranted(t, granted))
+	}
+	if order[0] != "sam" || order[1] != "frodo" || order[2] != "sam" || order[3] != "frodo" {
+		t.Fatalf("expected the slots to alternate between the users, got %v", order)
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := newFairQueue(3)
+	granted := make(chan string, 20)
+	weights := map[string]float64{"frodo": 2, "ci": 1}
+
+	for i := 0; i < 3; i++ {
+		q.acquire("admin", 1, 0, nil)
+	}
+	queueWaiters(t, q, granted, weights, "ci", "ci", "ci", "frodo", "frodo", "frodo")
+
+	held := map[string]int{}
+	for i := 0; i < 3; i++ {
+		q.release("admin")
+		held[nextGranted(t, granted)]++
+	}
+	if held["frodo"] != 2 || held["ci"] != 1 {
+		t.Fatalf("expected frodo to get twice the slots of ci, got %v", held)
+	}
+}
+
+func TestFairQueueWait(t *testing.T) {
+	q := newFairQueue(1)
+	q.acquire("frodo", 1, 0, nil)
+
+	if q.acquire("sam", 1, 10*time.Millisecond, nil) {
+		t.Fatalf("expected no slot while frodo holds it")
+	}
+	done := make(chan struct{})
+	close(done)
+	if q.acquire("sam", 1, time.Minute, done) {
+		t.Fatalf("expected no slot for a request that's done")
+	}
+	if len(q.waiting) != 0 {
+		t.Fatalf("expected no one to wait after giving up, got %d", len(q.waiting))
+	}
+
+	q.release("frodo")
+	if !q.acquire("sam", 1, 0, nil) {
+		t.Fatalf("expected the freed slot to be granted")
+	}
+}
+
+func TestQueueUploads(t *testing.T) {
+	wait := Config.UploadQueueWait
+	Config.UploadQueueWait = "10ms"
+	defer func() { Config.UploadQueueWait = wait }()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.uploadQueue = newFairQueue(1)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	put := func() *http.Response {
+		req, err := http.NewRequest("PUT", server.URL+"/user/repo/objects/"+nonExistingOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	app.uploadQueue.acquire("user:other", 1, 0, nil)
+	if res := put(); res.StatusCode != 503 || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected status 503 with Retry-After while the slot is taken, got %d", res.StatusCode)
+	}
+
+	app.uploadQueue.release("user:other")
+	if res := put(); res.StatusCode != 404 {
+		t.Fatalf("expected the upload to go through once the slot is free, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errInjectedFault = errors.New("Injected fault")
+
+// FaultConfig sets which faults are injected into the reads and writes of a
+// store, each with its probability between 0 and 1. Delayed operations wait
+// DelayMs milliseconds first, and truncated reads end early with
+// io.ErrUnexpectedEOF. Writes are truncated by truncating what's written,
+// which the store then refuses as it doesn't match the oid.
+type FaultConfig struct {
+	ErrorRate    float64 `json:"error_rate"`
+	DelayRate    float64 `json:"delay_rate"`
+	DelayMs      int64   `json:"delay_ms"`
+	TruncateRate float64 `json:"truncate_rate"`
+}
+
+func (c *FaultConfig) valid() bool {
+	for _, p := range []float64{c.ErrorRate, c.DelayRate, c.TruncateRate} {
+		if p < 0 || p > 1 {
+			return false
+		}
+	}
+	return c.DelayMs >= 0
+}
+
+// faultInjector decides which operations fail, for chaos experiments. It
+// injects nothing until configured.
+type faultInjector struct {
+	mu   sync.Mutex
+	cfg  FaultConfig
+	rand *rand.Rand
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (f *faultInjector) config() FaultConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cfg
+}
+
+func (f *faultInjector) set(cfg FaultConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg = cfg
+}
+
+func (f *faultInjector) roll(p float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return p > 0 && f.rand.Float64() < p
+}
+
+// before is called before an operation, delaying it or failing it.
+func (f *faultInjector) before(op string, meta *MetaObject) error {
+	cfg := f.config()
+	if f.roll(cfg.DelayRate) {
+		metrics.Add("lfs_faults_injected_total", 1)
+		time.Sleep(time.Duration(cfg.DelayMs) * time.Millisecond)
+	}
+	if f.roll(cfg.ErrorRate) {
+		metrics.Add("lfs_faults_injected_total", 1)
+		logger.Log(kv{"fn": "faults", "op": op, "oid": meta.Oid, "fault": "error"})
+		return errInjectedFault
+	}
+	return nil
+}
+
+// truncate returns r cut short at a random point, or r itself if this read
+// isn't truncated.
+func (f *faultInjector) truncate(op string, meta *MetaObject, r io.Reader) io.Reader {
+	if !f.roll(f.config().TruncateRate) {
+		return r
+	}
+	metrics.Add("lfs_faults_injected_total", 1)
+	logger.Log(kv{"fn": "faults", "op": op, "oid": meta.Oid, "fault": "truncate"})
+
+	f.mu.Lock()
+	var left int64
+	if meta.Size > 1 {
+		left = f.rand.Int63n(meta.Size)
+	}
+	f.mu.Unlock()
+	return &truncatedReader{r: r, left: left}
+}
+
+// truncatedReader reads left bytes of r and then fails.
+type truncatedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (t *truncatedReader) Read(p []byte) (int, error) {
+	if t.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > t.left {
+		p = p[:t.left]
+	}
+	n, err := t.r.Read(p)
+	t.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// faultyStore injects faults into the reads and writes of a ContentStore.
+// Everything else, the optional interfaces included, is the ContentStore's.
+type faultyStore struct {
+	*ContentStore
+	faults *faultInjector
+}
+
+func (s *faultyStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	return s.get(meta, fromByte, s.ContentStore.Get)
+}
+
+func (s *faultyStore) GetCached(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	return s.get(meta, fromByte, s.ContentStore.GetCached)
+}
+
+func (s *faultyStore) get(meta *MetaObject, fromByte int64, get func(*MetaObject, int64) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if err := s.faults.before("get", meta); err != nil {
+		return nil, err
+	}
+	r, err := get(meta, fromByte)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{Reader: s.faults.truncate("get", meta, r), Closer: r}, nil
+}
+
+func (s *faultyStore) Put(meta *MetaObject, r io.Reader) error {
+	if err := s.faults.before("put", meta); err != nil {
+		return err
+	}
+	return s.ContentStore.Put(meta, s.faults.truncate("put", meta, r))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// adminFaultsHandler reports the faults injected on GET, sets them from a
+// FaultConfig on PUT and stops injecting any on DELETE. It's only there when
+// the server was built and configured for fault injection.
+func (a *App) adminFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.faults == nil {
+		writeAdminError(w, r, 404, "Fault injection is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var cfg FaultConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeAdminError(w, r, 400, err.Error())
+			return
+		}
+		if !cfg.valid() {
+			writeAdminError(w, r, 400, "Rates must be between 0 and 1")
+			return
+		}
+		a.faults.set(cfg)
+		logger.Log(kv{"fn": "adminFaultsHandler", "error_rate": cfg.ErrorRate, "delay_rate": cfg.DelayRate, "delay_ms": cfg.DelayMs, "truncate_rate": cfg.TruncateRate})
+	case "DELETE":
+		a.faults.set(FaultConfig{})
+		logger.Log(kv{"fn": "adminFaultsHandler", "msg": "fault injection stopped"})
+	}
+
+	cfg := a.faults.config()
+	writeAdminJSON(w, r, 200, &cfg)
+}
@@ -0,0 +1,8 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+// faultInjectionBuilt is set in builds with the chaos tag, the only ones
+// that can inject faults.
+const faultInjectionBuilt = true
@@ -0,0 +1,8 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+// faultInjectionBuilt is unset in regular builds, which refuse to inject
+// faults whatever the configuration says.
+const faultInjectionBuilt = false
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFaultyStore(t *testing.T) {
+	setup()
+	defer teardown()
+
+	faults := newFaultInjector()
+	store := &faultyStore{ContentStore: contentStore, faults: faults}
+
+	data := "object read while faults are injected"
+	m := &MetaObject{Oid: hex.EncodeToString(sha256Sum(data)), Size: int64(len(data))}
+
+	faults.set(FaultConfig{ErrorRate: 1})
+	if err := store.Put(m, bytes.NewBufferString(data)); err != errInjectedFault {
+		t.Fatalf("expected the put to fail with the injected fault, got: %v", err)
+	}
+	if contentStore.Exists(m) {
+		t.Fatalf("expected nothing to be stored")
+	}
+
+	faults.set(FaultConfig{TruncateRate: 1})
+	if err := store.Put(m, bytes.NewBufferString(data)); err == nil {
+		t.Fatalf("expected a truncated put to fail")
+	}
+
+	// Disabling injection restores normal behavior
+	faults.set(FaultConfig{})
+	if err := store.Put(m, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected the put to succeed, got: %s", err)
+	}
+
+	faults.set(FaultConfig{ErrorRate: 1})
+	if _, err := store.Get(m, 0); err != errInjectedFault {
+		t.Fatalf("expected the get to fail with the injected fault, got: %v", err)
+	}
+
+	faults.set(FaultConfig{TruncateRate: 1})
+	r, err := store.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected a truncated get to start, got: %s", err)
+	}
+	if got, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF || len(got) >= len(data) {
+		t.Fatalf("expected the read to end early, got %d bytes: %v", len(got), err)
+	}
+	r.Close()
+
+	faults.set(FaultConfig{})
+	r, err = store.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected the get to succeed, got: %s", err)
+	}
+	if got, _ := ioutil.ReadAll(r); string(got) != data {
+		t.Fatalf("expected the content, got %q", got)
+	}
+	r.Close()
+}
+
+func TestAdminFaults(t *testing.T) {
+	defer setupAdmin()()
+
+	if res := adminAPI(t, "GET", "/admin/faults", ""); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 without fault injection, got %d", res.StatusCode)
+	}
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.faults = newFaultInjector()
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	for _, c := range []struct {
+		method, body string
+		status       int
+	}{
+		{"PUT", `{"error_rate":2}`, 400},
+		{"PUT", `{"error_rate":0.5,"delay_rate":1,"delay_ms":10}`, 200},
+		{"DELETE", "", 200},
+	} {
+		req, _ := http.NewRequest(c.method, server.URL+"/admin/faults", strings.NewReader(c.body))
+		req.SetBasicAuth(testAdminUser, testAdminPass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Fatalf("expected status %d for %s %s, got %d", c.status, c.method, c.body, res.StatusCode)
+		}
+		if c.status == 200 && c.method == "PUT" && app.faults.config().ErrorRate != 0.5 {
+			t.Fatalf("expected the faults to be set, got %+v", app.faults.config())
+		}
+	}
+	if cfg := app.faults.config(); cfg != (FaultConfig{}) {
+		t.Fatalf("expected no faults after DELETE, got %+v", cfg)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// diskFree isn't implemented on windows, so the free space check is skipped.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("Free space is not available on windows")
+}
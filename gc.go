@@ -0,0 +1,442 @@
+package main
+
+import (
+	stdcontext "context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// objectIndex tells the garbage collector which oids objects are recorded
+// for. MetaStore implements it.
+type objectIndex interface {
+	// Unknown returns those of oids no object is recorded for.
+	Unknown(oids []string) ([]string, error)
+}
+
+// garbageCollector is implemented by stores that can remove content no
+// object is recorded for.
+type garbageCollector interface {
+	CollectGarbage(index objectIndex, opts GCOptions) (*GCResult, error)
+}
+
+// GCOptions configures a garbage collection.
+type GCOptions struct {
+	// Workers is the number of shards scanned at once, at least 1.
+	Workers int
+	// BatchSize is the number of oids looked up in the index at once.
+	BatchSize int
+	// Grace is how long ago a file has to have been modified to be removed,
+	// as an upload may be landing while its object is being recorded.
+	Grace time.Duration
+	// DryRun finds orphans without removing them.
+	DryRun bool
+	// Context, if set, ends the collection early with its error once done.
+	Context stdcontext.Context
+	// Progress, if set, is called with the number of files scanned so far
+	// after every batch.
+	Progress func(scanned int)
+}
+
+// GCResult describes the files found by CollectGarbage.
+type GCResult struct {
+	DryRun  bool     `json:"dry_run,omitempty"`
+	Scanned int      `json:"scanned"`
+	Removed int      `json:"removed"`
+	Bytes   int64    `json:"bytes"`
+	Orphans []string `json:"orphans"`
+}
+
+// gcFile is a content file found by the garbage collector.
+type gcFile struct {
+	oid  string
+	path string
+	size int64
+}
+
+// CollectGarbage removes content files whose oid the index has no object
+// for. The store is scanned in shards, the top level directories of the
+// layout of each size class and hash algorithm, opts.Workers at a time.
+// Temporary files, quarantined objects and files that don't follow the
+// layout of the store are left alone.
+//
+// Orphans are first moved aside to the temporary file of an upload of their
+// object, with that upload claimed, and the index is asked about them again.
+// An object recorded meanwhile gets its file back, and one recorded after
+// finds no content and is uploaded again, so the index is never held while
+// files are removed.
+func (s *ContentStore) CollectGarbage(index objectIndex, opts GCOptions) (*GCResult, error) {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+
+	res := &GCResult{DryRun: opts.DryRun, Orphans: []string{}}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	// collect looks up a batch of files and removes the orphans among them
+	collect := func(batch []*gcFile) error {
+		if opts.Context != nil {
+			if err := opts.Context.Err(); err != nil {
+				return err
+			}
+		}
+		orphans, err := unknownFiles(index, batch)
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			orphans, err = s.removeOrphans(index, orphans)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.Scanned += len(batch)
+		for _, f := range orphans {
+			res.Orphans = append(res.Orphans, f.oid)
+			if !opts.DryRun {
+				res.Removed++
+				res.Bytes += f.size
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(res.Scanned)
+		}
+		return err
+	}
+
+	shards := make(chan gcShard)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shards {
+				if err := s.scanShard(shard, cutoff, opts.BatchSize, collect); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err := s.gcShards(func(shard gcShard) { shards <- shard })
+	close(shards)
+	wg.Wait()
+	if err != nil {
+		return res, err
+	}
+	if firstErr != nil {
+		return res, firstErr
+	}
+
+	sort.Strings(res.Orphans)
+	return res, nil
+}
+
+// unknownFiles returns the files of batch whose oid index has no object for.
+func unknownFiles(index objectIndex, batch []*gcFile) ([]*gcFile, error) {
+	oids := make([]string, len(batch))
+	for i, f := range batch {
+		oids[i] = f.oid
+	}
+	unknown, err := index.Unknown(oids)
+	if err != nil {
+		return nil, err
+	}
+
+	orphan := make(map[string]bool, len(unknown))
+	for _, oid := range unknown {
+		orphan[oid] = true
+	}
+	var files []*gcFile
+	for _, f := range batch {
+		if orphan[f.oid] {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// removeOrphans removes the files of orphans still unknown to index once
+// moved aside, and returns those removed. Files left aside by a failure are
+// temporary files, which CleanTemp removes.
+func (s *ContentStore) removeOrphans(index objectIndex, orphans []*gcFile) ([]*gcFile, error) {
+	var aside []*gcFile
+	defer func() {
+		for _, f := range aside {
+			s.setWriting(f.path+".tmp", false)
+		}
+	}()
+	restore := func(files []*gcFile) {
+		for _, f := range files {
+			os.Rename(f.path+".tmp", f.path)
+		}
+	}
+
+	for _, f := range orphans {
+		// An upload of the object in progress will record it
+		if !s.claimWriting(f.path + ".tmp") {
+			continue
+		}
+		if err := os.Rename(f.path, f.path+".tmp"); err != nil {
+			s.setWriting(f.path+".tmp", false)
+			if os.IsNotExist(err) {
+				continue
+			}
+			restore(aside)
+			return nil, err
+		}
+		aside = append(aside, f)
+	}
+
+	unknown, err := unknownFiles(index, aside)
+	if err != nil {
+		restore(aside)
+		return nil, err
+	}
+	orphan := make(map[*gcFile]bool, len(unknown))
+	for _, f := range unknown {
+		orphan[f] = true
+	}
+
+	var removed []*gcFile
+	for _, f := range aside {
+		if !orphan[f] {
+			if err := os.Rename(f.path+".tmp", f.path); err != nil {
+				return removed, err
+			}
+			continue
+		}
+		if err := os.Remove(f.path + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, f)
+	}
+	return removed, nil
+}
+
+// gcShard is a part of the store scanned on its own: the whole tree under
+// path, or with files set only the files directly in it. root is the
+// directory the layout of the store starts at, and algo the hash algorithm
+// of the objects in it.
+type gcShard struct {
+	root  string
+	path  string
+	algo  string
+	files bool
+}
+
+// gcShards calls fn with every shard of the store.
+func (s *ContentStore) gcShards(fn func(gcShard)) error {
+	skip := map[string]bool{"quarantine": true}
+	for algo := range hashSizes {
+		skip[algo] = true
+	}
+	for _, c := range s.SizeClasses {
+		skip[c.Name] = true
+	}
+
+	var roots []string
+	for _, base := range s.roots() {
+		roots = append(roots, base)
+		for _, c := range s.SizeClasses {
+			roots = append(roots, filepath.Join(base, c.Name))
+		}
+	}
+
+	for _, root := range roots {
+		for algo := range hashSizes {
+			dir := root
+			if algo != hashSHA256 {
+				dir = filepath.Join(root, algo)
+			}
+
+			// The trailing separator follows size classes linked elsewhere
+			entries, err := ioutil.ReadDir(dir + string(filepath.Separator))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			fn(gcShard{root: dir, path: dir, algo: algo, files: true})
+			for _, e := range entries {
+				if e.IsDir() && !skip[e.Name()] {
+					fn(gcShard{root: dir, path: filepath.Join(dir, e.Name()), algo: algo})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scanShard finds the content files of shard modified before cutoff, and
+// passes them to collect in batches.
+func (s *ContentStore) scanShard(shard gcShard, cutoff time.Time, batchSize int, collect func([]*gcFile) error) error {
+	var batch []*gcFile
+	add := func(path string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		oid, ok := s.gcOid(shard, path)
+		if !ok {
+			return nil
+		}
+		batch = append(batch, &gcFile{oid: oid, path: path, size: info.Size()})
+		if len(batch) < batchSize {
+			return nil
+		}
+		err := collect(batch)
+		batch = nil
+		return err
+	}
+
+	if shard.files {
+		entries, err := ioutil.ReadDir(shard.path + string(filepath.Separator))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := add(filepath.Join(shard.path, e.Name()), e); err != nil {
+				return err
+			}
+		}
+	} else {
+		err := filepath.Walk(shard.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			return add(path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return collect(batch)
+}
+
+// gcOid returns the oid of the content file at path, if it is where the
+// store puts the object of that oid, or where LegacyKeyFunc did.
+func (s *ContentStore) gcOid(shard gcShard, path string) (string, bool) {
+	if strings.HasSuffix(path, ".tmp") {
+		return "", false
+	}
+	rel, err := filepath.Rel(shard.root, path)
+	if err != nil {
+		return "", false
+	}
+	for _, suffix := range encodingSuffixes {
+		if suffix != "" {
+			rel = strings.TrimSuffix(rel, suffix)
+		}
+	}
+
+	oid := strings.Replace(rel, string(filepath.Separator), "", -1)
+	if len(oid) != 2*hashSizes[shard.algo] || !validHex(oid) {
+		return "", false
+	}
+
+	key := transformKey
+	if s.KeyFunc != nil {
+		key = s.KeyFunc
+	}
+	if key(oid) == rel || s.LegacyKeyFunc != nil && s.LegacyKeyFunc(oid) == rel {
+		return oid, true
+	}
+	return "", false
+}
+
+func validHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGCOptions returns the options of a collection asked for with the
+// dry_run and grace parameters, read with param.
+func parseGCOptions(param func(string) string) (GCOptions, error) {
+	opts := GCOptions{
+		Workers:   Config.GCWorkerCount(),
+		BatchSize: Config.GCBatch(),
+		Grace:     Config.TempGrace(),
+		DryRun:    isTrue(param("dry_run")),
+	}
+	if v := param("grace"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, errors.New("Invalid grace: " + v)
+		}
+		opts.Grace = d
+	}
+	return opts, nil
+}
+
+// adminGCHandler removes content no object is recorded for, unless called
+// with ?dry_run=true. A grace parameter overrides the configured grace
+// period of temporary files, which applies to orphans as well.
+func (a *App) adminGCHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseGCOptions(r.FormValue)
+	if err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	context.Set(r, "AUDIT_DRY_RUN", opts.DryRun)
+
+	gc, ok := a.contentStore.(garbageCollector)
+	if !ok {
+		writeAdminJSON(w, r, 200, &GCResult{DryRun: opts.DryRun, Orphans: []string{}})
+		return
+	}
+	if !a.gcMu.TryLock() {
+		writeAdminError(w, r, 409, errGCRunning.Error())
+		return
+	}
+	defer a.gcMu.Unlock()
+
+	start := time.Now()
+	res, err := gc.CollectGarbage(a.metaStore, opts)
+	if res != nil && !opts.DryRun {
+		for _, oid := range res.Orphans {
+			a.contentChanged(oid)
+		}
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	logger.Log(kv{"fn": "adminGCHandler", "scanned": res.Scanned, "orphans": len(res.Orphans), "removed": res.Removed, "bytes": res.Bytes, "dry_run": opts.DryRun, "took": time.Since(start).String()})
+	writeAdminJSON(w, r, 200, res)
+}
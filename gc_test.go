@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbageParallel(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.SizeClasses = []SizeClass{{Name: "small", MaxSize: 20}, {Name: "large"}}
+
+	meta := setupScrubMeta(t)
+	defer os.Remove("lfs-scrub-test.db")
+	defer meta.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	var known []*MetaObject
+	for i := 0; i < 10; i++ {
+		m := putScrubObject(t, meta, contentStore, fmt.Sprintf("object %d recorded in the meta store", i))
+		os.Chtimes(contentStore.path(m), old, old)
+		known = append(known, m)
+	}
+
+	var orphans []string
+	for i := 0; i < 40; i++ {
+		o := putOrphan(t, fmt.Sprintf("orphan %d", i), old)
+		orphans = append(orphans, o.Oid)
+	}
+	sum := sha512.Sum512([]byte("orphan of another algorithm"))
+	o := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: 27, HashAlgo: hashSHA512}
+	if err := contentStore.Put(o, bytes.NewBufferString("orphan of another algorithm")); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+	os.Chtimes(contentStore.path(o), old, old)
+	orphans = append(orphans, o.Oid)
+	sort.Strings(orphans)
+
+	// Too recent to be removed, and not content
+	recent := putOrphan(t, "orphan still being recorded", time.Now())
+	tmp := contentStore.path(recent) + ".tmp"
+	ioutil.WriteFile(tmp, []byte("partial upload"), 0640)
+	os.Chtimes(tmp, old, old)
+
+	serial, err := contentStore.CollectGarbage(meta, GCOptions{Workers: 1, BatchSize: 1000, Grace: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatalf("expected the serial scan to succeed, got: %s", err)
+	}
+	parallel, err := contentStore.CollectGarbage(meta, GCOptions{Workers: 8, BatchSize: 3, Grace: time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatalf("expected the parallel scan to succeed, got: %s", err)
+	}
+	if !reflect.DeepEqual(serial.Orphans, orphans) || !reflect.DeepEqual(parallel.Orphans, orphans) {
+		t.Fatalf("expected both scans to find the %d orphans, got %d and %d", len(orphans), len(serial.Orphans), len(parallel.Orphans))
+	}
+	if serial.Scanned != parallel.Scanned || serial.Scanned != len(known)+len(orphans) || parallel.Removed != 0 {
+		t.Fatalf("expected a dry run over %d files, got %+v and %+v", len(known)+len(orphans), serial, parallel)
+	}
+
+	res, err := contentStore.CollectGarbage(meta, GCOptions{Workers: 8, BatchSize: 3, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("expected garbage collection to succeed, got: %s", err)
+	}
+	if res.Removed != len(orphans) || !reflect.DeepEqual(res.Orphans, orphans) {
+		t.Fatalf("expected %d orphans to be removed, got %+v", len(orphans), res)
+	}
+	for _, m := range known {
+		if !contentStore.Exists(m) {
+			t.Fatalf("expected recorded object %s to be kept", m.Oid)
+		}
+	}
+	if !contentStore.Exists(recent) {
+		t.Fatalf("expected a recent orphan to be kept")
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Fatalf("expected temporary files to be left alone, got: %s", err)
+	}
+
+	if res, _ := contentStore.CollectGarbage(meta, GCOptions{Workers: 1, BatchSize: 1000, Grace: time.Hour}); len(res.Orphans) != 0 {
+		t.Fatalf("expected no orphans after collection, got %v", res.Orphans)
+	}
+}
+
+func TestAdminGC(t *testing.T) {
+	defer setupAdmin()()
+
+	res := adminAPI(t, "POST", "/admin/content/gc?dry_run=true", "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res := adminAPI(t, "POST", "/admin/content/gc?grace=soon", ""); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an invalid grace, got %d", res.StatusCode)
+	}
+}
+
+func TestCollectGarbageRoots(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.Roots = []string{"content-store-test/disk0", "content-store-test/disk1"}
+
+	meta := setupScrubMeta(t)
+	defer os.Remove("lfs-scrub-test.db")
+	defer meta.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	var known []*MetaObject
+	for i := 0; i < 6; i++ {
+		m := putScrubObject(t, meta, contentStore, fmt.Sprintf("object %d recorded on a root", i))
+		os.Chtimes(contentStore.path(m), old, old)
+		known = append(known, m)
+	}
+	var orphans []string
+	for i := 0; i < 6; i++ {
+		orphans = append(orphans, putOrphan(t, fmt.Sprintf("orphan %d on a root", i), old).Oid)
+	}
+	sort.Strings(orphans)
+
+	res, err := contentStore.CollectGarbage(meta, GCOptions{Workers: 2, BatchSize: 2, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("expected garbage collection to succeed, got: %s", err)
+	}
+	if res.Scanned != len(known)+len(orphans) || !reflect.DeepEqual(res.Orphans, orphans) {
+		t.Fatalf("expected the orphans of every root to be found, got %+v", res)
+	}
+	for _, m := range known {
+		if !contentStore.Exists(m) {
+			t.Fatalf("expected recorded object %s to be kept", m.Oid)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsObjectsRecordedMeanwhile(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	old := time.Now().Add(-2 * time.Hour)
+	recorded := putOrphan(t, "orphan recorded during the collection", old)
+	uploading := putOrphan(t, "orphan being uploaded again", old)
+	removed := putOrphan(t, "orphan nobody records", old)
+
+	// An upload of the object in flight holds its temporary file
+	if !contentStore.claimWriting(contentStore.path(uploading) + ".tmp") {
+		t.Fatalf("expected to claim the upload")
+	}
+	defer contentStore.setWriting(contentStore.path(uploading)+".tmp", false)
+
+	index := &recordingIndex{MetaStore: meta, t: t, record: recorded}
+	res, err := contentStore.CollectGarbage(index, GCOptions{Workers: 1, BatchSize: 10, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("expected garbage collection to succeed, got: %s", err)
+	}
+	if res.Removed != 1 || !reflect.DeepEqual(res.Orphans, []string{removed.Oid}) {
+		t.Fatalf("expected only the orphan nobody records to be removed, got %+v", res)
+	}
+	if !contentStore.Exists(recorded) || !contentStore.Exists(uploading) || contentStore.Exists(removed) {
+		t.Fatalf("expected the objects recorded or being uploaded to be kept")
+	}
+}
+
+// recordingIndex records an object in its meta store right after the first
+// lookup, as a batch would while the garbage collector is running.
+type recordingIndex struct {
+	*MetaStore
+	t      *testing.T
+	record *MetaObject
+	done   bool
+}
+
+func (r *recordingIndex) Unknown(oids []string) ([]string, error) {
+	unknown, err := r.MetaStore.Unknown(oids)
+	if !r.done {
+		r.done = true
+		if _, err := r.MetaStore.Put(&RequestVars{Oid: r.record.Oid, Size: r.record.Size}); err != nil {
+			r.t.Fatalf("expected meta put to succeed, got: %s", err)
+		}
+	}
+	return unknown, err
+}
+
+func putOrphan(t *testing.T, data string, modified time.Time) *MetaObject {
+	sum := sha256.Sum256([]byte(data))
+	meta := &MetaObject{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if err := contentStore.Put(meta, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+	os.Chtimes(contentStore.path(meta), modified, modified)
+	return meta
+}
@@ -2,11 +2,14 @@ module github.com/git-lfs/lfs-test-server
 
 require (
 	github.com/GeertJohan/go.rice v0.0.0-20150223153050-b4a18af23143
+	github.com/andybalholm/brotli v1.0.4
 	github.com/boltdb/bolt v0.0.0-20150329202000-ee954308d641
 	github.com/daaku/go.zipexe v0.0.0-20150329023125-a5fe2436ffcb // indirect
 	github.com/gorilla/context v0.0.0-20141217160251-215affda49ad
 	github.com/gorilla/mux v0.0.0-20140926153814-e444e69cbd2e
 	github.com/kardianos/osext v0.0.0-20150317202929-efacde031546 // indirect
+	github.com/klauspost/compress v1.11.13
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
 
 go 1.11
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// idTokenLeeway is how far the clocks of the provider and this server may
+// be apart when checking the expiry of an ID token.
+const idTokenLeeway = time.Minute
+
+var errInvalidIDToken = errors.New("Invalid OIDC ID token")
+
+// idTokenClaims are the claims of an ID token that are checked.
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+}
+
+// audience is the "aud" claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk is a public key of the provider's key set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the RSA or P-256 key k describes.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+// keys returns the signing keys of the provider by key ID, fetching them on
+// first use, or again when refresh is set because a token names a key that
+// isn't known yet.
+func (p *OIDCProvider) keys(refresh bool) (map[string]crypto.PublicKey, error) {
+	e, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwks != nil && !refresh {
+		return p.jwks, nil
+	}
+
+	res, err := p.Client.Get(e.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("OIDC key set request failed with status %d", res.StatusCode)
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("Invalid OIDC key set: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Log(kv{"fn": "keys", "kid": k.Kid, "err": err.Error()})
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.jwks = keys
+	return keys, nil
+}
+
+// verifyIDToken checks the signature of the ID token raw against the keys
+// of the provider, and that it was issued by the provider to this client,
+// for the login with nonce, and hasn't expired. It returns its claims.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errInvalidIDToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+
+	keys, err := p.keys(false)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		// The provider may have rotated its keys since they were fetched
+		if keys, err = p.keys(true); err != nil {
+			return nil, err
+		}
+		if key, ok = keys[header.Kid]; !ok {
+			return nil, fmt.Errorf("OIDC ID token signed with unknown key %q", header.Kid)
+		}
+	}
+	if !verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig) {
+		return nil, errors.New("OIDC ID token signature doesn't verify")
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidIDToken
+	}
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("OIDC ID token issued by %s", claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.New("OIDC ID token issued to another client")
+	case time.Now().Add(-idTokenLeeway).Unix() > claims.Expiry:
+		return nil, errors.New("OIDC ID token expired")
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, errors.New("OIDC ID token is of another login")
+	case claims.Subject == "":
+		return nil, errInvalidIDToken
+	}
+	return &claims, nil
+}
+
+// verifySignature returns true if sig signs input under key with the JWS
+// algorithm alg. Only RS256 and ES256 are accepted.
+func verifySignature(alg string, key crypto.PublicKey, input string, sig []byte) bool {
+	h := sha256.Sum256([]byte(input))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
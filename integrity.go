@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// integrity is the server's word on the content of a download: it has
+// hashed the stored content of Size bytes at VerifiedAt and found it matching
+// the oid.
+type integrity struct {
+	Size       int64     `json:"size"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// setVerified records that the content of the object was just found to match
+// its oid.
+func (m *MetaObject) setVerified() {
+	now := time.Now().UTC()
+	m.VerifiedAt = &now
+}
+
+// hashBudget is how many bytes are left to hash for one batch request.
+type hashBudget struct {
+	left int64
+}
+
+// take returns true, and spends n bytes, if the budget has them left.
+func (b *hashBudget) take(n int64) bool {
+	if n > b.left {
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+// integrity returns what the server vouches for about the content of meta,
+// or nil if it can't. A verification within maxAge counts, and objects of up
+// to maxSize bytes are hashed now otherwise, as long as budget has the bytes
+// left, so no batch waits on hashing a large object or many of them.
+func (a *App) integrity(meta *MetaObject, maxAge time.Duration, maxSize int64, budget *hashBudget) *integrity {
+	if meta.VerifiedAt != nil && time.Since(*meta.VerifiedAt) <= maxAge {
+		return &integrity{Size: meta.Size, VerifiedAt: *meta.VerifiedAt}
+	}
+	if meta.Size > maxSize || !budget.take(meta.Size) {
+		return nil
+	}
+
+	r, err := a.contentStore.Get(meta, 0)
+	if err != nil {
+		logger.Log(kv{"fn": "integrity", "oid": meta.Oid, "err": err.Error()})
+		return nil
+	}
+	defer r.Close()
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		logger.Log(kv{"fn": "integrity", "oid": meta.Oid, "err": err.Error()})
+		return nil
+	}
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		logger.Log(kv{"fn": "integrity", "oid": meta.Oid, "err": err.Error()})
+		return nil
+	}
+	if n != meta.Size || hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		metrics.Add("lfs_integrity_failures_total", 1)
+		logger.Log(kv{"fn": "integrity", "oid": meta.Oid, "err": errScrubMismatch.Error()})
+		return nil
+	}
+
+	meta.setVerified()
+	if err := a.metaStore.Update(meta); err != nil {
+		logger.Log(kv{"fn": "integrity", "oid": meta.Oid, "err": err.Error()})
+	}
+	return &integrity{Size: meta.Size, VerifiedAt: *meta.VerifiedAt}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBatchIntegrity(t *testing.T) {
+	defer func(vouch, size string) {
+		Config.VouchIntegrity, Config.IntegrityMaxSize = vouch, size
+	}(Config.VouchIntegrity, Config.IntegrityMaxSize)
+
+	meta := putBulkObject(t, "vouched content", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	Config.VouchIntegrity = "false"
+	if got := integrityOf(t, meta); got != nil {
+		t.Fatalf("expected no integrity unless enabled, got %+v", got)
+	}
+
+	Config.VouchIntegrity = "true"
+	got := integrityOf(t, meta)
+	if got == nil || got.Size != meta.Size || time.Since(got.VerifiedAt) > time.Minute {
+		t.Fatalf("expected the object to be verified, got %+v", got)
+	}
+
+	stored, err := testMetaStore.UnsafeGet(&RequestVars{Oid: meta.Oid})
+	if err != nil || stored.VerifiedAt == nil || !stored.VerifiedAt.Equal(got.VerifiedAt) {
+		t.Fatalf("expected the verification to be recorded, got %+v: %v", stored, err)
+	}
+}
+
+func TestBatchIntegritySizeBound(t *testing.T) {
+	defer func(vouch, size string) {
+		Config.VouchIntegrity, Config.IntegrityMaxSize = vouch, size
+	}(Config.VouchIntegrity, Config.IntegrityMaxSize)
+
+	meta := putBulkObject(t, "content too large to hash", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	Config.VouchIntegrity = "true"
+	Config.IntegrityMaxSize = strconv.FormatInt(meta.Size-1, 10)
+	if got := integrityOf(t, meta); got != nil {
+		t.Fatalf("expected no integrity for an unverified object above the bound, got %+v", got)
+	}
+
+	// A recent verification is vouched for at any size, an old one isn't
+	meta.setVerified()
+	if err := testMetaStore.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	if got := integrityOf(t, meta); got == nil || got.Size != meta.Size {
+		t.Fatalf("expected the recent verification to be vouched for, got %+v", got)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	meta.VerifiedAt = &old
+	if err := testMetaStore.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	if got := integrityOf(t, meta); got != nil {
+		t.Fatalf("expected an old verification not to be vouched for, got %+v", got)
+	}
+}
+
+func TestBatchIntegrityBudget(t *testing.T) {
+	defer func(vouch, batch string) {
+		Config.VouchIntegrity, Config.IntegrityBatchSize = vouch, batch
+	}(Config.VouchIntegrity, Config.IntegrityBatchSize)
+
+	first := putBulkObject(t, "first content hashed", "repo")
+	defer removeMeta(first.Oid)
+	defer testContentStore.Delete(first)
+	second := putBulkObject(t, "second content, over the budget", "repo")
+	defer removeMeta(second.Oid)
+	defer testContentStore.Delete(second)
+
+	Config.VouchIntegrity = "true"
+	Config.IntegrityBatchSize = strconv.FormatInt(first.Size, 10)
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":%d}]}`,
+		first.Oid, first.Size, second.Oid, second.Size)
+	batch := batchRequest(t, bytes.NewBufferString(body))
+	if len(batch.Objects) != 2 || batch.Objects[0].Actions["download"] == nil || batch.Objects[1].Actions["download"] == nil {
+		t.Fatalf("expected two download actions, got %+v", batch.Objects)
+	}
+	if batch.Objects[0].Actions["download"].Integrity == nil {
+		t.Fatalf("expected the object within the budget to be verified")
+	}
+	if got := batch.Objects[1].Actions["download"].Integrity; got != nil {
+		t.Fatalf("expected no integrity for the object over the budget, got %+v", got)
+	}
+}
+
+// integrityOf returns the integrity of the download action of meta.
+func integrityOf(t *testing.T, meta *MetaObject) *integrity {
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, meta.Oid, meta.Size)
+	batch := batchRequest(t, bytes.NewBufferString(body))
+	if len(batch.Objects) != 1 || batch.Objects[0].Actions["download"] == nil {
+		t.Fatalf("expected a download action, got %+v", batch.Objects)
+	}
+	return batch.Objects[0].Actions["download"].Integrity
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownJob    = errors.New("Unknown job")
+	errJobNotFound   = errors.New("Job not found")
+	errJobRunning    = errors.New("A job of this name is already running")
+	errJobNotRunning = errors.New("Job isn't running")
+	errGCRunning     = errors.New("Garbage collection, a cleanup of temporary files or a migration is already running")
+	errNoMigration   = errors.New("No legacy content layout to migrate from")
+)
+
+const (
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// maxFinishedJobs is the number of finished jobs kept for listing, oldest
+// dropped first.
+const maxFinishedJobs = 100
+
+// jobPollInterval is how often the progress of jobs run by a runner of their
+// own, like the Rehasher, is read.
+var jobPollInterval = time.Second
+
+// Job is a maintenance job started through /admin/jobs. Done and Total count
+// the units of work of the job, objects or files, with Total left at 0 when
+// it isn't known up front. Result holds the stats of the job, updated while
+// it runs where the job has any.
+type Job struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Params     map[string]string `json:"params,omitempty"`
+	State      string            `json:"state"`
+	Done       int64             `json:"done"`
+	Total      int64             `json:"total,omitempty"`
+	Result     interface{}       `json:"result,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// jobReport records the progress of a job, along with its stats so far if
+// stats isn't nil.
+type jobReport func(done, total int64, stats interface{})
+
+// jobFunc runs a job until it's done or ctx is, returning its result.
+type jobFunc func(ctx context.Context, report jobReport) (interface{}, error)
+
+// jobKind is a job that can be started by name. prepare checks the
+// parameters of the job and returns what runs it. Only one job of an
+// exclusive kind runs at a time. A job that moves or removes content files
+// holds the gc lock of the app while it runs, which the endpoints doing the
+// same hold too, so only one of them runs at a time.
+type jobKind struct {
+	exclusive bool
+	gc        bool
+	prepare   func(a *App, params map[string]string) (jobFunc, error)
+}
+
+// jobKinds are the jobs /admin/jobs starts, taking the parameters of their
+// own admin endpoints where they have one.
+var jobKinds = map[string]jobKind{
+	"gc":        {exclusive: true, gc: true, prepare: (*App).gcJob},
+	"clean-tmp": {exclusive: true, gc: true, prepare: (*App).cleanTempJob},
+	"migrate":   {exclusive: true, gc: true, prepare: (*App).migrateJob},
+	"scrub":     {exclusive: true, prepare: (*App).scrubJob},
+	"reconcile": {exclusive: true, prepare: (*App).reconcileJob},
+	"rehash":    {exclusive: true, prepare: (*App).rehashJob},
+	"rekey":     {exclusive: true, prepare: (*App).rekeyJob},
+}
+
+// JobManager runs the jobs operators start and keeps the last ones that
+// finished, in memory only.
+type JobManager struct {
+	app *App
+
+	mu   sync.Mutex
+	next int
+	jobs []*Job
+}
+
+func newJobManager(app *App) *JobManager {
+	return &JobManager{app: app}
+}
+
+// Start runs the job called name in the background.
+func (m *JobManager) Start(name string, params map[string]string) (*Job, error) {
+	kind, ok := jobKinds[name]
+	if !ok {
+		return nil, errUnknownJob
+	}
+	run, err := kind.prepare(m.app, params)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kind.exclusive {
+		for _, job := range m.jobs {
+			if job.Name == name && job.State == jobRunning {
+				return nil, errJobRunning
+			}
+		}
+	}
+	if kind.gc {
+		if !m.app.gcMu.TryLock() {
+			return nil, errGCRunning
+		}
+		locked := run
+		run = func(ctx context.Context, report jobReport) (interface{}, error) {
+			defer m.app.gcMu.Unlock()
+			return locked(ctx, report)
+		}
+	}
+
+	m.next++
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        strconv.Itoa(m.next),
+		Name:      name,
+		Params:    params,
+		State:     jobRunning,
+		StartedAt: time.Now().UTC(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	m.jobs = append(m.jobs, job)
+	m.prune()
+	logger.Log(kv{"fn": "jobs", "id": job.ID, "job": name, "state": job.State})
+
+	go m.run(ctx, job, run)
+	return job.copy(), nil
+}
+
+func (m *JobManager) run(ctx context.Context, job *Job, run jobFunc) {
+	defer close(job.done)
+	defer job.cancel()
+
+	res, err := run(ctx, func(done, total int64, stats interface{}) {
+		m.mu.Lock()
+		job.Done, job.Total = done, total
+		if stats != nil {
+			job.Result = stats
+		}
+		m.mu.Unlock()
+	})
+
+	now := time.Now().UTC()
+	m.mu.Lock()
+	job.FinishedAt = &now
+	if res != nil {
+		job.Result = res
+	}
+	switch {
+	case ctx.Err() != nil:
+		job.State = jobCanceled
+	case err != nil:
+		job.State = jobFailed
+		job.Error = err.Error()
+		metrics.Add("lfs_jobs_failed_total", 1)
+	default:
+		job.State = jobDone
+	}
+	entry := kv{"fn": "jobs", "id": job.ID, "job": job.Name, "state": job.State, "done": job.Done, "took": now.Sub(job.StartedAt).String()}
+	if job.Error != "" {
+		entry["err"] = job.Error
+	}
+	m.mu.Unlock()
+	logger.Log(entry)
+}
+
+// prune drops the oldest finished jobs past maxFinishedJobs.
+func (m *JobManager) prune() {
+	finished := 0
+	for _, job := range m.jobs {
+		if job.State != jobRunning {
+			finished++
+		}
+	}
+	jobs := m.jobs[:0]
+	for _, job := range m.jobs {
+		if job.State != jobRunning && finished > maxFinishedJobs {
+			finished--
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	m.jobs = jobs
+}
+
+// Jobs returns the running and last finished jobs, newest first.
+func (m *JobManager) Jobs() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]*Job, len(m.jobs))
+	for i, job := range m.jobs {
+		jobs[i] = job.copy()
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// Job returns the job of id.
+func (m *JobManager) Job(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job := m.find(id)
+	if job == nil {
+		return nil, errJobNotFound
+	}
+	return job.copy(), nil
+}
+
+// Cancel cancels the running job of id and waits for it to stop, or for ctx
+// to be done.
+func (m *JobManager) Cancel(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	job := m.find(id)
+	switch {
+	case job == nil:
+		m.mu.Unlock()
+		return nil, errJobNotFound
+	case job.State != jobRunning:
+		m.mu.Unlock()
+		return nil, errJobNotRunning
+	}
+	m.mu.Unlock()
+
+	job.cancel()
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return m.Job(id)
+}
+
+// Drain cancels the running jobs and waits for them to stop, or for ctx to
+// be done.
+func (m *JobManager) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	jobs := append([]*Job(nil), m.jobs...)
+	m.mu.Unlock()
+
+	for _, job := range jobs {
+		job.cancel()
+	}
+	for _, job := range jobs {
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *JobManager) find(id string) *Job {
+	for _, job := range m.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// copy returns a copy of job to hand out, read under the lock of its
+// manager.
+func (job *Job) copy() *Job {
+	c := *job
+	return &c
+}
+
+// gcJob collects garbage like /admin/content/gc, reporting the files scanned.
+func (a *App) gcJob(params map[string]string) (jobFunc, error) {
+	opts, err := parseGCOptions(func(name string) string { return params[name] })
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		gc, ok := a.contentStore.(garbageCollector)
+		if !ok {
+			return &GCResult{DryRun: opts.DryRun, Orphans: []string{}}, nil
+		}
+		opts.Context = ctx
+		opts.Progress = func(scanned int) { report(int64(scanned), 0, nil) }
+		res, err := gc.CollectGarbage(a.metaStore, opts)
+		if res != nil && !opts.DryRun {
+			for _, oid := range res.Orphans {
+				a.contentChanged(oid)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}, nil
+}
+
+// cleanTempJob removes stale temporary files like /admin/content/clean-tmp.
+// It can't be canceled once it runs.
+func (a *App) cleanTempJob(params map[string]string) (jobFunc, error) {
+	grace := Config.TempGrace()
+	if v := params["grace"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, errors.New("Invalid grace: " + v)
+		}
+		grace = d
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		res, err := a.cleanTemp(grace)
+		if err != nil {
+			return nil, err
+		}
+		report(int64(res.Found), int64(res.Found), nil)
+		return res, nil
+	}, nil
+}
+
+// migrateJob moves the objects left in the legacy content layout to the
+// current one, like the rebalance command without parameters, reporting the
+// objects scanned. Objects keep being served from either layout meanwhile.
+func (a *App) migrateJob(params map[string]string) (jobFunc, error) {
+	store, ok := a.contentStore.(layoutMigrator)
+	if !ok || !store.HasLegacyLayout() {
+		return nil, errNoMigration
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		res, err := store.MigrateLayout(ctx, a.metaStore, func(scanned int) { report(int64(scanned), 0, nil) })
+		if res == nil {
+			return nil, err
+		}
+		failed := []string{}
+		for _, f := range res.Failures {
+			logger.Log(kv{"fn": "migrate", "oid": f.Oid, "err": f.Err.Error()})
+			failed = append(failed, f.Oid)
+		}
+		missing := res.Missing
+		if missing == nil {
+			missing = []string{}
+		}
+		return &MigrateResult{Scanned: res.Scanned, Moved: res.Moved, InPlace: res.InPlace, Missing: missing, Failed: failed}, err
+	}, nil
+}
+
+// MigrateResult describes a migrate job. Missing lists the objects whose
+// content is in neither layout, and Failed those that couldn't be moved.
+type MigrateResult struct {
+	Scanned int      `json:"scanned"`
+	Moved   int      `json:"moved"`
+	InPlace int      `json:"in_place"`
+	Missing []string `json:"missing"`
+	Failed  []string `json:"failed"`
+}
+
+// scrubJob verifies every object once like a pass of the background
+// scrubber, reading at the rate parameter in MB/s or the configured one and
+// reporting the objects looked at.
+func (a *App) scrubJob(params map[string]string) (jobFunc, error) {
+	rate, err := parseRate(params["rate"], Config.ScrubBytesPerSecond())
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		s := NewScrubber(a.metaStore, a.contentStore, rate)
+		s.Quarantine = Config.IsQuarantiningScrubFailures()
+		s.OnQuarantine = a.contentChanged
+		return s.Pass(ctx, func(checked int) { report(int64(checked), 0, nil) })
+	}, nil
+}
+
+// reconcileJob corrects the recorded sizes of every object from its content
+// like /admin/objects/fix-sizes, reporting the objects checked.
+func (a *App) reconcileJob(params map[string]string) (jobFunc, error) {
+	dryRun := isTrue(params["dry_run"])
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		return a.fixSizes(ctx, dryRun, func(checked int) { report(int64(checked), 0, nil) })
+	}, nil
+}
+
+// rehashJob runs a rehash like /admin/objects/rehash. Canceling it stops the
+// rehash, which can be resumed.
+func (a *App) rehashJob(params map[string]string) (jobFunc, error) {
+	job, err := parseRehashJob(func(name string) string { return params[name] })
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		if err := a.rehasher.Start(job); err != nil {
+			return nil, err
+		}
+		return follow(ctx, report, a.rehasher.Stop, func() (int64, interface{}, bool, error) {
+			job, err := a.rehasher.Status()
+			if err != nil || job == nil {
+				return 0, nil, false, err
+			}
+			if !job.Running && !job.Done {
+				err = errors.New("The rehash stopped before it was done")
+			}
+			return int64(job.Checked + job.Skipped), job, job.Running, err
+		})
+	}, nil
+}
+
+// rekeyJob runs a rekey like /admin/objects/rekey. Canceling it stops the
+// rekey, which can be resumed.
+func (a *App) rekeyJob(params map[string]string) (jobFunc, error) {
+	rate, err := parseRate(params["rate"], Config.RekeyBytesPerSecond())
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, report jobReport) (interface{}, error) {
+		if err := a.rekeyer.Start(newRekeyJob(rate)); err != nil {
+			return nil, err
+		}
+		return follow(ctx, report, a.rekeyer.Stop, func() (int64, interface{}, bool, error) {
+			job, err := a.rekeyer.Status()
+			if err != nil || job == nil {
+				return 0, nil, false, err
+			}
+			if !job.Running && !job.Done {
+				err = errors.New("The rekey stopped before it was done")
+			}
+			return int64(job.Rekeyed + job.Skipped + len(job.Failures)), job, job.Running, err
+		})
+	}, nil
+}
+
+// follow reports the progress of a job run by a runner of its own, as read by
+// status, until it stops, or stops it once ctx is done. A runner that stopped
+// before it was done fails the job.
+func follow(ctx context.Context, report jobReport, stop func(context.Context) error, status func() (done int64, stats interface{}, running bool, err error)) (interface{}, error) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			stopCtx, cancel := context.WithTimeout(context.Background(), Config.ShutdownTimeout())
+			defer cancel()
+			if err := stop(stopCtx); err != nil {
+				return nil, err
+			}
+			_, stats, _, _ := status()
+			return stats, ctx.Err()
+		case <-ticker.C:
+		}
+
+		done, stats, running, err := status()
+		if err != nil {
+			return stats, err
+		}
+		report(done, 0, stats)
+		if !running {
+			return stats, nil
+		}
+	}
+}
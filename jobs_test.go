@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestJobCanceled(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+	defer func(d time.Duration) { jobPollInterval = d }(jobPollInterval)
+	jobPollInterval = 10 * time.Millisecond
+
+	for i := 0; i < 4; i++ {
+		putScrubObject(t, meta, contentStore, fmt.Sprintf("rehashed job object %d", i))
+	}
+	app := NewApp(contentStore, meta)
+
+	if _, err := app.jobs.Start("defrag", nil); err != errUnknownJob {
+		t.Fatalf("expected an unknown job to be refused, got: %v", err)
+	}
+	if _, err := app.jobs.Start("rehash", map[string]string{"rate": "fast"}); err == nil {
+		t.Fatalf("expected invalid parameters to be refused")
+	}
+
+	// About 100 bytes per second, so every object takes about 200ms
+	job, err := app.jobs.Start("rehash", map[string]string{"rate": "0.0001"})
+	if err != nil {
+		t.Fatalf("expected the rehash job to start, got: %s", err)
+	}
+	if _, err := app.jobs.Start("rehash", nil); err != errJobRunning {
+		t.Fatalf("expected a second rehash job to be refused, got: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if job, _ = app.jobs.Job(job.ID); job.Done > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to make progress, got %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.State != jobRunning || job.Result == nil {
+		t.Fatalf("expected the running job to report its stats, got %+v", job)
+	}
+
+	job, err = app.jobs.Cancel(context.Background(), job.ID)
+	if err != nil {
+		t.Fatalf("expected the job to be canceled, got: %s", err)
+	}
+	rehash, ok := job.Result.(*RehashJob)
+	if job.State != jobCanceled || job.FinishedAt == nil || !ok || rehash.Running || rehash.Done || rehash.Checked == 4 {
+		t.Fatalf("expected the job to be canceled mid-run, got %+v with %+v", job, job.Result)
+	}
+	if _, err := app.jobs.Cancel(context.Background(), job.ID); err != errJobNotRunning {
+		t.Fatalf("expected a finished job not to be canceled again, got: %v", err)
+	}
+
+	// The rehash it ran stopped where it was and can be resumed
+	if status, err := app.rehasher.Status(); err != nil || status.Running || status.Cursor == "" {
+		t.Fatalf("expected the rehash to be stopped with its cursor, got %+v: %v", status, err)
+	}
+	if _, err := app.jobs.Start("rehash", nil); err != nil {
+		t.Fatalf("expected another rehash job to start once canceled, got: %s", err)
+	}
+	app.jobs.Drain(context.Background())
+}
+
+func TestMaintenanceJobs(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	bad := putScrubObject(t, meta, contentStore, "object rotting in place")
+	if err := ioutil.WriteFile(contentStore.path(bad), []byte("bit rotted!"), 0644); err != nil {
+		t.Fatalf("expected to corrupt the object, got: %s", err)
+	}
+	contentStore.KeyFunc = flatKey
+	moved := putScrubObject(t, meta, contentStore, "object left in the legacy layout")
+	contentStore.KeyFunc, contentStore.LegacyKeyFunc = transformKey, flatKey
+
+	// The jobs reach the files through a wrapping store too
+	app := NewApp(&faultyStore{ContentStore: contentStore, faults: newFaultInjector()}, meta)
+	run := func(name string, params map[string]string) *Job {
+		job, err := app.jobs.Start(name, params)
+		if err != nil {
+			t.Fatalf("expected the %s job to start, got: %s", name, err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for job.State == jobRunning {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the %s job to finish, got %+v", name, job)
+			}
+			time.Sleep(10 * time.Millisecond)
+			job, _ = app.jobs.Job(job.ID)
+		}
+		if job.State != jobDone || job.Done != 2 {
+			t.Fatalf("expected the %s job to be done with both objects, got %+v", name, job)
+		}
+		return job
+	}
+
+	scrub, _ := run("scrub", nil).Result.(*ScrubResult)
+	if scrub == nil || scrub.Checked != 2 || scrub.Verified != 1 || len(scrub.Failed) != 1 || scrub.Failed[0] != bad.Oid {
+		t.Fatalf("expected the scrub to find the rotted object, got %+v", scrub)
+	}
+
+	migrated, _ := run("migrate", nil).Result.(*MigrateResult)
+	if migrated == nil || migrated.Scanned != 2 || migrated.Moved != 1 || migrated.InPlace != 1 || len(migrated.Failed) != 0 {
+		t.Fatalf("expected the legacy object to be migrated, got %+v", migrated)
+	}
+	contentStore.LegacyKeyFunc = nil
+	if !contentStore.Exists(moved) {
+		t.Fatalf("expected the migrated object in the current layout")
+	}
+
+	sizes, _ := run("reconcile", map[string]string{"dry_run": "true"}).Result.(*AdminSizeResponse)
+	if sizes == nil || !sizes.DryRun || sizes.Checked != 2 || len(sizes.Objects) != 1 || sizes.Objects[0].Oid != bad.Oid {
+		t.Fatalf("expected the reconcile to report the rotted object only, got %+v", sizes)
+	}
+	if _, err := app.jobs.Start("migrate", nil); err != errNoMigration {
+		t.Fatalf("expected no migration without a legacy layout, got: %v", err)
+	}
+}
+
+func TestGarbageJobsShareLock(t *testing.T) {
+	defer setupAdmin()()
+
+	app := lfsServer.Config.Handler.(*App)
+	app.gcMu.Lock()
+	for _, name := range []string{"gc", "clean-tmp"} {
+		if _, err := app.jobs.Start(name, nil); err != errGCRunning {
+			t.Errorf("expected the %s job to wait for the lock, got: %v", name, err)
+		}
+	}
+	for _, path := range []string{"/admin/content/gc", "/admin/content/clean-tmp"} {
+		if res := adminAPI(t, "POST", path, ""); res.StatusCode != 409 {
+			t.Errorf("expected %s to be refused with 409, got %d", path, res.StatusCode)
+		}
+	}
+	app.gcMu.Unlock()
+
+	// A job holds it until it's done
+	job, err := app.jobs.Start("gc", map[string]string{"dry_run": "true"})
+	if err != nil {
+		t.Fatalf("expected the gc job to start, got: %s", err)
+	}
+	if _, err := app.jobs.Start("clean-tmp", nil); err != errGCRunning {
+		t.Errorf("expected the clean-tmp job to wait for the gc job, got: %v", err)
+	}
+	app.jobs.Drain(context.Background())
+	if job, _ = app.jobs.Job(job.ID); job.State == jobRunning {
+		t.Fatalf("expected the job to stop, got %+v", job)
+	}
+	if res := adminAPI(t, "POST", "/admin/content/clean-tmp", ""); res.StatusCode != 200 {
+		t.Fatalf("expected the cleanup to run once the job stopped, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminJobs(t *testing.T) {
+	defer setupAdmin()()
+
+	res := adminAPI(t, "POST", "/admin/jobs", `{"name":"gc","params":{"dry_run":"true"}}`)
+	if res.StatusCode != 202 {
+		t.Fatalf("expected the job to start with 202, got %d", res.StatusCode)
+	}
+	var job Job
+	if err := json.NewDecoder(res.Body).Decode(&job); err != nil || job.ID == "" || job.Name != "gc" {
+		t.Fatalf("expected the started job, got %+v: %v", job, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == jobRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to finish, got %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		res = adminAPI(t, "GET", "/admin/jobs/"+job.ID, "")
+		if err := json.NewDecoder(res.Body).Decode(&job); err != nil {
+			t.Fatalf("expected the job, got: %s", err)
+		}
+	}
+	result, _ := job.Result.(map[string]interface{})
+	if job.State != jobDone || result == nil || result["dry_run"] != true {
+		t.Fatalf("expected the job to be done with a dry run result, got %+v", job)
+	}
+
+	var jobs []*Job
+	res = adminAPI(t, "GET", "/admin/jobs", "")
+	if err := json.NewDecoder(res.Body).Decode(&jobs); err != nil || len(jobs) == 0 || jobs[0].ID != job.ID {
+		t.Fatalf("expected the job to be listed first, got %v: %v", jobs, err)
+	}
+
+	for path, status := range map[string]int{
+		"/admin/jobs/" + job.ID + "/cancel": 409,
+		"/admin/jobs/nope/cancel":           404,
+	} {
+		if res := adminAPI(t, "POST", path, ""); res.StatusCode != status {
+			t.Errorf("expected %s to return %d, got %d", path, status, res.StatusCode)
+		}
+	}
+	if res := adminAPI(t, "POST", "/admin/jobs", `{"name":"defrag"}`); res.StatusCode != 400 {
+		t.Errorf("expected an unknown job to be refused with 400, got %d", res.StatusCode)
+	}
+	if res := adminAPI(t, "POST", "/admin/jobs", `{"name":"gc","params":{"grace":"soon"}}`); res.StatusCode != 400 {
+		t.Errorf("expected invalid parameters to be refused with 400, got %d", res.StatusCode)
+	}
+}
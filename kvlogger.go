@@ -32,6 +32,12 @@ type kv map[string]interface{}
 type KVLogger struct {
 	w  io.Writer
 	mu sync.Mutex
+
+	// Buffer, if set, also keeps the logged entries.
+	Buffer *LogBuffer
+	// Syslog, if set, also receives the logged entries, those with an err
+	// at the error severity.
+	Syslog *SyslogSink
 }
 
 // NewKVLogger creates a KVLogger that writes to `out`.
@@ -61,9 +67,35 @@ func (l *KVLogger) Log(data kv) {
 	}
 	out += strings.Join(vals, " ")
 
+	// Syslog has a time, host and tag of its own
+	if l.Syslog != nil {
+		_, failed := data["err"]
+		l.Syslog.Send(failed, fmt.Sprintf("[%s:%d]: %s", file, line, strings.Join(vals, " ")))
+	}
+
 	l.mu.Lock()
 	fmt.Fprint(l.w, out+"\n")
 	l.mu.Unlock()
+
+	if l.Buffer != nil {
+		l.Buffer.Add(newLogEntry(fmt.Sprintf("%s:%d", file, line), data))
+	}
+}
+
+// Flush flushes the logger's output if it buffers writes, and waits a moment
+// for the entries still on their way to syslog.
+func (l *KVLogger) Flush() error {
+	if l.Syslog != nil {
+		l.Syslog.Flush(time.Second)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 // Fatal is equivalent to Log() follwed by a call to os.Exit(1)
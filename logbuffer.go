@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Log levels. The logger has no levels of its own, so an entry is an error
+// if it carries an "err" value and informational otherwise.
+const (
+	levelInfo  = "info"
+	levelError = "error"
+)
+
+var logLevels = map[string]int{levelInfo: 0, levelError: 1}
+
+var (
+	// recentLogs holds what the server logged lately. main sizes it from
+	// the configuration.
+	recentLogs = NewLogBuffer(0)
+)
+
+// LogEntry is a log line as kept by a LogBuffer.
+type LogEntry struct {
+	Time   time.Time         `json:"time"`
+	Level  string            `json:"level"`
+	Source string            `json:"source"`
+	Fields map[string]string `json:"fields"`
+}
+
+func newLogEntry(source string, data kv) *LogEntry {
+	e := &LogEntry{Time: time.Now().UTC(), Level: levelInfo, Source: source, Fields: make(map[string]string, len(data))}
+	for k, v := range data {
+		e.Fields[k] = fmt.Sprintf("%v", v)
+	}
+	if _, ok := data["err"]; ok {
+		e.Level = levelError
+	}
+	return e
+}
+
+// matches returns true if the entry is at least at level and, if oid is set,
+// about that object.
+func (e *LogEntry) matches(level, oid string) bool {
+	return logLevels[e.Level] >= logLevels[level] && (oid == "" || e.Fields["oid"] == oid)
+}
+
+// LogBuffer keeps the most recent log entries in memory, so they can be looked
+// at through the admin API without access to the server's output. It is no
+// substitute for shipping the logs somewhere.
+type LogBuffer struct {
+	mu          sync.Mutex
+	entries     []*LogEntry
+	next        int
+	full        bool
+	subscribers map[chan *LogEntry]bool
+}
+
+// NewLogBuffer creates a LogBuffer holding up to size entries. A size of 0
+// keeps nothing, but entries are still passed to subscribers.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &LogBuffer{entries: make([]*LogEntry, size), subscribers: make(map[chan *LogEntry]bool)}
+}
+
+// Add records e, replacing the oldest entry if the buffer is full, and passes
+// it to every subscriber that keeps up.
+func (b *LogBuffer) Add(e *LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.entries) > 0 {
+		b.entries[b.next] = e
+		b.next = (b.next + 1) % len(b.entries)
+		b.full = b.full || b.next == 0
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// A slow reader misses entries rather than holding up logging
+		}
+	}
+}
+
+// Entries returns the buffered entries at least at level and about oid, if
+// set, oldest first.
+func (b *LogBuffer) Entries(level, oid string) []*LogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := b.entries[:b.next]
+	if b.full {
+		entries = append(append([]*LogEntry{}, b.entries[b.next:]...), entries...)
+	}
+
+	matched := []*LogEntry{}
+	for _, e := range entries {
+		if e.matches(level, oid) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// Subscribe returns a channel receiving every entry added from now on, and a
+// function ending the subscription.
+func (b *LogBuffer) Subscribe() (<-chan *LogEntry, func()) {
+	ch := make(chan *LogEntry, 64)
+
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// logFilter returns the level and oid parameters of a request for log entries.
+func logFilter(r *http.Request) (string, string, error) {
+	level := r.FormValue("level")
+	if level == "" {
+		level = levelInfo
+	}
+	if _, ok := logLevels[level]; !ok {
+		return "", "", fmt.Errorf("Invalid level: %s", level)
+	}
+	return level, r.FormValue("oid"), nil
+}
+
+// adminLogsHandler lists the recent log entries, optionally limited to those
+// at least at the level parameter and about the object in the oid parameter.
+func (a *App) adminLogsHandler(w http.ResponseWriter, r *http.Request) {
+	level, oid, err := logFilter(r)
+	if err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, r, 200, recentLogs.Entries(level, oid))
+}
+
+// adminLogStreamHandler sends log entries as Server-Sent Events as they are
+// logged, filtered like adminLogsHandler, until the client goes away.
+func (a *App) adminLogStreamHandler(w http.ResponseWriter, r *http.Request) {
+	level, oid, err := logFilter(r)
+	if err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminError(w, r, 500, "Streaming is not supported")
+		return
+	}
+
+	entries, cancel := recentLogs.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-entries:
+			if !e.matches(level, oid) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogBufferBounded(t *testing.T) {
+	b := NewLogBuffer(3)
+	for i := 0; i < 5; i++ {
+		b.Add(newLogEntry("test", kv{"n": i}))
+	}
+
+	entries := b.Entries(levelInfo, "")
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if n := e.Fields["n"]; n != strconv.Itoa(i+2) {
+			t.Fatalf("expected the newest entries oldest first, got %s at %d", n, i)
+		}
+	}
+}
+
+func TestAdminLogs(t *testing.T) {
+	defer setupAdmin()()
+	defer setupLogBuffer()()
+
+	// Upload content not matching its oid
+	sum := sha256.Sum256([]byte("logged content"))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: 14}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString("tampered conte"))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 500 {
+		t.Fatalf("expected status 500, got %d", res.StatusCode)
+	}
+
+	var entries []*LogEntry
+	res = adminAPI(t, "GET", "/admin/logs?level=error&oid="+oid, "")
+	json.NewDecoder(res.Body).Decode(&entries)
+	res.Body.Close()
+	if len(entries) != 1 || entries[0].Level != levelError || entries[0].Fields["err"] != errHashMismatch.Error() {
+		t.Fatalf("expected the hash mismatch to be logged, got %+v", entries)
+	}
+
+	res = adminAPI(t, "GET", "/admin/logs", "")
+	json.NewDecoder(res.Body).Decode(&entries)
+	res.Body.Close()
+	if len(entries) < 2 {
+		t.Fatalf("expected the requests to be logged too, got %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Level == levelInfo {
+			return
+		}
+	}
+	t.Fatalf("expected informational entries without a level filter, got %+v", entries)
+}
+
+func TestAdminLogsInvalidLevel(t *testing.T) {
+	defer setupAdmin()()
+
+	res := adminAPI(t, "GET", "/admin/logs?level=verbose", "")
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an unknown level, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminLogStream(t *testing.T) {
+	defer setupAdmin()()
+	defer setupLogBuffer()()
+
+	req, err := http.NewRequest("GET", lfsServer.URL+"/admin/logs/stream?level=error", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", ct)
+	}
+
+	logger.Log(kv{"fn": "test", "oid": "streamed"})
+	logger.Log(kv{"fn": "test", "oid": "streamed", "err": "streamed error"})
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected an event, got: %s", err)
+	}
+
+	var e LogEntry
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+		t.Fatalf("expected a log entry as event data, got %q: %s", line, err)
+	}
+	if e.Fields["err"] != "streamed error" {
+		t.Fatalf("expected only the error to be streamed, got %+v", e)
+	}
+}
+
+// setupLogBuffer has the logger keep its entries in a new buffer and returns
+// a function restoring the previous one.
+func setupLogBuffer() func() {
+	buffer, logs := logger.Buffer, recentLogs
+	recentLogs = NewLogBuffer(100)
+	logger.Buffer = recentLogs
+	return func() {
+		logger.Buffer, recentLogs = buffer, logs
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// accessSampler thins out the access log, or is nil to log every request.
+var accessSampler *logSampler
+
+// logSampler writes the access log line of 1 in N successful requests of an
+// action. Failed and slow requests, and requests of actions without a rate,
+// are always logged. Whether a request is logged follows from its request
+// id, so every line logged through logRequest for it is either kept or not.
+type logSampler struct {
+	// Rates maps actions to the N of their rate.
+	Rates map[string]int
+	// Slow is the duration from which requests are always logged, or 0 to
+	// sample requests however long they take.
+	Slow time.Duration
+}
+
+// parseLogSampling parses rates given as "action=n" pairs separated by
+// commas, such as "download=100,batch=10".
+func parseLogSampling(v string) (map[string]int, error) {
+	rates := make(map[string]int)
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid log sampling %q, expected action=n", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid log sampling rate %q", parts[1])
+		}
+		rates[strings.TrimSpace(parts[0])] = n
+	}
+	return rates, nil
+}
+
+// keep returns true if the access log line of r, answered with status, is
+// written.
+func (s *logSampler) keep(r *http.Request, status int) bool {
+	if s == nil || status >= 400 {
+		return true
+	}
+
+	action, _ := context.Get(r, "ACTION").(string)
+	n := s.Rates[action]
+	if n <= 1 {
+		return true
+	}
+	if start, ok := context.Get(r, "RequestStart").(time.Time); ok && s.Slow > 0 && time.Since(start) >= s.Slow {
+		return true
+	}
+
+	id, _ := context.Get(r, "RequestID").(string)
+	if id == "" {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32()%uint32(n) == 0
+}
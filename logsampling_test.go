@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+func TestLogSamplerRate(t *testing.T) {
+	s := &logSampler{Rates: map[string]int{actionDownload: 10}}
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		r := sampledRequest(actionDownload, fmt.Sprintf("request-%d", i), time.Now())
+		if s.keep(r, 200) {
+			kept++
+		}
+		// The same request is always decided the same way
+		if s.keep(r, 200) != s.keep(r, 200) {
+			t.Fatalf("expected sampling to be deterministic per request")
+		}
+		context.Clear(r)
+	}
+	if kept < 800 || kept > 1200 {
+		t.Fatalf("expected about 1 in 10 of 10000 requests to be logged, got %d", kept)
+	}
+}
+
+func TestLogSamplerAlwaysLogs(t *testing.T) {
+	s := &logSampler{Rates: map[string]int{actionDownload: 1000000}, Slow: time.Second}
+
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("request-%d", i)
+
+		r := sampledRequest(actionDownload, id, time.Now())
+		for _, status := range []int{400, 404, 500, 503} {
+			if !s.keep(r, status) {
+				t.Fatalf("expected status %d to be logged", status)
+			}
+		}
+		context.Clear(r)
+
+		r = sampledRequest(actionUpload, id, time.Now())
+		if !s.keep(r, 200) {
+			t.Fatalf("expected uploads without a rate to be logged")
+		}
+		context.Clear(r)
+
+		r = sampledRequest(actionDownload, id, time.Now().Add(-2*time.Second))
+		if !s.keep(r, 200) {
+			t.Fatalf("expected slow requests to be logged")
+		}
+		context.Clear(r)
+	}
+
+	var none *logSampler
+	if !none.keep(sampledRequest(actionDownload, "request", time.Now()), 200) {
+		t.Fatalf("expected every request to be logged without sampling")
+	}
+}
+
+func TestParseLogSampling(t *testing.T) {
+	rates, err := parseLogSampling("download=100, batch=10")
+	if err != nil || rates[actionDownload] != 100 || rates[actionBatch] != 10 || len(rates) != 2 {
+		t.Fatalf("expected two rates, got %v: %v", rates, err)
+	}
+	if rates, err := parseLogSampling(""); err != nil || len(rates) != 0 {
+		t.Fatalf("expected no rates, got %v: %v", rates, err)
+	}
+	for _, v := range []string{"download", "download=0", "download=often"} {
+		if _, err := parseLogSampling(v); err == nil {
+			t.Fatalf("expected %q to be invalid", v)
+		}
+	}
+}
+
+func sampledRequest(action, id string, start time.Time) *http.Request {
+	r := httptest.NewRequest("GET", "/user/repo/objects/oid", nil)
+	context.Set(r, "ACTION", action)
+	context.Set(r, "RequestID", id)
+	context.Set(r, "RequestStart", start)
+	return r
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -59,12 +63,229 @@ func wrapHttps(l net.Listener, cert, key string) (net.Listener, error) {
 	return tlsListener, nil
 }
 
+// Content backends selected with LFS_CONTENTBACKEND.
+const (
+	contentBackendDisk   = "disk"
+	contentBackendMemory = "memory"
+)
+
+// configureStore applies the storage settings of the configuration to store.
+func configureStore(store *ContentStore) error {
+	store.CompressMaxSize = Config.CompressionLimit()
+	store.SkipCompression = Config.SkipCompressionTypes()
+	store.EntropySkip = Config.EntropySkipBits()
+	store.MaxCompressionRatio = Config.CompressionRatioLimit()
+	store.FreeSpaceMargin = Config.FreeSpaceReserve()
+	store.TempGrace = Config.TempGrace()
+
+	switch Config.Compression {
+	case encodingGzip, encodingZstd:
+		store.Compression = Config.Compression
+	default:
+		return fmt.Errorf("Unknown compression: %s", Config.Compression)
+	}
+	store.CompressionLevel = Config.CompressionLevelValue()
+
+	bands, err := parseCompressionBands(Config.CompressionBands)
+	if err != nil {
+		return err
+	}
+	store.CompressionBands = bands
+
+	classes, err := parseSizeClasses(Config.SizeClasses)
+	if err != nil {
+		return err
+	}
+	store.SizeClasses = classes
+
+	key, ok := contentLayouts[Config.ContentLayout]
+	if !ok {
+		return fmt.Errorf("Unknown content layout: %s", Config.ContentLayout)
+	}
+	store.KeyFunc = key
+
+	if Config.LegacyContentLayout != "" {
+		legacy, ok := contentLayouts[Config.LegacyContentLayout]
+		if !ok {
+			return fmt.Errorf("Unknown legacy content layout: %s", Config.LegacyContentLayout)
+		}
+		store.LegacyKeyFunc = legacy
+	}
+
+	if Config.IsEncrypting() {
+		keys := Config.EncryptionKeys
+		if Config.EncryptionKeyFile != "" {
+			b, err := ioutil.ReadFile(Config.EncryptionKeyFile)
+			if err != nil {
+				return fmt.Errorf("Could not read the encryption keys: %s", err)
+			}
+			// Keys in the environment come first, so a new current key
+			// can be set there while the file holds the older ones
+			keys += "," + string(b)
+		}
+
+		keyring, err := parseKeyring(keys)
+		if err != nil {
+			return err
+		}
+		store.Keys = keyring
+	}
+	return nil
+}
+
+// openPrimaryStore opens the content store of the configuration, spread over
+// its roots and inlining small objects into meta.
+func openPrimaryStore(meta *MetaStore) (*ContentStore, error) {
+	store, err := NewContentStore(Config.ContentPath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the content store: %s", err)
+	}
+	if err := configureStore(store); err != nil {
+		return nil, err
+	}
+	// Only the primary store is spread over roots, a replica has its path
+	for _, root := range Config.ContentRootPaths() {
+		if err := os.MkdirAll(root, 0750); err != nil {
+			return nil, fmt.Errorf("Could not open the content root: %s", err)
+		}
+		store.Roots = append(store.Roots, root)
+	}
+	// Only the primary store inlines, a replica keeps inline objects in files.
+	// Objects inlined before stay readable when inlining is turned off.
+	store.Inline, store.InlineMaxSize = meta, Config.InlineMaxBytes()
+	// Only the primary store caches, it serves the downloads
+	if max := Config.ContentCacheBytes(); max > 0 {
+		store.Cache = newContentCache(max, Config.ContentCacheObjectBytes())
+	}
+	return store, nil
+}
+
+// cleanTemp removes the temporary files that uploads interrupted by a crash
+// left in store.
+func cleanTemp(name string, store *ContentStore) {
+	res, err := store.CleanTemp(Config.TempGrace())
+	if err != nil {
+		logger.Log(kv{"fn": "main", "store": name, "msg": "Could not clean temporary files", "err": err.Error()})
+		return
+	}
+	logger.Log(kv{"fn": "main", "store": name, "msg": "cleaned temporary files", "found": res.Found, "removed": res.Removed, "bytes": res.Bytes})
+}
+
+// seedEmptyObject stores the object of empty content, pinned so it's never
+// removed, for downloads of empty files tracked by any repo to find it.
+func seedEmptyObject(meta *MetaStore, store objectStore) error {
+	m, err := meta.Put(&RequestVars{Oid: emptyOids[hashSHA256]})
+	if err != nil {
+		return err
+	}
+	if !store.Exists(m) {
+		if err := store.Put(m, bytes.NewReader(nil)); err != nil {
+			return err
+		}
+		if err := meta.Update(m); err != nil {
+			return err
+		}
+	}
+	_, err = meta.SetPinned(m.Oid, true)
+	return err
+}
+
+// runDump exports the meta store to, or imports it from, the file named in
+// args, or stdout/stdin if there is none or it is "-". The server has to be
+// stopped, as it holds the lock on the meta store.
+func runDump(cmd string, args []string) error {
+	metaStore, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		return fmt.Errorf("Could not open the meta store: %s", err)
+	}
+	defer metaStore.Close()
+
+	file := "-"
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	var n int
+	if cmd == "export" {
+		w := os.Stdout
+		if file != "-" {
+			if w, err = os.Create(file); err != nil {
+				return err
+			}
+			defer w.Close()
+		}
+		n, err = metaStore.Export(w)
+		if err == nil && file != "-" {
+			err = w.Sync()
+		}
+	} else {
+		r := os.Stdin
+		if file != "-" {
+			if r, err = os.Open(file); err != nil {
+				return err
+			}
+			defer r.Close()
+		}
+		n, err = metaStore.Import(r)
+	}
+
+	logger.Log(kv{"fn": cmd, "records": n})
+	return err
+}
+
 func main() {
 	if len(os.Args) == 2 && os.Args[1] == "-v" {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
+	if len(os.Args) >= 2 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		// Keep stdout for the dump
+		logger = NewKVLogger(os.Stderr)
+		if err := runDump(os.Args[1], os.Args[2:]); err != nil {
+			logger.Fatal(kv{"fn": os.Args[1], "err": err.Error()})
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) >= 2 && os.Args[1] == "rebalance" {
+		if err := runRebalance(os.Args[2:]); err != nil {
+			logger.Fatal(kv{"fn": "rebalance", "err": err.Error()})
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) >= 2 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:]); err != nil {
+			logger.Fatal(kv{"fn": "verify", "err": err.Error()})
+		}
+		os.Exit(0)
+	}
+
+	if !Config.IsLoggingToStdout() && !Config.IsLoggingToSyslog() {
+		logger.Fatal(kv{"fn": "main", "err": "Unknown log output: " + Config.LogOutput})
+	}
+	if Config.IsLoggingToSyslog() {
+		sink, err := NewSyslogSink(Config.SyslogAddress, Config.SyslogFacility, Config.SyslogTag)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": err.Error()})
+		}
+		if !Config.IsLoggingToStdout() {
+			logger = NewKVLogger(ioutil.Discard)
+		}
+		logger.Syslog = sink
+	}
+	recentLogs = NewLogBuffer(Config.LogBufferEntries())
+	logger.Buffer = recentLogs
+
+	rates, err := parseLogSampling(Config.LogSampling)
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
+	}
+	if len(rates) > 0 {
+		accessSampler = &logSampler{Rates: rates, Slow: Config.LogSamplingSlowThreshold()}
+	}
+
 	var listener net.Listener
 
 	tl, err := NewTrackingListener(Config.Listen)
@@ -86,19 +307,56 @@ func main() {
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
 	}
+	metaStore.SoftDelete = Config.DeleteGrace() > 0
 
-	contentStore, err := NewContentStore(Config.ContentPath)
-	if err != nil {
-		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
+	var contentStore objectStore
+	switch Config.ContentBackend {
+	case contentBackendDisk:
+		store, err := openPrimaryStore(metaStore)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": err.Error()})
+		}
+		// Objects left under the content path would be reported missing
+		if stray, err := store.strayObjects(); err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not check the content path: " + err.Error()})
+		} else if stray {
+			logger.Fatal(kv{"fn": "main", "err": "LFS_CONTENTPATH still holds objects stored before LFS_CONTENTROOTS was set, move them with rebalance roots="})
+		}
+		cleanTemp("content", store)
+		contentStore = store
+	case contentBackendMemory:
+		contentStore = NewMemoryStore()
+		logger.Log(kv{"fn": "main", "msg": "content is kept in memory and lost when the server stops"})
+	default:
+		logger.Fatal(kv{"fn": "main", "err": "Unknown content backend: " + Config.ContentBackend})
+	}
+	if Config.IsSeedingEmptyObject() {
+		if err := seedEmptyObject(metaStore, contentStore); err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not store the empty object: " + err.Error()})
+		}
+	}
+
+	trustedProxies = Config.TrustedProxyNets()
+	if trustedHeader, err = Config.ProxyHeader(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
+	}
+	if _, err := Config.ActionPolicy(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
+	}
+	if _, err := Config.UploadWeightPolicy(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
+	}
+	if _, err := Config.DownloadRatePolicy(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM)
 	go func(c chan os.Signal, listener net.Listener) {
 		for {
 			sig := <-c
 			switch sig {
-			case syscall.SIGHUP: // Graceful shutdown
+			case syscall.SIGHUP, syscall.SIGTERM: // Graceful shutdown
 				tl.Close()
 			}
 		}
@@ -106,13 +364,140 @@ func main() {
 
 	logger.Log(kv{"fn": "main", "msg": "listening", "pid": os.Getpid(), "addr": Config.Listen, "version": version})
 
-	app := NewApp(contentStore, metaStore)
+	var store objectStore = contentStore
+	var faults *faultInjector
+	if Config.IsInjectingFaults() {
+		if !faultInjectionBuilt {
+			logger.Fatal(kv{"fn": "main", "err": "Fault injection needs a build with the chaos tag"})
+		}
+		disk, ok := contentStore.(*ContentStore)
+		if !ok {
+			logger.Fatal(kv{"fn": "main", "err": "Fault injection needs the disk content backend"})
+		}
+		faults = newFaultInjector()
+		store = &faultyStore{ContentStore: disk, faults: faults}
+		logger.Log(kv{"fn": "main", "msg": "fault injection is enabled, set faults through /admin/faults"})
+	}
+
+	app := NewApp(store, metaStore)
+	app.faults = faults
+	if Config.IsUsingOIDC() {
+		if Config.OIDCAdminValue == "" || Config.OIDCRedirectURL == "" {
+			logger.Fatal(kv{"fn": "main", "err": "OIDC login needs LFS_OIDCREDIRECTURL and LFS_OIDCADMINVALUE"})
+		}
+		oidc, err := NewOIDCProvider(Config.OIDCIssuer, Config.OIDCClientID, Config.OIDCClientSecret, Config.OIDCRedirectURL)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not set up OIDC login: " + err.Error()})
+		}
+		oidc.Scopes = strings.Fields(Config.OIDCScopes)
+		oidc.AdminClaim = Config.OIDCAdminClaim
+		oidc.AdminValue = Config.OIDCAdminValue
+		oidc.SessionLifetime = Config.AdminSessionLifetime()
+		app.enableOIDC(oidc)
+	}
+	if Config.UpstreamURL != "" {
+		app.upstream = NewUpstream(Config.UpstreamURL, Config.UpstreamUser, Config.UpstreamPass)
+		app.upstream.Client.Timeout = Config.DownloadDeadline()
+	}
+	if ttl := Config.BatchCacheLifetime(); ttl > 0 {
+		app.batches = newBatchCache(ttl, Config.BatchCacheEntries())
+		metaStore.OnChange = app.batches.invalidate
+	}
+	if Config.IsCountingDownloads() {
+		app.downloadCounts = NewDownloadCounter(metaStore, Config.DownloadCountFlushInterval(), Config.DownloadCountDaysKept())
+		app.downloadCounts.Start()
+	}
+	if interval := Config.StatsFlushInterval(); interval > 0 {
+		app.stats = NewLifetimeStats(metaStore, interval)
+		if err := app.stats.Start(); err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not load lifetime stats: " + err.Error()})
+		}
+	}
+	if Config.IsNotifyingDurability() {
+		if Config.DurabilityWebhookSecret == "" {
+			logger.Fatal(kv{"fn": "main", "err": "LFS_DURABILITYWEBHOOKSECRET is required to sign durability callbacks"})
+		}
+		app.durability = NewDurabilityHook(metaStore, Config.DurabilityWebhook, Config.DurabilityWebhookSecret)
+		if err := app.durability.Start(); err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not load pending durability callbacks: " + err.Error()})
+		}
+	}
+	if Config.IsReplicating() {
+		replicaStore, err := NewContentStore(Config.ReplicaPath)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not open the replica content store: " + err.Error()})
+		}
+		if err := configureStore(replicaStore); err != nil {
+			logger.Fatal(kv{"fn": "main", "err": err.Error()})
+		}
+		cleanTemp("replica", replicaStore)
+		app.replicator = NewReplicator(contentStore, replicaStore)
+		app.replicator.Progress = logProgress("replicate")
+		app.replicator.Replicated = app.replicated
+		app.replicator.Start()
+		shutdownHooks.Register("replication", app.replicator.Drain)
+	}
+	if app.durability != nil {
+		shutdownHooks.Register("durability", app.durability.Drain)
+	}
+	if Config.IsScrubbing() {
+		scrubber := NewScrubber(metaStore, contentStore, Config.ScrubBytesPerSecond())
+		scrubber.Interval = Config.ScrubPause()
+		scrubber.Quarantine = Config.IsQuarantiningScrubFailures()
+		scrubber.Progress = logProgress("scrub")
+		scrubber.OnQuarantine = app.contentChanged
+		scrubber.Start()
+		shutdownHooks.Register("scrub", scrubber.Stop)
+	}
+	shutdownHooks.Register("rehash", app.rehasher.Stop)
+	shutdownHooks.Register("rekey", app.rekeyer.Stop)
+	shutdownHooks.Register("jobs", app.jobs.Drain)
+	if Config.ExpirySweepPause() > 0 {
+		expirer := NewExpirer(metaStore, contentStore)
+		expirer.Interval = Config.ExpirySweepPause()
+		expirer.Jitter = Config.ExpirySweepSpread()
+		expirer.Limit = Config.ExpirySweepMax()
+		expirer.DeleteGrace = Config.DeleteGrace()
+		expirer.Replicator = app.replicator
+		expirer.Uploads = app.uploads
+		expirer.Start()
+		shutdownHooks.Register("expire", expirer.Stop)
+	} else if metaStore.SoftDelete {
+		logger.Log(kv{"fn": "main", "msg": "expiry sweep is disabled, soft deleted objects are never removed"})
+	}
+	if app.upstream != nil && Config.IsPurgingUpstreamGone() {
+		purger := NewUpstreamPurger(metaStore, contentStore, app.upstream)
+		purger.Interval = Config.UpstreamPurgeInterval()
+		purger.Replicator = app.replicator
+		purger.Start()
+		shutdownHooks.Register("purge upstream", purger.Stop)
+	}
 	if Config.IsUsingTus() {
 		tusServer.Start()
+		shutdownHooks.Register("tus", func(ctx context.Context) error {
+			tusServer.Stop()
+			return nil
+		})
+	}
+	shutdownHooks.Register("metrics", func(ctx context.Context) error {
+		logger.Log(kv{"fn": "shutdown", "metrics": metrics.Snapshot()})
+		return nil
+	})
+	if app.stats != nil {
+		shutdownHooks.Register("stats", app.stats.Drain)
+	}
+	if app.downloadCounts != nil {
+		shutdownHooks.Register("downloads", app.downloadCounts.Drain)
 	}
+	shutdownHooks.Register("meta", func(ctx context.Context) error {
+		metaStore.Close()
+		return nil
+	})
+	shutdownHooks.Register("log", func(ctx context.Context) error {
+		return logger.Flush()
+	})
+
 	app.Serve(listener)
 	tl.WaitForChildren()
-	if Config.IsUsingTus() {
-		tusServer.Stop()
-	}
+	shutdownHooks.Run(Config.ShutdownTimeout())
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var errNotInMemory = errors.New("Object not found in memory store")
+
+// Operation names passed to MemoryStore.Hook.
+const (
+	memoryGet    = "get"
+	memoryPut    = "put"
+	memoryExists = "exists"
+	memoryDelete = "delete"
+)
+
+// MemoryStore keeps objects in memory. It is meant for tests and small
+// deployments where losing objects on restart is acceptable.
+type MemoryStore struct {
+	// Hook, if set, is called before every operation with the operation name
+	// and object. A returned error fails the operation, and sleeping in the
+	// hook delays it, which makes backend failures easy to simulate. For
+	// Exists an error reports the object as missing.
+	Hook func(op string, meta *MetaObject) error
+
+	mu      sync.Mutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	encoding string
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]*memoryObject)}
+}
+
+// Get returns the content of meta, starting at fromByte.
+func (s *MemoryStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	if err := s.hook(memoryGet, meta); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	obj, ok := s.objects[meta.Oid]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errNotInMemory
+	}
+
+	if fromByte > int64(len(obj.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data[fromByte:])), nil
+}
+
+// Put reads the content of meta from r, verifying its size and hash the same
+// way ContentStore does, including recording an unknown size. Content is held
+// uncompressed, so a missing encoding is recorded as identity.
+func (s *MemoryStore) Put(meta *MetaObject, r io.Reader) error {
+	if err := s.hook(memoryPut, meta); err != nil {
+		return err
+	}
+	return s.put(meta, r)
+}
+
+// PutContext is Put, but fails with the error of ctx once it's done, even
+// while the hook delays the write, the way a remote backend gives up at the
+// deadline of a request.
+func (s *MemoryStore) PutContext(ctx context.Context, meta *MetaObject, r io.Reader) error {
+	hooked := make(chan error, 1)
+	go func() { hooked <- s.hook(memoryPut, meta) }()
+	select {
+	case err := <-hooked:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.put(meta, r)
+}
+
+func (s *MemoryStore) put(meta *MetaObject, r io.Reader) error {
+	if meta.Encoding == "" {
+		meta.Encoding = encodingIdentity
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if meta.Size > 0 && int64(len(data)) != meta.Size {
+		return errSizeMismatch
+	}
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return err
+	}
+	hash.Write(data)
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+
+	if meta.Size <= 0 {
+		meta.Size = int64(len(data))
+	}
+
+	s.Set(meta, data)
+	return nil
+}
+
+// Exists returns true if the object is in the store.
+func (s *MemoryStore) Exists(meta *MetaObject) bool {
+	if err := s.hook(memoryExists, meta); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[meta.Oid]
+	return ok
+}
+
+// Delete removes the object from the store.
+func (s *MemoryStore) Delete(meta *MetaObject) error {
+	if err := s.hook(memoryDelete, meta); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.objects, meta.Oid)
+	s.mu.Unlock()
+	return nil
+}
+
+// Set stores data for meta as is, without verifying it. Tests use it to plant
+// objects that are corrupt or don't match their metadata.
+func (s *MemoryStore) Set(meta *MetaObject, data []byte) {
+	s.mu.Lock()
+	s.objects[meta.Oid] = &memoryObject{data: data, encoding: meta.Encoding}
+	s.mu.Unlock()
+}
+
+// Encoding returns the encoding the object was stored with, or an empty
+// string if it isn't in the store.
+func (s *MemoryStore) Encoding(oid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj, ok := s.objects[oid]; ok {
+		return obj.encoding
+	}
+	return ""
+}
+
+func (s *MemoryStore) hook(op string, meta *MetaObject) error {
+	if s.Hook == nil {
+		return nil
+	}
+	return s.Hook(op, meta)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePutGet(t *testing.T) {
+	s := NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := s.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if m.Encoding != encodingIdentity || s.Encoding(contentOid) != encodingIdentity {
+		t.Fatalf("expected identity encoding to be recorded, got %q", m.Encoding)
+	}
+
+	if !s.Exists(m) {
+		t.Fatalf("expected object to exist")
+	}
+
+	r, err := s.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != content[5:] {
+		t.Fatalf("expected to read content from byte 5, got: %s", string(by))
+	}
+}
+
+func TestMemoryStorePutMismatch(t *testing.T) {
+	s := NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := s.Put(m, bytes.NewBufferString("this is not my content")); err != errSizeMismatch {
+		t.Fatalf("expected size mismatch, got: %v", err)
+	}
+
+	m = &MetaObject{Oid: nonExistingOid, Size: contentSize}
+	if err := s.Put(m, bytes.NewBufferString(content)); err != errHashMismatch {
+		t.Fatalf("expected hash mismatch, got: %v", err)
+	}
+
+	if s.Exists(m) {
+		t.Fatalf("expected rejected object not to be stored")
+	}
+}
+
+func TestMemoryStoreGetNonExisting(t *testing.T) {
+	s := NewMemoryStore()
+
+	if _, err := s.Get(&MetaObject{Oid: nonExistingOid}, 0); err != errNotInMemory {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestMemoryStoreSetPlantsCorruptContent(t *testing.T) {
+	s := NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	s.Set(m, []byte("corrupt"))
+
+	r, err := s.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "corrupt" {
+		t.Fatalf("expected planted content, got: %s", string(by))
+	}
+}
+
+func TestMemoryStoreHookErrors(t *testing.T) {
+	s := NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := s.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	injected := errors.New("injected failure")
+	var ops []string
+	s.Hook = func(op string, meta *MetaObject) error {
+		ops = append(ops, op)
+		return injected
+	}
+
+	if _, err := s.Get(m, 0); err != injected {
+		t.Fatalf("expected injected get error, got: %v", err)
+	}
+	if err := s.Put(m, bytes.NewBufferString(content)); err != injected {
+		t.Fatalf("expected injected put error, got: %v", err)
+	}
+	if s.Exists(m) {
+		t.Fatalf("expected failing exists to report the object missing")
+	}
+
+	if len(ops) != 3 || ops[0] != memoryGet || ops[1] != memoryPut || ops[2] != memoryExists {
+		t.Fatalf("expected hook to see each operation, got %v", ops)
+	}
+}
+
+func TestMemoryStoreHookLatency(t *testing.T) {
+	s := NewMemoryStore()
+	s.Hook = func(op string, meta *MetaObject) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	start := time.Now()
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := s.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected the hook to delay the put")
+	}
+}
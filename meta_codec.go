@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// metaSchemaVersion is the version objects are stored in. Records start with
+// a byte of metaSchemaMarker|version, which never starts a gob stream, so
+// the records of older versions, written as gob without one, are told apart.
+const (
+	metaSchemaVersion byte = 1
+	metaSchemaMarker  byte = 0x80
+)
+
+// metaCodec encodes the stored form of objects in one schema version. A
+// codec decodes the records of its own version and leaves fields they don't
+// have at their zero value, which is the default for every field.
+type metaCodec interface {
+	encode(m *MetaObject) ([]byte, error)
+	decode(data []byte, m *MetaObject) error
+}
+
+// metaCodecs are the codecs of the schema versions that can be read. Versions
+// only ever get added, the newest one being used to write.
+var metaCodecs = map[byte]metaCodec{
+	1: jsonMetaCodec{},
+}
+
+// encodeMeta returns the stored form of m in the current schema version.
+func encodeMeta(m *MetaObject) ([]byte, error) {
+	data, err := metaCodecs[metaSchemaVersion].encode(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{metaSchemaMarker | metaSchemaVersion}, data...), nil
+}
+
+// decodeMeta reads a stored object of any schema version into m. It returns
+// true if the record is of an older version and should be written again.
+func decodeMeta(value []byte, m *MetaObject) (bool, error) {
+	if len(value) == 0 || value[0]&0xf8 == 0xf8 || value[0] < metaSchemaMarker {
+		return true, gobMetaCodec{}.decode(value, m)
+	}
+	version := value[0] &^ metaSchemaMarker
+	codec, ok := metaCodecs[version]
+	if !ok {
+		return false, fmt.Errorf("Unknown meta schema version %d", version)
+	}
+	return version != metaSchemaVersion, codec.decode(value[1:], m)
+}
+
+// gobMetaCodec reads the records written before schema versions, which are
+// gob encoded MetaObjects.
+type gobMetaCodec struct{}
+
+func (gobMetaCodec) encode(m *MetaObject) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(m)
+	return buf.Bytes(), err
+}
+
+func (gobMetaCodec) decode(data []byte, m *MetaObject) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(m)
+}
+
+// metaRecordV1 is the stored form of objects in schema version 1. Its fields
+// are mapped from and to those of MetaObject one by one, so fields that only
+// live in memory, or only in the API representation, never end up stored.
+type metaRecordV1 struct {
+	Oid         string            `json:"oid"`
+	Size        int64             `json:"size"`
+	Encoding    string            `json:"enc,omitempty"`
+	StoredSize  int64             `json:"stored,omitempty"`
+	HashAlgo    string            `json:"algo,omitempty"`
+	KeyID       string            `json:"key,omitempty"`
+	Repos       []string          `json:"repos,omitempty"`
+	VerifiedAt  *time.Time        `json:"verified,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires,omitempty"`
+	DeletedAt   *time.Time        `json:"deleted,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Pinned      bool              `json:"pinned,omitempty"`
+	RetainUntil *time.Time        `json:"retain,omitempty"`
+	Mirrored    bool              `json:"mirrored,omitempty"`
+	MirroredFor string            `json:"mirrored_for,omitempty"`
+	Pending     bool              `json:"pending,omitempty"`
+	PendingTags map[string]string `json:"ptags,omitempty"`
+}
+
+// jsonMetaCodec encodes schema version 1.
+type jsonMetaCodec struct{}
+
+func (jsonMetaCodec) encode(m *MetaObject) ([]byte, error) {
+	return json.Marshal(&metaRecordV1{
+		Oid:         m.Oid,
+		Size:        m.Size,
+		Encoding:    m.Encoding,
+		StoredSize:  m.StoredSize,
+		HashAlgo:    m.HashAlgo,
+		KeyID:       m.KeyID,
+		Repos:       m.Repos,
+		VerifiedAt:  m.VerifiedAt,
+		ExpiresAt:   m.ExpiresAt,
+		DeletedAt:   m.DeletedAt,
+		Tags:        m.Tags,
+		Pinned:      m.Pinned,
+		RetainUntil: m.RetainUntil,
+		Mirrored:    m.Mirrored,
+		MirroredFor: m.MirroredFor,
+		Pending:     m.Pending,
+		PendingTags: m.PendingTags,
+	})
+}
+
+func (jsonMetaCodec) decode(data []byte, m *MetaObject) error {
+	var rec metaRecordV1
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	*m = MetaObject{
+		Oid:         rec.Oid,
+		Size:        rec.Size,
+		Encoding:    rec.Encoding,
+		StoredSize:  rec.StoredSize,
+		HashAlgo:    rec.HashAlgo,
+		KeyID:       rec.KeyID,
+		Repos:       rec.Repos,
+		VerifiedAt:  rec.VerifiedAt,
+		ExpiresAt:   rec.ExpiresAt,
+		DeletedAt:   rec.DeletedAt,
+		Tags:        rec.Tags,
+		Pinned:      rec.Pinned,
+		RetainUntil: rec.RetainUntil,
+		Mirrored:    rec.Mirrored,
+		MirroredFor: rec.MirroredFor,
+		Pending:     rec.Pending,
+		PendingTags: rec.PendingTags,
+	}
+	return nil
+}
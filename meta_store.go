@@ -2,36 +2,80 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // MetaStore implements a metadata storage. It stores user credentials and Meta information
 // for objects. The storage is handled by boltdb.
 type MetaStore struct {
 	db *bolt.DB
+
+	// SoftDelete has Release mark objects deleted instead of removing them,
+	// so they can be restored until the expiry sweep reaps them.
+	SoftDelete bool
+
+	// OnChange, if set, is called with the oid of every object written or
+	// deleted through the store, once the change is committed.
+	OnChange func(oid string)
 }
 
 var (
 	errNoBucket       = errors.New("Bucket not found")
 	errObjectNotFound = errors.New("Object not found")
 	errNotOwner       = errors.New("Attempt to delete other user's lock")
+	errUserNotFound   = errors.New("User not found")
+	errUserExists     = errors.New("User already exists")
+	errNotDeleted     = errors.New("Object is not deleted")
+	errRetained       = errors.New("Object is under retention")
+	errRetainShorter  = errors.New("Retention can only be extended")
+	errLocksConflict  = errors.New("Both repos have a lock on the same path")
+	errMoveNamespace  = errors.New("Repos can only be moved within their namespace")
+	errLocksShared    = errors.New("Locks are shared with a repo of the same name in another namespace")
+)
+
+var (
+	usersBucket      = []byte("users")
+	objectsBucket    = []byte("objects")
+	locksBucket      = []byte("locks")
+	tokensBucket     = []byte("tokens")
+	auditBucket      = []byte("audit")
+	scrubBucket      = []byte("scrub")
+	statsBucket      = []byte("stats")
+	inlineBucket     = []byte("inline")
+	downloadsBucket  = []byte("downloads")
+	usageBucket      = []byte("usage")
+	durabilityBucket = []byte("durability")
 )
 
 var (
-	usersBucket   = []byte("users")
-	objectsBucket = []byte("objects")
-	locksBucket   = []byte("locks")
+	scrubCursorKey = []byte("cursor")
+	rehashJobKey   = []byte("rehash")
+	rekeyJobKey    = []byte("rekey")
+)
+
+// User roles. Users created before roles existed have roleUser.
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
 )
 
+// bcryptCost is the cost used to hash user passwords.
+var bcryptCost = bcrypt.DefaultCost
+
 // NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
 func NewMetaStore(dbFile string) (*MetaStore, error) {
 	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
@@ -52,12 +96,54 @@ func NewMetaStore(dbFile string) (*MetaStore, error) {
 			return err
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(auditBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(scrubBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(statsBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(inlineBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(downloadsBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(durabilityBucket); err != nil {
+			return err
+		}
+
+		// Stores from before usage was kept get it counted once
+		if tx.Bucket(usageBucket) == nil {
+			if err := countUsage(tx); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
 	return &MetaStore{db: db}, nil
 }
 
+// changed reports a change to the object of oid to OnChange.
+func (s *MetaStore) changed(oid string) {
+	if s.OnChange != nil {
+		s.OnChange(oid)
+	}
+}
+
 // Get retrieves the Meta information for an object given information in
 // RequestVars
 func (s *MetaStore) Get(v *RequestVars) (*MetaObject, error) {
@@ -70,6 +156,8 @@ func (s *MetaStore) Get(v *RequestVars) (*MetaObject, error) {
 // DO NOT CHECK authentication, as it is supposed to have been done before
 func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 	var meta MetaObject
+	var stale bool
+	var old []byte
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(objectsBucket)
@@ -82,10 +170,22 @@ func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 			return errObjectNotFound
 		}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(value))
-		return dec.Decode(&meta)
+		var err error
+		if stale, err = decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if stale {
+			old = append([]byte(nil), value...)
+		}
+		if meta.DeletedAt != nil {
+			return errObjectNotFound
+		}
+		return nil
 	})
 
+	if old != nil {
+		s.upgrade(map[string][]byte{v.Oid: old})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -93,303 +193,1654 @@ func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 	return &meta, nil
 }
 
-// Put writes meta information from RequestVars to the store.
+// Put writes meta information from RequestVars to the store. The repo in v,
+// if any, is added to the references of the object. The tags in v are added
+// to its tags, or kept pending until the upload stored its content. A soft
+// deleted object is restored with the repo in v as its only reference.
 func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
-	// Check if it exists first
-	if meta, err := s.Get(v); err == nil {
-		meta.Existing = true
-		return meta, nil
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	meta := MetaObject{Oid: v.Oid, Size: v.Size}
-	err := enc.Encode(meta)
-	if err != nil {
-		return nil, err
-	}
+	var meta *MetaObject
 
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err = bucket.Put([]byte(v.Oid), buf.Bytes())
-		if err != nil {
+		if value := bucket.Get([]byte(v.Oid)); len(value) > 0 {
+			meta = &MetaObject{}
+			stale, err := decodeMeta(value, meta)
+			if err != nil {
+				return err
+			}
+			meta.Existing = true
+			if meta.DeletedAt != nil {
+				meta.DeletedAt = nil
+				meta.Repos = nil
+				meta.addRepo(repoName(v))
+				meta.addTags(v.Tags)
+			} else if added, tagged := meta.addRepo(repoName(v)), meta.addUploadTags(v.Tags); !added && !tagged && !stale {
+				return nil
+			}
+		} else {
+			meta = &MetaObject{Oid: v.Oid, Size: v.Size, HashAlgo: v.HashAlgo, Pending: true}
+			meta.addRepo(repoName(v))
+			meta.addUploadTags(v.Tags)
+		}
+		if err := meta.validateAllTags(); err != nil {
 			return err
 		}
 
-		return nil
+		return putMeta(bucket, meta)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &meta, nil
+	s.changed(v.Oid)
+	return meta, nil
 }
 
-// Delete removes the meta information from RequestVars to the store.
-func (s *MetaStore) Delete(v *RequestVars) error {
+// Update replaces the stored meta information for meta.Oid, e.g. to record
+// the encoding chosen by the content store. The stored references, tags, pin,
+// retention and deletion are kept, they only change through Put, Release,
+// SetPinned, SetRetention and Restore. It returns errObjectNotFound if the
+// object isn't stored, rather than recreating one deleted meanwhile.
+func (s *MetaStore) Update(meta *MetaObject) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(v.Oid))
-		if err != nil {
+		// An object deleted meanwhile stays deleted
+		value := bucket.Get([]byte(meta.Oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		var stored MetaObject
+		if _, err := decodeMeta(value, &stored); err != nil {
 			return err
 		}
 
-		return nil
-	})
+		m := *meta
+		m.Repos = stored.Repos
+		m.Pinned = stored.Pinned
+		m.RetainUntil = stored.RetainUntil
+		m.DeletedAt = stored.DeletedAt
+		m.Tags = stored.Tags
+		m.PendingTags = stored.PendingTags
+		// Once stored an object stays stored, with the tags of its upload
+		m.Pending = stored.Pending && meta.Pending
+		if !m.Pending && m.PendingTags != nil {
+			m.addTags(m.PendingTags)
+			m.PendingTags = nil
+		}
 
+		return putMeta(bucket, &m)
+	})
+	if err == nil {
+		s.changed(meta.Oid)
+	}
 	return err
 }
 
-// AddLocks write locks to the store for the repo.
-func (s *MetaStore) AddLocks(repo string, l ...Lock) error {
+// SetKey records the key and stored size of rekeyed, the object old was
+// encrypted again, if it's still stored as old. It returns errRewritten if
+// the object was written differently meanwhile, or errObjectNotFound if it
+// was deleted. Unlike Update it leaves every other attribute as stored.
+func (s *MetaStore) SetKey(old, rekeyed *MetaObject) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
+		value := bucket.Get([]byte(old.Oid))
+		if len(value) == 0 {
+			return errObjectNotFound
 		}
-		locks = append(locks, l...)
-		sort.Sort(LocksByCreatedAt(locks))
-		data, err := json.Marshal(&locks)
-		if err != nil {
+		var stored MetaObject
+		if _, err := decodeMeta(value, &stored); err != nil {
 			return err
 		}
+		if stored.KeyID != old.KeyID || stored.Encoding != old.Encoding || stored.StoredSize != old.StoredSize {
+			return errRewritten
+		}
 
-		return bucket.Put([]byte(repo), data)
+		stored.KeyID = rekeyed.KeyID
+		stored.StoredSize = rekeyed.StoredSize
+		return putMeta(bucket, &stored)
 	})
+	if err == nil {
+		s.changed(old.Oid)
+	}
 	return err
 }
 
-// Locks retrieves locks for the repo from the store
-func (s *MetaStore) Locks(repo string) ([]Lock, error) {
-	var locks []Lock
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+// Release drops the reference of repo to the object and deletes its meta
+// information once no references remain, unless it is pinned or retained.
+// With an empty repo only objects that are already unreferenced are deleted.
+// It returns the object as it was left and whether it was deleted, in which
+// case the caller removes the content unless the object was only soft
+// deleted, which sets its DeletedAt. A soft deleted object keeps its
+// references for Restore.
+func (s *MetaStore) Release(oid, repo string) (*MetaObject, bool, error) {
+	var meta MetaObject
+	var deleted bool
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if meta.DeletedAt != nil {
+			return errObjectNotFound
+		}
+
+		repos := append([]string(nil), meta.Repos...)
+		released := meta.removeRepo(repo)
+		if len(meta.Repos) > 0 || meta.Pinned || meta.retained(time.Now()) {
+			if !released {
+				return nil
 			}
+			return putMeta(bucket, &meta)
 		}
-		return nil
+
+		deleted = true
+		if s.SoftDelete {
+			now := time.Now().UTC()
+			meta.DeletedAt = &now
+			kept := meta
+			kept.Repos = repos
+			return putMeta(bucket, &kept)
+		}
+		return deleteObject(tx, oid)
 	})
-	return locks, err
-}
 
-// FilteredLocks return filtered locks for the repo
-func (s *MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []Lock, next string, err error) {
-	locks, err = s.Locks(repo)
 	if err != nil {
-		return
+		return nil, false, err
 	}
 
-	if cursor != "" {
-		lastSeen := -1
-		for i, l := range locks {
-			if l.Id == cursor {
-				lastSeen = i
-				break
-			}
-		}
+	s.changed(oid)
+	return &meta, deleted, nil
+}
 
-		if lastSeen > -1 {
-			locks = locks[lastSeen:]
-		} else {
-			err = fmt.Errorf("cursor (%s) not found", cursor)
-			return
-		}
+// deleteObject deletes the meta information of oid along with its download
+// count, so an object stored again later starts counting afresh.
+func deleteObject(tx *bolt.Tx, oid string) error {
+	bucket := tx.Bucket(objectsBucket)
+	if err := accountUsage(tx, bucket.Get([]byte(oid)), nil); err != nil {
+		return err
+	}
+	if err := bucket.Delete([]byte(oid)); err != nil {
+		return err
 	}
+	if downloads := tx.Bucket(downloadsBucket); downloads != nil {
+		return downloads.Delete([]byte(oid))
+	}
+	return nil
+}
 
-	if path != "" {
-		var filtered []Lock
-		for _, l := range locks {
-			if l.Path == path {
-				filtered = append(filtered, l)
-			}
-		}
+func putMeta(bucket *bolt.Bucket, meta *MetaObject) error {
+	m := *meta
+	m.Existing = false
 
-		locks = filtered
+	value, err := encodeMeta(&m)
+	if err != nil {
+		return err
+	}
+	if err := accountUsage(bucket.Tx(), bucket.Get([]byte(m.Oid)), &m); err != nil {
+		return err
 	}
 
-	if limit != "" {
-		var size int
-		size, err = strconv.Atoi(limit)
-		if err != nil || size < 0 {
-			locks = make([]Lock, 0)
-			err = fmt.Errorf("Invalid limit amount: %s", limit)
-			return
-		}
+	return bucket.Put([]byte(m.Oid), value)
+}
 
-		size = int(math.Min(float64(size), float64(len(locks))))
-		if size+1 < len(locks) {
-			next = locks[size].Id
+// upgrade writes the objects read in an older schema version again in the
+// current one, each unless it changed since it was read from the given value.
+// It doesn't change what the objects hold, so failing is only logged.
+func (s *MetaStore) upgrade(stale map[string][]byte) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		for oid, old := range stale {
+			if !bytes.Equal(bucket.Get([]byte(oid)), old) {
+				continue
+			}
+			var meta MetaObject
+			if _, err := decodeMeta(old, &meta); err != nil {
+				return err
+			}
+			if err := putMeta(bucket, &meta); err != nil {
+				return err
+			}
 		}
-		locks = locks[:size]
+		return nil
+	})
+	if err != nil {
+		logger.Log(kv{"fn": "meta_store", "err": "Could not upgrade stored objects: " + err.Error()})
 	}
+}
 
-	return locks, next, nil
+// RepoMove is the outcome of moving the references of one repo to another.
+// Moved objects were only referenced by From among the two, merged ones by
+// both and are now referenced by To once. Locks are the locks moved along.
+type RepoMove struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Moved  int    `json:"moved"`
+	Merged int    `json:"merged"`
+	Locks  int    `json:"locks"`
 }
 
-// DeleteLock removes lock for the repo by id from the store
-func (s *MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
-	var deleted *Lock
+// MoveRepo re-assigns every object referenced by from to to, as when a repo
+// is renamed or transferred, in one transaction. Content is shared between
+// repos, so only references change, and an object both already reference
+// keeps a single reference of to. Soft deleted objects are moved as well, so
+// restoring them restores the new reference. The locks of from move to to
+// in the same transaction; if both lock a path it returns errLocksConflict
+// and moves nothing.
+//
+// Locks are kept by the name of the repo alone, as the lock API has it, so
+// repos of one name in different namespaces share them. A move to another
+// namespace returns errMoveNamespace, and a move of locks that a repo of from
+// or to in another namespace also has returns errLocksShared; neither moves
+// anything.
+func (s *MetaStore) MoveRepo(from, to string) (*RepoMove, error) {
+	if repoNamespace(from) != repoNamespace(to) {
+		return nil, errMoveNamespace
+	}
+	res := &RepoMove{From: from, To: to}
+	var oids []string
+
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
+		var moved []*MetaObject
+		shared := false
+		err := bucket.ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			if _, err := decodeMeta(v, &meta); err != nil {
 				return err
 			}
-		}
-		newLocks := make([]Lock, 0, len(locks))
-
-		var lock Lock
-		for _, l := range locks {
-			if l.Id == id {
-				if l.Owner.Name != user && !force {
-					return errNotOwner
+			for _, r := range meta.Repos {
+				if repoNamespace(r) != repoNamespace(from) && (lockRepo(r) == lockRepo(from) || lockRepo(r) == lockRepo(to)) {
+					shared = true
 				}
-				lock = l
-			} else if len(l.Id) > 0 {
-				newLocks = append(newLocks, l)
 			}
-		}
-		if lock.Id == "" {
+			if !meta.removeRepo(from) {
+				return nil
+			}
+			if meta.addRepo(to) {
+				res.Moved++
+			} else {
+				res.Merged++
+			}
+			moved = append(moved, &meta)
 			return nil
+		})
+		if err != nil {
+			return err
 		}
-		deleted = &lock
 
-		if len(newLocks) == 0 {
-			return bucket.Delete([]byte(repo))
+		// Written once the walk is done, as bolt doesn't allow changing a
+		// bucket while iterating over it
+		for _, meta := range moved {
+			if err := putMeta(bucket, meta); err != nil {
+				return err
+			}
+			oids = append(oids, meta.Oid)
 		}
 
-		data, err := json.Marshal(&newLocks)
-		if err != nil {
-			return err
+		if shared {
+			if locks := tx.Bucket(locksBucket); locks != nil && locks.Get([]byte(lockRepo(from))) != nil {
+				return errLocksShared
+			}
 		}
-		return bucket.Put([]byte(repo), data)
+		res.Locks, err = moveLocks(tx, lockRepo(from), lockRepo(to))
+		return err
 	})
-	return deleted, err
-}
 
-type LocksByCreatedAt []Lock
+	if err != nil {
+		return nil, err
+	}
+	for _, oid := range oids {
+		s.changed(oid)
+	}
+	return res, nil
+}
 
-func (c LocksByCreatedAt) Len() int           { return len(c) }
-func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j].LockedAt) }
-func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+// lockRepo returns the name locks of the repo name ("user/repo") are kept
+// under, which is that of the repo alone, as the lock API has it.
+func lockRepo(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
 
-// Close closes the underlying boltdb.
-func (s *MetaStore) Close() {
-	s.db.Close()
+// repoNamespace returns the user or organization of the repo name
+// ("user/repo").
+func repoNamespace(name string) string {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
 }
 
-// AddUser adds user credentials to the meta store.
-func (s *MetaStore) AddUser(user, pass string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
-			return errNoBucket
+// moveLocks moves the locks kept under from to to and returns how many it
+// moved.
+func moveLocks(tx *bolt.Tx, from, to string) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+	bucket := tx.Bucket(locksBucket)
+	if bucket == nil {
+		return 0, errNoBucket
+	}
+
+	var moved, locks []Lock
+	if data := bucket.Get([]byte(from)); data != nil {
+		if err := json.Unmarshal(data, &moved); err != nil {
+			return 0, err
+		}
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	}
+	if data := bucket.Get([]byte(to)); data != nil {
+		if err := json.Unmarshal(data, &locks); err != nil {
+			return 0, err
 		}
+	}
 
-		err := bucket.Put([]byte(user), []byte(pass))
-		if err != nil {
-			return err
+	locked := make(map[string]bool)
+	for _, l := range locks {
+		locked[l.Path] = true
+	}
+	for _, l := range moved {
+		if locked[l.Path] {
+			return 0, errLocksConflict
 		}
-		return nil
-	})
+	}
 
-	return err
+	locks = append(locks, moved...)
+	sort.Sort(LocksByCreatedAt(locks))
+	data, err := json.Marshal(&locks)
+	if err != nil {
+		return 0, err
+	}
+	if err := bucket.Put([]byte(to), data); err != nil {
+		return 0, err
+	}
+	return len(moved), bucket.Delete([]byte(from))
 }
 
-// DeleteUser removes user credentials from the meta store.
-func (s *MetaStore) DeleteUser(user string) error {
+// RepoUsage is what a repo references. Objects shared with other repos count
+// fully towards each.
+type RepoUsage struct {
+	Repo    string `json:"repo"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// Usage returns the objects repo references, not counting soft deleted ones.
+func (s *MetaStore) Usage(repo string) (*RepoUsage, error) {
+	usage := &RepoUsage{Repo: repo}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			if _, err := decodeMeta(v, &meta); err != nil {
+				return err
+			}
+			if meta.DeletedAt != nil {
+				return nil
+			}
+			for _, r := range meta.Repos {
+				if r == repo {
+					usage.Objects++
+					usage.Bytes += meta.Size
+					break
+				}
+			}
+			return nil
+		})
+	})
+
+	return usage, err
+}
+
+// StoredUsage returns the bytes of all objects, not counting soft deleted or
+// pending ones or those in skip, and of those a repo of namespace references. An
+// empty namespace references nothing. The totals are kept as objects are
+// written, so only the objects in skip are read.
+func (s *MetaStore) StoredUsage(namespace string, skip map[string]bool) (total, inNamespace int64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		usage := tx.Bucket(usageBucket)
+		if bucket == nil || usage == nil {
+			return errNoBucket
+		}
+		total = usageValue(usage, usageTotalKey)
+		if namespace != "" {
+			inNamespace = usageValue(usage, usageNamespaceKey(namespace))
+		}
+
+		for oid := range skip {
+			value := bucket.Get([]byte(oid))
+			if value == nil {
+				continue
+			}
+			var meta MetaObject
+			if _, err := decodeMeta(value, &meta); err != nil {
+				return err
+			}
+			if meta.DeletedAt != nil || meta.Pending {
+				continue
+			}
+			total -= meta.Size
+			if meta.inNamespace(namespace) {
+				inNamespace -= meta.Size
+			}
+		}
+		return nil
+	})
+	return total, inNamespace, err
+}
+
+// usageTotalKey is the key of the bytes of all objects in the usage bucket,
+// which also holds those of every namespace under usageNamespaceKey.
+var usageTotalKey = []byte("total")
+
+func usageNamespaceKey(namespace string) []byte {
+	return []byte("namespace/" + namespace)
+}
+
+func usageValue(bucket *bolt.Bucket, key []byte) int64 {
+	if v := bucket.Get(key); len(v) == 8 {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+// accountUsage updates the usage totals for an object written as meta in tx,
+// over its previous value old. Either is nil for an object stored or deleted.
+// Soft deleted objects, and pending ones waiting for their content, take no
+// room.
+func accountUsage(tx *bolt.Tx, old []byte, meta *MetaObject) error {
+	usage := tx.Bucket(usageBucket)
+	if usage == nil {
+		return errNoBucket
+	}
+
+	deltas := make(map[string]int64)
+	if old != nil {
+		var prev MetaObject
+		if _, err := decodeMeta(old, &prev); err != nil {
+			return err
+		}
+		addUsage(deltas, &prev, -1)
+	}
+	if meta != nil {
+		addUsage(deltas, meta, 1)
+	}
+
+	for key, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		var value [8]byte
+		binary.BigEndian.PutUint64(value[:], uint64(usageValue(usage, []byte(key))+delta))
+		if err := usage.Put([]byte(key), value[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addUsage adds the size of meta, times sign, to deltas for the total and
+// for each namespace referencing it.
+func addUsage(deltas map[string]int64, meta *MetaObject, sign int64) {
+	if meta.DeletedAt != nil || meta.Pending {
+		return
+	}
+	deltas[string(usageTotalKey)] += sign * meta.Size
+
+	seen := make(map[string]bool)
+	for _, r := range meta.Repos {
+		i := strings.Index(r, "/")
+		if i <= 0 || seen[r[:i]] {
+			continue
+		}
+		seen[r[:i]] = true
+		deltas[string(usageNamespaceKey(r[:i]))] += sign * meta.Size
+	}
+}
+
+// countUsage creates the usage bucket with the totals of the objects stored.
+func countUsage(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucket(usageBucket); err != nil {
+		return err
+	}
+	return tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+		var meta MetaObject
+		if _, err := decodeMeta(v, &meta); err != nil {
+			return err
+		}
+		return accountUsage(tx, nil, &meta)
+	})
+}
+
+// repoName returns the "user/repo" name referencing objects requested through
+// v, or an empty string for requests outside a repo.
+func repoName(v *RequestVars) string {
+	if v.Repo == "" {
+		return ""
+	}
+	return v.User + "/" + v.Repo
+}
+
+// Delete removes the meta information from RequestVars to the store. Objects
+// under retention are kept, returning errRetained.
+func (s *MetaStore) Delete(v *RequestVars) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if value := bucket.Get([]byte(v.Oid)); len(value) > 0 {
+			var meta MetaObject
+			if _, err := decodeMeta(value, &meta); err != nil {
+				return err
+			}
+			if meta.retained(time.Now()) {
+				return errRetained
+			}
+		}
+
+		return deleteObject(tx, v.Oid)
+	})
+
+	if err == nil {
+		s.changed(v.Oid)
+	}
+	return err
+}
+
+// DeletePending removes the meta information of an object whose upload
+// through v failed. It is kept if another repo references the object, as an
+// upload for that repo may still store it, or if it is pinned or retained.
+func (s *MetaStore) DeletePending(v *RequestVars) error {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(v.Oid))
+		if len(value) == 0 {
+			return nil
+		}
+		var meta MetaObject
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if meta.Pinned || meta.retained(time.Now()) {
+			return nil
+		}
+		for _, repo := range meta.Repos {
+			if repo != repoName(v) {
+				return nil
+			}
+		}
+
+		deleted = true
+		return deleteObject(tx, v.Oid)
+	})
+
+	if deleted && err == nil {
+		s.changed(v.Oid)
+	}
+	return err
+}
+
+// AddTags sets tags on the object, as an upload of it does once its content
+// is stored. It returns errTagsTooLarge if the object's tags wouldn't fit
+// the configured limit anymore.
+func (s *MetaStore) AddTags(oid string, tags map[string]string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		var meta MetaObject
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+
+		if !meta.addTags(tags) {
+			return nil
+		}
+		if err := validateTags(meta.Tags); err != nil {
+			return err
+		}
+		return putMeta(bucket, &meta)
+	})
+
+	if err == nil {
+		s.changed(oid)
+	}
+	return err
+}
+
+// SetPinned pins or unpins the object. It returns the object as stored.
+func (s *MetaStore) SetPinned(oid string, pinned bool) (*MetaObject, error) {
+	var meta MetaObject
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+
+		if meta.DeletedAt != nil {
+			return errObjectNotFound
+		}
+
+		meta.Pinned = pinned
+		return putMeta(bucket, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	s.changed(oid)
+	return &meta, nil
+}
+
+// SetRetention keeps the object from being removed until until. A retention
+// can only be extended: an earlier time than the one set returns
+// errRetainShorter. It returns the object as stored.
+func (s *MetaStore) SetRetention(oid string, until time.Time) (*MetaObject, error) {
+	var meta MetaObject
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+
+		if meta.DeletedAt != nil {
+			return errObjectNotFound
+		}
+		if meta.RetainUntil != nil && until.Before(*meta.RetainUntil) {
+			return errRetainShorter
+		}
+
+		until = until.UTC()
+		meta.RetainUntil = &until
+		return putMeta(bucket, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	s.changed(oid)
+	return &meta, nil
+}
+
+// Restore undoes the soft delete of oid, with the references it had. It
+// returns the restored object, errObjectNotFound if there is none and
+// errNotDeleted if it isn't deleted.
+func (s *MetaStore) Restore(oid string) (*MetaObject, error) {
+	var meta MetaObject
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if meta.DeletedAt == nil {
+			return errNotDeleted
+		}
+
+		meta.DeletedAt = nil
+		return putMeta(bucket, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	s.changed(oid)
+	return &meta, nil
+}
+
+// Expire deletes the meta information of oid if it expired before now. It
+// returns the object and whether it was deleted, in which case the caller
+// removes the content. The check and delete are a single transaction, so an
+// object whose expiry was just extended by an upload is kept. Soft deleted
+// objects are left to Reap once their grace period is over.
+func (s *MetaStore) Expire(oid string, now time.Time) (*MetaObject, bool, error) {
+	return s.deleteIf(oid, func(meta *MetaObject) bool { return meta.DeletedAt == nil && meta.expired(now) })
+}
+
+// Reap deletes the meta information of oid if it was soft deleted before
+// before. Like Expire, it returns the object and whether it was deleted, and
+// a restore or re-upload in the meantime keeps the object.
+func (s *MetaStore) Reap(oid string, before time.Time) (*MetaObject, bool, error) {
+	return s.deleteIf(oid, func(meta *MetaObject) bool { return meta.deletedBefore(before) })
+}
+
+// deleteIf deletes the meta information of oid if it matches in the same
+// transaction as the check, and isn't under retention.
+func (s *MetaStore) deleteIf(oid string, matches func(*MetaObject) bool) (*MetaObject, bool, error) {
+	var meta MetaObject
+	var deleted bool
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		if _, err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+
+		if !matches(&meta) || meta.retained(time.Now()) {
+			return nil
+		}
+		deleted = true
+		return deleteObject(tx, oid)
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+	s.changed(oid)
+	return &meta, deleted, nil
+}
+
+// AddLocks write locks to the store for the repo.
+func (s *MetaStore) AddLocks(repo string, l ...Lock) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+		locks = append(locks, l...)
+		sort.Sort(LocksByCreatedAt(locks))
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(repo), data)
+	})
+	return err
+}
+
+// Locks retrieves locks for the repo from the store
+func (s *MetaStore) Locks(repo string) ([]Lock, error) {
+	var locks []Lock
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return locks, err
+}
+
+// FilteredLocks return filtered locks for the repo
+func (s *MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []Lock, next string, err error) {
+	locks, err = s.Locks(repo)
+	if err != nil {
+		return
+	}
+
+	if cursor != "" {
+		lastSeen := -1
+		for i, l := range locks {
+			if l.Id == cursor {
+				lastSeen = i
+				break
+			}
+		}
+
+		if lastSeen > -1 {
+			locks = locks[lastSeen:]
+		} else {
+			err = fmt.Errorf("cursor (%s) not found", cursor)
+			return
+		}
+	}
+
+	if path != "" {
+		var filtered []Lock
+		for _, l := range locks {
+			if l.Path == path {
+				filtered = append(filtered, l)
+			}
+		}
+
+		locks = filtered
+	}
+
+	if limit != "" {
+		var size int
+		size, err = strconv.Atoi(limit)
+		if err != nil || size < 0 {
+			locks = make([]Lock, 0)
+			err = fmt.Errorf("Invalid limit amount: %s", limit)
+			return
+		}
+
+		size = int(math.Min(float64(size), float64(len(locks))))
+		if size+1 < len(locks) {
+			next = locks[size].Id
+		}
+		locks = locks[:size]
+	}
+
+	return locks, next, nil
+}
+
+// DeleteLock removes lock for the repo by id from the store
+func (s *MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
+	var deleted *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+		newLocks := make([]Lock, 0, len(locks))
+
+		var lock Lock
+		for _, l := range locks {
+			if l.Id == id {
+				if l.Owner.Name != user && !force {
+					return errNotOwner
+				}
+				lock = l
+			} else if len(l.Id) > 0 {
+				newLocks = append(newLocks, l)
+			}
+		}
+		if lock.Id == "" {
+			return nil
+		}
+		deleted = &lock
+
+		if len(newLocks) == 0 {
+			return bucket.Delete([]byte(repo))
+		}
+
+		data, err := json.Marshal(&newLocks)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(repo), data)
+	})
+	return deleted, err
+}
+
+type LocksByCreatedAt []Lock
+
+func (c LocksByCreatedAt) Len() int           { return len(c) }
+func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j].LockedAt) }
+func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Close closes the underlying boltdb.
+func (s *MetaStore) Close() {
+	s.db.Close()
+}
+
+// userRecord is the stored form of a user. Passwords are kept as bcrypt
+// hashes; records written before hashing was introduced hold the plain
+// password instead of JSON.
+type userRecord struct {
+	Hash string `json:"hash"`
+	Role string `json:"role"`
+}
+
+func decodeUserRecord(value []byte) *userRecord {
+	if len(value) == 0 {
+		return nil
+	}
+
+	var rec userRecord
+	if value[0] != '{' || json.Unmarshal(value, &rec) != nil {
+		return &userRecord{Role: roleUser}
+	}
+	if rec.Role == "" {
+		rec.Role = roleUser
+	}
+	return &rec
+}
+
+// matches returns true if password is valid for the stored record value.
+func (rec *userRecord) matches(value []byte, password string) bool {
+	if rec.Hash == "" {
+		return string(value) == password
+	}
+	return bcrypt.CompareHashAndPassword([]byte(rec.Hash), []byte(password)) == nil
+}
+
+func newUserRecord(pass, role string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&userRecord{Hash: string(hash), Role: role})
+}
+
+// AddUser adds user credentials to the meta store, replacing the password of
+// an existing user. An existing user keeps its role.
+func (s *MetaStore) AddUser(user, pass string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		role := roleUser
+		if rec := decodeUserRecord(bucket.Get([]byte(user))); rec != nil {
+			role = rec.Role
+		} else if _, err := deleteTokens(tx, user); err != nil {
+			// Tokens of a removed user of the same name must not pass
+			// for the new one
+			return err
+		}
+
+		value, err := newUserRecord(pass, role)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put([]byte(user), value)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+
+	return err
+}
+
+// CreateUser adds a new user with the given role to the meta store. It fails
+// with errUserExists if the user is already present.
+func (s *MetaStore) CreateUser(user, pass, role string) error {
+	value, err := newUserRecord(pass, role)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if bucket.Get([]byte(user)) != nil {
+			return errUserExists
+		}
+		// Tokens of a removed user of the same name must not pass for the
+		// new one
+		if _, err := deleteTokens(tx, user); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), value)
+	})
+}
+
+// UpdateUser changes the password and/or role of an existing user. Empty
+// values are left unchanged.
+func (s *MetaStore) UpdateUser(user, pass, role string) error {
+	var hash []byte
+	if pass != "" {
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(pass), bcryptCost)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(user))
+		rec := decodeUserRecord(value)
+		if rec == nil {
+			return errUserNotFound
+		}
+		if rec.Hash == "" && hash == nil {
+			// Hash the legacy plain text password while we're here
+			h, err := bcrypt.GenerateFromPassword(value, bcryptCost)
+			if err != nil {
+				return err
+			}
+			hash = h
+		}
+
+		if hash != nil {
+			rec.Hash = string(hash)
+		}
+		if role != "" {
+			rec.Role = role
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), data)
+	})
+}
+
+// DeleteUser removes user credentials from the meta store. The user's access
+// tokens stop authenticating with it, but are only removed by DeleteTokens or
+// when a user of the same name is added again.
+func (s *MetaStore) DeleteUser(user string) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(user))
+		err := bucket.Delete([]byte(user))
+		return err
+	})
+
+	return err
+}
+
+// MetaUser encapsulates information about a meta store user
+type MetaUser struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Users returns all MetaUsers in the meta store
+func (s *MetaStore) Users() ([]*MetaUser, error) {
+	var users []*MetaUser
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		bucket.ForEach(func(k, v []byte) error {
+			users = append(users, &MetaUser{string(k), decodeUserRecord(v).Role})
+			return nil
+		})
+		return nil
+	})
+
+	return users, err
+}
+
+// User returns the MetaUser for name.
+func (s *MetaStore) User(name string) (*MetaUser, error) {
+	var user *MetaUser
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		rec := decodeUserRecord(bucket.Get([]byte(name)))
+		if rec == nil {
+			return errUserNotFound
+		}
+		user = &MetaUser{name, rec.Role}
+		return nil
+	})
+
+	return user, err
+}
+
+// tokenRecord is the stored form of an access token. Tokens are keyed by
+// their SHA-256 so the token itself is never stored.
+type tokenRecord struct {
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+func tokenKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// AddToken mints a new access token for user, which can be used in place of
+// the user's password. The token is only returned here.
+func (s *MetaStore) AddToken(user string) (string, error) {
+	var raw [20]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw[:])
+
+	data, err := json.Marshal(&tokenRecord{User: user, Created: time.Now()})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(user)) == nil {
+			return errUserNotFound
+		}
+
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(tokenKey(token), data)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// DeleteTokens removes all access tokens of user, returning how many were
+// removed.
+func (s *MetaStore) DeleteTokens(user string) (int, error) {
+	deleted := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		deleted, err = deleteTokens(tx, user)
+		return err
+	})
+
+	return deleted, err
+}
+
+func deleteTokens(tx *bolt.Tx, user string) (int, error) {
+	bucket := tx.Bucket(tokensBucket)
+	if bucket == nil {
+		return 0, errNoBucket
+	}
+
+	var keys [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		var rec tokenRecord
+		if json.Unmarshal(v, &rec) == nil && rec.User == user {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+
+	deleted := 0
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Objects returns all MetaObjects in the meta store
+func (s *MetaStore) Objects() ([]*MetaObject, error) {
+	var objects []*MetaObject
+	stale := make(map[string][]byte)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		bucket.ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			isStale, err := decodeMeta(v, &meta)
+			if err != nil {
+				return err
+			}
+			if isStale {
+				stale[string(k)] = append([]byte(nil), v...)
+			}
+			objects = append(objects, &meta)
+			return nil
+		})
+		return nil
+	})
+
+	if len(stale) > 0 {
+		s.upgrade(stale)
+	}
+	return objects, err
+}
+
+// NextObject returns the object with the smallest oid after the given one, or
+// nil if there is none. Objects are ordered by oid, so repeated calls walk the
+// whole store.
+func (s *MetaStore) NextObject(after string) (*MetaObject, error) {
+	return s.seekObject(after, true)
+}
+
+// ObjectFrom returns the first object whose oid is from or after it, or nil
+// if there is none, so a walk of the objects with a prefix starts at the
+// prefix.
+func (s *MetaStore) ObjectFrom(from string) (*MetaObject, error) {
+	return s.seekObject(from, false)
+}
+
+// seekObject returns the first object at or after key, skipping key itself
+// if skip is set.
+func (s *MetaStore) seekObject(key string, skip bool) (*MetaObject, error) {
+	var meta *MetaObject
+	var stale map[string][]byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		c := bucket.Cursor()
+		k, v := c.Seek([]byte(key))
+		if skip && k != nil && string(k) == key {
+			k, v = c.Next()
+		}
+		if k == nil {
+			return nil
+		}
+
+		meta = &MetaObject{}
+		isStale, err := decodeMeta(v, meta)
+		if isStale {
+			stale = map[string][]byte{string(k): append([]byte(nil), v...)}
+		}
 		return err
 	})
 
-	return err
+	if stale != nil && err == nil {
+		s.upgrade(stale)
+	}
+	return meta, err
 }
 
-// MetaUser encapsulates information about a meta store user
-type MetaUser struct {
-	Name string
+// Unknown returns those of oids no object is recorded for, deleted or not.
+func (s *MetaStore) Unknown(oids []string) ([]string, error) {
+	var unknown []string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		for _, oid := range oids {
+			if bucket.Get([]byte(oid)) == nil {
+				unknown = append(unknown, oid)
+			}
+		}
+		return nil
+	})
+
+	return unknown, err
 }
 
-// Users returns all MetaUsers in the meta store
-func (s *MetaStore) Users() ([]*MetaUser, error) {
-	var users []*MetaUser
+// GetInline returns the content of oid kept in the meta store by a
+// ContentStore, or errObjectNotFound.
+func (s *MetaStore) GetInline(oid string) ([]byte, error) {
+	var data []byte
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
+		bucket := tx.Bucket(inlineBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			users = append(users, &MetaUser{string(k)})
+		value := bucket.Get([]byte(oid))
+		if value == nil {
+			return errObjectNotFound
+		}
+		data = append([]byte{}, value...)
+		return nil
+	})
+
+	return data, err
+}
+
+// PutInline keeps the content of oid in the meta store.
+func (s *MetaStore) PutInline(oid string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inlineBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put([]byte(oid), data)
+	})
+}
+
+// DeleteInline removes the content of oid from the meta store. Deleting
+// content that isn't there is not an error.
+func (s *MetaStore) DeleteInline(oid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inlineBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Delete([]byte(oid))
+	})
+}
+
+// ScrubCursor returns the oid the scrubber last verified, or an empty string
+// at the start of a pass.
+func (s *MetaStore) ScrubCursor() (string, error) {
+	var cursor string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		cursor = string(bucket.Get(scrubCursorKey))
+		return nil
+	})
+
+	return cursor, err
+}
+
+// SetScrubCursor records the oid the scrubber last verified.
+func (s *MetaStore) SetScrubCursor(oid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(scrubCursorKey, []byte(oid))
+	})
+}
+
+// RehashJob returns the last saved rehash job, or nil if there is none.
+func (s *MetaStore) RehashJob() (*RehashJob, error) {
+	var job *RehashJob
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		value := bucket.Get(rehashJobKey)
+		if len(value) == 0 {
+			return nil
+		}
+		job = &RehashJob{}
+		return json.Unmarshal(value, job)
+	})
+
+	return job, err
+}
+
+// SetRehashJob saves the state of a rehash job.
+func (s *MetaStore) SetRehashJob(job *RehashJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(rehashJobKey, value)
+	})
+}
+
+// RekeyJob returns the last saved rekey job, or nil if there is none.
+func (s *MetaStore) RekeyJob() (*RekeyJob, error) {
+	var job *RekeyJob
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		value := bucket.Get(rekeyJobKey)
+		if len(value) == 0 {
+			return nil
+		}
+		job = &RekeyJob{}
+		return json.Unmarshal(value, job)
+	})
+
+	return job, err
+}
+
+// SetRekeyJob saves the state of a rekey job.
+func (s *MetaStore) SetRekeyJob(job *RekeyJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(rekeyJobKey, value)
+	})
+}
+
+// Stats returns the lifetime counters recorded by AddStats.
+func (s *MetaStore) Stats() (map[string]int64, error) {
+	stats := make(map[string]int64)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				stats[string(k)] = int64(binary.BigEndian.Uint64(v))
+			}
 			return nil
 		})
-		return nil
 	})
 
-	return users, err
+	return stats, err
 }
 
-// Objects returns all MetaObjects in the meta store
-func (s *MetaStore) Objects() ([]*MetaObject, error) {
-	var objects []*MetaObject
+// AddStats adds deltas to the lifetime counters, all in one transaction.
+func (s *MetaStore) AddStats(deltas map[string]int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		for name, delta := range deltas {
+			var value [8]byte
+			if v := bucket.Get([]byte(name)); len(v) == 8 {
+				copy(value[:], v)
+			}
+			binary.BigEndian.PutUint64(value[:], uint64(int64(binary.BigEndian.Uint64(value[:]))+delta))
+			if err := bucket.Put([]byte(name), value[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Downloads returns the download count of oid recorded by AddDownloads.
+func (s *MetaStore) Downloads(oid string) (*DownloadCount, error) {
+	count := &DownloadCount{Oid: oid}
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
+		bucket := tx.Bucket(downloadsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
+		if v := bucket.Get([]byte(oid)); v != nil {
+			return json.Unmarshal(v, count)
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+// AllDownloads returns the download counts of the objects that are stored
+// and not deleted, by oid.
+func (s *MetaStore) AllDownloads() (map[string]*DownloadCount, error) {
+	counts := make(map[string]*DownloadCount)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		objects := tx.Bucket(objectsBucket)
+		if bucket == nil || objects == nil {
+			return errNoBucket
+		}
 
-		bucket.ForEach(func(k, v []byte) error {
+		return bucket.ForEach(func(k, v []byte) error {
+			value := objects.Get(k)
+			if value == nil {
+				return nil
+			}
 			var meta MetaObject
-			dec := gob.NewDecoder(bytes.NewBuffer(v))
-			err := dec.Decode(&meta)
-			if err != nil {
+			if _, err := decodeMeta(value, &meta); err != nil || meta.DeletedAt != nil {
+				return nil
+			}
+
+			count := &DownloadCount{}
+			if err := json.Unmarshal(v, count); err != nil {
 				return err
 			}
-			objects = append(objects, &meta)
+			counts[count.Oid] = count
 			return nil
 		})
-		return nil
 	})
 
-	return objects, err
+	return counts, err
+}
+
+// AddDownloads adds the pending downloads to the counts of their objects, all
+// in one transaction. Per-day counts are kept if days is above 0, those of
+// days before first being dropped. Downloads of objects deleted meanwhile
+// are dropped too.
+func (s *MetaStore) AddDownloads(pending map[downloadKey]int64, days int, first string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(downloadsBucket)
+		objects := tx.Bucket(objectsBucket)
+		if bucket == nil || objects == nil {
+			return errNoBucket
+		}
+
+		counts := make(map[string]*DownloadCount)
+		for key, n := range pending {
+			if objects.Get([]byte(key.oid)) == nil {
+				continue
+			}
+			count, ok := counts[key.oid]
+			if !ok {
+				count = &DownloadCount{Oid: key.oid}
+				if v := bucket.Get([]byte(key.oid)); v != nil {
+					if err := json.Unmarshal(v, count); err != nil {
+						return err
+					}
+				}
+				counts[key.oid] = count
+			}
+			count.add(key.day, n, days)
+		}
+
+		for oid, count := range counts {
+			count.prune(first)
+			value, err := json.Marshal(count)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(oid), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // AllLocks return all locks in the store, lock path is prepended with repo
@@ -418,6 +1869,136 @@ func (s *MetaStore) AllLocks() ([]Lock, error) {
 	return locks, err
 }
 
+// AuditEntry records one administrative action.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target,omitempty"`
+	Outcome string    `json:"outcome"`
+}
+
+// AddAudit appends e to the audit log. Entries are never modified or removed.
+func (s *MetaStore) AddAudit(e *AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		return bucket.Put(key[:], data)
+	})
+}
+
+// Audit returns the audit entries recorded between since and until, oldest
+// first. A zero time leaves that end of the range open.
+func (s *MetaStore) Audit(since, until time.Time) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !since.IsZero() && e.Time.Before(since) {
+				return nil
+			}
+			if !until.IsZero() && e.Time.After(until) {
+				return nil
+			}
+			entries = append(entries, &e)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// AddDurabilityEvent records e as waiting to be delivered, until it's
+// removed with DeleteDurabilityEvent.
+func (s *MetaStore) AddDurabilityEvent(e *DurabilityEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(durabilityBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		if err := bucket.Put(key[:], data); err != nil {
+			return err
+		}
+		e.seq = seq
+		return nil
+	})
+}
+
+// DurabilityEvents returns the durability events waiting to be delivered,
+// oldest first.
+func (s *MetaStore) DurabilityEvents() ([]*DurabilityEvent, error) {
+	var events []*DurabilityEvent
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(durabilityBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			e := &DurabilityEvent{seq: binary.BigEndian.Uint64(k)}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+	})
+
+	return events, err
+}
+
+// DeleteDurabilityEvent removes e once it's delivered or given up on.
+func (s *MetaStore) DeleteDurabilityEvent(e *DurabilityEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(durabilityBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], e.seq)
+		return bucket.Delete(key[:])
+	})
+}
+
 // Authenticate authorizes user with password and returns the user name
 func (s *MetaStore) Authenticate(user, password string) (string, bool) {
 	// check admin
@@ -427,7 +2008,8 @@ func (s *MetaStore) Authenticate(user, password string) (string, bool) {
 		}
 	}
 
-	value := ""
+	var value []byte
+	var token *tokenRecord
 
 	s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
@@ -435,9 +2017,24 @@ func (s *MetaStore) Authenticate(user, password string) (string, bool) {
 			return errNoBucket
 		}
 
-		value = string(bucket.Get([]byte(user)))
+		if v := bucket.Get([]byte(user)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+
+		if t := tx.Bucket(tokensBucket).Get(tokenKey(password)); t != nil {
+			token = &tokenRecord{}
+			json.Unmarshal(t, token)
+		}
 		return nil
 	})
 
-	return user, value != "" && value == password
+	if value == nil || password == "" {
+		return user, false
+	}
+
+	if token != nil && token.User == user {
+		return user, true
+	}
+
+	return user, decodeUserRecord(value).matches(value, password)
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var (
@@ -65,6 +72,307 @@ func TestPutMeta(t *testing.T) {
 	}
 }
 
+func TestUpdateMeta(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("Error retreiving meta: %s", err)
+	}
+
+	meta.Encoding = encodingIdentity
+	if err := metaStoreTest.Update(meta); err != nil {
+		t.Fatalf("expected update to succeed, got: %s", err)
+	}
+
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("Error retreiving meta: %s", err)
+	}
+
+	if meta.Encoding != encodingIdentity {
+		t.Errorf("expected encoding to be updated, got: %s", meta.Encoding)
+	}
+
+	if meta.Size != contentSize {
+		t.Errorf("expected size to be preserved, got: %d", meta.Size)
+	}
+}
+
+func TestUpdateMetaOfDeletedObject(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.Update(&MetaObject{Oid: nonExistingOid, Size: 42}); err != errObjectNotFound {
+		t.Fatalf("expected errObjectNotFound, got: %v", err)
+	}
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid}); err != errObjectNotFound {
+		t.Fatalf("expected the update not to recreate the object, got: %v", err)
+	}
+}
+
+func TestPutMetaTracksRepos(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, repo := range []string{"repo", "other", "repo"} {
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42, User: testUser, Repo: repo}); err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+	}
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	if len(meta.Repos) != 2 || meta.Repos[0] != "bilbo/repo" || meta.Repos[1] != "bilbo/other" {
+		t.Fatalf("expected each repo to be referenced once, got %v", meta.Repos)
+	}
+
+	// Updates don't drop references
+	if err := metaStoreTest.Update(&MetaObject{Oid: nonExistingOid, Size: 42, Encoding: encodingGzip}); err != nil {
+		t.Fatalf("expected update to succeed, got: %s", err)
+	}
+	meta, _ = metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if len(meta.Repos) != 2 {
+		t.Fatalf("expected update to keep references, got %v", meta.Repos)
+	}
+}
+
+func TestReleaseMeta(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42, User: testUser, Repo: "repo"})
+	metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42, User: testUser, Repo: "other"})
+
+	meta, deleted, err := metaStoreTest.Release(nonExistingOid, "bilbo/repo")
+	if err != nil || deleted {
+		t.Fatalf("expected object to be kept while referenced, got deleted=%v err=%v", deleted, err)
+	}
+	if len(meta.Repos) != 1 || meta.Repos[0] != "bilbo/other" {
+		t.Fatalf("expected one remaining reference, got %v", meta.Repos)
+	}
+
+	if _, deleted, _ := metaStoreTest.Release(nonExistingOid, ""); deleted {
+		t.Fatalf("expected release without a repo to keep referenced objects")
+	}
+
+	if _, deleted, err := metaStoreTest.Release(nonExistingOid, "bilbo/other"); err != nil || !deleted {
+		t.Fatalf("expected the last release to delete the object, got deleted=%v err=%v", deleted, err)
+	}
+
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid}); err != errObjectNotFound {
+		t.Fatalf("expected object to be gone, got: %v", err)
+	}
+}
+
+func TestAuthenticateHashedPassword(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, ok := metaStoreTest.Authenticate(testUser, testPass); !ok {
+		t.Errorf("expected user to authenticate")
+	}
+
+	if _, ok := metaStoreTest.Authenticate(testUser, testPass+"x"); ok {
+		t.Errorf("expected wrong password to be rejected")
+	}
+
+	metaStoreTest.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(usersBucket).Get([]byte(testUser)); bytes.Contains(v, []byte(testPass)) {
+			t.Errorf("expected password to be stored hashed, got %s", v)
+		}
+		return nil
+	})
+}
+
+func TestAddUserKeepsRole(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.UpdateUser(testUser, "", roleAdmin); err != nil {
+		t.Fatalf("expected update to succeed, got %s", err)
+	}
+	if err := metaStoreTest.AddUser(testUser, "newpassword"); err != nil {
+		t.Fatalf("expected add to succeed, got %s", err)
+	}
+
+	if _, ok := metaStoreTest.Authenticate(testUser, "newpassword"); !ok {
+		t.Errorf("expected the new password to be accepted")
+	}
+	user, err := metaStoreTest.User(testUser)
+	if err != nil || user.Role != roleAdmin {
+		t.Errorf("expected the user to stay an admin, got %v %v", user, err)
+	}
+}
+
+func TestAuthenticateLegacyPassword(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	metaStoreTest.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte("legacy"), []byte("plaintext"))
+	})
+
+	if _, ok := metaStoreTest.Authenticate("legacy", "plaintext"); !ok {
+		t.Errorf("expected legacy plain text password to authenticate")
+	}
+
+	user, err := metaStoreTest.User("legacy")
+	if err != nil || user.Role != roleUser {
+		t.Errorf("expected legacy user to have the user role, got %v %v", user, err)
+	}
+
+	if err := metaStoreTest.UpdateUser("legacy", "", roleAdmin); err != nil {
+		t.Fatalf("expected update to succeed, got %s", err)
+	}
+
+	if _, ok := metaStoreTest.Authenticate("legacy", "plaintext"); !ok {
+		t.Errorf("expected password to survive a role change")
+	}
+}
+
+func TestLegacyMetaRecord(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// Objects were stored as gob before schema versions, with fewer fields
+	legacy := struct {
+		Oid      string
+		Size     int64
+		Encoding string
+		Repos    []string
+	}{nonExistingOid, 42, encodingGzip, []string{"user/repo"}}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatalf("expected to encode the legacy record, got: %s", err)
+	}
+	metaStoreTest.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).Put([]byte(nonExistingOid), buf.Bytes())
+	})
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if err != nil {
+		t.Fatalf("expected the legacy record to be read, got: %s", err)
+	}
+	if meta.Size != 42 || meta.Encoding != encodingGzip || len(meta.Repos) != 1 {
+		t.Errorf("expected the legacy fields to be kept, got %+v", meta)
+	}
+	if meta.hashAlgo() != hashSHA256 || meta.Pinned || meta.Tags != nil || meta.DeletedAt != nil {
+		t.Errorf("expected the newer fields to have their defaults, got %+v", meta)
+	}
+
+	// Reading it wrote it again in the current version
+	metaStoreTest.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(objectsBucket).Get([]byte(nonExistingOid)); value[0] != metaSchemaMarker|metaSchemaVersion {
+			t.Errorf("expected the record to be upgraded, got version byte %x", value[0])
+		}
+		return nil
+	})
+	if upgraded, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid}); err != nil || upgraded.Size != 42 || upgraded.Repos[0] != "user/repo" {
+		t.Errorf("expected the upgraded record to hold the same object, got %+v: %v", upgraded, err)
+	}
+}
+
+func TestMetaRecordRoundTrip(t *testing.T) {
+	now := time.Now().UTC()
+	meta := &MetaObject{
+		Oid:        nonExistingOid,
+		Size:       42,
+		Encoding:   encodingZstd,
+		HashAlgo:   hashSHA512,
+		KeyID:      "key-1",
+		Repos:      []string{"user/repo", "user/other"},
+		VerifiedAt: &now,
+		ExpiresAt:  &now,
+		DeletedAt:  &now,
+		Tags:       map[string]string{"build": "1234"},
+		Pinned:     true,
+	}
+
+	value, err := encodeMeta(meta)
+	if err != nil {
+		t.Fatalf("expected encoding to succeed, got: %s", err)
+	}
+	var decoded MetaObject
+	stale, err := decodeMeta(value, &decoded)
+	if err != nil || stale {
+		t.Fatalf("expected a current record to decode, got stale %v: %v", stale, err)
+	}
+	if !reflect.DeepEqual(meta, &decoded) {
+		t.Errorf("expected the round trip to keep every field, got %+v", decoded)
+	}
+
+	// What only lives in memory is never stored
+	meta.Existing, meta.hint, meta.requested = true, "build.zip", encodingIdentity
+	meta.downloads = &DownloadCount{Total: 3}
+	if value, err = encodeMeta(meta); err != nil {
+		t.Fatalf("expected encoding to succeed, got: %s", err)
+	}
+	decoded = MetaObject{}
+	if _, err := decodeMeta(value, &decoded); err != nil || decoded.Existing || decoded.hint != "" || decoded.requested != "" || decoded.downloads != nil {
+		t.Errorf("expected in-memory fields not to be stored, got %+v: %v", decoded, err)
+	}
+
+	if _, err := decodeMeta([]byte{metaSchemaMarker | 0x70, '{', '}'}, &decoded); err == nil {
+		t.Errorf("expected a record of an unknown version to be refused")
+	}
+}
+
+func TestMoveRepoMovesLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for i := 0; i < 2; i++ {
+		if err := metaStoreTest.AddLocks("old", NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), "user")); err != nil {
+			t.Fatalf("expected AddLocks to succeed, got: %s", err)
+		}
+	}
+	if err := metaStoreTest.AddLocks("new", NewTestLock(randomLockId(), "other-path", "user")); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got: %s", err)
+	}
+
+	move, err := metaStoreTest.MoveRepo("user/old", "user/new")
+	if err != nil || move.Locks != 2 {
+		t.Fatalf("expected two locks to be moved, got %+v: %v", move, err)
+	}
+	if locks, _ := metaStoreTest.Locks("old"); len(locks) != 0 {
+		t.Fatalf("expected the old repo to keep no locks, got %d", len(locks))
+	}
+	if locks, _ := metaStoreTest.Locks("new"); len(locks) != 3 {
+		t.Fatalf("expected the new repo to have every lock, got %d", len(locks))
+	}
+
+	// Two locks of one path can't be merged, so nothing moves
+	if err := metaStoreTest.AddLocks("third", NewTestLock(randomLockId(), "path-0", "user")); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.MoveRepo("user/third", "user/new"); err != errLocksConflict {
+		t.Fatalf("expected errLocksConflict, got: %v", err)
+	}
+	if locks, _ := metaStoreTest.Locks("third"); len(locks) != 1 {
+		t.Fatalf("expected the conflicting lock to stay, got %d", len(locks))
+	}
+
+	// Locks are kept by repo name, so another namespace's repo of that name
+	// would see them move too
+	if _, err := metaStoreTest.MoveRepo("user/third", "team/third"); err != errMoveNamespace {
+		t.Fatalf("expected errMoveNamespace, got: %v", err)
+	}
+	oid := hex.EncodeToString(sha256Sum("object of another namespace"))
+	if _, err := metaStoreTest.Put(&RequestVars{User: "other", Repo: "third", Oid: oid, Size: 27}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.MoveRepo("user/third", "user/fourth"); err != errLocksShared {
+		t.Fatalf("expected errLocksShared, got: %v", err)
+	}
+	if locks, _ := metaStoreTest.Locks("third"); len(locks) != 1 {
+		t.Fatalf("expected the shared lock to stay, got %d", len(locks))
+	}
+}
+
 func TestLocks(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
@@ -226,6 +534,84 @@ func NewTestLock(id, path, user string) Lock {
 	}
 }
 
+func TestStoredUsageKeptUpToDate(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// Objects take room once their content is stored
+	stored := func(rv *RequestVars) {
+		t.Helper()
+		meta, err := metaStoreTest.Put(rv)
+		if err != nil {
+			t.Fatalf("expected put to succeed, got: %s", err)
+		}
+		meta.uploaded()
+		if err := metaStoreTest.Update(meta); err != nil {
+			t.Fatalf("expected update to succeed, got: %s", err)
+		}
+	}
+
+	a, b := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	for _, rv := range []*RequestVars{
+		{Oid: contentOid, Size: contentSize},
+		{User: "alice", Repo: "one", Oid: a, Size: 10},
+		{User: "alice", Repo: "two", Oid: a, Size: 10},
+		{User: "bob", Repo: "one", Oid: a, Size: 10},
+	} {
+		stored(rv)
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{User: "alice", Repo: "one", Oid: b, Size: 5}); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	expect := func(what string, total, alice, bob int64) {
+		t.Helper()
+		if used, inAlice, err := metaStoreTest.StoredUsage("alice", nil); err != nil || used != total || inAlice != alice {
+			t.Fatalf("%s: expected %d bytes, %d of alice, got %d and %d: %v", what, total, alice, used, inAlice, err)
+		}
+		if _, inBob, _ := metaStoreTest.StoredUsage("bob", nil); inBob != bob {
+			t.Fatalf("%s: expected %d bytes of bob, got %d", what, bob, inBob)
+		}
+	}
+	expect("pending", contentSize+10, 10, 10)
+	stored(&RequestVars{User: "alice", Repo: "one", Oid: b, Size: 5})
+	expect("stored", contentSize+15, 15, 10)
+	if used, inAlice, _ := metaStoreTest.StoredUsage("alice", map[string]bool{a: true}); used != contentSize+5 || inAlice != 5 {
+		t.Fatalf("expected a skipped object not to count, got %d and %d", used, inAlice)
+	}
+
+	// alice still references a through her other repo
+	if _, _, err := metaStoreTest.Release(a, "alice/one"); err != nil {
+		t.Fatalf("expected release to succeed, got: %s", err)
+	}
+	expect("released", contentSize+15, 15, 10)
+	if _, _, err := metaStoreTest.Release(a, "alice/two"); err != nil {
+		t.Fatalf("expected release to succeed, got: %s", err)
+	}
+	expect("released by alice", contentSize+15, 5, 10)
+
+	metaStoreTest.SoftDelete = true
+	if _, deleted, err := metaStoreTest.Release(a, "bob/one"); err != nil || !deleted {
+		t.Fatalf("expected the object to be deleted, got: %v", err)
+	}
+	expect("soft deleted", contentSize+5, 5, 0)
+	if err := metaStoreTest.Delete(&RequestVars{Oid: b}); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	expect("deleted", contentSize, 0, 0)
+
+	// A store from before usage was kept gets it counted on opening
+	stored(&RequestVars{User: "bob", Repo: "one", Oid: b, Size: 5})
+	metaStoreTest.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(usageBucket) })
+	metaStoreTest.Close()
+	store, err := NewMetaStore("test-meta-store.db")
+	if err != nil {
+		t.Fatalf("expected the store to open, got: %s", err)
+	}
+	metaStoreTest = store
+	expect("counted", contentSize+5, 0, 5)
+}
+
 func setupMeta() {
 	store, err := NewMetaStore("test-meta-store.db")
 	if err != nil {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metrics is a minimal registry of named integer values. Values are exposed in
+// the Prometheus text format so they can be scraped by standard tooling.
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+var (
+	metrics = NewMetrics()
+)
+
+// NewMetrics creates an empty Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{values: make(map[string]int64)}
+}
+
+// Add increments the named value by delta.
+func (m *Metrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.values[name] += delta
+	m.mu.Unlock()
+}
+
+// Set replaces the named value.
+func (m *Metrics) Set(name string, value int64) {
+	m.mu.Lock()
+	m.values[name] = value
+	m.mu.Unlock()
+}
+
+// Get returns the current value for name, or 0 if it was never recorded.
+func (m *Metrics) Get(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[name]
+}
+
+// Snapshot returns a copy of all current values.
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(m.values))
+	for name, value := range m.values {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// WriteTo writes all values to w, sorted by name.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	snapshot := m.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var written int64
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "%s %d\n", name, snapshot[name])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// MetricsHandler serves the current metric values.
+func (a *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(w)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/GeertJohan/go.rice"
+	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 )
 
@@ -25,17 +26,43 @@ type pageData struct {
 }
 
 func (a *App) addMgmt(r *mux.Router) {
-	r.HandleFunc("/mgmt", basicAuth(a.indexHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/objects", basicAuth(a.objectsHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/raw/{oid}", basicAuth(a.objectsRawHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/locks", basicAuth(a.locksHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/users", basicAuth(a.usersHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/add", basicAuth(a.addUserHandler)).Methods("POST")
-	r.HandleFunc("/mgmt/del", basicAuth(a.delUserHandler)).Methods("POST")
+	r.HandleFunc("/mgmt", a.mgmtAuth(a.indexHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/objects", a.mgmtAuth(a.objectsHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/raw/{oid}", a.mgmtAuth(a.objectsRawHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/locks", a.mgmtAuth(a.locksHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/users", a.mgmtAuth(a.usersHandler)).Methods("GET")
+	r.HandleFunc("/mgmt/add", a.audited("user.create", a.mgmtAuth(a.addUserHandler))).Methods("POST")
+	r.HandleFunc("/mgmt/del", a.audited("user.delete", a.mgmtAuth(a.delUserHandler))).Methods("POST")
 
 	cssBox = rice.MustFindBox("mgmt/css")
 	templateBox = rice.MustFindBox("mgmt/templates")
-	r.HandleFunc("/mgmt/css/{file}", basicAuth(cssHandler))
+	r.HandleFunc("/mgmt/css/{file}", a.mgmtAuth(cssHandler))
+}
+
+// mgmtAuth wraps h so that it only runs for requests authorized for
+// administration, like the admin API. The interface is disabled unless an
+// admin user or OIDC login is configured, and with OIDC login set up browsers
+// without credentials are sent to log in.
+func (a *App) mgmtAuth(h http.HandlerFunc) http.HandlerFunc {
+	authorized := a.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r)
+		logRequest(r, 200)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.oidc == nil && (Config.AdminUser == "" || Config.AdminPass == "") {
+			writeStatus(w, r, 404)
+			return
+		}
+		if a.oidc != nil {
+			_, session := a.oidc.validSession(r)
+			if _, _, ok := r.BasicAuth(); !ok && !session {
+				http.Redirect(w, r, "/admin/login", http.StatusFound)
+				logRequest(r, http.StatusFound)
+				return
+			}
+		}
+		authorized(w, r)
+	}
 }
 
 func cssHandler(w http.ResponseWriter, r *http.Request) {
@@ -63,27 +90,6 @@ func checkBasicAuth(user string, pass string, ok bool) bool {
 	return true
 }
 
-func basicAuth(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if Config.AdminUser == "" || Config.AdminPass == "" {
-			writeStatus(w, r, 404)
-			return
-		}
-
-		user, pass, ok := r.BasicAuth()
-
-		ret := checkBasicAuth(user, pass, ok)
-		if !ret {
-			w.Header().Set("WWW-Authenticate", "Basic realm=mgmt")
-			writeStatus(w, r, 401)
-			return
-		}
-
-		h(w, r)
-		logRequest(r, 200)
-	}
-}
-
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 	if err := render(w, "config.tmpl", pageData{Name: "index", Config: Config}); err != nil {
 		writeStatus(w, r, 404)
@@ -97,6 +103,14 @@ func (a *App) objectsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	listed := objects[:0]
+	for _, o := range objects {
+		if o.DeletedAt == nil {
+			listed = append(listed, o)
+		}
+	}
+	objects = listed
+
 	if err := render(w, "objects.tmpl", pageData{Name: "objects", Objects: objects}); err != nil {
 		writeStatus(w, r, 404)
 	}
@@ -112,7 +126,7 @@ func (a *App) objectsRawHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := a.contentStore.Get(meta, 0)
+	content, err := a.getContent(meta, 0)
 	if err != nil {
 		writeStatus(w, r, 404)
 		return
@@ -153,12 +167,21 @@ func (a *App) usersHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) addUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.FormValue("name")
 	pass := r.FormValue("password")
+	context.Set(r, "AUDIT_TARGET", user)
 	if user == "" || pass == "" {
+		context.Set(r, "AUDIT_OUTCOME", auditFailed)
 		fmt.Fprint(w, "Invalid username or password")
 		return
 	}
 
+	if err := validatePassword(pass); err != nil {
+		context.Set(r, "AUDIT_OUTCOME", auditFailed)
+		fmt.Fprint(w, err)
+		return
+	}
+
 	if err := a.metaStore.AddUser(user, pass); err != nil {
+		context.Set(r, "AUDIT_OUTCOME", auditFailed)
 		fmt.Fprintf(w, "Error adding user: %s", err)
 		return
 	}
@@ -168,12 +191,15 @@ func (a *App) addUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func (a *App) delUserHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.FormValue("name")
+	context.Set(r, "AUDIT_TARGET", user)
 	if user == "" {
+		context.Set(r, "AUDIT_OUTCOME", auditFailed)
 		fmt.Fprint(w, "Invalid username")
 		return
 	}
 
 	if err := a.metaStore.DeleteUser(user); err != nil {
+		context.Set(r, "AUDIT_OUTCOME", auditFailed)
 		fmt.Fprintf(w, "Error deleting user: %s", err)
 		return
 	}
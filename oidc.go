@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "lfs_admin_session"
+	stateCookie   = "lfs_oidc_state"
+	nonceCookie   = "lfs_oidc_nonce"
+)
+
+// sessionPaths are the paths the session cookie is sent to, so it never goes
+// along with requests of the LFS API.
+var sessionPaths = []string{"/admin", "/mgmt"}
+
+var errNotAdmin = errors.New("Not an administrator")
+
+// OIDCProvider logs administrators in through an OpenID Connect provider
+// with the authorization code flow. The ID token has to be signed by the
+// provider and carry the nonce of the login. Whoever the provider's userinfo
+// says has AdminValue in the AdminClaim claim gets an admin session, kept in
+// a signed cookie.
+type OIDCProvider struct {
+	// Issuer is the URL of the provider, where its configuration is found
+	// under /.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, the
+	// /admin/login/callback route of this server.
+	RedirectURL string
+	Scopes      []string
+
+	// AdminClaim names the userinfo claim, either a string or a list of
+	// them, that has to hold AdminValue for admin access.
+	AdminClaim string
+	AdminValue string
+
+	// SessionLifetime is how long a login lasts.
+	SessionLifetime time.Duration
+
+	Client *http.Client
+
+	// key signs sessions. It's made up on start, so a restart ends every
+	// session.
+	key []byte
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+	jwks      map[string]crypto.PublicKey
+}
+
+type oidcEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	Userinfo      string `json:"userinfo_endpoint"`
+	JWKS          string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider creates an OIDCProvider for the client of the issuer.
+func NewOIDCProvider(issuer, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &OIDCProvider{
+		Issuer:          strings.TrimRight(issuer, "/"),
+		ClientID:        clientID,
+		ClientSecret:    clientSecret,
+		RedirectURL:     redirectURL,
+		Scopes:          []string{"openid"},
+		AdminClaim:      "groups",
+		SessionLifetime: 8 * time.Hour,
+		Client:          &http.Client{Timeout: 30 * time.Second},
+		key:             key,
+	}, nil
+}
+
+// discover returns the endpoints of the provider, fetching them on first use.
+func (p *OIDCProvider) discover() (*oidcEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	res, err := p.Client.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("OIDC discovery failed with status %d", res.StatusCode)
+	}
+
+	var e oidcEndpoints
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		return nil, fmt.Errorf("Invalid OIDC configuration: %s", err)
+	}
+	if e.Authorization == "" || e.Token == "" || e.Userinfo == "" || e.JWKS == "" {
+		return nil, errors.New("OIDC configuration lacks an endpoint")
+	}
+	p.endpoints = &e
+	return p.endpoints, nil
+}
+
+// loginURL returns where to send a user to log in with state and nonce.
+func (p *OIDCProvider) loginURL(state, nonce string) (string, error) {
+	e, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.RedirectURL},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(e.Authorization, "?") {
+		sep = "&"
+	}
+	return e.Authorization + sep + q.Encode(), nil
+}
+
+// exchange redeems an authorization code of the login with nonce and returns
+// the name of the user it was issued to, or errNotAdmin if the user isn't an
+// administrator.
+func (p *OIDCProvider) exchange(code, nonce string) (string, error) {
+	e, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.RedirectURL},
+	}
+	req, err := http.NewRequest("POST", e.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("OIDC token request failed with status %d", res.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil || token.AccessToken == "" || token.IDToken == "" {
+		return "", errors.New("Invalid OIDC token response")
+	}
+	id, err := p.verifyIDToken(token.IDToken, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequest("GET", e.Userinfo, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err = p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("OIDC userinfo request failed with status %d", res.StatusCode)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&claims); err != nil {
+		return "", errors.New("Invalid OIDC userinfo response")
+	}
+	// The userinfo has to be of the user the ID token was issued to
+	if sub, _ := claims["sub"].(string); sub != id.Subject {
+		return "", errors.New("OIDC userinfo is of another user")
+	}
+
+	name := ""
+	for _, c := range []string{"preferred_username", "email", "sub"} {
+		if v, ok := claims[c].(string); ok && v != "" {
+			name = v
+			break
+		}
+	}
+	if name == "" {
+		return "", errors.New("OIDC userinfo names no user")
+	}
+	if !p.isAdmin(claims) {
+		return name, errNotAdmin
+	}
+	return name, nil
+}
+
+// isAdmin returns true if the AdminClaim of claims holds AdminValue.
+func (p *OIDCProvider) isAdmin(claims map[string]interface{}) bool {
+	if p.AdminValue == "" {
+		return false
+	}
+
+	switch v := claims[p.AdminClaim].(type) {
+	case string:
+		return v == p.AdminValue
+	case []interface{}:
+		for _, s := range v {
+			if s == p.AdminValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// session returns the signed session cookie value for name.
+func (p *OIDCProvider) session(name string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + p.sign(payload)
+}
+
+// validSession returns the name of the admin whose unexpired session r
+// carries.
+func (p *OIDCProvider) validSession(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(c.Value[i+1:]), []byte(p.sign(c.Value[:i]))) {
+		return "", false
+	}
+
+	parts := strings.SplitN(c.Value[:i], ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+func (p *OIDCProvider) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionAuthenticator authenticates admin sessions of an OIDCProvider, and
+// leaves requests without one to next.
+type sessionAuthenticator struct {
+	oidc *OIDCProvider
+	next Authenticator
+}
+
+func (s *sessionAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if name, ok := s.oidc.validSession(r); ok {
+		return Identity{Name: name, Role: roleAdmin}, nil
+	}
+	return s.next.Authenticate(r)
+}
+
+// enableOIDC has admins log in through p, in addition to the other ways.
+func (a *App) enableOIDC(p *OIDCProvider) {
+	a.oidc = p
+	a.authenticator = &sessionAuthenticator{oidc: p, next: a.authenticator}
+}
+
+// adminLoginHandler sends the user to log in at the OIDC provider.
+func (a *App) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		writeAdminError(w, r, 404, "OIDC login isn't configured")
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	state, nonce := hex.EncodeToString(b[:16]), hex.EncodeToString(b[16:])
+
+	to, err := a.oidc.loginURL(state, nonce)
+	if err != nil {
+		logger.Log(kv{"fn": "adminLoginHandler", "err": err.Error()})
+		writeAdminError(w, r, 502, "Could not reach the OIDC provider")
+		return
+	}
+
+	for name, value := range map[string]string{stateCookie: state, nonceCookie: nonce} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/admin/login",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   Config.IsHTTPS(),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, to, http.StatusFound)
+	logRequest(r, http.StatusFound)
+}
+
+// adminLoginCallbackHandler is where the OIDC provider sends the user back to.
+// Administrators get a session and go on to the management UI.
+func (a *App) adminLoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		writeAdminError(w, r, 404, "OIDC login isn't configured")
+		return
+	}
+
+	// The state ties the callback to a login started in this browser
+	state, err := r.Cookie(stateCookie)
+	if err != nil || state.Value == "" || !hmac.Equal([]byte(state.Value), []byte(r.FormValue("state"))) {
+		writeAdminError(w, r, 400, "Invalid login state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/admin/login", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: nonceCookie, Path: "/admin/login", MaxAge: -1})
+
+	if e := r.FormValue("error"); e != "" {
+		writeAdminError(w, r, 401, "Login failed: "+e)
+		return
+	}
+
+	// The nonce ties the ID token to that login too
+	var nonce string
+	if c, err := r.Cookie(nonceCookie); err == nil {
+		nonce = c.Value
+	}
+	name, err := a.oidc.exchange(r.FormValue("code"), nonce)
+	if err == errNotAdmin {
+		logger.Log(kv{"fn": "adminLoginCallbackHandler", "user": name, "err": err.Error()})
+		writeAdminError(w, r, 403, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Log(kv{"fn": "adminLoginCallbackHandler", "err": err.Error()})
+		writeAdminError(w, r, 502, "Could not log in with the OIDC provider")
+		return
+	}
+
+	expires := time.Now().Add(a.oidc.SessionLifetime)
+	session := a.oidc.session(name, expires)
+	for _, path := range sessionPaths {
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     path,
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   Config.IsHTTPS(),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	logger.Log(kv{"fn": "adminLoginCallbackHandler", "user": name, "msg": "admin logged in"})
+	http.Redirect(w, r, "/mgmt", http.StatusFound)
+	logRequest(r, http.StatusFound)
+}
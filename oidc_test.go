@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOIDCAdminLogin(t *testing.T) {
+	provider := newStubOIDCProvider()
+	defer provider.Close()
+	server := newOIDCServer(provider.URL)
+	defer server.Close()
+
+	res, state := oidcLogin(t, server, "admin-code")
+	if res.StatusCode != 302 || res.Header.Get("Location") != "/mgmt" {
+		t.Fatalf("expected to be sent on to /mgmt, got %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	session := responseCookie(res, sessionCookie)
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("expected an HTTP only session cookie, got %+v", session)
+	}
+	var paths []string
+	for _, c := range res.Cookies() {
+		if c.Name == sessionCookie {
+			paths = append(paths, c.Path)
+		}
+	}
+	if strings.Join(paths, " ") != "/admin /mgmt" {
+		t.Fatalf("expected the session cookie to be limited to /admin and /mgmt, got %v", paths)
+	}
+	if state.Path != "/admin/login" {
+		t.Fatalf("expected the state cookie to be limited to the login, got %q", state.Path)
+	}
+
+	for _, path := range []string{"/admin/users", "/mgmt/users"} {
+		if status := oidcGet(t, server, path, session); status != 200 {
+			t.Fatalf("expected status 200 for %s with the session, got %d", path, status)
+		}
+	}
+}
+
+func TestOIDCNonAdminRejected(t *testing.T) {
+	provider := newStubOIDCProvider()
+	defer provider.Close()
+	server := newOIDCServer(provider.URL)
+	defer server.Close()
+
+	res, _ := oidcLogin(t, server, "user-code")
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403 for a user who isn't an admin, got %d", res.StatusCode)
+	}
+	if responseCookie(res, sessionCookie) != nil {
+		t.Fatalf("expected no session for a user who isn't an admin")
+	}
+
+	if status := oidcGet(t, server, "/admin/users", nil); status != 401 {
+		t.Fatalf("expected status 401 without a session, got %d", status)
+	}
+	forged := &http.Cookie{Name: sessionCookie, Value: "Z2FuZGFsZg.9999999999.00"}
+	if status := oidcGet(t, server, "/admin/users", forged); status != 401 {
+		t.Fatalf("expected status 401 for a forged session, got %d", status)
+	}
+	if status := oidcGet(t, server, "/mgmt/users", nil); status != 302 {
+		t.Fatalf("expected the management UI to send users to log in, got %d", status)
+	}
+}
+
+func TestOIDCLoginState(t *testing.T) {
+	provider := newStubOIDCProvider()
+	defer provider.Close()
+	server := newOIDCServer(provider.URL)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/admin/login/callback?code=admin-code&state=guessed", nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: "other"})
+	res, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 || responseCookie(res, sessionCookie) != nil {
+		t.Fatalf("expected a callback of another login to get 400 without a session, got %d", res.StatusCode)
+	}
+}
+
+func TestOIDCVerifiesIDToken(t *testing.T) {
+	provider := newStubOIDCProvider()
+	defer provider.Close()
+	server := newOIDCServer(provider.URL)
+	defer server.Close()
+
+	res, _ := oidcLogin(t, server, "forged-code")
+	if res.StatusCode != 502 || responseCookie(res, sessionCookie) != nil {
+		t.Fatalf("expected an ID token signed with another key to be refused, got %d", res.StatusCode)
+	}
+
+	oidc := &OIDCProvider{Issuer: provider.URL, ClientID: "lfs", Client: http.DefaultClient}
+	for name, claims := range map[string]map[string]interface{}{
+		"of another login": {"iss": provider.URL, "sub": "1", "aud": "lfs", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "other"},
+		"expired":          {"iss": provider.URL, "sub": "1", "aud": "lfs", "exp": time.Now().Add(-time.Hour).Unix(), "nonce": "n"},
+		"of an audience":   {"iss": provider.URL, "sub": "1", "aud": "other", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n"},
+		"of an issuer":     {"iss": "https://other.example", "sub": "1", "aud": "lfs", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n"},
+	} {
+		if _, err := oidc.verifyIDToken(provider.idToken(provider.key, claims), "n"); err == nil {
+			t.Fatalf("expected an ID token %s to be refused", name)
+		}
+	}
+	valid := provider.idToken(provider.key, map[string]interface{}{
+		"iss": provider.URL, "sub": "1", "aud": []string{"lfs"}, "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n",
+	})
+	if claims, err := oidc.verifyIDToken(valid, "n"); err != nil || claims.Subject != "1" {
+		t.Fatalf("expected a valid ID token to verify, got %+v: %v", claims, err)
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	res, err := noRedirects.Get(lfsServer.URL + "/admin/login")
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 without OIDC, got %d", res.StatusCode)
+	}
+}
+
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+// stubOIDCProvider is a provider where the code "admin-code" logs in
+// gandalf, an admin, and "user-code" logs in frodo, who isn't. The ID tokens
+// carry the nonce of the last login started at /authorize, and the code
+// "forged-code" gets gandalf one signed with another key.
+type stubOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	forger *rsa.PrivateKey
+
+	mu    sync.Mutex
+	nonce string
+}
+
+func newStubOIDCProvider() *stubOIDCProvider {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p := &stubOIDCProvider{key: key, forger: forger}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	// The user logs in as login_hint says, and the provider sends them back
+	// with that as the code
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.nonce = r.FormValue("nonce")
+		p.mu.Unlock()
+		back := url.Values{"code": {r.FormValue("login_hint")}, "state": {r.FormValue("state")}}
+		http.Redirect(w, r, r.FormValue("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokens := map[string]string{"admin-code": "admin-token", "user-code": "user-token", "forged-code": "admin-token"}
+		subjects := map[string]string{"admin-token": "1", "user-token": "2"}
+		// Client credentials are form encoded before going into basic auth
+		id, secret, _ := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		token, ok := tokens[r.FormValue("code")]
+		if id != "lfs" || secret != "client secret" || !ok || r.FormValue("grant_type") != "authorization_code" {
+			w.WriteHeader(400)
+			return
+		}
+
+		signer := key
+		if r.FormValue("code") == "forged-code" {
+			signer = forger
+		}
+		p.mu.Lock()
+		nonce := p.nonce
+		p.mu.Unlock()
+		idToken := p.idToken(signer, map[string]interface{}{
+			"iss":   p.URL,
+			"sub":   subjects[token],
+			"aud":   "lfs",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": nonce,
+		})
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token, "token_type": "Bearer", "id_token": idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		users := map[string]interface{}{
+			"Bearer admin-token": map[string]interface{}{"sub": "1", "preferred_username": "gandalf", "groups": []string{"wizards", "lfs-admins"}},
+			"Bearer user-token":  map[string]interface{}{"sub": "2", "preferred_username": "frodo", "groups": []string{"hobbits"}},
+		}
+		user, ok := users[r.Header.Get("Authorization")]
+		if !ok {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	})
+
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// idToken returns an RS256 ID token with claims signed by key.
+func (p *stubOIDCProvider) idToken(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCServer(issuer string) *httptest.Server {
+	app := NewApp(testContentStore, testMetaStore)
+	server := httptest.NewServer(app)
+
+	oidc, _ := NewOIDCProvider(issuer, "lfs", "client secret", server.URL+"/admin/login/callback")
+	oidc.AdminValue = "lfs-admins"
+	app.enableOIDC(oidc)
+	return server
+}
+
+// oidcLogin goes through the login at server, with the provider giving code,
+// and returns the response of the callback and the state cookie.
+func oidcLogin(t *testing.T, server *httptest.Server, code string) (*http.Response, *http.Cookie) {
+	res, err := noRedirects.Get(server.URL + "/admin/login")
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	to, err := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != 302 || err != nil || !strings.HasSuffix(to.Path, "/authorize") {
+		t.Fatalf("expected to be sent to the provider, got %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	q := to.Query()
+	if q.Get("client_id") != "lfs" || q.Get("redirect_uri") != server.URL+"/admin/login/callback" || q.Get("state") == "" || q.Get("nonce") == "" {
+		t.Fatalf("expected the client, redirect, state and nonce in the login, got %s", to.RawQuery)
+	}
+	state := responseCookie(res, stateCookie)
+	if state == nil || state.Value != q.Get("state") {
+		t.Fatalf("expected the state to be kept in a cookie, got %+v", state)
+	}
+	nonce := responseCookie(res, nonceCookie)
+	if nonce == nil || nonce.Value != q.Get("nonce") {
+		t.Fatalf("expected the nonce to be kept in a cookie, got %+v", nonce)
+	}
+
+	q.Set("login_hint", code)
+	to.RawQuery = q.Encode()
+	res, err = noRedirects.Get(to.String())
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	req, _ := http.NewRequest("GET", res.Header.Get("Location"), nil)
+	req.AddCookie(state)
+	req.AddCookie(nonce)
+	res, err = noRedirects.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	return res, state
+}
+
+func oidcGet(t *testing.T, server *httptest.Server, path string, session *http.Cookie) int {
+	req, _ := http.NewRequest("GET", server.URL+path, nil)
+	if session != nil {
+		req.AddCookie(session)
+	}
+	res, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func responseCookie(res *http.Response, name string) *http.Cookie {
+	for _, c := range res.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
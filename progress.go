@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// How often long transfers started by the server itself report progress.
+const (
+	progressBytes    = 64 << 20
+	progressInterval = 10 * time.Second
+)
+
+// progressReader calls fn with the number of bytes read so far once every
+// bytes have been read or interval has passed since the last call, whichever
+// comes first, and a last time at the end of r. The counts passed to fn only
+// grow, and the last one is the total read.
+type progressReader struct {
+	r        io.Reader
+	fn       func(n int64)
+	every    int64
+	interval time.Duration
+
+	n        int64
+	reported int64
+	last     time.Time
+	done     bool
+}
+
+// newProgressReader returns r reporting progress to fn, or r itself if fn is
+// nil so transfers nobody watches cost nothing.
+func newProgressReader(r io.Reader, every int64, interval time.Duration, fn func(n int64)) io.Reader {
+	if fn == nil {
+		return r
+	}
+	return &progressReader{r: r, fn: fn, every: every, interval: interval, last: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+
+	switch {
+	case err == io.EOF:
+		if !p.done {
+			p.done = true
+			p.report()
+		}
+	case p.n-p.reported >= p.every:
+		p.report()
+	case n > 0 && time.Since(p.last) >= p.interval:
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progressReader) report() {
+	p.reported = p.n
+	p.last = time.Now()
+	p.fn(p.n)
+}
+
+// logProgress returns a progress callback logging how much of an object fn
+// has read. Objects too small to report progress on before they're done
+// aren't logged.
+func logProgress(fn string) func(meta *MetaObject, n int64) {
+	return func(meta *MetaObject, n int64) {
+		if meta.Size >= progressBytes {
+			logger.Log(kv{"fn": fn, "oid": meta.Oid, "read": n, "size": meta.Size})
+		}
+	}
+}
+
+// objectProgress returns the callback reporting the progress of meta to fn,
+// or nil if fn is nil.
+func objectProgress(meta *MetaObject, fn func(meta *MetaObject, n int64)) func(n int64) {
+	if fn == nil {
+		return nil
+	}
+	return func(n int64) { fn(meta, n) }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	content := benchmarkContent()
+
+	var counts []int64
+	r := newProgressReader(bytes.NewReader(content), 100<<10, time.Hour, func(n int64) {
+		counts = append(counts, n)
+	})
+	if _, err := io.Copy(ioutil.Discard, iotest.HalfReader(r)); err != nil {
+		t.Fatalf("expected to read the content, got: %s", err)
+	}
+
+	if len(counts) < 10 || len(counts) > 11 {
+		t.Fatalf("expected a report for every 100KiB, got %d", len(counts))
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			t.Fatalf("expected growing counts, got %v", counts)
+		}
+	}
+	if last := counts[len(counts)-1]; last != int64(len(content)) {
+		t.Fatalf("expected the last report to be the size %d, got %d", len(content), last)
+	}
+}
+
+func TestProgressReaderInterval(t *testing.T) {
+	var counts []int64
+	r := newProgressReader(&slowReader{data: []byte("slowly"), delay: 20 * time.Millisecond}, 1<<20, 30*time.Millisecond, func(n int64) {
+		counts = append(counts, n)
+	})
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatalf("expected to read the content, got: %s", err)
+	}
+
+	if len(counts) < 2 || counts[len(counts)-1] != 6 {
+		t.Fatalf("expected reports over time ending at 6 bytes, got %v", counts)
+	}
+}
+
+func TestProgressReaderWithoutCallback(t *testing.T) {
+	br := bytes.NewReader(nil)
+	if r := newProgressReader(br, 1, time.Second, nil); r != io.Reader(br) {
+		t.Fatalf("expected the reader itself without a callback")
+	}
+}
+
+func TestScrubberProgress(t *testing.T) {
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	store := NewMemoryStore()
+	m := putScrubObject(t, meta, store, "watched object")
+
+	var last int64
+	s := NewScrubber(meta, store, 0)
+	s.Progress = func(meta *MetaObject, n int64) {
+		if meta.Oid != m.Oid || n < last {
+			t.Errorf("expected growing progress of %s, got %d of %s", m.Oid, n, meta.Oid)
+		}
+		last = n
+	}
+	scrubPass(t, s)
+
+	if last != m.Size {
+		t.Fatalf("expected progress to end at %d, got %d", m.Size, last)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// quotaReservation is the room an admitted upload takes until its content is
+// stored, in the total and in namespace. It's held by an upload in progress,
+// with a zero expires, and lapses at expires otherwise, so objects a batch
+// offered but never got uploaded stop taking room.
+type quotaReservation struct {
+	size      int64
+	namespace string
+	expires   time.Time
+}
+
+// reserveQuota returns the errors of the objects of an upload batch that
+// don't fit in the storage quota, or in the quota of the namespace, the user
+// part of the repo, they're uploaded to, and reserves room for the others
+// until expires, or until released with a zero expires. Objects are admitted
+// in the order requested, so the first objects of a batch that partly fits
+// still get upload actions. Objects stored already take no more room and are
+// never rejected. Objects larger than a quota are refused with 422, as they
+// never fit, and the others that don't fit with 507.
+func (a *App) reserveQuota(objects []*RequestVars, expires time.Time) (map[string]*ObjectError, error) {
+	if !quotaEnabled() || len(objects) == 0 {
+		return nil, nil
+	}
+
+	a.quotaMu.Lock()
+	defer a.quotaMu.Unlock()
+
+	if a.reserved == nil {
+		a.reserved = make(map[string]*quotaReservation)
+	}
+	rejected, admitted, err := a.quotaRejections(objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range admitted {
+		// An upload in progress keeps holding its room
+		if held := a.reserved[res.oid]; held != nil && held.expires.IsZero() && !expires.IsZero() {
+			continue
+		}
+		a.reserved[res.oid] = &quotaReservation{size: res.size, namespace: res.namespace, expires: expires}
+	}
+	return rejected, nil
+}
+
+// releaseQuota drops the reservation of oid, once its upload stored it and
+// the usage totals count it, or failed.
+func (a *App) releaseQuota(oid string) {
+	a.quotaMu.Lock()
+	delete(a.reserved, oid)
+	a.quotaMu.Unlock()
+}
+
+// admission is an upload quotaRejections admitted.
+type admission struct {
+	oid       string
+	size      int64
+	namespace string
+}
+
+// quotaRejections checks objects against the stored usage and the rooms
+// reserved for other objects, with quotaMu held. See reserveQuota.
+func (a *App) quotaRejections(objects []*RequestVars) (map[string]*ObjectError, []admission, error) {
+	quota, nsQuota := Config.StorageQuotaBytes(), Config.NamespaceQuotaBytes()
+	namespace := ""
+	if objects[0].Repo != "" {
+		namespace = objects[0].User
+	}
+	if namespace == "" {
+		nsQuota = 0
+	}
+
+	// The objects of the batch are counted here rather than by the store or
+	// their reservations, so those requested before count once
+	requested := make(map[string]bool)
+	for _, o := range objects {
+		requested[o.Oid] = true
+	}
+	used, nsUsed, err := a.metaStore.StoredUsage(namespace, requested)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	for oid, res := range a.reserved {
+		if !res.expires.IsZero() && now.After(res.expires) {
+			delete(a.reserved, oid)
+			continue
+		}
+		if requested[oid] {
+			continue
+		}
+		used += res.size
+		if namespace != "" && res.namespace == namespace {
+			nsUsed += res.size
+		}
+	}
+
+	var uploads []*RequestVars
+	seen := make(map[string]bool)
+	for _, o := range objects {
+		if seen[o.Oid] {
+			continue
+		}
+		seen[o.Oid] = true
+
+		meta, err := a.metaStore.Get(o)
+		if err != nil && err != errObjectNotFound {
+			return nil, nil, err
+		}
+		if err == nil && a.contentStore.Exists(meta) {
+			// What StoredUsage left out is added back as it counts
+			if !meta.Pending {
+				used += meta.Size
+				if meta.inNamespace(namespace) {
+					nsUsed += meta.Size
+				}
+			}
+			continue
+		}
+		uploads = append(uploads, o)
+	}
+
+	rejected := make(map[string]*ObjectError)
+	var admitted []admission
+	for _, o := range uploads {
+		size := o.Size
+		if size < 0 {
+			size = 0
+		}
+
+		switch {
+		case quota > 0 && size > quota:
+			rejected[o.Oid] = &ObjectError{Code: 422, Message: fmt.Sprintf("Object of %d bytes exceeds the storage quota of %d bytes", size, quota)}
+		case nsQuota > 0 && size > nsQuota:
+			rejected[o.Oid] = &ObjectError{Code: 422, Message: fmt.Sprintf("Object of %d bytes exceeds the quota of %d bytes of namespace %s", size, nsQuota, namespace)}
+		case quota > 0 && used+size > quota:
+			rejected[o.Oid] = &ObjectError{Code: 507, Message: fmt.Sprintf("Storage quota exceeded, %d of %d bytes are left", bytesLeft(quota, used), quota)}
+		case nsQuota > 0 && nsUsed+size > nsQuota:
+			rejected[o.Oid] = &ObjectError{Code: 507, Message: fmt.Sprintf("Quota of namespace %s exceeded, %d of %d bytes are left", namespace, bytesLeft(nsQuota, nsUsed), nsQuota)}
+		default:
+			used += size
+			nsUsed += size
+			admitted = append(admitted, admission{oid: o.Oid, size: size, namespace: namespace})
+			continue
+		}
+		metrics.Add("lfs_quota_rejections_total", 1)
+	}
+	return rejected, admitted, nil
+}
+
+// quotaEnabled returns true if a storage or namespace quota is configured.
+func quotaEnabled() bool {
+	return Config.StorageQuotaBytes() > 0 || Config.NamespaceQuotaBytes() > 0
+}
+
+// bytesLeft returns how many bytes of quota are left with used taken, which
+// is none once objects stored before the quota was lowered exceed it.
+func bytesLeft(quota, used int64) int64 {
+	if used > quota {
+		return 0
+	}
+	return quota - used
+}
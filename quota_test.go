@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchStorageQuota(t *testing.T) {
+	defer func(v string) { Config.StorageQuota = v }(Config.StorageQuota)
+	defer resetQuotaReservations()
+
+	used, _, err := testMetaStore.StoredUsage("", nil)
+	if err != nil {
+		t.Fatalf("expected the stored usage, got: %s", err)
+	}
+	Config.StorageQuota = strconv.FormatInt(used+10, 10)
+
+	fits, over, last := strings.Repeat("d", 64), strings.Repeat("e", 64), strings.Repeat("f", 64)
+	for _, oid := range []string{fits, over, last} {
+		defer removeMeta(oid)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":6},{"oid":"%s","size":6},{"oid":"%s","size":4}]}`,
+		contentOid, contentSize, fits, over, last))
+	batch := batchRequest(t, buf)
+
+	if len(batch.Objects) != 4 {
+		t.Fatalf("expected a result for every object, got %d", len(batch.Objects))
+	}
+	if obj := batch.Objects[0]; obj.Error != nil || obj.Actions["upload"] != nil {
+		t.Fatalf("expected the stored object to need no upload, got %+v", obj)
+	}
+	if obj := batch.Objects[1]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the object that fits, got %+v", obj)
+	}
+	if obj := batch.Objects[2]; obj.Error == nil || obj.Error.Code != 507 || obj.Actions["upload"] != nil {
+		t.Fatalf("expected the object over the quota to be refused with 507, got %+v", obj)
+	}
+	if obj := batch.Objects[3]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the object that fits what's left, got %+v", obj)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: over}); err != errObjectNotFound {
+		t.Fatalf("expected no meta for the refused object, got: %v", err)
+	}
+
+	// Asking again counts the objects waiting for their content once
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":6},{"oid":"%s","size":4}]}`, fits, last))
+	for i, obj := range batchRequest(t, buf).Objects {
+		if obj.Error != nil || obj.Actions["upload"] == nil {
+			t.Fatalf("expected an upload action for object %d asked for again, got %+v", i, obj)
+		}
+	}
+
+	// The pending objects take no room in the usage, only their reservations
+	// keep another batch from taking it
+	if now, _, err := testMetaStore.StoredUsage("", nil); err != nil || now != used {
+		t.Fatalf("expected pending objects not to count as stored, got %d over %d: %v", now, used, err)
+	}
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":4}]}`, over))
+	if obj := batchRequest(t, buf).Objects[0]; obj.Error == nil || obj.Error.Code != 507 {
+		t.Fatalf("expected the room reserved by the first batch to be taken, got %+v", obj)
+	}
+
+	// Reservations lapse once their uploads don't start in time
+	app := lfsServer.Config.Handler.(*App)
+	app.quotaMu.Lock()
+	for _, res := range app.reserved {
+		res.expires = time.Now().Add(-time.Second)
+	}
+	app.quotaMu.Unlock()
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":6}]}`, over))
+	if obj := batchRequest(t, buf).Objects[0]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action once the reservations lapsed, got %+v", obj)
+	}
+}
+
+func TestBatchNamespaceQuota(t *testing.T) {
+	defer func(v string) { Config.NamespaceQuota = v }(Config.NamespaceQuota)
+	defer resetQuotaReservations()
+	Config.NamespaceQuota = "10"
+
+	huge, fits, over := strings.Repeat("d", 64), strings.Repeat("e", 64), strings.Repeat("f", 64)
+	for _, oid := range []string{huge, fits, over} {
+		defer removeMeta(oid)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":11},{"oid":"%s","size":6},{"oid":"%s","size":6}]}`, huge, fits, over))
+	batch := namespaceBatch(t, "quota", buf)
+
+	if obj := batch.Objects[0]; obj.Error == nil || obj.Error.Code != 422 {
+		t.Fatalf("expected the object larger than the quota to be refused with 422, got %+v", obj)
+	}
+	if obj := batch.Objects[1]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the object that fits, got %+v", obj)
+	}
+	if obj := batch.Objects[2]; obj.Error == nil || obj.Error.Code != 507 {
+		t.Fatalf("expected the object over the quota to be refused with 507, got %+v", obj)
+	}
+
+	// Other namespaces have a quota of their own
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":6}]}`, over))
+	if obj := namespaceBatch(t, "other", buf).Objects[0]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action in another namespace, got %+v", obj)
+	}
+}
+
+func TestPutStorageQuota(t *testing.T) {
+	defer func(v string) { Config.StorageQuota = v }(Config.StorageQuota)
+	defer resetQuotaReservations()
+
+	data := "refused once the quota is lowered"
+	oid := hex.EncodeToString(sha256Sum(data))
+	defer removeMeta(oid)
+
+	// Something larger is stored, so the object fits in a quota of what's
+	// used but not on top of it
+	stored := putBulkObject(t, strings.Repeat("stored before the quota is lowered ", 4), "repo")
+	defer removeMeta(stored.Oid)
+	defer testContentStore.Delete(stored)
+
+	used, _, err := testMetaStore.StoredUsage("", nil)
+	if err != nil {
+		t.Fatalf("expected the stored usage, got: %s", err)
+	}
+	Config.StorageQuota = strconv.FormatInt(used+int64(len(data)), 10)
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d}]}`, oid, len(data)))
+	if obj := batchRequest(t, buf).Objects[0]; obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the object that fits, got %+v", obj)
+	}
+
+	Config.StorageQuota = strconv.FormatInt(used, 10)
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 507 {
+		t.Fatalf("expected the upload over the lowered quota to be refused with 507, got %d", res.StatusCode)
+	}
+	if testContentStore.Exists(&MetaObject{Oid: oid, Size: int64(len(data))}) {
+		t.Fatalf("expected the refused upload not to be stored")
+	}
+}
+
+// resetQuotaReservations drops the room reserved by the batches of a test.
+func resetQuotaReservations() {
+	app := lfsServer.Config.Handler.(*App)
+	app.quotaMu.Lock()
+	app.reserved = nil
+	app.quotaMu.Unlock()
+}
+
+// namespaceBatch posts a batch request to a repo of namespace.
+func namespaceBatch(t *testing.T, namespace string, buf *bytes.Buffer) *BatchResponse {
+	res, err := api("POST", "/"+namespace+"/repo/objects/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
+	}
+	return &batch
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errRebalanceMissing = errors.New("Content is missing from its previous location")
+
+// RebalanceResult describes a rebalance of a store. InPlace counts the
+// objects already at their location, such as those moved by an earlier run,
+// and Missing the objects whose content is at neither location.
+type RebalanceResult struct {
+	Scanned  int
+	Moved    int
+	InPlace  int
+	Missing  []string
+	Failures []*VerifyFailure
+}
+
+// layoutMigrator is implemented by stores that can move their objects out of
+// a legacy content layout, including those wrapping a ContentStore, like
+// faultyStore, which migrate the files underneath without injected faults.
+type layoutMigrator interface {
+	// HasLegacyLayout returns true if objects may be left in a legacy
+	// layout to migrate from.
+	HasLegacyLayout() bool
+	MigrateLayout(ctx context.Context, meta *MetaStore, progress func(scanned int)) (*RebalanceResult, error)
+}
+
+// HasLegacyLayout returns true if a legacy layout is configured.
+func (s *ContentStore) HasLegacyLayout() bool {
+	return s.LegacyKeyFunc != nil
+}
+
+// MigrateLayout moves the objects left in the legacy layout to the current
+// one, like the rebalance command without parameters.
+func (s *ContentStore) MigrateLayout(ctx context.Context, meta *MetaStore, progress func(scanned int)) (*RebalanceResult, error) {
+	if !s.HasLegacyLayout() {
+		return nil, errNoMigration
+	}
+	return rebalanceStore(ctx, meta, s, s, progress)
+}
+
+// rebalanceStore moves the content of every object recorded in meta, soft
+// deleted ones included, from its location in from to its location in to,
+// the same store under its previous and current layout, roots or size
+// classes. Each object is verified at its new location before its previous
+// one is removed, and left where it was if it doesn't read back. Objects
+// already at their new location are skipped, so an interrupted rebalance is
+// finished by running it again. Nothing records where content is, so meta
+// itself is left as is. It ends early with the error of ctx once done, and
+// calls progress, if set, with the objects scanned so far.
+func rebalanceStore(ctx context.Context, meta *MetaStore, from, to *ContentStore, progress func(scanned int)) (*RebalanceResult, error) {
+	res := &RebalanceResult{}
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		m, err := meta.NextObject(after)
+		if err != nil || m == nil {
+			return res, err
+		}
+		after = m.Oid
+		res.Scanned++
+
+		moved, err := rebalanceObject(from, to, m)
+		switch {
+		case err == errRebalanceMissing:
+			res.Missing = append(res.Missing, m.Oid)
+		case err != nil:
+			res.Failures = append(res.Failures, &VerifyFailure{Oid: m.Oid, Err: err})
+		case moved:
+			res.Moved++
+		default:
+			res.InPlace++
+		}
+		if progress != nil {
+			progress(res.Scanned)
+		}
+	}
+}
+
+// rebalanceObject moves the content of m from its location in from to its
+// location in to. It returns false if the content was already there.
+func rebalanceObject(from, to *ContentStore, m *MetaObject) (bool, error) {
+	// Inline objects are kept in the meta store, whatever the layout
+	if to.inlined(m) {
+		return false, nil
+	}
+
+	src, dst := from.path(m), to.path(m)
+	if _, err := os.Stat(src); os.IsNotExist(err) && from.LegacyKeyFunc != nil {
+		src = from.legacyPath(m)
+	}
+	if src == dst {
+		return false, nil
+	}
+	_, srcErr := os.Stat(src)
+	if srcErr != nil && !os.IsNotExist(srcErr) {
+		return false, srcErr
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		if os.IsNotExist(srcErr) {
+			return false, nil
+		}
+		// An earlier run was interrupted before it removed the content from
+		// its previous location, and maybe before it finished the copy
+		if verifyObject(to, m, nil, nil) == nil {
+			return false, removeRebalanced(src, from.root(m.Oid))
+		}
+		if err := os.Remove(dst); err != nil {
+			return false, err
+		}
+	}
+	if os.IsNotExist(srcErr) {
+		return false, errRebalanceMissing
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return false, err
+	}
+	if err := moveFile(src, dst); err != nil {
+		return false, err
+	}
+	if err := verifyObject(to, m, nil, nil); err != nil {
+		// A rename took it from its previous location, where it goes back
+		if _, statErr := os.Stat(src); os.IsNotExist(statErr) {
+			os.Rename(dst, src)
+		} else {
+			os.Remove(dst)
+		}
+		return false, err
+	}
+	return true, removeRebalanced(src, from.root(m.Oid))
+}
+
+// removeRebalanced removes the previous location of moved content, if a copy
+// left it, along with the directories of root it leaves empty.
+func removeRebalanced(path, root string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, prefix); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// runRebalance moves the objects of the configured content store from the
+// locations of its previous layout parameters, given in args as layout=,
+// roots= and size-classes= for those that changed, to their locations under
+// the configured ones. Without args it moves the objects left in the legacy
+// content layout. Run it while the server is stopped.
+func runRebalance(args []string) error {
+	metaStore, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		return fmt.Errorf("Could not open the meta store: %s", err)
+	}
+	defer metaStore.Close()
+
+	to, err := openPrimaryStore(metaStore)
+	if err != nil {
+		return err
+	}
+	from, err := openPrimaryStore(metaStore)
+	if err != nil {
+		return err
+	}
+	if err := previousLayout(from, args); err != nil {
+		return err
+	}
+
+	res, err := rebalanceStore(context.Background(), metaStore, from, to, nil)
+	for _, oid := range res.Missing {
+		logger.Log(kv{"fn": "rebalance", "oid": oid, "err": errRebalanceMissing.Error()})
+	}
+	for _, f := range res.Failures {
+		logger.Log(kv{"fn": "rebalance", "oid": f.Oid, "err": f.Err.Error()})
+	}
+	logger.Log(kv{"fn": "rebalance", "scanned": res.Scanned, "moved": res.Moved, "in_place": res.InPlace, "missing": len(res.Missing), "failed": len(res.Failures)})
+	if err != nil {
+		return err
+	}
+	if len(res.Failures) > 0 {
+		return fmt.Errorf("%d of %d objects could not be moved", len(res.Failures), res.Scanned)
+	}
+	return nil
+}
+
+// previousLayout applies the previous layout parameters given in args, as
+// "name=value", to store.
+func previousLayout(store *ContentStore, args []string) error {
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Previous layout parameter isn't given as name=value: %q", arg)
+		}
+
+		switch value := parts[1]; parts[0] {
+		case "layout":
+			key, ok := contentLayouts[value]
+			if !ok {
+				return fmt.Errorf("Unknown content layout: %s", value)
+			}
+			store.KeyFunc = key
+		case "roots":
+			store.Roots = nil
+			for _, root := range strings.Split(value, ",") {
+				if root = strings.TrimSpace(root); root != "" {
+					store.Roots = append(store.Roots, root)
+				}
+			}
+		case "size-classes":
+			classes, err := parseSizeClasses(value)
+			if err != nil {
+				return err
+			}
+			store.SizeClasses = classes
+		default:
+			return fmt.Errorf("Unknown layout parameter: %s", parts[0])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRebalanceLayout(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	var objects []*MetaObject
+	for i := 0; i < 3; i++ {
+		objects = append(objects, putScrubObject(t, meta, contentStore, fmt.Sprintf("rebalanced object %d", i)))
+	}
+	// An object whose upload never finished has no content to move
+	missing := strings.Repeat("9", 64)
+	if _, err := meta.Put(&RequestVars{Oid: missing, Size: 4}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+
+	// From the sharded layout, two directories deep, to none
+	to, err := NewContentStore("content-store-test")
+	if err != nil {
+		t.Fatalf("expected the content store, got: %s", err)
+	}
+	if err := previousLayout(to, []string{"layout=flat"}); err != nil {
+		t.Fatalf("expected the layout to apply, got: %s", err)
+	}
+
+	res, err := rebalanceStore(context.Background(), meta, contentStore, to, nil)
+	if err != nil {
+		t.Fatalf("expected the rebalance to succeed, got: %s", err)
+	}
+	if res.Scanned != 4 || res.Moved != 3 || len(res.Missing) != 1 || res.Missing[0] != missing || len(res.Failures) != 0 {
+		t.Fatalf("expected every object with content to be moved, got %+v", res)
+	}
+	for _, m := range objects {
+		if want := filepath.Join("content-store-test", m.Oid) + encodingSuffixes[m.Encoding]; to.path(m) != want {
+			t.Fatalf("expected the flat path %s, got %s", want, to.path(m))
+		}
+		if _, err := os.Stat(contentStore.path(m)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone from its sharded path, got: %v", m.Oid, err)
+		}
+		if err := verifyObject(to, m, nil, nil); err != nil {
+			t.Errorf("expected %s to resolve at its new path, got: %s", m.Oid, err)
+		}
+	}
+	if dirs, _ := filepath.Glob("content-store-test/??"); len(dirs) != 0 {
+		t.Errorf("expected the emptied shard directories to be removed, got %v", dirs)
+	}
+
+	// A run cut short after its copy leaves the content at both paths
+	by, err := ioutil.ReadFile(to.path(objects[1]))
+	if err != nil {
+		t.Fatalf("expected the moved content, got: %s", err)
+	}
+	os.MkdirAll(filepath.Dir(contentStore.path(objects[1])), 0750)
+	if err := ioutil.WriteFile(contentStore.path(objects[1]), by, 0640); err != nil {
+		t.Fatalf("expected the content to be copied back, got: %s", err)
+	}
+
+	res, err = rebalanceStore(context.Background(), meta, contentStore, to, nil)
+	if err != nil || res.Moved != 0 || res.InPlace != 3 || len(res.Failures) != 0 {
+		t.Fatalf("expected a second run to find the objects in place, got %+v: %v", res, err)
+	}
+	if _, err := os.Stat(contentStore.path(objects[1])); !os.IsNotExist(err) {
+		t.Errorf("expected the left over content to be removed, got: %v", err)
+	}
+
+	// And back, verifying what it moves
+	if err := ioutil.WriteFile(to.path(objects[2]), []byte("corrupted"), 0640); err != nil {
+		t.Fatalf("expected the content to be corrupted, got: %s", err)
+	}
+	res, err = rebalanceStore(context.Background(), meta, to, contentStore, nil)
+	if err != nil || res.Moved != 2 || len(res.Failures) != 1 || res.Failures[0].Oid != objects[2].Oid {
+		t.Fatalf("expected the corrupted object to fail, got %+v: %v", res, err)
+	}
+	if _, err := os.Stat(to.path(objects[2])); err != nil {
+		t.Errorf("expected the corrupted object to stay where it was, got: %s", err)
+	}
+	for _, m := range objects[:2] {
+		if err := verifyObject(contentStore, m, nil, nil); err != nil {
+			t.Errorf("expected %s to resolve at its sharded path again, got: %s", m.Oid, err)
+		}
+	}
+}
+
+func TestPreviousLayout(t *testing.T) {
+	store := &ContentStore{}
+	if err := previousLayout(store, []string{"roots=/a, /b", "size-classes=small=10,large"}); err != nil {
+		t.Fatalf("expected the layout to apply, got: %s", err)
+	}
+	if len(store.Roots) != 2 || store.Roots[1] != "/b" || len(store.SizeClasses) != 2 {
+		t.Fatalf("expected the roots and size classes, got %+v", store)
+	}
+	for _, arg := range []string{"layout", "layout=deep", "depth=3", "size-classes=.=1"} {
+		if err := previousLayout(store, []string{arg}); err == nil {
+			t.Errorf("expected %q to be refused", arg)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errRehashRunning = errors.New("A rehash is already running")
+	errNoRehash      = errors.New("No rehash to resume")
+)
+
+// storedTimer is implemented by stores that know when an object was stored.
+type storedTimer interface {
+	StoredAt(meta *MetaObject) (time.Time, bool)
+}
+
+// StoredAt returns when the content of meta was written, which is the time
+// of its file. Inline objects have none.
+func (s *ContentStore) StoredAt(meta *MetaObject) (time.Time, bool) {
+	if s.inlined(meta) {
+		return time.Time{}, false
+	}
+	info, err := os.Stat(s.path(meta))
+	if os.IsNotExist(err) && s.LegacyKeyFunc != nil {
+		info, err = os.Stat(s.legacyPath(meta))
+	}
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// RehashFilter selects the objects a rehash covers. Fields left at their
+// zero value don't restrict it. Since and Until are compared to when the
+// content was stored, so objects of a store that can't tell never match them.
+type RehashFilter struct {
+	Prefix  string     `json:"prefix,omitempty"`
+	MinSize int64      `json:"min_size,omitempty"`
+	MaxSize int64      `json:"max_size,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+func (f *RehashFilter) matches(meta *MetaObject, store objectStore) bool {
+	if !strings.HasPrefix(meta.Oid, f.Prefix) || meta.Size < f.MinSize || (f.MaxSize > 0 && meta.Size > f.MaxSize) {
+		return false
+	}
+	if f.Since == nil && f.Until == nil {
+		return true
+	}
+	st, ok := store.(storedTimer)
+	if !ok {
+		return false
+	}
+	at, ok := st.StoredAt(meta)
+	return ok && (f.Since == nil || !at.Before(*f.Since)) && (f.Until == nil || at.Before(*f.Until))
+}
+
+// past returns true if no object after oid can match, as oids are walked in
+// order.
+func (f *RehashFilter) past(oid string) bool {
+	return f.Prefix != "" && oid > f.Prefix && !strings.HasPrefix(oid, f.Prefix)
+}
+
+// RehashMismatch is an object of a rehash whose content is missing or doesn't
+// match its oid and size.
+type RehashMismatch struct {
+	Oid   string `json:"oid"`
+	Error string `json:"error"`
+}
+
+// maxRehashMismatches is the number of mismatches a rehash lists. More are
+// only counted, so a rehash over a broken disk doesn't grow without bound in
+// memory and in the meta store.
+const maxRehashMismatches = 1000
+
+// RehashJob is a rehash of the objects matching Filter, as saved in the meta
+// store at every checkpoint and when it stops.
+type RehashJob struct {
+	Filter  RehashFilter `json:"filter"`
+	Rate    int64        `json:"rate"`
+	Checked int          `json:"checked"`
+	Skipped int          `json:"skipped"`
+	// Mismatches lists the first maxRehashMismatches mismatches found, and
+	// MismatchCount counts all of them.
+	Mismatches    []*RehashMismatch `json:"mismatches"`
+	MismatchCount int               `json:"mismatch_count"`
+	jobState
+}
+
+// Rehasher runs the rehash jobs operators start, one at a time, for instance
+// to check the objects of a date range after a suspected hardware issue
+// without scrubbing the whole store. Content is read at the rate of the job.
+type Rehasher struct {
+	jobRunner
+	meta  *MetaStore
+	store objectStore
+
+	job *RehashJob
+}
+
+func newRehasher(meta *MetaStore, store objectStore) *Rehasher {
+	return &Rehasher{meta: meta, store: store}
+}
+
+// Start runs job in the background from its cursor.
+func (r *Rehasher) Start(job *RehashJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running() {
+		return errRehashRunning
+	}
+
+	if job.Mismatches == nil {
+		job.Mismatches = []*RehashMismatch{}
+	}
+	if job.MismatchCount < len(job.Mismatches) {
+		// Saved before mismatches were counted
+		job.MismatchCount = len(job.Mismatches)
+	}
+	if err := r.launch(&job.jobState, r.steps(job)); err != nil {
+		return err
+	}
+	r.job = job
+	return nil
+}
+
+// Resume restarts the saved job where it stopped, after Stop or a restart.
+func (r *Rehasher) Resume() (*RehashJob, error) {
+	job, err := r.meta.RehashJob()
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.Done {
+		return nil, errNoRehash
+	}
+	if err := r.Start(job); err != nil {
+		return nil, err
+	}
+	return r.Status()
+}
+
+// Status returns a copy of the running or last saved job, or nil if there
+// never was one.
+func (r *Rehasher) Status() (*RehashJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.job == nil {
+		job, err := r.meta.RehashJob()
+		if job != nil {
+			// A job saved as running was cut short by a restart
+			job.Running = false
+		}
+		return job, err
+	}
+	job := *r.job
+	job.Mismatches = append([]*RehashMismatch(nil), r.job.Mismatches...)
+	return &job, nil
+}
+
+// steps returns how job walks the objects.
+func (r *Rehasher) steps(job *RehashJob) jobSteps {
+	limit := newThrottle(job.Rate)
+
+	return jobSteps{
+		name: "rehash",
+		next: func(cursor string) (*MetaObject, error) {
+			// A job of a prefix starts at it instead of walking up to it
+			var meta *MetaObject
+			var err error
+			if cursor < job.Filter.Prefix {
+				meta, err = r.meta.ObjectFrom(job.Filter.Prefix)
+			} else {
+				meta, err = r.meta.NextObject(cursor)
+			}
+			if err != nil || meta == nil || job.Filter.past(meta.Oid) {
+				return nil, err
+			}
+			return meta, nil
+		},
+		process: func(meta *MetaObject) func() {
+			var mismatch *RehashMismatch
+			checked := meta.DeletedAt == nil && job.Filter.matches(meta, r.store)
+			if checked {
+				if err := verifyObject(r.store, meta, limit, nil); err != nil {
+					mismatch = &RehashMismatch{Oid: meta.Oid, Error: err.Error()}
+					metrics.Add("lfs_rehash_mismatches_total", 1)
+					logger.Log(kv{"fn": "rehash", "oid": meta.Oid, "err": err.Error()})
+				}
+			}
+
+			return func() {
+				if checked {
+					job.Checked++
+				} else {
+					job.Skipped++
+				}
+				if mismatch != nil {
+					job.MismatchCount++
+					if len(job.Mismatches) < maxRehashMismatches {
+						job.Mismatches = append(job.Mismatches, mismatch)
+					}
+				}
+			}
+		},
+		save: func() error { return r.meta.SetRehashJob(job) },
+		summary: func() kv {
+			return kv{"checked": job.Checked, "mismatches": job.MismatchCount}
+		},
+	}
+}
+
+// parseRehashJob returns the rehash asked for with the prefix, min_size,
+// max_size, since, until and rate parameters, read with param.
+func parseRehashJob(param func(string) string) (*RehashJob, error) {
+	job := &RehashJob{Rate: Config.RehashBytesPerSecond()}
+	job.StartedAt = time.Now().UTC()
+	f := &job.Filter
+
+	f.Prefix = strings.ToLower(param("prefix"))
+	if !validHex(f.Prefix) {
+		return nil, errors.New("Invalid prefix: " + f.Prefix)
+	}
+	for name, size := range map[string]*int64{"min_size": &f.MinSize, "max_size": &f.MaxSize} {
+		if v := param(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("Invalid " + name + ": " + v)
+			}
+			*size = n
+		}
+	}
+	for name, at := range map[string]**time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := param(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("Invalid " + name + ": " + v)
+			}
+			*at = &t
+		}
+	}
+	rate, err := parseRate(param("rate"), job.Rate)
+	if err != nil {
+		return nil, err
+	}
+	job.Rate = rate
+	return job, nil
+}
+
+// parseRate returns the bytes per second of a rate parameter given in MB/s,
+// or def if it's empty.
+func parseRate(v string, def int64) (int64, error) {
+	if v == "" {
+		return def, nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 {
+		return 0, errors.New("Invalid rate: " + v)
+	}
+	return int64(rate * 1024 * 1024), nil
+}
+
+// adminRehashHandler starts a rehash of the objects matching the filter in
+// the prefix, min_size, max_size, since and until parameters, reading at the
+// rate parameter in MB/s or the configured one.
+func (a *App) adminRehashHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := parseRehashJob(r.FormValue)
+	if err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+
+	if err := a.rehasher.Start(job); err != nil {
+		a.writeRehashError(w, r, err)
+		return
+	}
+	job, _ = a.rehasher.Status()
+	writeAdminJSON(w, r, 202, job)
+}
+
+// adminRehashResumeHandler resumes the last rehash where it stopped.
+func (a *App) adminRehashResumeHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := a.rehasher.Resume()
+	if err != nil {
+		a.writeRehashError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, r, 202, job)
+}
+
+// adminRehashStatusHandler reports the progress and mismatches of the
+// running or last rehash.
+func (a *App) adminRehashStatusHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := a.rehasher.Status()
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	if job == nil {
+		writeAdminError(w, r, 404, "No rehash was started")
+		return
+	}
+	writeAdminJSON(w, r, 200, job)
+}
+
+// adminRehashStopHandler stops the running rehash, which can be resumed.
+func (a *App) adminRehashStopHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.rehasher.Stop(r.Context()); err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	a.adminRehashStatusHandler(w, r)
+}
+
+func (a *App) writeRehashError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errRehashRunning:
+		writeAdminError(w, r, 409, err.Error())
+	case errNoRehash:
+		writeAdminError(w, r, 404, err.Error())
+	default:
+		writeAdminError(w, r, 500, err.Error())
+	}
+}
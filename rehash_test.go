@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRehashFilter(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	old := putScrubObject(t, meta, contentStore, "object stored last year")
+	recent := putScrubObject(t, meta, contentStore, "object stored today")
+	stored := time.Now().AddDate(-1, 0, 0)
+	if err := os.Chtimes(contentStore.path(old), stored, stored); err != nil {
+		t.Fatalf("expected to age the object, got: %s", err)
+	}
+
+	since, until := stored.Add(-time.Hour), stored.Add(time.Hour)
+	for _, c := range []struct {
+		filter RehashFilter
+		old    bool
+		recent bool
+	}{
+		{RehashFilter{}, true, true},
+		{RehashFilter{Since: &since, Until: &until}, true, false},
+		{RehashFilter{Since: &until}, false, true},
+		{RehashFilter{Prefix: recent.Oid[:4]}, strings.HasPrefix(old.Oid, recent.Oid[:4]), true},
+		{RehashFilter{MinSize: old.Size + 1}, false, false},
+		{RehashFilter{MaxSize: recent.Size}, false, true},
+	} {
+		if c.filter.matches(old, contentStore) != c.old || c.filter.matches(recent, contentStore) != c.recent {
+			t.Errorf("expected filter %+v to match old %v and recent %v", c.filter, c.old, c.recent)
+		}
+	}
+}
+
+func TestRehashReportsMismatchesInScope(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	var small, large []*MetaObject
+	for i := 0; i < 5; i++ {
+		small = append(small, putScrubObject(t, meta, contentStore, fmt.Sprintf("small %d", i)))
+		large = append(large, putScrubObject(t, meta, contentStore, fmt.Sprintf("larger object %d", i)))
+	}
+	// Both sizes have a missing object, only the large one is in scope
+	os.Remove(contentStore.path(small[1]))
+	os.Remove(contentStore.path(large[2]))
+
+	r := newRehasher(meta, contentStore)
+	if err := r.Start(&RehashJob{Filter: RehashFilter{MinSize: large[0].Size}}); err != nil {
+		t.Fatalf("expected the rehash to start, got: %s", err)
+	}
+	job := waitRehash(t, r)
+
+	if !job.Done || job.Checked != len(large) || job.Skipped != len(small) {
+		t.Fatalf("expected the large objects to be checked and the small skipped, got %+v", job)
+	}
+	if len(job.Mismatches) != 1 || job.MismatchCount != 1 || job.Mismatches[0].Oid != large[2].Oid {
+		t.Fatalf("expected only %s to be reported, got %+v", large[2].Oid, job.Mismatches)
+	}
+	if err := r.Start(&RehashJob{}); err != nil {
+		t.Fatalf("expected another rehash to start once done, got: %s", err)
+	}
+	waitRehash(t, r)
+}
+
+func TestRehashResumes(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	var oids []string
+	for i := 0; i < 6; i++ {
+		oids = append(oids, putScrubObject(t, meta, contentStore, fmt.Sprintf("resumed object %d", i)).Oid)
+	}
+	sort.Strings(oids)
+
+	// A job cut short by a restart, halfway through
+	saved := &RehashJob{jobState: jobState{Cursor: oids[2], Running: true}, Checked: 3, Mismatches: []*RehashMismatch{}}
+	if err := meta.SetRehashJob(saved); err != nil {
+		t.Fatalf("expected the job to be saved, got: %s", err)
+	}
+
+	r := newRehasher(meta, contentStore)
+	if job, err := r.Status(); err != nil || job.Running || job.Cursor != oids[2] {
+		t.Fatalf("expected the saved job to be reported stopped, got %+v: %v", job, err)
+	}
+	if _, err := r.Resume(); err != nil {
+		t.Fatalf("expected the job to resume, got: %s", err)
+	}
+	if job := waitRehash(t, r); !job.Done || job.Checked != len(oids) || job.Cursor != oids[5] {
+		t.Fatalf("expected the job to finish the remaining objects, got %+v", job)
+	}
+	if _, err := r.Resume(); err != errNoRehash {
+		t.Fatalf("expected nothing to resume once done, got: %v", err)
+	}
+}
+
+func TestRehashStartsAtPrefix(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	var oids []string
+	for i := 0; i < 6; i++ {
+		oids = append(oids, putScrubObject(t, meta, contentStore, fmt.Sprintf("prefixed object %d", i)).Oid)
+	}
+	sort.Strings(oids)
+
+	// The objects before the prefix aren't walked at all
+	r := newRehasher(meta, contentStore)
+	if err := r.Start(&RehashJob{Filter: RehashFilter{Prefix: oids[3]}}); err != nil {
+		t.Fatalf("expected the rehash to start, got: %s", err)
+	}
+	if job := waitRehash(t, r); !job.Done || job.Checked != 1 || job.Skipped != 0 || job.Cursor != oids[3] {
+		t.Fatalf("expected only the object of the prefix to be looked at, got %+v", job)
+	}
+}
+
+func waitRehash(t *testing.T, r *Rehasher) *RehashJob {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := r.Status()
+		if err != nil {
+			t.Fatalf("expected the rehash status, got: %s", err)
+		}
+		if !job.Running {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected the rehash to finish")
+	return nil
+}
+
+func TestAdminRehash(t *testing.T) {
+	defer setupAdmin()()
+
+	if res := adminAPI(t, "POST", "/admin/objects/rehash?prefix=xyz", ""); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an invalid prefix, got %d", res.StatusCode)
+	}
+
+	res := adminAPI(t, "POST", "/admin/objects/rehash?prefix="+contentOid[:8]+"&max_size=1000&rate=0", "")
+	if res.StatusCode != 202 {
+		t.Fatalf("expected status 202, got %d", res.StatusCode)
+	}
+	var job RehashJob
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		res := adminAPI(t, "GET", "/admin/objects/rehash", "")
+		err := json.NewDecoder(res.Body).Decode(&job)
+		res.Body.Close()
+		if err != nil || res.StatusCode != 200 {
+			t.Fatalf("expected the rehash status, got status %d: %v", res.StatusCode, err)
+		}
+		if !job.Running {
+			break
+		}
+	}
+	if !job.Done || job.Checked != 1 || job.Filter.Prefix != contentOid[:8] || len(job.Mismatches) != 0 {
+		t.Fatalf("expected only the content object to be checked, got %+v", job)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	errRekeyRunning = errors.New("A rekey is already running")
+	errNoRekey      = errors.New("No rekey to resume")
+	errNoRotation   = errors.New("Objects can't be rekeyed, encryption is not enabled")
+	errRewritten    = errors.New("Object was rewritten while it was rekeyed")
+)
+
+// keyRotator is implemented by stores that can encrypt stored objects again
+// under the current master key.
+type keyRotator interface {
+	// CurrentKey returns the id of the master key new objects are encrypted
+	// with, or an empty string if the store doesn't encrypt.
+	CurrentKey() string
+	Rekey(meta *MetaObject, limit *throttle) (bool, error)
+}
+
+// CurrentKey returns the id of the first configured master key.
+func (s *ContentStore) CurrentKey() string {
+	if s.Keys == nil {
+		return ""
+	}
+	return s.Keys.current
+}
+
+// Rekey encrypts the content of meta again under a new data key wrapped with
+// the current master key, if it was encrypted with another key, and returns
+// true if it did. What the old key decrypts to is encrypted as it is, without
+// compressing it again, read back and hashed before it replaces the stored
+// file, so a failed rekey leaves the object as it was. The object is claimed
+// from reading it to replacing it, so no other write of it interleaves.
+// Objects stored unencrypted are left alone. On success meta records the new
+// key and stored size, which the caller persists.
+func (s *ContentStore) Rekey(meta *MetaObject, limit *throttle) (bool, error) {
+	if s.Keys == nil {
+		return false, errNoKeyring
+	}
+	if meta.KeyID == "" || meta.KeyID == s.Keys.current || s.inlined(meta) {
+		return false, nil
+	}
+
+	path := s.path(meta)
+	if _, err := os.Stat(path); os.IsNotExist(err) && s.LegacyKeyFunc != nil {
+		path = s.legacyPath(meta)
+	}
+	tmpPath := path + ".tmp"
+	if !s.claimWriting(tmpPath) {
+		return false, errUploadBusy
+	}
+	defer s.setWriting(tmpPath, false)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	src, err := s.Keys.decrypter(f, meta.Oid)
+	if err != nil {
+		return false, err
+	}
+	if limit != nil {
+		src = &throttledReader{r: src, limit: limit}
+	}
+
+	file, err := s.createTemp(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpPath)
+
+	enc, err := s.Keys.encrypter(file, meta.Oid)
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := enc.Close(); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+
+	rekeyed := *meta
+	rekeyed.KeyID = s.Keys.current
+	if err := s.verifyEncrypted(&rekeyed, tmpPath); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	if err := moveFile(tmpPath, path); err != nil {
+		return false, err
+	}
+
+	meta.KeyID = rekeyed.KeyID
+	meta.StoredSize = info.Size()
+	return true, nil
+}
+
+// verifyEncrypted checks that the encrypted file at path decrypts and decodes
+// to the content of meta.
+func (s *ContentStore) verifyEncrypted(meta *MetaObject, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := s.Keys.decrypter(f, meta.Oid)
+	if err != nil {
+		return err
+	}
+	if meta.Encoding != encodingIdentity {
+		d, err := newDecompressor(meta.Encoding, r)
+		if err != nil {
+			return errCorruptObject
+		}
+		defer d.Close()
+		r = d
+	}
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+	if n != meta.Size {
+		return errSizeMismatch
+	}
+	return nil
+}
+
+// RekeyFailure is an object a rekey couldn't encrypt again. It's left as it
+// was, readable with its old key.
+type RekeyFailure struct {
+	Oid   string `json:"oid"`
+	Error string `json:"error"`
+}
+
+// RekeyJob is a rekey of every object to the current master key, KeyID, as
+// saved in the meta store at every checkpoint and when it stops. Objects
+// looked at again after a restart are already on KeyID and skipped.
+type RekeyJob struct {
+	KeyID    string          `json:"key_id"`
+	Rate     int64           `json:"rate"`
+	Rekeyed  int             `json:"rekeyed"`
+	Skipped  int             `json:"skipped"`
+	Failures []*RekeyFailure `json:"failures"`
+	jobState
+}
+
+// Rekeyer runs the rekey jobs operators start after putting a new master key
+// first, one at a time, so objects no longer depend on the old keys. Objects
+// stay readable throughout, as every object file names the key it was
+// encrypted with, and the old keys are only needed until the job is done.
+type Rekeyer struct {
+	jobRunner
+	meta  *MetaStore
+	store objectStore
+
+	job *RekeyJob
+}
+
+func newRekeyer(meta *MetaStore, store objectStore) *Rekeyer {
+	return &Rekeyer{meta: meta, store: store}
+}
+
+// currentKey returns the master key objects are rekeyed to, or false if the
+// store can't rekey objects.
+func (r *Rekeyer) currentKey() (string, bool) {
+	rotator, ok := r.store.(keyRotator)
+	if !ok || rotator.CurrentKey() == "" {
+		return "", false
+	}
+	return rotator.CurrentKey(), true
+}
+
+// Start runs job in the background from its cursor.
+func (r *Rekeyer) Start(job *RekeyJob) error {
+	key, ok := r.currentKey()
+	if !ok {
+		return errNoRotation
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running() {
+		return errRekeyRunning
+	}
+
+	job.KeyID = key
+	if job.Failures == nil {
+		job.Failures = []*RekeyFailure{}
+	}
+	if err := r.launch(&job.jobState, r.steps(job)); err != nil {
+		return err
+	}
+	r.job = job
+	return nil
+}
+
+// Resume restarts the saved job where it stopped, after Stop or a restart.
+func (r *Rekeyer) Resume() (*RekeyJob, error) {
+	job, err := r.meta.RekeyJob()
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.Done {
+		return nil, errNoRekey
+	}
+	if err := r.Start(job); err != nil {
+		return nil, err
+	}
+	return r.Status()
+}
+
+// Status returns a copy of the running or last saved job, or nil if there
+// never was one.
+func (r *Rekeyer) Status() (*RekeyJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.job == nil {
+		job, err := r.meta.RekeyJob()
+		if job != nil {
+			// A job saved as running was cut short by a restart
+			job.Running = false
+		}
+		return job, err
+	}
+	job := *r.job
+	job.Failures = append([]*RekeyFailure(nil), r.job.Failures...)
+	return &job, nil
+}
+
+// steps returns how job walks the objects.
+func (r *Rekeyer) steps(job *RekeyJob) jobSteps {
+	limit := newThrottle(job.Rate)
+	rotator := r.store.(keyRotator)
+
+	return jobSteps{
+		name: "rekey",
+		next: r.meta.NextObject,
+		process: func(meta *MetaObject) func() {
+			var failure *RekeyFailure
+			rekeyed := false
+			if meta.DeletedAt == nil {
+				old := *meta
+				var err error
+				rekeyed, err = rotator.Rekey(meta, limit)
+				if err == nil && rekeyed {
+					if err = r.meta.SetKey(&old, meta); err == errObjectNotFound {
+						// Deleted while it was rekeyed, so the content
+						// written back is gone again
+						r.store.Delete(meta)
+					}
+				}
+				if err == errRewritten || err != nil && r.deleted(meta) {
+					rekeyed, err = false, nil
+				}
+				if err != nil {
+					rekeyed = false
+					failure = &RekeyFailure{Oid: meta.Oid, Error: err.Error()}
+					metrics.Add("lfs_rekey_failures_total", 1)
+					logger.Log(kv{"fn": "rekey", "oid": meta.Oid, "err": err.Error()})
+				}
+			}
+
+			return func() {
+				switch {
+				case rekeyed:
+					job.Rekeyed++
+					metrics.Add("lfs_rekeyed_objects_total", 1)
+				case failure != nil:
+					job.Failures = append(job.Failures, failure)
+				default:
+					job.Skipped++
+				}
+			}
+		},
+		save: func() error { return r.meta.SetRekeyJob(job) },
+		summary: func() kv {
+			return kv{"rekeyed": job.Rekeyed, "failures": len(job.Failures)}
+		},
+	}
+}
+
+// deleted returns true if meta was deleted since the job read it, in which
+// case it's skipped rather than failed.
+func (r *Rekeyer) deleted(meta *MetaObject) bool {
+	_, err := r.meta.UnsafeGet(&RequestVars{Oid: meta.Oid})
+	return err == errObjectNotFound
+}
+
+// newRekeyJob returns a rekey reading at rate bytes per second, started now.
+func newRekeyJob(rate int64) *RekeyJob {
+	job := &RekeyJob{Rate: rate}
+	job.StartedAt = time.Now().UTC()
+	return job
+}
+
+// adminRekeyHandler starts a rekey of every object to the current master
+// key, reading at the rate parameter in MB/s or the configured one.
+func (a *App) adminRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	rate, err := parseRate(r.FormValue("rate"), Config.RekeyBytesPerSecond())
+	if err != nil {
+		writeAdminError(w, r, 400, err.Error())
+		return
+	}
+	job := newRekeyJob(rate)
+	if err := a.rekeyer.Start(job); err != nil {
+		a.writeRekeyError(w, r, err)
+		return
+	}
+	job, _ = a.rekeyer.Status()
+	writeAdminJSON(w, r, 202, job)
+}
+
+// adminRekeyResumeHandler resumes the last rekey where it stopped.
+func (a *App) adminRekeyResumeHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := a.rekeyer.Resume()
+	if err != nil {
+		a.writeRekeyError(w, r, err)
+		return
+	}
+	writeAdminJSON(w, r, 202, job)
+}
+
+// adminRekeyStatusHandler reports the progress and failures of the running
+// or last rekey.
+func (a *App) adminRekeyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := a.rekeyer.Status()
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	if job == nil {
+		writeAdminError(w, r, 404, "No rekey was started")
+		return
+	}
+	writeAdminJSON(w, r, 200, job)
+}
+
+// adminRekeyStopHandler stops the running rekey, which can be resumed.
+func (a *App) adminRekeyStopHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.rekeyer.Stop(r.Context()); err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	a.adminRekeyStatusHandler(w, r)
+}
+
+func (a *App) writeRekeyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errRekeyRunning:
+		writeAdminError(w, r, 409, err.Error())
+	case errNoRekey, errNoRotation:
+		writeAdminError(w, r, 404, err.Error())
+	default:
+		writeAdminError(w, r, 500, err.Error())
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestContentStoreRekey(t *testing.T) {
+	setup()
+	defer teardown()
+
+	content := benchmarkContent()[:2*encryptedChunkSize+100]
+	for _, limit := range []int64{0, 1} {
+		contentStore.Keys = mustKeyring(t, testKey1)
+		contentStore.CompressMaxSize = limit
+		m := encryptedObject(t, content)
+
+		contentStore.Keys = mustKeyring(t, testKey2+","+testKey1)
+		rekeyed, err := contentStore.Rekey(m, nil)
+		if err != nil || !rekeyed {
+			t.Fatalf("expected the %s object to be rekeyed, got %v: %v", m.Encoding, rekeyed, err)
+		}
+		if m.KeyID != "k2" || m.StoredSize == 0 {
+			t.Fatalf("expected the new key and stored size to be recorded, got %+v", m)
+		}
+		if rekeyed, err := contentStore.Rekey(m, nil); err != nil || rekeyed {
+			t.Fatalf("expected an object of the current key to be left alone, got %v: %v", rekeyed, err)
+		}
+
+		// Only the new key reads it now
+		contentStore.Keys = mustKeyring(t, testKey2)
+		if got := readObject(t, m, 0); string(got) != string(content) {
+			t.Fatalf("expected the rekeyed %s object to read under the new key, got %d bytes", m.Encoding, len(got))
+		}
+		contentStore.Keys = mustKeyring(t, testKey1)
+		if _, err := contentStore.Get(m, 0); err != errUnknownKey {
+			t.Fatalf("expected the rekeyed %s object to fail under the old key, got: %v", m.Encoding, err)
+		}
+		contentStore.Delete(m)
+	}
+
+	// Objects stored unencrypted stay so
+	contentStore.Keys = nil
+	plain := encryptedObject(t, []byte("plain content"))
+	contentStore.Keys = mustKeyring(t, testKey2)
+	if rekeyed, err := contentStore.Rekey(plain, nil); err != nil || rekeyed || plain.KeyID != "" {
+		t.Fatalf("expected the unencrypted object to be left alone, got %v: %v", rekeyed, err)
+	}
+}
+
+func TestRekeyResumes(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+	var oids []string
+	for i := 0; i < 4; i++ {
+		oids = append(oids, putScrubObject(t, meta, contentStore, fmt.Sprintf("rekeyed object %d", i)).Oid)
+	}
+	sort.Strings(oids)
+
+	r := newRekeyer(meta, contentStore)
+	contentStore.Keys = nil
+	if err := r.Start(&RekeyJob{}); err != errNoRotation {
+		t.Fatalf("expected no rekey without encryption, got: %v", err)
+	}
+	contentStore.Keys = mustKeyring(t, testKey2+","+testKey1)
+
+	// A job cut short by a restart, halfway through
+	saved := &RekeyJob{jobState: jobState{Cursor: oids[1], Running: true}, Failures: []*RekeyFailure{}}
+	if err := meta.SetRekeyJob(saved); err != nil {
+		t.Fatalf("expected the job to be saved, got: %s", err)
+	}
+	if job, err := r.Status(); err != nil || job.Running || job.Cursor != oids[1] {
+		t.Fatalf("expected the saved job to be reported stopped, got %+v: %v", job, err)
+	}
+	if _, err := r.Resume(); err != nil {
+		t.Fatalf("expected the job to resume, got: %s", err)
+	}
+	if job := waitRekey(t, r); !job.Done || job.KeyID != "k2" || job.Rekeyed != 2 || len(job.Failures) != 0 {
+		t.Fatalf("expected the remaining objects to be rekeyed, got %+v", job)
+	}
+	for i, oid := range oids {
+		m, err := meta.Get(&RequestVars{Oid: oid})
+		if err != nil {
+			t.Fatalf("expected the object, got: %s", err)
+		}
+		if want := map[bool]string{true: "k1", false: "k2"}[i <= 1]; m.KeyID != want {
+			t.Errorf("expected object %d to be recorded with key %s, got %q", i, want, m.KeyID)
+		}
+	}
+
+	// Another run picks up the rest
+	if err := r.Start(&RekeyJob{}); err != nil {
+		t.Fatalf("expected another rekey to start once done, got: %s", err)
+	}
+	if job := waitRekey(t, r); !job.Done || job.Rekeyed != 2 || job.Skipped != 2 {
+		t.Fatalf("expected the objects left to be rekeyed, got %+v", job)
+	}
+	contentStore.Keys = mustKeyring(t, testKey2)
+	for _, oid := range oids {
+		m, _ := meta.Get(&RequestVars{Oid: oid})
+		if err := verifyObject(contentStore, m, nil, nil); err != nil {
+			t.Errorf("expected %s to read under the new key, got: %s", oid, err)
+		}
+	}
+}
+
+func TestRekeySkipsDeletedObjects(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+	kept := putScrubObject(t, meta, contentStore, "object kept during the rekey")
+	gone := putScrubObject(t, meta, contentStore, "object deleted during the rekey")
+	contentStore.Keys = mustKeyring(t, testKey2+","+testKey1)
+
+	// The object is deleted while its content is rewritten
+	store := &deletingRotator{ContentStore: contentStore, meta: meta, oid: gone.Oid}
+	r := newRekeyer(meta, store)
+	if err := r.Start(&RekeyJob{}); err != nil {
+		t.Fatalf("expected the rekey to start, got: %s", err)
+	}
+	if job := waitRekey(t, r); !job.Done || job.Rekeyed != 1 || job.Skipped != 1 || len(job.Failures) != 0 {
+		t.Fatalf("expected the deleted object to be skipped, got %+v", job)
+	}
+	if _, err := meta.UnsafeGet(&RequestVars{Oid: gone.Oid}); err != errObjectNotFound {
+		t.Fatalf("expected the deleted object to stay deleted, got: %v", err)
+	}
+	if contentStore.Exists(gone) {
+		t.Fatalf("expected the content written back to be removed")
+	}
+	if m, err := meta.Get(&RequestVars{Oid: kept.Oid}); err != nil || m.KeyID != "k2" {
+		t.Fatalf("expected the other object to be rekeyed, got %+v: %v", m, err)
+	}
+}
+
+func TestRekeySkipsRewrittenObjects(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	contentStore.Keys = mustKeyring(t, testKey1)
+	obj := putScrubObject(t, meta, contentStore, "object rewritten during the rekey")
+	contentStore.Keys = mustKeyring(t, testKey2+","+testKey1)
+
+	// Another write records a stored size of its own while the content is
+	// rekeyed
+	store := &rewritingRotator{ContentStore: contentStore, meta: meta}
+	r := newRekeyer(meta, store)
+	if err := r.Start(&RekeyJob{}); err != nil {
+		t.Fatalf("expected the rekey to start, got: %s", err)
+	}
+	if job := waitRekey(t, r); !job.Done || job.Rekeyed != 0 || job.Skipped != 1 || len(job.Failures) != 0 {
+		t.Fatalf("expected the rewritten object to be skipped, got %+v", job)
+	}
+	if m, err := meta.Get(&RequestVars{Oid: obj.Oid}); err != nil || m.KeyID != "k1" || m.StoredSize != 1 {
+		t.Fatalf("expected what the other write recorded to be kept, got %+v: %v", m, err)
+	}
+
+	// An object being written isn't rekeyed underneath the write
+	tmp := contentStore.path(obj) + ".tmp"
+	contentStore.setWriting(tmp, true)
+	defer contentStore.setWriting(tmp, false)
+	m, _ := meta.Get(&RequestVars{Oid: obj.Oid})
+	if rekeyed, err := contentStore.Rekey(m, nil); err != errUploadBusy || rekeyed {
+		t.Fatalf("expected the object being written to be busy, got %v: %v", rekeyed, err)
+	}
+}
+
+// rewritingRotator records another stored size for each object it rekeys,
+// as if it was written again meanwhile.
+type rewritingRotator struct {
+	*ContentStore
+	meta *MetaStore
+}
+
+func (s *rewritingRotator) Rekey(m *MetaObject, limit *throttle) (bool, error) {
+	rekeyed, err := s.ContentStore.Rekey(m, limit)
+	other := *m
+	other.KeyID = "k1"
+	other.StoredSize = 1
+	s.meta.Update(&other)
+	return rekeyed, err
+}
+
+// deletingRotator deletes the meta of oid while it's rekeyed.
+type deletingRotator struct {
+	*ContentStore
+	meta *MetaStore
+	oid  string
+}
+
+func (s *deletingRotator) Rekey(m *MetaObject, limit *throttle) (bool, error) {
+	rekeyed, err := s.ContentStore.Rekey(m, limit)
+	if m.Oid == s.oid {
+		s.meta.Delete(&RequestVars{Oid: m.Oid})
+	}
+	return rekeyed, err
+}
+
+func waitRekey(t *testing.T, r *Rekeyer) *RekeyJob {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := r.Status()
+		if err != nil {
+			t.Fatalf("expected the rekey status, got: %s", err)
+		}
+		if !job.Running {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected the rekey to finish")
+	return nil
+}
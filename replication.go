@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	replicationMaxAttempts = 8
+	replicationBaseBackoff = 500 * time.Millisecond
+	replicationMaxBackoff  = time.Minute
+)
+
+type replicationTask struct {
+	meta     *MetaObject
+	queuedAt time.Time
+}
+
+// Replicator asynchronously mirrors objects from the primary content store to a
+// secondary store. Uploads only enqueue work, so mirroring never delays the
+// upload response.
+type Replicator struct {
+	primary   objectStore
+	secondary objectStore
+
+	// MaxAttempts is the number of times a copy is tried before giving up.
+	MaxAttempts int
+	// BaseBackoff is the delay after the first failure, doubled on each retry.
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Progress, if set, is called with the bytes of an object copied so far
+	// while it is copied.
+	Progress func(meta *MetaObject, n int64)
+	// Replicated, if set, is called with every object once it is in the
+	// secondary store. Objects whose copy is abandoned never are.
+	Replicated func(meta *MetaObject)
+
+	mu      sync.Mutex
+	queue   []*replicationTask
+	signal  chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+// NewReplicator creates a Replicator copying from primary to secondary. Call
+// Start to begin processing the queue.
+func NewReplicator(primary, secondary objectStore) *Replicator {
+	return &Replicator{
+		primary:     primary,
+		secondary:   secondary,
+		MaxAttempts: replicationMaxAttempts,
+		BaseBackoff: replicationBaseBackoff,
+		MaxBackoff:  replicationMaxBackoff,
+		signal:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start launches the background worker.
+func (r *Replicator) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return
+	}
+	r.started = true
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Stop signals the worker to exit and waits for it. Objects still queued are
+// not copied.
+func (r *Replicator) Stop() {
+	r.mu.Lock()
+	if !r.started {
+		r.mu.Unlock()
+		return
+	}
+	r.started = false
+	r.mu.Unlock()
+
+	close(r.stop)
+	r.wg.Wait()
+
+	// Nothing is copied anymore, so the lag doesn't grow either
+	metrics.Set("lfs_replication_lag_seconds", 0)
+}
+
+// Drain waits for the queue to empty, or for ctx to be done, and then stops the
+// worker. Objects still queued when ctx is done are not copied.
+func (r *Replicator) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.Backlog() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			r.Stop()
+			logger.Log(kv{"fn": "Drain", "msg": "replication queue not drained", "backlog": r.Backlog()})
+			return ctx.Err()
+		}
+	}
+
+	r.Stop()
+	return nil
+}
+
+// Enqueue schedules meta to be copied to the secondary store.
+func (r *Replicator) Enqueue(meta *MetaObject) {
+	m := *meta
+	task := &replicationTask{meta: &m, queuedAt: time.Now()}
+
+	r.mu.Lock()
+	r.queue = append(r.queue, task)
+	r.updateMetrics()
+	r.mu.Unlock()
+
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Backlog returns the number of objects waiting to be replicated.
+func (r *Replicator) Backlog() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queue)
+}
+
+// Get reads meta from the secondary store.
+func (r *Replicator) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	return r.secondary.Get(meta, fromByte)
+}
+
+// Exists returns true if meta is in the secondary store.
+func (r *Replicator) Exists(meta *MetaObject) bool {
+	return r.secondary.Exists(meta)
+}
+
+// Delete removes an object from the secondary store.
+func (r *Replicator) Delete(meta *MetaObject) error {
+	return r.secondary.Delete(meta)
+}
+
+func (r *Replicator) run() {
+	defer r.wg.Done()
+
+	for {
+		task := r.peek()
+		if task == nil {
+			select {
+			case <-r.signal:
+				continue
+			case <-r.stop:
+				return
+			}
+		}
+
+		if !r.replicate(task) {
+			return
+		}
+
+		r.mu.Lock()
+		r.queue = r.queue[1:]
+		r.updateMetrics()
+		r.mu.Unlock()
+	}
+}
+
+func (r *Replicator) peek() *replicationTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queue) == 0 {
+		return nil
+	}
+	return r.queue[0]
+}
+
+// replicate copies a single object, retrying with exponential backoff. It
+// returns false if the replicator was stopped while waiting to retry.
+func (r *Replicator) replicate(task *replicationTask) bool {
+	backoff := r.BaseBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := r.copy(task.meta)
+		if err == nil {
+			metrics.Add("lfs_replication_copied_total", 1)
+			if r.Replicated != nil {
+				r.Replicated(task.meta)
+			}
+			return true
+		}
+
+		// The lag keeps growing while the oldest object is retried
+		r.mu.Lock()
+		r.updateMetrics()
+		r.mu.Unlock()
+
+		logger.Log(kv{"fn": "replicate", "oid": task.meta.Oid, "attempt": attempt, "err": err})
+		metrics.Add("lfs_replication_failures_total", 1)
+
+		if attempt >= r.MaxAttempts {
+			metrics.Add("lfs_replication_abandoned_total", 1)
+			return true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-r.stop:
+			return false
+		}
+
+		backoff *= 2
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+func (r *Replicator) copy(meta *MetaObject) error {
+	if r.secondary.Exists(meta) {
+		return nil
+	}
+
+	content, err := r.primary.Get(meta, 0)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	// Put verifies the size and hash of the stream before committing it.
+	// The copy is stored as meta records it, leaving meta as it is.
+	m := *meta
+	m.copy = true
+	return r.secondary.Put(&m, newProgressReader(content, progressBytes, progressInterval, objectProgress(meta, r.Progress)))
+}
+
+// updateMetrics must be called with r.mu held.
+func (r *Replicator) updateMetrics() {
+	metrics.Set("lfs_replication_backlog", int64(len(r.queue)))
+
+	var lag int64
+	if len(r.queue) > 0 {
+		lag = int64(time.Since(r.queue[0].queuedAt) / time.Second)
+	}
+	metrics.Set("lfs_replication_lag_seconds", lag)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplicatorCopiesToSecondary(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := primary.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	r := NewReplicator(primary, secondary)
+	r.Start()
+	defer r.Stop()
+
+	r.Enqueue(m)
+	waitForReplication(t, r)
+
+	if !secondary.Exists(m) {
+		t.Fatalf("expected object to exist in the secondary store")
+	}
+
+	c, err := secondary.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get from secondary to succeed, got: %s", err)
+	}
+	defer c.Close()
+
+	by, _ := ioutil.ReadAll(c)
+	if string(by) != content {
+		t.Fatalf("expected replicated content, got: %s", string(by))
+	}
+}
+
+func TestReplicatorRetriesFailures(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := primary.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	var mu sync.Mutex
+	var attempts int
+	secondary.Hook = func(op string, meta *MetaObject) error {
+		if op != memoryPut {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= 2 {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+
+	r := NewReplicator(primary, secondary)
+	r.BaseBackoff = time.Millisecond
+	r.Start()
+	defer r.Stop()
+
+	r.Enqueue(m)
+	waitForReplication(t, r)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("expected 3 put attempts, got %d", attempts)
+	}
+
+	if !secondary.Exists(m) {
+		t.Fatalf("expected object to exist in the secondary store after retrying")
+	}
+}
+
+func TestReplicatorLag(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := primary.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	secondary.Hook = func(op string, meta *MetaObject) error {
+		if op == memoryPut {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+
+	// The copy of an object queued a minute ago keeps failing
+	r := NewReplicator(primary, secondary)
+	r.BaseBackoff = time.Hour
+	r.Enqueue(m)
+	r.mu.Lock()
+	r.queue[0].queuedAt = time.Now().Add(-time.Minute)
+	r.mu.Unlock()
+	failures := metrics.Get("lfs_replication_failures_total")
+	r.Start()
+	for deadline := time.Now().Add(5 * time.Second); metrics.Get("lfs_replication_failures_total") == failures; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the copy to be attempted")
+		}
+	}
+	if lag := metrics.Get("lfs_replication_lag_seconds"); lag < 60 {
+		t.Fatalf("expected the lag of the retried object, got %d", lag)
+	}
+
+	r.Stop()
+	if r.Backlog() != 1 {
+		t.Fatalf("expected the object to stay queued, got a backlog of %d", r.Backlog())
+	}
+	if lag := metrics.Get("lfs_replication_lag_seconds"); lag != 0 {
+		t.Fatalf("expected the lag to be reset once stopped, got %d", lag)
+	}
+}
+
+func waitForReplication(t *testing.T, r *Replicator) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Backlog() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for replication, backlog %d", r.Backlog())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// requestLimiter counts the requests in progress per client IP. It counts
+// requests rather than connections, as clients behind a proxy share its
+// connections, and a client can keep idle connections open without holding
+// up a handler. The counts aren't exported per IP, which would make a metric
+// for every client ever seen.
+type requestLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{active: make(map[string]int)}
+}
+
+// acquire registers a request from ip. It returns false, without registering
+// it, if ip already has max requests in progress.
+func (l *requestLimiter) acquire(ip string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[ip] >= max {
+		return false
+	}
+	l.active[ip]++
+	metrics.Add("lfs_client_requests", 1)
+	return true
+}
+
+// release marks a request from ip as done.
+func (l *requestLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+	metrics.Add("lfs_client_requests", -1)
+}
+
+// limitRequests rejects requests with 429 once the client has max requests in
+// progress.
+func (a *App) limitRequests(h http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		if !a.inFlight.acquire(ip, max) {
+			metrics.Add("lfs_client_requests_rejected_total", 1)
+			w.Header().Set("Retry-After", "1")
+			writeStatus(w, r, 429)
+			return
+		}
+		defer a.inFlight.release(ip)
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestLimitRejectsExcess(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	app := &App{inFlight: newRequestLimiter()}
+	server := httptest.NewServer(app.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}), 2))
+	defer server.Close()
+
+	before := metrics.Get("lfs_client_requests")
+
+	// Hold two requests open from the same IP
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := http.Get(server.URL)
+			if err != nil {
+				results <- 0
+				return
+			}
+			res.Body.Close()
+			results <- res.StatusCode
+		}()
+		<-entered
+	}
+
+	if n := metrics.Get("lfs_client_requests") - before; n != 2 {
+		t.Fatalf("expected 2 requests to be counted, got %d", n)
+	}
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected excess request to get a response, got: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 429 {
+		t.Fatalf("expected excess request to be rejected with 429, got %d", res.StatusCode)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if status := <-results; status != 200 {
+			t.Fatalf("expected requests within the limit to succeed, got %d", status)
+		}
+	}
+
+	if n := metrics.Get("lfs_client_requests") - before; n != 0 {
+		t.Fatalf("expected the requests to be uncounted once done, got %d", n)
+	}
+	if len(app.inFlight.active) != 0 {
+		t.Fatalf("expected the client to be forgotten once idle, got %v", app.inFlight.active)
+	}
+}
+
+func TestConnectionLimitRejectsExcess(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	limited := limitConnections(l, 2, nil)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(limited)
+	defer server.Close()
+
+	// Open connections are counted, idle or not
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %s", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	excess, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer excess.Close()
+	excess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(excess), nil)
+	if err != nil {
+		t.Fatalf("expected the excess connection to get a response, got: %s", err)
+	}
+	if res.StatusCode != 429 {
+		t.Fatalf("expected the excess connection to be refused with 429, got %d", res.StatusCode)
+	}
+
+	// A closed connection makes room for another
+	conns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		limited.mu.Lock()
+		n := limited.open["127.0.0.1"]
+		limited.mu.Unlock()
+		if n < 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the closed connection to be uncounted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || res.StatusCode != 200 {
+		t.Fatalf("expected a connection within the limit to be served, got %v, %v", res, err)
+	}
+}
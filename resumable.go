@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// jobState is the progress of a job walking the objects in oid order, as
+// saved with the job. Cursor is the oid last looked at, from which a stopped
+// job resumes.
+type jobState struct {
+	Cursor     string     `json:"cursor"`
+	Running    bool       `json:"running"`
+	Done       bool       `json:"done"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobSteps are what a resumable job does on its walk.
+type jobSteps struct {
+	// name is what the job logs as.
+	name string
+	// next returns the object to look at after cursor, or nil once the job
+	// is done.
+	next func(cursor string) (*MetaObject, error)
+	// process looks at meta and returns how the job records the outcome,
+	// which is called with the runner's lock held.
+	process func(meta *MetaObject) func()
+	// save writes the job to the meta store.
+	save func() error
+	// summary is what the job logs when it stops.
+	summary func() kv
+}
+
+// jobRunner runs one resumable job at a time in the background, saving it
+// at every checkpoint and when it stops, so it can be resumed from its cursor
+// after Stop or a restart. Jobs embedding it hold mu while they read or
+// change their job.
+type jobRunner struct {
+	mu    sync.Mutex
+	state *jobState
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// running returns true if a job is running. mu must be held.
+func (r *jobRunner) running() bool {
+	return r.state != nil && r.state.Running
+}
+
+// launch saves the job of state as running and runs steps in the background
+// from its cursor. mu must be held.
+func (r *jobRunner) launch(state *jobState, steps jobSteps) error {
+	state.Running = true
+	state.Done = false
+	state.FinishedAt = nil
+	if err := steps.save(); err != nil {
+		return err
+	}
+
+	r.state = state
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(state, steps, r.stop, r.done)
+	return nil
+}
+
+// Stop ends the running job after the current object, leaving it to be
+// resumed, and waits for it or for ctx to expire.
+func (r *jobRunner) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.running() {
+		r.mu.Unlock()
+		return nil
+	}
+	stop, done := r.stop, r.done
+	r.mu.Unlock()
+
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *jobRunner) run(state *jobState, steps jobSteps, stop, done chan struct{}) {
+	defer close(done)
+	cp := checkpoint{Objects: checkpointObjects, Interval: checkpointInterval}
+
+	for {
+		select {
+		case <-stop:
+			r.finish(state, steps, false)
+			return
+		default:
+		}
+
+		meta, err := steps.next(state.Cursor)
+		if err != nil {
+			logger.Log(kv{"fn": steps.name, "err": err.Error()})
+			r.finish(state, steps, false)
+			return
+		}
+		if meta == nil {
+			r.finish(state, steps, true)
+			return
+		}
+
+		record := steps.process(meta)
+
+		r.mu.Lock()
+		state.Cursor = meta.Oid
+		record()
+		if cp.due() {
+			if err := steps.save(); err != nil {
+				logger.Log(kv{"fn": steps.name, "err": err.Error()})
+			}
+			cp.saved()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// finish saves the job as stopped, or done once every object was looked at.
+func (r *jobRunner) finish(state *jobState, steps jobSteps, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state.Running = false
+	if done {
+		now := time.Now().UTC()
+		state.Done = true
+		state.FinishedAt = &now
+	}
+	if err := steps.save(); err != nil {
+		logger.Log(kv{"fn": steps.name, "err": err.Error()})
+	}
+	summary := steps.summary()
+	summary["fn"], summary["done"], summary["cursor"] = steps.name, done, state.Cursor
+	logger.Log(summary)
+}
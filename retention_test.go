@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetainedObjectSurvives(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	m := putScrubObject(t, meta, contentStore, "retained content")
+	until := time.Now().Add(time.Hour)
+	if _, err := meta.SetRetention(m.Oid, until); err != nil {
+		t.Fatalf("expected the retention to be set, got: %s", err)
+	}
+	if _, err := meta.SetRetention(m.Oid, until.Add(-time.Minute)); err != errRetainShorter {
+		t.Fatalf("expected a shorter retention to be refused, got: %v", err)
+	}
+	if m, err := meta.SetRetention(m.Oid, until.Add(time.Hour)); err != nil || !m.RetainUntil.Equal(until.Add(time.Hour)) {
+		t.Fatalf("expected the retention to be extended, got %+v: %v", m, err)
+	}
+
+	// An expiry and updates leave the retention in place
+	past := time.Now().Add(-time.Hour)
+	m.ExpiresAt, m.RetainUntil = &past, nil
+	if err := meta.Update(m); err != nil {
+		t.Fatalf("expected the object to be updated, got: %s", err)
+	}
+
+	if err := meta.Delete(&RequestVars{Oid: m.Oid}); err != errRetained {
+		t.Fatalf("expected the delete to be refused, got: %v", err)
+	}
+	if _, deleted, err := meta.Release(m.Oid, ""); err != nil || deleted {
+		t.Fatalf("expected the release to keep the object, got %v: %v", deleted, err)
+	}
+	if _, deleted, err := meta.Expire(m.Oid, time.Now()); err != nil || deleted {
+		t.Fatalf("expected the expiry to keep the object, got %v: %v", deleted, err)
+	}
+	if _, err := contentStore.CollectGarbage(meta, GCOptions{}); err != nil {
+		t.Fatalf("expected the garbage collection to succeed, got: %s", err)
+	}
+
+	m, err := meta.Get(&RequestVars{Oid: m.Oid})
+	if err != nil || m.RetainUntil == nil {
+		t.Fatalf("expected the object to be kept with its retention, got %+v: %v", m, err)
+	}
+	if err := contentStore.Delete(m); err != errRetained {
+		t.Fatalf("expected the content delete to be refused, got: %v", err)
+	}
+	if err := verifyObject(contentStore, m, nil, nil); err != nil {
+		t.Fatalf("expected the content to be kept, got: %s", err)
+	}
+
+	// Once the retention passed the object is removed as any other
+	gone := putScrubObject(t, meta, contentStore, "formerly retained content")
+	if _, err := meta.SetRetention(gone.Oid, past); err != nil {
+		t.Fatalf("expected the retention to be set, got: %s", err)
+	}
+	if _, deleted, err := meta.Release(gone.Oid, ""); err != nil || !deleted {
+		t.Fatalf("expected the object to be deleted after its retention, got %v: %v", deleted, err)
+	}
+}
+
+func TestAdminRetention(t *testing.T) {
+	defer setupAdmin()()
+
+	oid := strings.Repeat("7", 64)
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: 4}); err != nil {
+		t.Fatalf("expected the object to be stored, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body := func(at time.Time) string { return fmt.Sprintf(`{"retain_until":%q}`, at.Format(time.RFC3339)) }
+
+	res := adminAPI(t, "PUT", "/admin/objects/"+oid+"/retention", body(until))
+	var m MetaObject
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil || res.StatusCode != 200 || m.RetainUntil == nil || !m.RetainUntil.Equal(until) {
+		t.Fatalf("expected the retention to be set, got %d with %+v: %v", res.StatusCode, m, err)
+	}
+
+	for path, c := range map[string]struct {
+		body   string
+		status int
+	}{
+		"/admin/objects/" + oid + "/retention":                     {body(until.Add(-time.Minute)), 409},
+		"/admin/objects/" + strings.Repeat("8", 64) + "/retention": {body(until), 404},
+		"/admin/objects/" + oid + "/retention?missing":             {`{}`, 400},
+	} {
+		if res := adminAPI(t, "PUT", path, c.body); res.StatusCode != c.status {
+			t.Errorf("expected %s with %s to return %d, got %d", path, c.body, c.status, res.StatusCode)
+		}
+	}
+
+	// Not even a bulk delete by an admin removes it
+	res = adminAPI(t, "POST", "/admin/objects/bulk-delete?dry_run=true", fmt.Sprintf(`{"oids":[%q]}`, oid))
+	var preview AdminBulkDeleteResponse
+	if err := json.NewDecoder(res.Body).Decode(&preview); err != nil || len(preview.Objects) != 1 || preview.Objects[0].Result != "retained" {
+		t.Fatalf("expected the object to be reported retained, got %+v: %v", preview, err)
+	}
+	res = adminAPI(t, "POST", "/admin/objects/bulk-delete", fmt.Sprintf(`{"oids":[%q],"confirm":%q}`, oid, preview.Confirm))
+	var deleted AdminBulkDeleteResponse
+	if err := json.NewDecoder(res.Body).Decode(&deleted); err != nil || len(deleted.Objects) != 1 || deleted.Objects[0].Result != "retained" {
+		t.Fatalf("expected the object to be retained, got %+v: %v", deleted, err)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: oid}); err != nil {
+		t.Fatalf("expected the object to be kept, got: %s", err)
+	}
+}
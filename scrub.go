@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errScrubMismatch = errors.New("Stored content does not match its oid")
+
+// quarantiner is implemented by stores that can set a bad object aside
+// instead of serving it.
+type quarantiner interface {
+	Quarantine(meta *MetaObject) error
+}
+
+// Scrubber walks every object in the background, verifying that the stored
+// content still hashes to its oid. Reads are throttled to Rate bytes per
+// second so scrubbing doesn't compete with serving. The position is saved in
+// the meta store every so many objects, so a restart resumes the pass close
+// to where it stopped.
+type Scrubber struct {
+	// Rate is the read throughput limit in bytes per second.
+	Rate int64
+	// Interval is the pause between two passes over all objects.
+	Interval time.Duration
+	// Quarantine sets objects that fail verification aside, if the store
+	// supports it, so they are no longer served and can be uploaded again.
+	Quarantine bool
+	// Progress, if set, is called with the bytes of an object verified so
+	// far while it is read.
+	Progress func(meta *MetaObject, n int64)
+	// OnQuarantine, if set, is called with the oid of every object set
+	// aside.
+	OnQuarantine func(oid string)
+
+	meta       *MetaStore
+	store      objectStore
+	limit      *throttle
+	ctx        context.Context
+	cursor     string
+	loaded     bool
+	checkpoint checkpoint
+
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+	mu      sync.Mutex
+}
+
+// NewScrubber creates a Scrubber verifying the objects of meta in store. Call
+// Start to begin scrubbing.
+func NewScrubber(meta *MetaStore, store objectStore, rate int64) *Scrubber {
+	return &Scrubber{
+		Rate:     rate,
+		Interval: 24 * time.Hour,
+		meta:     meta,
+		store:    store,
+		stop:     make(chan struct{}),
+		checkpoint: checkpoint{
+			Objects:  checkpointObjects,
+			Interval: checkpointInterval,
+		},
+	}
+}
+
+// Start launches the background worker.
+func (s *Scrubber) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop signals the worker to exit after the current object and waits for it,
+// or for ctx to expire.
+func (s *Scrubber) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	started := s.started
+	s.started = false
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	close(s.stop)
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scrubber) run() {
+	defer s.wg.Done()
+
+	for {
+		more, err := s.step()
+		if err != nil {
+			logger.Log(kv{"fn": "scrub", "err": err.Error()})
+		}
+
+		wait := time.Duration(0)
+		if !more {
+			wait = s.Interval
+		} else if err != nil {
+			wait = time.Minute
+		}
+
+		select {
+		case <-s.stop:
+			if err := s.saveCursor(); err != nil {
+				logger.Log(kv{"fn": "scrub", "err": err.Error()})
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// step verifies the object after the cursor, which is first read from the
+// meta store. It returns false once the pass is complete, after resetting the
+// cursor for the next one.
+func (s *Scrubber) step() (bool, error) {
+	if !s.loaded {
+		cursor, err := s.meta.ScrubCursor()
+		if err != nil {
+			return false, err
+		}
+		s.cursor, s.loaded = cursor, true
+	}
+
+	meta, err := s.meta.NextObject(s.cursor)
+	if err != nil {
+		return false, err
+	}
+	if meta == nil {
+		metrics.Add("lfs_scrub_passes_total", 1)
+		s.cursor = ""
+		return false, s.saveCursor()
+	}
+
+	if _, err := s.check(meta); err != nil {
+		return true, err
+	}
+
+	s.cursor = meta.Oid
+	if s.checkpoint.due() {
+		return true, s.saveCursor()
+	}
+	return true, nil
+}
+
+// saveCursor records the cursor in the meta store.
+func (s *Scrubber) saveCursor() error {
+	if !s.loaded {
+		return nil
+	}
+	if err := s.meta.SetScrubCursor(s.cursor); err != nil {
+		return err
+	}
+	s.checkpoint.saved()
+	return nil
+}
+
+// ScrubResult describes a scrub pass run as a job. Failed lists the objects
+// that didn't verify.
+type ScrubResult struct {
+	Checked  int      `json:"checked"`
+	Verified int      `json:"verified"`
+	Failed   []string `json:"failed"`
+}
+
+// Pass verifies every object once, like a pass of the background worker,
+// but from the start and without touching its saved position. It ends early
+// with the error of ctx once done, and calls progress, if set, with the
+// objects looked at so far.
+func (s *Scrubber) Pass(ctx context.Context, progress func(checked int)) (*ScrubResult, error) {
+	res := &ScrubResult{Failed: []string{}}
+	s.ctx = ctx
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		meta, err := s.meta.NextObject(after)
+		if err != nil || meta == nil {
+			return res, err
+		}
+		after = meta.Oid
+
+		switch outcome, err := s.check(meta); {
+		case err != nil:
+			return res, err
+		case outcome == scrubFailed:
+			res.Failed = append(res.Failed, meta.Oid)
+		case outcome == scrubVerified:
+			res.Verified++
+		}
+		res.Checked++
+		if progress != nil {
+			progress(res.Checked)
+		}
+	}
+}
+
+// scrubOutcome is what checking an object found.
+type scrubOutcome int
+
+const (
+	scrubSkipped scrubOutcome = iota
+	scrubVerified
+	scrubFailed
+)
+
+// check verifies the content of meta, if it's stored, and records the
+// outcome: the time it was verified, or the failure. An object deleted while
+// it was checked isn't an error, while an object cut short by the context of
+// a pass is left alone and returns its error.
+func (s *Scrubber) check(meta *MetaObject) (scrubOutcome, error) {
+	if !s.store.Exists(meta) {
+		return scrubSkipped, nil
+	}
+
+	err := s.verify(meta)
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return scrubSkipped, s.ctx.Err()
+	}
+	if err != nil {
+		s.fail(meta, err)
+		return scrubFailed, nil
+	}
+
+	metrics.Add("lfs_scrub_verified_total", 1)
+	meta.setVerified()
+	if err := s.meta.Update(meta); err != nil && err != errObjectNotFound {
+		return scrubVerified, err
+	}
+	return scrubVerified, nil
+}
+
+func (s *Scrubber) verify(meta *MetaObject) error {
+	r, err := s.store.Get(meta, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if s.limit == nil {
+		s.limit = newThrottle(s.Rate)
+	}
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return err
+	}
+	src := newProgressReader(&throttledReader{r: r, limit: s.limit, ctx: s.ctx}, progressBytes, progressInterval, objectProgress(meta, s.Progress))
+	n, err := io.Copy(hash, src)
+	if err != nil {
+		return err
+	}
+
+	if n != meta.Size || hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errScrubMismatch
+	}
+	return nil
+}
+
+func (s *Scrubber) fail(meta *MetaObject, err error) {
+	metrics.Add("lfs_scrub_failures_total", 1)
+	logger.Log(kv{"fn": "scrub", "oid": meta.Oid, "err": err.Error()})
+
+	outcome := auditFailed
+	if q, ok := s.store.(quarantiner); ok && s.Quarantine {
+		if err := q.Quarantine(meta); err != nil {
+			logger.Log(kv{"fn": "scrub", "oid": meta.Oid, "msg": "quarantine failed", "err": err.Error()})
+		} else {
+			outcome = "quarantined"
+			if s.OnQuarantine != nil {
+				s.OnQuarantine(meta.Oid)
+			}
+		}
+	}
+
+	entry := &AuditEntry{Time: time.Now().UTC(), Actor: "scrubber", Action: "object.scrub", Target: meta.Oid, Outcome: outcome}
+	if err := s.meta.AddAudit(entry); err != nil {
+		logger.Log(kv{"fn": "scrub", "oid": meta.Oid, "err": err.Error()})
+	}
+}
+
+const (
+	checkpointObjects  = 100
+	checkpointInterval = 10 * time.Second
+)
+
+// checkpoint decides when a background job walking the objects saves its
+// position: after Objects objects or Interval, whichever comes first. An
+// interrupted job then only repeats the objects since.
+type checkpoint struct {
+	Objects  int
+	Interval time.Duration
+
+	pending int
+	last    time.Time
+}
+
+// due counts one more object done and returns true if the position should
+// be saved now.
+func (c *checkpoint) due() bool {
+	if c.last.IsZero() {
+		c.last = time.Now()
+	}
+	c.pending++
+	return c.pending >= c.Objects || time.Since(c.last) >= c.Interval
+}
+
+// saved records that the position was saved.
+func (c *checkpoint) saved() {
+	c.pending, c.last = 0, time.Now()
+}
+
+// throttle paces reads to a number of bytes per second. Time spent idle only
+// builds up a second of credit, so reading resumes at the rate after a pause.
+type throttle struct {
+	rate  int64
+	start time.Time
+	total int64
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, now: time.Now, sleep: time.Sleep}
+}
+
+// wait accounts for n more bytes and sleeps until reading them keeps within
+// the rate. A rate of 0 never sleeps.
+func (t *throttle) wait(n int) {
+	if d := t.delay(n); d > 0 {
+		t.sleep(d)
+	}
+}
+
+// waitContext is wait, but returns ctx.Err() as soon as ctx is done rather
+// than sleeping on.
+func (t *throttle) waitContext(ctx context.Context, n int) error {
+	d := t.delay(n)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay accounts for n more bytes and returns how long to wait until
+// reading them keeps within the rate.
+func (t *throttle) delay(n int) time.Duration {
+	if t.rate <= 0 {
+		return 0
+	}
+	now := t.now()
+	if t.start.IsZero() || now.Sub(t.due()) > time.Second {
+		t.start, t.total = now, 0
+	}
+
+	t.total += int64(n)
+	return t.due().Sub(now)
+}
+
+// due returns when the bytes read so far may have been read at the rate.
+func (t *throttle) due() time.Time {
+	return t.start.Add(time.Duration(t.total * int64(time.Second) / t.rate))
+}
+
+type throttledReader struct {
+	r     io.Reader
+	limit *throttle
+	// ctx, if set, ends waiting for the rate once done.
+	ctx context.Context
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Read in small chunks so a low rate doesn't cause long stalls
+	if max := int(r.limit.rate / 10); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := r.r.Read(p)
+	if r.ctx == nil {
+		r.limit.wait(n)
+	} else if werr := r.limit.waitContext(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
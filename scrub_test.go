@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrubberDetectsCorruption(t *testing.T) {
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	store := NewMemoryStore()
+	good := putScrubObject(t, meta, store, "good object")
+	bad := putScrubObject(t, meta, store, "bad object")
+	store.Set(bad, []byte("bit rotted!"))
+
+	failures := metrics.Get("lfs_scrub_failures_total")
+
+	s := NewScrubber(meta, store, 0)
+	scrubPass(t, s)
+
+	if n := metrics.Get("lfs_scrub_failures_total") - failures; n != 1 {
+		t.Fatalf("expected one scrub failure, got %d", n)
+	}
+
+	entries, err := meta.Audit(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("expected audit log, got: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Target != bad.Oid || entries[0].Actor != "scrubber" || entries[0].Outcome != auditFailed {
+		t.Fatalf("expected an audit entry for the bad object only, got %+v", entries)
+	}
+
+	if !store.Exists(good) || !store.Exists(bad) {
+		t.Fatalf("expected objects to be kept without quarantine")
+	}
+}
+
+func TestScrubberQuarantines(t *testing.T) {
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	setup()
+	defer teardown()
+
+	bad := putScrubObject(t, meta, contentStore, "bad object")
+
+	// Replace the stored object with valid gzip of other content
+	var buf bytes.Buffer
+	g := gzip.NewWriter(&buf)
+	g.Write([]byte("bit rotted!"))
+	g.Close()
+	if err := ioutil.WriteFile(contentStore.path(bad), buf.Bytes(), 0640); err != nil {
+		t.Fatalf("expected to corrupt the object, got: %s", err)
+	}
+
+	s := NewScrubber(meta, contentStore, 0)
+	s.Quarantine = true
+	scrubPass(t, s)
+
+	if contentStore.Exists(bad) {
+		t.Fatalf("expected the bad object to no longer be served")
+	}
+
+	quarantined := filepath.Join("content-store-test", "quarantine", filepath.Base(contentStore.path(bad)))
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Fatalf("expected the bad object to be quarantined, got: %s", err)
+	}
+
+	entries, _ := meta.Audit(time.Time{}, time.Time{})
+	if len(entries) != 1 || entries[0].Outcome != "quarantined" {
+		t.Fatalf("expected a quarantined audit entry, got %+v", entries)
+	}
+}
+
+func TestScrubberResumesFromCursor(t *testing.T) {
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	store := NewMemoryStore()
+	putScrubObject(t, meta, store, "first object")
+	putScrubObject(t, meta, store, "second object")
+
+	var mu sync.Mutex
+	var scrubbed []string
+	store.Hook = func(op string, m *MetaObject) error {
+		if op == memoryGet {
+			mu.Lock()
+			scrubbed = append(scrubbed, m.Oid)
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	s := NewScrubber(meta, store, 0)
+	if more, err := s.step(); !more || err != nil {
+		t.Fatalf("expected the first step to scrub an object, got more=%v err=%v", more, err)
+	}
+
+	// The cursor is only saved once a checkpoint is due
+	if cursor, _ := meta.ScrubCursor(); cursor != "" {
+		t.Fatalf("expected the cursor not to be saved after one object, got %q", cursor)
+	}
+	if err := s.saveCursor(); err != nil {
+		t.Fatalf("expected the cursor to be saved, got: %s", err)
+	}
+
+	// A new scrubber, as after a restart, continues with the next object
+	s = NewScrubber(meta, store, 0)
+	if more, err := s.step(); !more || err != nil {
+		t.Fatalf("expected the second step to scrub an object, got more=%v err=%v", more, err)
+	}
+
+	if more, _ := s.step(); more {
+		t.Fatalf("expected the pass to be complete after two objects")
+	}
+
+	if len(scrubbed) != 2 || scrubbed[0] == scrubbed[1] {
+		t.Fatalf("expected each object to be scrubbed once, got %v", scrubbed)
+	}
+
+	if cursor, _ := meta.ScrubCursor(); cursor != "" {
+		t.Fatalf("expected the cursor to be reset after the pass, got %q", cursor)
+	}
+}
+
+func TestScrubberRateLimit(t *testing.T) {
+	meta := setupScrubMeta(t)
+	defer teardownScrubMeta(meta)
+
+	store := NewMemoryStore()
+	putScrubObject(t, meta, store, string(bytes.Repeat([]byte("x"), 50*1024)))
+
+	// The clock only advances by what the throttle sleeps
+	start := time.Now()
+	clock := start
+	s := NewScrubber(meta, store, 100*1024)
+	s.limit = newThrottle(s.Rate)
+	s.limit.now = func() time.Time { return clock }
+	s.limit.sleep = func(d time.Duration) { clock = clock.Add(d) }
+	scrubPass(t, s)
+
+	// 50KB at 100KB/s takes half a second
+	if elapsed := clock.Sub(start); elapsed != 500*time.Millisecond {
+		t.Fatalf("expected the scrub to take 500ms, took %s", elapsed)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	c := checkpoint{Objects: 3, Interval: time.Hour}
+	for i := 1; i <= 6; i++ {
+		if due := c.due(); due != (i%3 == 0) {
+			t.Fatalf("expected a checkpoint after every 3 objects, got %v after %d", due, i)
+		}
+		if i%3 == 0 {
+			c.saved()
+		}
+	}
+
+	c = checkpoint{Objects: 100, Interval: time.Hour}
+	c.due()
+	c.last = c.last.Add(-time.Hour)
+	if !c.due() {
+		t.Fatalf("expected a checkpoint once the interval passed")
+	}
+}
+
+func scrubPass(t *testing.T, s *Scrubber) {
+	for {
+		more, err := s.step()
+		if err != nil {
+			t.Fatalf("expected scrub step to succeed, got: %s", err)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+func putScrubObject(t *testing.T, meta *MetaStore, store objectStore, data string) *MetaObject {
+	sum := sha256.Sum256([]byte(data))
+	m, err := meta.Put(&RequestVars{Oid: hex.EncodeToString(sum[:]), Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if err := store.Put(m, bytes.NewBufferString(data)); err != nil {
+		t.Fatalf("expected content put to succeed, got: %s", err)
+	}
+	if err := meta.Update(m); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	return m
+}
+
+func setupScrubMeta(t *testing.T) *MetaStore {
+	os.Remove("lfs-scrub-test.db")
+	meta, err := NewMetaStore("lfs-scrub-test.db")
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	return meta
+}
+
+func teardownScrubMeta(meta *MetaStore) {
+	meta.Close()
+	os.Remove("lfs-scrub-test.db")
+}
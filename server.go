@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/andybalholm/brotli"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 )
@@ -25,24 +33,193 @@ type RequestVars struct {
 	Password      string
 	Repo          string
 	Authorization string
+	// HashAlgo is the hash algorithm of the oid, from the batch request.
+	HashAlgo string
+	// Tags are set on the object on upload.
+	Tags map[string]string
 }
 
 type BatchVars struct {
 	Transfers []string       `json:"transfers,omitempty"`
 	Operation string         `json:"operation"`
 	Objects   []*RequestVars `json:"objects"`
+	HashAlgo  string         `json:"hash_algo,omitempty"`
 }
 
 // MetaObject is object metadata as seen by the object and metadata stores.
 type MetaObject struct {
 	Oid      string `json:"oid"`
 	Size     int64  `json:"size"`
-	Existing bool
+	Encoding string `json:"encoding,omitempty"`
+	// StoredSize is the size of the content as stored, after compression
+	// and encryption, or 0 for objects stored before it was recorded.
+	StoredSize int64 `json:"stored_size,omitempty"`
+	// HashAlgo is the hash algorithm the oid was made with. Objects without
+	// one were stored before it was recorded and are sha256.
+	HashAlgo string `json:"hash_algo,omitempty"`
+	// KeyID is the master key the content was encrypted with when written,
+	// or empty if it is stored unencrypted.
+	KeyID string   `json:"key_id,omitempty"`
+	Repos []string `json:"repos,omitempty"`
+	// VerifiedAt is when the stored content was last hashed and found to
+	// match the oid, on upload or since.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// ExpiresAt, if set, is when the object is removed by the expiry sweep.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// DeletedAt, if set, is when the object was soft deleted. It's hidden
+	// until restored, and removed by the expiry sweep after a grace period.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Tags are what clients attached to the object on upload. PendingTags
+	// are those of upload batches, kept until the upload stored the object.
+	Tags        map[string]string `json:"tags,omitempty"`
+	PendingTags map[string]string `json:"pending_tags,omitempty"`
+	// Pinned objects are never removed automatically, not even once they
+	// are unreferenced or expired.
+	Pinned bool `json:"pinned"`
+	// RetainUntil, if set, is when the object can be removed again. Until
+	// then nothing deletes it, whoever asks, and it can only be extended.
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+	// Mirrored objects were fetched from the upstream server rather than
+	// uploaded, for the repo MirroredFor.
+	Mirrored    bool   `json:"mirrored,omitempty"`
+	MirroredFor string `json:"mirrored_for,omitempty"`
+	// Pending objects were offered for upload but their content hasn't been
+	// stored yet. They take no room in the usage totals.
+	Pending  bool `json:"pending,omitempty"`
+	Existing bool `json:"-"`
+
+	// hint is the file name or media type the client gave for an upload, if
+	// any. It's only used to choose the encoding and never stored.
+	hint string
+	// requested is the storage encoding the client asked for an upload to be
+	// stored in, if allowed. Like hint it's never stored, Encoding is.
+	requested string
+	// copy marks content copied from another store, like to a replica. It's
+	// written with the encoding and encryption meta records.
+	copy bool
+	// downloads is the download count shown with the object, if counted.
+	// It's stored on its own.
+	downloads *DownloadCount
+}
+
+// metaJSON is MetaObject without its MarshalJSON.
+type metaJSON MetaObject
+
+// MarshalJSON adds the compression ratio of the object, and its downloads if
+// they were looked up, to its attributes.
+func (m MetaObject) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		metaJSON
+		Ratio     float64        `json:"compression_ratio,omitempty"`
+		Downloads *DownloadCount `json:"downloads,omitempty"`
+	}{metaJSON(m), m.compressionRatio(), m.downloads})
+}
+
+// compressionRatio returns how many times smaller the object is stored than
+// it is, or 0 if its stored size isn't known.
+func (m *MetaObject) compressionRatio() float64 {
+	if m.StoredSize <= 0 {
+		return 0
+	}
+	return math.Round(float64(m.Size)/float64(m.StoredSize)*1000) / 1000
+}
+
+// emptyOids are the oids of empty content in each hash algorithm.
+var emptyOids = map[string]string{
+	hashSHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	hashSHA512: "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+}
+
+// empty returns true if the object is the one of empty content, whose size
+// is known to be 0 rather than not given.
+func (m *MetaObject) empty() bool {
+	return m.Oid == emptyOids[m.hashAlgo()]
+}
+
+// conflicts returns true if size is known and differs from the known size of
+// the object. An oid has exactly one content, so a request disagreeing about
+// its size comes from a broken or malicious client.
+func (m *MetaObject) conflicts(size int64) bool {
+	return size > 0 && m.Size > 0 && size != m.Size
+}
+
+// expired returns true if the object has an expiry time before now. Pinned
+// and retained objects never expire.
+func (m *MetaObject) expired(now time.Time) bool {
+	return !m.Pinned && !m.retained(now) && m.ExpiresAt != nil && m.ExpiresAt.Before(now)
+}
+
+// retained returns true if the object is under retention at now.
+func (m *MetaObject) retained(now time.Time) bool {
+	return m.RetainUntil != nil && now.Before(*m.RetainUntil)
+}
+
+// deletedBefore returns true if the object was soft deleted before t.
+func (m *MetaObject) deletedBefore(t time.Time) bool {
+	return m.DeletedAt != nil && m.DeletedAt.Before(t)
+}
+
+// setExpiry gives the object an expiry time ttl from now, if ttl is set.
+func (m *MetaObject) setExpiry(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	expires := time.Now().UTC().Add(ttl)
+	m.ExpiresAt = &expires
+}
+
+// uploaded records that the content was uploaded, so it counts towards the
+// usage and an object mirrored before isn't purged once upstream loses it.
+func (m *MetaObject) uploaded() {
+	m.Pending = false
+	m.Mirrored = false
+	m.MirroredFor = ""
+}
+
+// addRepo adds repo to the repos referencing the object, returning false if
+// it is empty or already there.
+func (m *MetaObject) addRepo(repo string) bool {
+	if repo == "" {
+		return false
+	}
+	for _, r := range m.Repos {
+		if r == repo {
+			return false
+		}
+	}
+	m.Repos = append(m.Repos, repo)
+	return true
+}
+
+// removeRepo removes repo from the repos referencing the object, returning
+// false if it wasn't there.
+func (m *MetaObject) removeRepo(repo string) bool {
+	for i, r := range m.Repos {
+		if r == repo {
+			m.Repos = append(m.Repos[:i], m.Repos[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// inNamespace returns true if a repo of namespace references the object.
+func (m *MetaObject) inNamespace(namespace string) bool {
+	if namespace == "" {
+		return false
+	}
+	for _, r := range m.Repos {
+		if strings.HasPrefix(r, namespace+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 type BatchResponse struct {
 	Transfer string            `json:"transfer,omitempty"`
 	Objects  []*Representation `json:"objects"`
+	HashAlgo string            `json:"hash_algo,omitempty"`
 }
 
 // Representation is object medata as seen by clients of the lfs server.
@@ -53,6 +230,25 @@ type Representation struct {
 	Error   *ObjectError     `json:"error,omitempty"`
 }
 
+// ObjectMeta is what the meta endpoint returns of an object. It's only the
+// documented attributes, leaving out internals such as the repos referencing
+// the object and its encryption key.
+type ObjectMeta struct {
+	Oid        string            `json:"oid"`
+	Size       int64             `json:"size"`
+	Encoding   string            `json:"encoding,omitempty"`
+	StoredSize int64             `json:"stored_size,omitempty"`
+	Ratio      float64           `json:"compression_ratio,omitempty"`
+	ExpiresAt  *time.Time        `json:"expires_at,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Pinned     bool              `json:"pinned"`
+	Downloads  *DownloadCount    `json:"downloads,omitempty"`
+	// CreatedAt is when the content was stored, if the store knows.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// RefCount is the number of repos referencing the object.
+	RefCount int `json:"refcount"`
+}
+
 type ObjectError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -160,48 +356,122 @@ func (v *RequestVars) VerifyLink() string {
 type link struct {
 	Href      string            `json:"href"`
 	Header    map[string]string `json:"header,omitempty"`
-	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+	ExpiresIn int64             `json:"expires_in,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	// Integrity is set on downloads the server vouches for, if enabled.
+	Integrity *integrity `json:"integrity,omitempty"`
+}
+
+// newLink creates a link to href. When links are signed, the signature
+// authorizes method requests and the link expires with it.
+func newLink(href, method string, header map[string]string) *link {
+	l := &link{Href: href, Header: header}
+
+	if Config.IsSigningLinks() {
+		lifetime := Config.SignedLinkLifetime()
+		expires := time.Now().Add(lifetime).Truncate(time.Second)
+
+		l.Href = signLink(href, method, expires)
+		l.ExpiresIn = int64(lifetime / time.Second)
+		l.ExpiresAt = &expires
+	}
+
+	return l
 }
 
 // App links a Router, ContentStore, and MetaStore to provide the LFS server.
 type App struct {
-	router       *mux.Router
-	contentStore *ContentStore
-	metaStore    *MetaStore
+	router         *mux.Router
+	contentStore   objectStore
+	metaStore      *MetaStore
+	replicator     *Replicator
+	durability     *DurabilityHook
+	downloads      *downloadGroup
+	batches        *batchCache
+	rehasher       *Rehasher
+	rekeyer        *Rekeyer
+	jobs           *JobManager
+	faults         *faultInjector
+	uploads        *uploadTracker
+	inFlight       *requestLimiter
+	upstream       *Upstream
+	oidc           *OIDCProvider
+	stats          *LifetimeStats
+	downloadCounts *DownloadCounter
+	authenticator  Authenticator
+	authorizer     Authorizer
+	// uploadQueue, if set, shares the upload slots between users, by the
+	// uploadWeights of their roles.
+	uploadQueue   *fairQueue
+	uploadWeights map[string]float64
+	// downloadRates are the download rates of roles that don't have the
+	// default one.
+	downloadRates map[string]int64
+	// quotaMu is held while uploads are checked against the quotas and
+	// reserved, so concurrent batches can't take the same room. reserved
+	// holds the room of admitted uploads, by oid, until they're stored.
+	quotaMu  sync.Mutex
+	reserved map[string]*quotaReservation
+	// gcMu is held while garbage is collected, temporary files are cleaned
+	// up or objects are migrated, through a job or an endpoint, so only one
+	// of them touches the content files at a time.
+	gcMu sync.Mutex
 }
 
-// NewApp creates a new App using the ContentStore and MetaStore provided
-func NewApp(content *ContentStore, meta *MetaStore) *App {
-	app := &App{contentStore: content, metaStore: meta}
+// NewApp creates a new App using the content store and MetaStore provided
+func NewApp(content objectStore, meta *MetaStore) *App {
+	app := &App{contentStore: content, metaStore: meta, downloads: newDownloadGroup(filepath.Join(Config.ContentPath, "tmp"), Config.CoalesceMemoryLimit()), uploads: newUploadTracker(), inFlight: newRequestLimiter()}
+	app.authenticator = &metaStoreAuthenticator{meta: meta}
+	app.rehasher = newRehasher(meta, content)
+	app.rekeyer = newRekeyer(meta, content)
+	app.jobs = newJobManager(app)
+	policy, err := Config.ActionPolicy()
+	if err != nil {
+		policy = defaultRolePolicy
+	}
+	app.authorizer = &policyAuthorizer{policy: policy}
+	if slots := Config.UploadConcurrency(); slots > 0 {
+		app.uploadQueue = newFairQueue(slots)
+		app.uploadWeights, _ = Config.UploadWeightPolicy()
+	}
+	app.downloadRates, _ = Config.DownloadRatePolicy()
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/{user}/{repo}/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects/batch", app.authorize(actionBatch, app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
 	route := "/{user}/{repo}/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.authorize(actionDownload, app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.authorize(actionDownload, app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
+	r.HandleFunc(route, app.authorize(actionUpload, app.queueUploads(app.PutHandler))).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route+"/meta", app.authorize(actionDownload, app.ObjectMetaHandler)).Methods("GET")
 
-	r.HandleFunc("/{user}/{repo}/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects", app.authorize(actionUpload, app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.LocksHandler)).Methods("GET").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/verify", app.requireAuth(app.LocksVerifyHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.CreateLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.requireAuth(app.DeleteLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks", app.authorize(actionLocks, app.LocksHandler)).Methods("GET").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/verify", app.authorize(actionLocks, app.LocksVerifyHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks", app.authorize(actionLock, app.CreateLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.authorize(actionUnlock, app.DeleteLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/objects/batch", app.authorize(actionBatch, app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
 	route = "/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.authorize(actionDownload, app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.authorize(actionDownload, app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
+	r.HandleFunc(route, app.authorize(actionUpload, app.queueUploads(app.PutHandler))).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route+"/meta", app.authorize(actionDownload, app.ObjectMetaHandler)).Methods("GET")
 
-	r.HandleFunc("/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/objects", app.authorize(actionUpload, app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
 
-	r.HandleFunc("/verify/{oid}", app.VerifyHandler).Methods("POST")
+	r.HandleFunc("/verify/{oid}", app.authorize(actionVerify, app.VerifyHandler)).Methods("POST")
+
+	r.HandleFunc("/metrics", app.authorize(actionMetrics, app.MetricsHandler)).Methods("GET")
+	r.HandleFunc("/info", app.authorize(actionDownload, app.InfoHandler)).Methods("GET")
+	r.HandleFunc("/.well-known/lfs", app.DiscoveryHandler).Methods("GET")
+	r.HandleFunc("/", app.DiscoveryHandler).Methods("GET").MatcherFunc(MetaMatcher)
 
 	app.addMgmt(r)
+	app.addAdmin(r)
 
 	app.router = r
 
@@ -209,29 +479,92 @@ func NewApp(content *ContentStore, meta *MetaStore) *App {
 }
 
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, "RequestStart", time.Now())
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err == nil {
 		context.Set(r, "RequestID", fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
 	}
 
-	a.router.ServeHTTP(w, r)
+	var h http.Handler = a.router
+	if Config.IsCompressingResponses() {
+		h = compressResponse(h, Config.ResponseCompressionMinSize())
+	}
+	if Config.IsAllowingCORS() {
+		h = allowCORS(h, Config.CORS())
+	}
+	if max := Config.RequestsPerIP(); max > 0 {
+		h = a.limitRequests(h, max)
+	}
+	h.ServeHTTP(w, r)
 }
 
-// Serve calls http.Serve with the provided Listener and the app's router
+// Serve serves the app on the provided Listener. Connections are closed once
+// they take too long to send request headers or are idle for too long, while
+// the time of whole requests is bounded per route.
 func (a *App) Serve(l net.Listener) error {
-	return http.Serve(l, a)
+	if max := Config.ConnectionsPerIP(); max > 0 {
+		l = limitConnections(l, max, trustedProxies)
+	}
+	srv := &http.Server{
+		Handler:           a,
+		ReadHeaderTimeout: Config.HeaderReadTimeout(),
+		IdleTimeout:       Config.IdleConnTimeout(),
+	}
+	return srv.Serve(l)
 }
 
 // GetContentHandler gets the content from the content store
 func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
+	if a.upstream != nil && (err == errObjectNotFound || err == nil && !a.hasContent(meta)) {
+		// Only a download is worth fetching the whole object for
+		if r.Method == "HEAD" {
+			a.headUpstream(w, r, rv)
+			return
+		}
+		if meta, err = a.fetchUpstream(rv); err != nil {
+			status, _ := upstreamError(err)
+			writeStatus(w, r, status)
+			return
+		}
+	}
 	if err != nil {
 		writeStatus(w, r, 404)
 		return
 	}
 
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", `"`+meta.Oid+`"`)
+
+	// The empty object, once uploaded, has nothing to read from the store
+	if meta.empty() && !meta.Pending {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(200)
+		if r.Method != "HEAD" {
+			a.downloadCounts.Add(meta.Oid, time.Now())
+		}
+		logRequest(r, 200)
+		return
+	}
+
+	// HEAD is answered from the meta store, without opening the content
+	if r.Method == "HEAD" {
+		if !a.hasContent(meta) {
+			writeStatus(w, r, 404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		w.WriteHeader(200)
+		logRequest(r, 200)
+		return
+	}
+
+	if a.redirectToCDN(w, r, meta) {
+		return
+	}
+
 	// Support resume download using Range header
 	var fromByte int64
 	statusCode := 200
@@ -245,18 +578,83 @@ func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	content, err := a.contentStore.Get(meta, fromByte)
+	content, err := a.getContent(meta, fromByte)
+	if err == errCorruptObject {
+		writeStatus(w, r, 500)
+		return
+	}
 	if err != nil {
 		writeStatus(w, r, 404)
 		return
 	}
 	defer content.Close()
 
+	if cd := contentDisposition(r.URL.Query().Get("filename")); cd != "" {
+		w.Header().Set("Content-Disposition", cd)
+	}
+
+	ctx, cancel := withDeadline(r.Context(), a.downloadDeadline(r, meta.Size-fromByte))
+	defer cancel()
+
+	// A write blocked on a client that stopped reading fails at the deadline
+	// too, instead of holding the handler until the client goes away
+	if deadline, ok := ctx.Deadline(); ok {
+		http.NewResponseController(w).SetWriteDeadline(deadline)
+	}
+
+	var dst io.Writer = &contextWriter{ctx: ctx, w: w}
+	if Config.IsBrotliDownloading() {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	var bw *brotli.Writer
+	if brotliDownload(r, meta) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Header().Set("ETag", `"`+meta.Oid+`-br"`)
+		bw = brotli.NewWriter(dst)
+		dst = bw
+	}
+
 	w.WriteHeader(statusCode)
-	io.Copy(w, content)
+	n, err := io.Copy(dst, a.throttleDownload(ctx, r, content))
+	if bw != nil && err == nil {
+		err = bw.Close()
+	}
+	a.stats.Add(statBytesDownloaded, n)
+	if err == nil && fromByte == 0 {
+		a.downloadCounts.Add(meta.Oid, time.Now())
+	}
+	if err != nil && timedOut(ctx, err) {
+		// The status is already sent, so break the connection rather than
+		// let the client take a truncated response as complete
+		metrics.Add("lfs_request_timeouts_total", 1)
+		logger.Log(kv{"fn": "GetContentHandler", "oid": meta.Oid, "err": "download deadline exceeded"})
+		panic(http.ErrAbortHandler)
+	}
 	logRequest(r, statusCode)
 }
 
+// contentDisposition returns an attachment Content-Disposition header for
+// filename, or an empty string if no usable filename is left after removing
+// control characters and path separators.
+func contentDisposition(filename string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, filename)
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return ""
+	}
+
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
 // GetMetaHandler retrieves metadata about the object
 func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
@@ -276,6 +674,48 @@ func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 	logRequest(r, 200)
 }
 
+// ObjectMetaHandler returns the stored attributes of an object as JSON,
+// without links or content
+func (a *App) ObjectMetaHandler(w http.ResponseWriter, r *http.Request) {
+	rv := unpack(r)
+	meta, err := a.metaStore.Get(rv)
+	if err != nil {
+		writeStatus(w, r, 404)
+		return
+	}
+	if a.downloadCounts != nil {
+		if meta.downloads, err = a.downloadCounts.Count(meta.Oid); err != nil {
+			writeStatus(w, r, 500)
+			return
+		}
+	}
+
+	var created *time.Time
+	if st, ok := a.contentStore.(storedTimer); ok {
+		if at, ok := st.StoredAt(meta); ok {
+			at = at.UTC()
+			created = &at
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(&ObjectMeta{
+		Oid:        meta.Oid,
+		Size:       meta.Size,
+		Encoding:   meta.Encoding,
+		StoredSize: meta.StoredSize,
+		Ratio:      meta.compressionRatio(),
+		ExpiresAt:  meta.ExpiresAt,
+		Tags:       meta.Tags,
+		Pinned:     meta.Pinned,
+		Downloads:  meta.downloads,
+		CreatedAt:  created,
+		RefCount:   len(meta.Repos),
+	})
+	logRequest(r, 200)
+}
+
 // PostHandler instructs the client how to upload data
 func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
@@ -289,6 +729,10 @@ func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 
 	sentStatus := 202
 	if meta.Existing && a.contentStore.Exists(meta) {
+		if meta.conflicts(rv.Size) {
+			writeConflict(w, r, meta)
+			return
+		}
 		sentStatus = 200
 	}
 	w.WriteHeader(sentStatus)
@@ -300,75 +744,453 @@ func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 
 // BatchHandler provides the batch api
 func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
-	bv := unpackBatch(r)
+	var (
+		cacheKey  string
+		cacheOids []string
+		cacheBody []byte
+	)
+
+	limit := Config.BatchBodyLimit()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeStatus(w, r, 422)
+		return
+	}
+	if int64(len(data)) > limit {
+		writeStatus(w, r, 413)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if a.batches != nil {
+		cacheKey = batchCacheKey(identity(r), r.Header.Get("Authorization"), r.URL.Path, data)
+		if e, ok := a.batches.get(cacheKey); ok {
+			metrics.Add("lfs_batch_cache_hits_total", 1)
+			writeBatchResponse(w, r, e.body, e.etag)
+			return
+		}
+
+		start := a.batches.begin()
+		defer func() { a.batches.done(cacheKey, start, cacheOids, cacheBody) }()
+	}
+
+	bv, err := unpackBatch(r)
+	if err != nil {
+		writeStatus(w, r, 422)
+		return
+	}
+
+	// The oids of a batch are all of one algorithm, which has to be one
+	// objects can be verified with
+	algo := bv.HashAlgo
+	if algo == "" {
+		algo = hashSHA256
+	}
+	if !supportsHashAlgo(algo) {
+		writeStatus(w, r, 409)
+		return
+	}
+
+	transfer, ok := negotiateTransfer(bv.Operation, bv.Transfers)
+	if !ok {
+		writeStatus(w, r, 422)
+		return
+	}
+	useTus := transfer == transferTus
 
 	var responseObjects []*Representation
 
-	var useTus bool
-	if bv.Operation == "upload" && Config.IsUsingTus() {
-		for _, t := range bv.Transfers {
-			if t == "tus" {
-				useTus = true
-				break
-			}
+	action := actionDownload
+	if bv.Operation == "upload" {
+		action = actionUpload
+	}
+	id := identity(r)
+
+	var allowed []*RequestVars
+	for _, object := range bv.Objects {
+		if a.authorizer.Can(id, action, object.Oid) {
+			allowed = append(allowed, object)
+		}
+	}
+	var overQuota map[string]*ObjectError
+	if bv.Operation == "upload" {
+		overQuota, err = a.reserveQuota(allowed, time.Now().Add(Config.QuotaReservationLifetime()))
+		if err != nil {
+			logger.Log(kv{"fn": "BatchHandler", "err": err.Error()})
+			writeStatus(w, r, 500)
+			return
 		}
 	}
 
-	// Create a response object
+	// Create a response object. A failing object gets an error of its own
+	// instead of failing the whole batch.
+	budget := &hashBudget{left: Config.IntegrityBatchBytes()}
 	for _, object := range bv.Objects {
-		meta, err := a.metaStore.Get(object)
-		if err == nil && a.contentStore.Exists(meta) { // Object is found and exists
-			responseObjects = append(responseObjects, a.Represent(object, meta, true, false, false))
+		if !a.authorizer.Can(id, action, object.Oid) {
+			responseObjects = append(responseObjects, &Representation{
+				Oid:   object.Oid,
+				Size:  object.Size,
+				Error: &ObjectError{Code: 403, Message: http.StatusText(403)},
+			})
+			continue
+		}
+		if e := overQuota[object.Oid]; e != nil {
+			responseObjects = append(responseObjects, &Representation{Oid: object.Oid, Size: object.Size, Error: e})
 			continue
 		}
+		responseObjects = append(responseObjects, a.batchObject(bv.Operation, object, useTus, budget))
+	}
+
+	respobj := &BatchResponse{Transfer: transfer, Objects: responseObjects, HashAlgo: algo}
+
+	if a.batches == nil {
+		w.Header().Set("Content-Type", metaMediaType)
+		json.NewEncoder(w).Encode(respobj)
+		logRequest(r, 200)
+		return
+	}
+
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(respobj)
+	if cacheable(responseObjects) {
+		for _, o := range responseObjects {
+			cacheOids = append(cacheOids, o.Oid)
+		}
+		cacheBody = buf.Bytes()
+	}
+	writeBatchResponse(w, r, buf.Bytes(), responseETag(buf.Bytes()))
+}
+
+// cacheable returns false if the response of a batch holds an object error
+// that may be gone when the request is repeated.
+func cacheable(objects []*Representation) bool {
+	for _, o := range objects {
+		if o.Error != nil && o.Error.Code >= 500 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBatchResponse writes an encoded batch response with its entity tag,
+// or only the status 304 to a client that has it already.
+func writeBatchResponse(w http.ResponseWriter, r *http.Request, body []byte, etag string) {
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		logRequest(r, 304)
+		return
+	}
+	w.Header().Set("Content-Type", metaMediaType)
+	w.Write(body)
+	logRequest(r, 200)
+}
+
+// Transfer adapters the batch API can choose.
+const (
+	transferBasic = "basic"
+	transferTus   = "tus"
+)
 
-		// Object is not found
-		if bv.Operation == "upload" {
-			meta, err = a.metaStore.Put(object)
-			if err == nil {
-				responseObjects = append(responseObjects, a.Represent(object, meta, false, true, useTus))
+// serverTransfers returns the transfer adapters offered for operation, the
+// preferred one first.
+func serverTransfers(operation string) []string {
+	if operation == "upload" && Config.IsUsingTus() {
+		return []string{transferTus, transferBasic}
+	}
+	return []string{transferBasic}
+}
+
+// negotiateTransfer returns the preferred transfer adapter for operation out
+// of those the client named, or false if it named none the server offers.
+// Clients naming none support basic.
+func negotiateTransfer(operation string, requested []string) (string, bool) {
+	if len(requested) == 0 {
+		requested = []string{transferBasic}
+	}
+	for _, offered := range serverTransfers(operation) {
+		for _, t := range requested {
+			if t == offered {
+				return offered, true
 			}
-		} else {
-			rep := &Representation{
-				Oid:  object.Oid,
-				Size: object.Size,
-				Error: &ObjectError{
-					Code:    404,
-					Message: "Not found",
-				},
+		}
+	}
+	return "", false
+}
+
+// batchObject returns the representation of one object of a batch request,
+// hashing objects to vouch for out of budget.
+func (a *App) batchObject(operation string, object *RequestVars, useTus bool, budget *hashBudget) *Representation {
+	meta, err := a.metaStore.Get(object)
+	if err == nil && meta.hashAlgo() != batchHashAlgo(object) {
+		return &Representation{
+			Oid:   object.Oid,
+			Size:  object.Size,
+			Error: &ObjectError{Code: 409, Message: fmt.Sprintf("Object %s is stored with hash algorithm %s", meta.Oid, meta.hashAlgo())},
+		}
+	}
+	if err == nil && a.contentStore.Exists(meta) { // Object is found and exists
+		if operation == "upload" && meta.conflicts(object.Size) {
+			return &Representation{
+				Oid:   object.Oid,
+				Size:  object.Size,
+				Error: &ObjectError{Code: 409, Message: sizeConflictMessage(meta)},
 			}
-			responseObjects = append(responseObjects, rep)
 		}
+		rep := a.Represent(object, meta, true, false, false)
+		if operation == "download" && Config.IsVouchingIntegrity() {
+			rep.Actions["download"].Integrity = a.integrity(meta, Config.IntegrityLifetime(), Config.IntegrityMaxBytes(), budget)
+		}
+		return rep
+	}
+	if err != nil && err != errObjectNotFound {
+		return batchError(object, err)
 	}
 
-	w.Header().Set("Content-Type", metaMediaType)
+	// Object is not found
+	if operation == "upload" {
+		if err := validateTags(object.Tags); err != nil {
+			return &Representation{Oid: object.Oid, Size: object.Size, Error: &ObjectError{Code: 422, Message: err.Error()}}
+		}
+		meta, err = a.metaStore.Put(object)
+		if err == errTagsTooLarge {
+			return &Representation{Oid: object.Oid, Size: object.Size, Error: &ObjectError{Code: 422, Message: err.Error()}}
+		}
+		if err != nil {
+			return batchError(object, err)
+		}
+		return a.Represent(object, meta, false, true, useTus)
+	}
 
-	respobj := &BatchResponse{Objects: responseObjects}
-	// Respond with TUS support if advertised
-	if useTus {
-		respobj.Transfer = "tus"
+	// A mirror offers the download of what upstream has, with the size
+	// upstream reports, and only fetches the object once it's downloaded
+	if a.upstream != nil {
+		size, err := a.upstream.Size(object)
+		if err != nil {
+			code, message := upstreamError(err)
+			if code != 404 {
+				logger.Log(kv{"fn": "BatchHandler", "oid": object.Oid, "err": err.Error()})
+			}
+			return &Representation{Oid: object.Oid, Size: object.Size, Error: &ObjectError{Code: code, Message: message}}
+		}
+		return a.Represent(object, &MetaObject{Oid: object.Oid, Size: size}, true, false, false)
+	}
+	return &Representation{
+		Oid:  object.Oid,
+		Size: object.Size,
+		Error: &ObjectError{
+			Code:    404,
+			Message: "Not found",
+		},
 	}
+}
 
-	enc := json.NewEncoder(w)
-	enc.Encode(respobj)
-	logRequest(r, 200)
+// batchHashAlgo returns the hash algorithm of an object of a batch request,
+// which is sha256 if the request names none.
+func batchHashAlgo(object *RequestVars) string {
+	if object.HashAlgo == "" {
+		return hashSHA256
+	}
+	return object.HashAlgo
+}
+
+// sizeConflictMessage explains why a request for meta with another size is
+// refused.
+func sizeConflictMessage(meta *MetaObject) string {
+	return fmt.Sprintf("Object %s is already stored with size %d", meta.Oid, meta.Size)
+}
+
+// writeConflict refuses a request that declares another size for the stored
+// object meta.
+func writeConflict(w http.ResponseWriter, r *http.Request, meta *MetaObject) {
+	w.Header().Set("Content-Type", metaMediaType)
+	w.WriteHeader(409)
+	json.NewEncoder(w).Encode(map[string]string{"message": sizeConflictMessage(meta)})
+	logRequest(r, 409)
+}
+
+// batchError logs err and returns a representation reporting an internal
+// error for object.
+func batchError(object *RequestVars, err error) *Representation {
+	logger.Log(kv{"fn": "BatchHandler", "oid": object.Oid, "err": err.Error()})
+	return &Representation{
+		Oid:  object.Oid,
+		Size: object.Size,
+		Error: &ObjectError{
+			Code:    500,
+			Message: http.StatusText(500),
+		},
+	}
 }
 
 // PutHandler receives data from the client and puts it into the content store
 func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
+
 	meta, err := a.metaStore.Get(rv)
 	if err != nil {
 		writeStatus(w, r, 404)
 		return
 	}
 
-	if err := a.contentStore.Put(meta, r.Body); err != nil {
-		a.metaStore.Delete(rv)
+	// A client stating the hash of the content it sends must be sending it
+	// to the object of that hash. The content is still verified by Put.
+	if sum := r.Header.Get("X-Lfs-SHA256"); sum != "" && meta.hashAlgo() == hashSHA256 && !strings.EqualFold(sum, rv.Oid) {
+		writeStatus(w, r, 400)
+		return
+	}
+
+	// Tags are only recorded once the upload stored the object
+	tags, err := parseTagsHeader(r.Header.Get("X-Lfs-Tags"), meta)
+	if err != nil {
+		writeStatus(w, r, 422)
+		return
+	}
+	// The encoding is checked up front but only set on meta for the Put
+	var requested string
+	if v := r.Header.Get("X-Lfs-Storage-Encoding"); v != "" && Config.IsHonoringStorageEncoding() {
+		if requested, err = parseStorageEncoding(v); err != nil {
+			writeStatus(w, r, 400)
+			return
+		}
+	}
+
+	// Everything below up to the Put is decided before the body is read, so
+	// a client sending "Expect: 100-continue" gets the final status without
+	// transferring the object; Go only sends "100 Continue" on the first read.
+
+	// Another upload of the object already stored it
+	if a.contentStore.Exists(meta) {
+		if meta.conflicts(r.ContentLength) {
+			writeConflict(w, r, meta)
+			return
+		}
+		logRequest(r, 200)
+		return
+	}
+
+	if max := Config.MaxObjectBytes(); max > 0 && (meta.Size > max || r.ContentLength > max) {
+		writeStatus(w, r, 413)
+		return
+	}
+
+	// The content store records an unknown size from the upload, but clients
+	// only get to leave it out if that's allowed
+	if meta.Size <= 0 && !meta.empty() && !Config.IsSizeOptional() {
+		writeStatus(w, r, 422)
+		return
+	}
+
+	size := meta.Size
+	if size <= 0 {
+		size = r.ContentLength
+	}
+
+	// Refuse if the upload can't fit
+	if rc, ok := a.contentStore.(roomChecker); ok {
+		if err := rc.HasRoom(meta, size); err != nil {
+			writeStatus(w, r, 507)
+			return
+		}
+	}
+
+	// A retry of an upload that is still being written waits for it, and
+	// is done if it succeeded
+	claimed, waited := a.uploads.claim(meta.Oid, Config.UploadRetryWait())
+	if waited && a.contentStore.Exists(meta) {
+		if claimed {
+			a.uploads.finish(meta.Oid)
+		}
+		logRequest(r, 200)
+		return
+	}
+	if !claimed {
+		metrics.Add("lfs_upload_conflicts_total", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(Config.UploadRetryWait())))
+		writeStatus(w, r, 409)
+		return
+	}
+	defer a.uploads.finish(meta.Oid)
+
+	// The quotas are checked again, as they may have been lowered since the
+	// batch offered the upload, and the room is held until it's done
+	rejected, err := a.reserveQuota([]*RequestVars{{User: rv.User, Repo: rv.Repo, Oid: meta.Oid, Size: size}}, time.Time{})
+	if err != nil {
+		logger.Log(kv{"fn": "PutHandler", "oid": meta.Oid, "err": err.Error(), "request_id": context.Get(r, "RequestID")})
+		writeStatus(w, r, 500)
+		return
+	}
+	defer a.releaseQuota(meta.Oid)
+	if e := rejected[meta.Oid]; e != nil {
+		writeStatus(w, r, e.Code)
+		return
+	}
+
+	ctx, cancel := withDeadline(r.Context(), Config.UploadDeadlineFor(size))
+	defer cancel()
+
+	meta.hint = uploadHint(r)
+	meta.requested = requested
+	body := newContextReader(ctx, r.Body, http.NewResponseController(w), Config.UploadIdleTime())
+	defer body.Close()
+	if cp, ok := a.contentStore.(contextPutter); ok {
+		err = cp.PutContext(ctx, meta, body)
+	} else {
+		err = a.contentStore.Put(meta, body)
+	}
+	if err == errUploadBusy {
+		// Another process is writing the object, the meta information is
+		// that upload's too
+		metrics.Add("lfs_upload_conflicts_total", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(Config.UploadRetryWait())))
+		writeStatus(w, r, 409)
+		return
+	} else if err != nil {
+		// Another repo may still upload the object, or another process may
+		// have stored it meanwhile; otherwise its meta information goes
+		if !a.contentStore.Exists(meta) {
+			a.metaStore.DeletePending(rv)
+		}
+		logger.Log(kv{"fn": "PutHandler", "oid": meta.Oid, "err": err.Error(), "request_id": context.Get(r, "RequestID")})
+		if body.timedOut() {
+			// The rest of the body isn't read, so the connection can't
+			// take another request
+			metrics.Add("lfs_request_timeouts_total", 1)
+			w.Header().Set("Connection", "close")
+			writeStatus(w, r, 408)
+			return
+		}
+		if deadlineExceeded(ctx) {
+			// The body was read, the backend couldn't write it in time
+			metrics.Add("lfs_request_timeouts_total", 1)
+			writeStatus(w, r, 504)
+			return
+		}
+		w.WriteHeader(500)
+		fmt.Fprintf(w, `{"message":"%s"}`, err)
+		return
+	}
+
+	meta.setVerified()
+	meta.setExpiry(Config.ObjectLifetime())
+	meta.uploaded()
+	if err := a.metaStore.Update(meta); err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, `{"message":"%s"}`, err)
 		return
 	}
+	if tags != nil {
+		if err := a.metaStore.AddTags(meta.Oid, tags); err != nil {
+			logger.Log(kv{"fn": "PutHandler", "oid": meta.Oid, "err": err.Error(), "request_id": context.Get(r, "RequestID")})
+			w.WriteHeader(500)
+			fmt.Fprintf(w, `{"message":"%s"}`, err)
+			return
+		}
+	}
+
+	a.stats.Add(statBytesUploaded, meta.Size)
+	a.stats.Add(statObjectsStored, 1)
+	a.stored(meta)
 
 	logRequest(r, 200)
 }
@@ -376,15 +1198,86 @@ func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	oid := vars["oid"]
-	err := tusServer.Finish(oid, a.contentStore)
+	meta, err := tusServer.Finish(oid, a.contentStore)
+	if err == errTusSessionNotFound {
+		// The session may have been closed by an administrator
+		writeStatus(w, r, 404)
+		return
+	}
+	if err == nil {
+		meta.setVerified()
+		meta.setExpiry(Config.ObjectLifetime())
+		meta.uploaded()
+		err = a.metaStore.Update(meta)
+		a.releaseQuota(oid)
+	}
 
 	if err != nil {
 		logger.Fatal(kv{"fn": "VerifyHandler", "err": fmt.Sprintf("Failed to verify %s: %v", oid, err)})
 	}
 
+	a.stats.Add(statBytesUploaded, meta.Size)
+	a.stats.Add(statObjectsStored, 1)
+	a.stored(meta)
+
 	logRequest(r, 200)
 }
 
+// hasContent returns true if the content of meta can be read, from the
+// content store or from the replica if configured to fall back to it.
+func (a *App) hasContent(meta *MetaObject) bool {
+	if a.contentStore.Exists(meta) {
+		return true
+	}
+	return a.replicator != nil && Config.IsReadingFromReplica() && a.replicator.Exists(meta)
+}
+
+// getContent reads an object for a download, sharing a single backend read
+// between concurrent downloads of the same object if configured to do so.
+func (a *App) getContent(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	if Config.IsCoalescingDownloads() {
+		return a.downloads.Get(meta.Oid, meta.Size, fromByte, func() (io.ReadCloser, error) {
+			return a.readContent(meta, 0)
+		})
+	}
+	return a.readContent(meta, fromByte)
+}
+
+// readContent reads an object from the content store, falling back to the
+// replica if configured to do so.
+func (a *App) readContent(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	var content io.ReadCloser
+	var err error
+	if c, ok := a.contentStore.(cachedGetter); ok {
+		content, err = c.GetCached(meta, fromByte)
+	} else {
+		content, err = a.contentStore.Get(meta, fromByte)
+	}
+	if err == errCorruptObject {
+		a.flagCorrupt(meta)
+	}
+	if err != nil && a.replicator != nil && Config.IsReadingFromReplica() {
+		logger.Log(kv{"fn": "readContent", "oid": meta.Oid, "msg": "reading from replica", "err": err})
+		return a.replicator.Get(meta, fromByte)
+	}
+	return content, err
+}
+
+// flagCorrupt records that the stored content of meta turned out to be
+// corrupt on a read, and quarantines it if scrub failures are quarantined.
+func (a *App) flagCorrupt(meta *MetaObject) {
+	metrics.Add("lfs_corrupt_objects_total", 1)
+	logger.Log(kv{"fn": "readContent", "oid": meta.Oid, "err": errCorruptObject.Error()})
+
+	if q, ok := a.contentStore.(quarantiner); ok && Config.IsQuarantiningScrubFailures() {
+		if err := q.Quarantine(meta); err != nil {
+			logger.Log(kv{"fn": "readContent", "oid": meta.Oid, "msg": "quarantine failed", "err": err.Error()})
+		} else {
+			a.contentChanged(meta.Oid)
+		}
+	}
+}
+
 func (a *App) LocksHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["repo"]
@@ -573,11 +1466,20 @@ func (a *App) Represent(rv *RequestVars, meta *MetaObject, download, upload, use
 	}
 
 	if download {
-		rep.Actions["download"] = &link{Href: rv.DownloadLink(), Header: header}
+		if href, ok := a.cdnLink(meta); ok {
+			// The CDN gets no credentials, only a signature if links are signed
+			rep.Actions["download"] = newLink(href, "GET", nil)
+		} else {
+			rep.Actions["download"] = newLink(rv.DownloadLink(), "GET", header)
+		}
 	}
 
 	if upload {
-		rep.Actions["upload"] = &link{Href: rv.UploadLink(useTus), Header: header}
+		if useTus {
+			rep.Actions["upload"] = &link{Href: rv.UploadLink(useTus), Header: header}
+		} else {
+			rep.Actions["upload"] = newLink(rv.UploadLink(useTus), "PUT", header)
+		}
 		if useTus {
 			rep.Actions["verify"] = &link{Href: rv.VerifyLink(), Header: verifyHeader}
 		}
@@ -585,22 +1487,6 @@ func (a *App) Represent(rv *RequestVars, meta *MetaObject, download, upload, use
 	return rep
 }
 
-func (a *App) requireAuth(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !Config.IsPublic() {
-			user, password, _ := r.BasicAuth()
-			if user, ret := a.metaStore.Authenticate(user, password); !ret {
-				w.Header().Set("WWW-Authenticate", "Basic realm=git-lfs-server")
-				writeStatus(w, r, 401)
-				return
-			} else {
-				context.Set(r, "USER", user)
-			}
-		}
-		h(w, r)
-	}
-}
-
 // ContentMatcher provides a mux.MatcherFunc that only allows requests that contain
 // an Accept header with the contentMediaType
 func ContentMatcher(r *http.Request, m *mux.RouteMatch) bool {
@@ -647,8 +1533,21 @@ func unpack(r *http.Request) *RequestVars {
 	return rv
 }
 
+// uploadHint returns the file name of an upload from its Content-Disposition,
+// or else its media type. The generic application/octet-stream every client
+// sends says nothing, so it's no hint.
+func uploadHint(r *http.Request) string {
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/octet-stream") {
+		return ct
+	}
+	return ""
+}
+
 // TODO cheap hack, unify with unpack
-func unpackBatch(r *http.Request) *BatchVars {
+func unpackBatch(r *http.Request) (*BatchVars, error) {
 	vars := mux.Vars(r)
 
 	var bv BatchVars
@@ -656,16 +1555,17 @@ func unpackBatch(r *http.Request) *BatchVars {
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&bv)
 	if err != nil {
-		return &bv
+		return nil, err
 	}
 
 	for i := 0; i < len(bv.Objects); i++ {
 		bv.Objects[i].User = vars["user"]
 		bv.Objects[i].Repo = vars["repo"]
 		bv.Objects[i].Authorization = r.Header.Get("Authorization")
+		bv.Objects[i].HashAlgo = bv.HashAlgo
 	}
 
-	return &bv
+	return &bv, nil
 }
 
 func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
@@ -683,5 +1583,9 @@ func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
 }
 
 func logRequest(r *http.Request, status int) {
-	logger.Log(kv{"method": r.Method, "url": r.URL, "status": status, "request_id": context.Get(r, "RequestID")})
+	if !accessSampler.keep(r, status) {
+		metrics.Add("lfs_access_logs_sampled_out_total", 1)
+		return
+	}
+	logger.Log(kv{"method": r.Method, "url": r.URL, "status": status, "ip": ClientIP(r), "request_id": context.Get(r, "RequestID")})
 }
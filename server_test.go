@@ -2,250 +2,1501 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TestGetAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+func TestGetAuthed(t *testing.T) {
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	by, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	if string(by) != content {
+		t.Fatalf("expected content to be `content`, got: %s", string(by))
+	}
+}
+
+func TestGetWithFilename(t *testing.T) {
+	path := "/user/repo/objects/" + contentOid + "?filename=" + url.QueryEscape(`my "report".txt`)
+	res, err := api("GET", path, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	expected := `attachment; filename="my \"report\".txt"`
+	if cd := res.Header.Get("Content-Disposition"); cd != expected {
+		t.Fatalf("expected Content-Disposition `%s`, got `%s`", expected, cd)
+	}
+}
+
+func TestGetWithoutFilename(t *testing.T) {
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if cd := res.Header.Get("Content-Disposition"); cd != "" {
+		t.Fatalf("expected no Content-Disposition, got `%s`", cd)
+	}
+}
+
+func TestContentDispositionSanitized(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"evil\r\nSet-Cookie: a=b": `attachment; filename="evilSet-Cookie: a=b"`,
+		"../../etc/passwd":        `attachment; filename=.._.._etc_passwd`,
+		`C:\secret`:               `attachment; filename="C:_secret"`,
+		"..":                      "",
+		"\x00\x7f":                "",
+	} {
+		if cd := contentDisposition(filename); cd != expected {
+			t.Fatalf("expected %q to produce `%s`, got `%s`", filename, expected, cd)
+		}
+	}
+
+	res, err := api("GET", "/user/repo/objects/"+contentOid+"?filename=a%0D%0ASet-Cookie:%20b=c", contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.Header.Get("Set-Cookie") != "" || strings.ContainsAny(res.Header.Get("Content-Disposition"), "\r\n") {
+		t.Fatalf("expected header injection to be stripped, got %v", res.Header)
+	}
+}
+
+func TestHeadContent(t *testing.T) {
+	store := &getCountingStore{objectStore: testContentStore}
+	server := httptest.NewServer(NewApp(store, testMetaStore))
+	defer server.Close()
+
+	head := func(oid string) *http.Response {
+		req, err := http.NewRequest("HEAD", server.URL+"/user/repo/objects/"+oid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := head(contentOid)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res.ContentLength != contentSize {
+		t.Fatalf("expected Content-Length %d, got %d", contentSize, res.ContentLength)
+	}
+	if res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected ranges to be accepted, got %q", res.Header.Get("Accept-Ranges"))
+	}
+	if etag := res.Header.Get("ETag"); etag != `"`+contentOid+`"` {
+		t.Fatalf("expected the oid as ETag, got %q", etag)
+	}
+	if store.gets != 0 {
+		t.Fatalf("expected HEAD not to read the content, read it %d times", store.gets)
+	}
+
+	if res := head(nonExistingOid); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for an unknown object, got %d", res.StatusCode)
+	}
+
+	// Known to the meta store, but without content
+	data := "content never uploaded"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	if res := head(oid); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for an object without content, got %d", res.StatusCode)
+	}
+}
+
+// getCountingStore counts the reads of the store it wraps.
+type getCountingStore struct {
+	objectStore
+	gets int
+}
+
+func (s *getCountingStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	s.gets++
+	return s.objectStore.Get(meta, fromByte)
+}
+
+func TestGetAuthedWithRange(t *testing.T) {
+	req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	fromByte := 5
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fromByte))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 206 {
+		t.Fatalf("expected status 206, got %d", res.StatusCode)
+	}
+	if cr := res.Header.Get("Content-Range"); len(cr) > 0 {
+		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content)-fromByte)
+		if cr != expected {
+			t.Fatalf("expected Content-Range header of %q, got %q", expected, cr)
+		}
+	} else {
+		t.Fatalf("missing Content-Range header in response")
+	}
+
+	by, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	if string(by) != content[fromByte:] {
+		t.Fatalf("expected content to be `content`, got: %s", string(by))
+	}
+}
+
+func TestGetCorrupt(t *testing.T) {
+	meta := putBulkObject(t, "content that gets corrupted", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	if err := ioutil.WriteFile(testContentStore.path(meta), []byte("not gzip"), 0640); err != nil {
+		t.Fatalf("expected to corrupt the object, got: %s", err)
+	}
+
+	res, err := api("GET", "/user/repo/objects/"+meta.Oid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 500 {
+		t.Fatalf("expected status 500 for a corrupt object, got %d", res.StatusCode)
+	}
+}
+
+func TestGetUnAuthed(t *testing.T) {
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestGetBadAuth(t *testing.T) {
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestGetMetaAuthed(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var meta Representation
+	dec := json.NewDecoder(res.Body)
+	dec.Decode(&meta)
+
+	if meta.Oid != contentOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
+	}
+
+	if meta.Size != contentSize {
+		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+	}
+
+	download := meta.Actions["download"]
+	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
+		t.Fatalf("expected download link, got %s", download.Href)
+	}
+}
+
+func TestGetMetaUnAuthed(t *testing.T) {
+	res, err := api("GET", "/user/repo/objects/"+contentOid, metaMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestGetObjectMeta(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid+"/meta", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var fields map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&fields); err != nil {
+		t.Fatalf("expected JSON body, got: %s", err)
+	}
+
+	if fields["oid"] != contentOid {
+		t.Fatalf("expected oid `%s`, got: `%v`", contentOid, fields["oid"])
+	}
+	if fields["size"] != float64(contentSize) {
+		t.Fatalf("expected size `%d`, got: `%v`", contentSize, fields["size"])
+	}
+	if _, ok := fields["Existing"]; ok {
+		t.Fatalf("expected internal fields to be omitted, got: %v", fields)
+	}
+	if _, ok := fields["created_at"]; !ok {
+		t.Fatalf("expected the time the content was stored, got: %v", fields)
+	}
+	if _, ok := fields["refcount"].(float64); !ok {
+		t.Fatalf("expected the number of referencing repos, got: %v", fields)
+	}
+}
+
+func TestGetObjectMetaNotFound(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/"+nonExistingOid+"/meta", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestGetObjectMetaUnAuthed(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid+"/meta", "", "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestGetObjectMetaCompression(t *testing.T) {
+	defer setupAdmin()()
+
+	data := strings.Repeat("compressible content ", 1000)
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data)), User: testUser, Repo: "repo"}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	res, err := api("PUT", "/bilbo/repo/objects/"+oid, contentMediaType, testUser, testPass, bytes.NewBufferString(data))
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("expected the upload to succeed, got %v: %v", res, err)
+	}
+
+	res, err = api("GET", "/bilbo/repo/objects/"+oid+"/meta", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&fields); err != nil {
+		t.Fatalf("expected JSON body, got: %s", err)
+	}
+
+	if _, ok := fields["repos"]; ok {
+		t.Fatalf("expected the repos referencing the object to be omitted, got: %v", fields)
+	}
+
+	info, err := os.Stat(testContentStore.path(&MetaObject{Oid: oid, Size: int64(len(data)), Encoding: encodingGzip}))
+	if err != nil {
+		t.Fatalf("expected the object to be stored compressed, got: %s", err)
+	}
+	if fields["encoding"] != encodingGzip || fields["stored_size"] != float64(info.Size()) {
+		t.Fatalf("expected the gzip file size %d, got %v", info.Size(), fields)
+	}
+	ratio := math.Round(float64(len(data))/float64(info.Size())*1000) / 1000
+	if fields["compression_ratio"] != ratio || ratio < 10 {
+		t.Fatalf("expected a compression ratio of %v, got %v", ratio, fields["compression_ratio"])
+	}
+
+	if listsObject(t, "/admin/objects?max_ratio=2", oid) || !listsObject(t, fmt.Sprintf("/admin/objects?max_ratio=%v", ratio), oid) {
+		t.Fatalf("expected the ratio filter to apply")
+	}
+}
+
+func TestPostAuthedNewObject(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":1234}`, nonExistingOid))
+	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 202 {
+		t.Fatalf("expected status 202, got %d", res.StatusCode)
+	}
+
+	var meta Representation
+	dec := json.NewDecoder(res.Body)
+	dec.Decode(&meta)
+
+	if meta.Oid != nonExistingOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", nonExistingOid, meta.Oid)
+	}
+
+	if meta.Size != 1234 {
+		t.Fatalf("expected to see a size of `1234`, got: `%d`", meta.Size)
+	}
+
+	if download, ok := meta.Actions["download"]; ok {
+		t.Fatalf("expected POST to not contain a download link, got %s", download.Href)
+	}
+
+	upload, ok := meta.Actions["upload"]
+	if !ok {
+		t.Fatal("expected upload link to be present")
+	}
+
+	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+nonExistingOid {
+		t.Fatalf("expected upload link, got %s", upload.Href)
+	}
+}
+
+func TestPostAuthedExistingObject(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
+	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var meta Representation
+	dec := json.NewDecoder(res.Body)
+	dec.Decode(&meta)
+
+	if meta.Oid != contentOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
+	}
+
+	if meta.Size != contentSize {
+		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+	}
+
+	download := meta.Actions["download"]
+	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
+		t.Fatalf("expected download link, got %s", download.Href)
+	}
+
+	upload, ok := meta.Actions["upload"]
+	if !ok {
+		t.Fatalf("expected upload link to be present")
+	}
+
+	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
+		t.Fatalf("expected upload link, got %s", upload.Href)
+	}
+}
+
+func TestPostUnAuthed(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
+	res, err := api("POST", "/bilbo/readonly/objects", metaMediaType, "", "", buf)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestPut(t *testing.T) {
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(content)))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	r, err := testContentStore.Get(&MetaObject{Oid: contentOid}, 0)
+	if err != nil {
+		t.Fatalf("error retreiving from content store: %s", err)
+	} else {
+		defer r.Close()
+	}
+	c, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error reading content: %s", err)
+	}
+	if string(c) != content {
+		t.Fatalf("expected content, got `%s`", string(c))
+	}
+}
+
+func TestPutInsufficientStorage(t *testing.T) {
+	freeSpace := testContentStore.FreeSpace
+	defer func() { testContentStore.FreeSpace = freeSpace }()
+
+	// A stored object is never refused, so upload one that isn't
+	data := "roomless content"
+	oid := "fc623f5d74b75d8566d8a046cc6be06b1a5431ecb8bb48404f6803a517238bbc"
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	testContentStore.FreeSpace = func(string) (uint64, error) { return uint64(len(data)) - 1, nil }
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(data)))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 507 {
+		t.Fatalf("expected status 507, got %d", res.StatusCode)
+	}
+}
+
+func TestPutBusy(t *testing.T) {
+	data := "content written by another process"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	tmp := testContentStore.path(&MetaObject{Oid: oid, Size: int64(len(data)), Encoding: encodingGzip}) + ".tmp"
+	os.MkdirAll(filepath.Dir(tmp), 0750)
+	ioutil.WriteFile(tmp, []byte("partial"), 0640)
+	defer os.Remove(tmp)
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 409 || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected status 409 with Retry-After, got %d", res.StatusCode)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid}); err != nil {
+		t.Fatalf("expected the meta information of the other upload to be kept, got: %s", err)
+	}
+}
+
+func TestPutFailureKeepsObjectsOfOtherRepos(t *testing.T) {
+	data := "content failing to upload"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	for _, repo := range []string{"repo", "fork"} {
+		if _, err := testMetaStore.Put(&RequestVars{User: testUser, Repo: repo, Oid: oid, Size: int64(len(data))}); err != nil {
+			t.Fatalf("expected meta put to succeed, got: %s", err)
+		}
+	}
+	defer removeMeta(oid)
+
+	// Content not matching the oid fails the upload
+	upload := func() int {
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/bilbo/repo/objects/"+oid, bytes.NewBufferString(strings.ToUpper(data)))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := upload(); code != 500 {
+		t.Fatalf("expected status 500, got %d", code)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid}); err != nil {
+		t.Fatalf("expected the object to stay pending for the fork, got: %s", err)
+	}
+
+	// Without the fork nothing else may upload it
+	testMetaStore.Release(oid, "bilbo/fork")
+	if code := upload(); code != 500 {
+		t.Fatalf("expected status 500, got %d", code)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid}); err != errObjectNotFound {
+		t.Fatalf("expected the failed object to be removed, got: %v", err)
+	}
+}
+
+func TestPutSkipCompression(t *testing.T) {
+	defer func(skip []string) { testContentStore.SkipCompression = skip }(testContentStore.SkipCompression)
+	testContentStore.SkipCompression = []string{"application/zip"}
+
+	data := "zipped content"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid, Encoding: encodingIdentity})
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/zip")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil || meta.Encoding != encodingIdentity {
+		t.Fatalf("expected the encoding to be recorded as identity, got %+v: %v", meta, err)
+	}
+
+	r, err := testContentStore.Get(meta, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+	if by, _ := ioutil.ReadAll(r); string(by) != data {
+		t.Fatalf("expected to read the content, got: %q", by)
+	}
+}
+
+func TestPutStorageEncodingHeader(t *testing.T) {
+	defer func(header string) { Config.StorageEncodingHeader = header }(Config.StorageEncodingHeader)
+
+	put := func(data, encoding string) (*MetaObject, int) {
+		sum := sha256.Sum256([]byte(data))
+		oid := hex.EncodeToString(sum[:])
+		if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+			t.Fatalf("expected meta put to succeed, got: %s", err)
+		}
+
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("X-Lfs-Storage-Encoding", encoding)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+		if err != nil {
+			t.Fatalf("expected the meta, got: %s", err)
+		}
+		return meta, res.StatusCode
+	}
+
+	// Ignored unless allowed
+	Config.StorageEncodingHeader = "false"
+	meta, status := put("content with an ignored encoding", "zstd")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+	if status != 200 || meta.Encoding != encodingGzip {
+		t.Fatalf("expected the header to be ignored, got %d and %s", status, meta.Encoding)
+	}
+
+	Config.StorageEncodingHeader = "true"
+	meta, status = put("content with a requested encoding", "ZSTD")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+	if status != 200 || meta.Encoding != encodingZstd {
+		t.Fatalf("expected the requested encoding, got %d and %s", status, meta.Encoding)
+	}
+	r, err := testContentStore.Get(meta, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+	if by, _ := ioutil.ReadAll(r); string(by) != "content with a requested encoding" {
+		t.Fatalf("expected to read the content, got: %q", by)
+	}
+
+	// Tags sent along are recorded without losing the encoding
+	data := "content with a requested encoding and tags"
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("X-Lfs-Storage-Encoding", "zstd")
+	req.Header.Set("X-Lfs-Tags", `{"build":"42"}`)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	meta, err = testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
+		t.Fatalf("expected the meta, got: %s", err)
+	}
+	defer testContentStore.Delete(meta)
+	if res.StatusCode != 200 || meta.Encoding != encodingZstd || meta.Tags["build"] != "42" {
+		t.Fatalf("expected the requested encoding and the tags, got %d and %+v", res.StatusCode, meta)
+	}
+
+	meta, status = put("content with an unknown encoding", "brotli")
+	defer removeMeta(meta.Oid)
+	if status != 400 || meta.Encoding != "" {
+		t.Fatalf("expected an unknown encoding to be refused, got %d and %s", status, meta.Encoding)
+	}
+}
+
+func TestPutChecksumHeader(t *testing.T) {
+	data := "checksummed content"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	put := func(checksum string) (int, bool) {
+		body := &trackingReader{r: strings.NewReader(data)}
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, body)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.ContentLength = int64(len(data))
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("X-Lfs-SHA256", checksum)
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode, body.read
+	}
+
+	if status, read := put(contentOid); status != 400 || read {
+		t.Fatalf("expected a checksum of another object to get 400 without sending the body, got %d (body sent: %v)", status, read)
+	}
+	if testContentStore.Exists(&MetaObject{Oid: oid}) {
+		t.Fatalf("expected nothing to be stored")
+	}
+
+	if status, read := put(strings.ToUpper(oid)); status != 200 || !read {
+		t.Fatalf("expected a matching checksum to be uploaded, got %d (body sent: %v)", status, read)
+	}
+	if !testContentStore.Exists(&MetaObject{Oid: oid}) {
+		t.Fatalf("expected the object to be stored")
+	}
+}
+
+func TestPutExpectContinue(t *testing.T) {
+	defer func(max string) { Config.MaxObjectSize = max }(Config.MaxObjectSize)
+
+	data := "oversized content"
+	oid := "f5d23f09513a01295f7ca38bf4dc6765110ccaf74c6af2c91f9b4ff581135a3c"
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	put := func(oid, data string) (int, bool) {
+		body := &trackingReader{r: strings.NewReader(data)}
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, body)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.ContentLength = int64(len(data))
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Expect", "100-continue")
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode, body.read
+	}
+
+	Config.MaxObjectSize = strconv.Itoa(len(data) - 1)
+	if status, read := put(oid, data); status != 413 || read {
+		t.Fatalf("expected an oversized upload to get 413 without sending its body, got %d (body sent: %v)", status, read)
+	}
+
+	// The limit doesn't matter for an object that's already stored
+	if status, read := put(contentOid, content); status != 200 || read {
+		t.Fatalf("expected an upload of a stored object to get 200 without sending its body, got %d (body sent: %v)", status, read)
+	}
+}
+
+// trackingReader records whether it was read from.
+type trackingReader struct {
+	r    io.Reader
+	read bool
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.r.Read(p)
+}
+
+func TestPutUnknownSize(t *testing.T) {
+	defer func(optional string) { Config.SizeOptional = optional }(Config.SizeOptional)
+
+	data := "unsized content"
+	oid := "e00c3d372d7401b5564fa780452f9b1817dfdaf42814a423b5690e82d84532ac"
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	put := func() int {
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	Config.SizeOptional = "false"
+	if status := put(); status != 422 {
+		t.Fatalf("expected an upload without a size to be refused with 422, got %d", status)
+	}
+
+	Config.SizeOptional = "true"
+	if status := put(); status != 200 {
+		t.Fatalf("expected an upload without a size to succeed, got %d", status)
+	}
+
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil {
+		t.Fatalf("expected meta to exist, got: %s", err)
+	}
+	if meta.Size != int64(len(data)) {
+		t.Fatalf("expected the uploaded size to be recorded, got %d", meta.Size)
+	}
+}
+
+func TestPutDeadlineExceeded(t *testing.T) {
+	defer func(timeout string) { Config.UploadTimeout = timeout }(Config.UploadTimeout)
+	Config.UploadTimeout = "100ms"
+
+	data := "slowly sent content"
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	// Each byte arrives well within any idle timeout, but all of them take
+	// longer than the deadline
+	body := &slowReader{data: []byte(data), delay: 20 * time.Millisecond}
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, body)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 408 {
+		t.Fatalf("expected status 408, got %d", res.StatusCode)
+	}
+	if d := time.Since(start); d > time.Duration(len(data))*20*time.Millisecond {
+		t.Fatalf("expected the upload to be aborted at the deadline, took %s", d)
+	}
+
+	meta := &MetaObject{Oid: oid}
+	if testContentStore.Exists(meta) {
+		t.Fatalf("expected no content to be stored")
+	}
+	if _, err := os.Stat(testContentStore.path(meta) + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be removed, got: %v", err)
+	}
+}
+
+func TestGetDeadlineStalledClient(t *testing.T) {
+	defer func(timeout string) { Config.DownloadTimeout = timeout }(Config.DownloadTimeout)
+	Config.DownloadTimeout = "200ms"
+
+	// Large enough not to fit in the socket buffers
+	meta := putBulkObject(t, strings.Repeat("stalled download ", 4<<20), "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(lfsServer.URL, "http://"))
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("expected to connect, got: %s", err)
 	}
+	defer conn.Close()
 
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/bilbo/repo/objects/"+meta.Oid, nil)
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	timeouts := metrics.Get("lfs_request_timeouts_total")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("expected to send the request, got: %s", err)
 	}
 
-	by, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
+	// The client never reads, so the server's writes block until the
+	// deadline interrupts them
+	for deadline := time.Now().Add(5 * time.Second); metrics.Get("lfs_request_timeouts_total") == timeouts; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the download to a stalled client to be aborted at its deadline")
+		}
 	}
 
-	if string(by) != content {
-		t.Fatalf("expected content to be `content`, got: %s", string(by))
+	n, _ := io.Copy(ioutil.Discard, conn)
+	if n >= meta.Size {
+		t.Fatalf("expected the aborted download to be truncated, got %d bytes", n)
 	}
 }
 
-func TestGetAuthedWithRange(t *testing.T) {
-	req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+func TestPutDeadlineScalesWithSize(t *testing.T) {
+	defer func(timeout, perGB string) {
+		Config.UploadTimeout, Config.UploadTimeoutPerGB = timeout, perGB
+	}(Config.UploadTimeout, Config.UploadTimeoutPerGB)
+	// The 100ms deadline grows by about 50ms a byte
+	Config.UploadTimeout = "100ms"
+	Config.UploadTimeoutPerGB = "15000h"
+
+	if d := Config.UploadDeadlineFor(1 << 30); d != 15000*time.Hour+100*time.Millisecond {
+		t.Fatalf("expected the deadline of a GiB to include its allowance, got %s", d)
+	}
+	if d := Config.UploadDeadlineFor(0); d != 100*time.Millisecond {
+		t.Fatalf("expected an unknown size to get the base deadline, got %s", d)
+	}
+
+	// Sent well past the base deadline, within that of its size
+	data := "slowly sent large content"
+	defer testContentStore.Delete(&MetaObject{Oid: hex.EncodeToString(sha256Sum(data))})
+	if status, d := timedPut(t, lfsServer.URL, data, &slowReader{data: []byte(data), delay: 20 * time.Millisecond}); status != 200 || d < 300*time.Millisecond {
+		t.Fatalf("expected the progressing upload to be stored after 300ms, got status %d in %s", status, d)
+	}
+
+	// The same size stalling after a byte is aborted at its deadline
+	stalled := "stalled sent large content"
+	release := make(chan struct{})
+	defer close(release)
+	body := io.MultiReader(strings.NewReader(stalled[:1]), &blockingReader{release: release})
+	if status, d := timedPut(t, lfsServer.URL, stalled, body); status != 408 || d > 2*time.Second {
+		t.Fatalf("expected the stalled upload to be aborted with 408, got status %d in %s", status, d)
+	}
+}
+
+func TestPutIdleTimeout(t *testing.T) {
+	defer func(timeout, idle string) {
+		Config.UploadTimeout, Config.UploadIdleTimeout = timeout, idle
+	}(Config.UploadTimeout, Config.UploadIdleTimeout)
+	Config.UploadTimeout = "1h"
+	Config.UploadIdleTimeout = "100ms"
+
+	// Each byte arrives within the idle timeout, all of them well after it
+	data := "content sent slowly but steadily"
+	defer testContentStore.Delete(&MetaObject{Oid: hex.EncodeToString(sha256Sum(data))})
+	if status, d := timedPut(t, lfsServer.URL, data, &slowReader{data: []byte(data), delay: 20 * time.Millisecond}); status != 200 || d < 300*time.Millisecond {
+		t.Fatalf("expected the progressing upload to be stored after 300ms, got status %d in %s", status, d)
+	}
+
+	// Stalling after a byte ends the upload long before its deadline
+	stalled := "content whose client stops sending"
+	release := make(chan struct{})
+	defer close(release)
+	body := io.MultiReader(strings.NewReader(stalled[:1]), &blockingReader{release: release})
+	if status, d := timedPut(t, lfsServer.URL, stalled, body); status != 408 || d > 2*time.Second {
+		t.Fatalf("expected the stalled upload to be aborted with 408, got status %d in %s", status, d)
+	}
+	if _, err := os.Stat(testContentStore.path(&MetaObject{Oid: hex.EncodeToString(sha256Sum(stalled))}) + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be removed, got: %v", err)
+	}
+}
+
+func TestPutDeadlineSlowBackend(t *testing.T) {
+	defer func(timeout, perGB string) {
+		Config.UploadTimeout, Config.UploadTimeoutPerGB = timeout, perGB
+	}(Config.UploadTimeout, Config.UploadTimeoutPerGB)
+	// The 100ms deadline grows by about 50ms a byte
+	Config.UploadTimeout = "100ms"
+	Config.UploadTimeoutPerGB = "15000h"
+
+	data := "written slowly by the backend"
+	stalled := "never written by the backend"
+	stalledOid := hex.EncodeToString(sha256Sum(stalled))
+	release := make(chan struct{})
+	defer close(release)
+
+	// A backend taking well past the base deadline to write, or forever
+	store := NewMemoryStore()
+	store.Hook = func(op string, meta *MetaObject) error {
+		if op != memoryPut {
+			return nil
+		}
+		if meta.Oid == stalledOid {
+			<-release
+		} else {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return nil
+	}
+	server := httptest.NewServer(NewApp(store, testMetaStore))
+	defer server.Close()
+
+	if status, d := timedPut(t, server.URL, data, strings.NewReader(data)); status != 200 || d < 300*time.Millisecond {
+		t.Fatalf("expected the slowly written upload to be stored after 300ms, got status %d in %s", status, d)
+	}
+	if !store.Exists(&MetaObject{Oid: hex.EncodeToString(sha256Sum(data))}) {
+		t.Fatalf("expected the backend to hold the object")
+	}
+
+	if status, d := timedPut(t, server.URL, stalled, strings.NewReader(stalled)); status != 504 || d > 2*time.Second {
+		t.Fatalf("expected the stalled write to be aborted with 504, got status %d in %s", status, d)
+	}
+	if store.Exists(&MetaObject{Oid: stalledOid}) {
+		t.Fatalf("expected the backend not to hold the aborted object")
+	}
+}
+
+// timedPut uploads data to the server at url, reading the body from body,
+// and returns the status and how long it took. The meta of data is removed
+// again, its content isn't.
+func timedPut(t *testing.T, url, data string, body io.Reader) (int, time.Duration) {
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	req, err := http.NewRequest("PUT", url+"/user/repo/objects/"+oid, body)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
 	req.SetBasicAuth(testUser, testPass)
 	req.Header.Set("Accept", contentMediaType)
-	fromByte := 5
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fromByte))
+	req.Header.Set("Content-Type", "application/octet-stream")
 
+	start := time.Now()
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("response error: %s", err)
 	}
+	res.Body.Close()
+	return res.StatusCode, time.Since(start)
+}
 
-	if res.StatusCode != 206 {
-		t.Fatalf("expected status 206, got %d", res.StatusCode)
+// blockingReader blocks reads until release is closed.
+type blockingReader struct {
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.release
+	return 0, io.EOF
+}
+
+// slowReader returns one byte of data per read, after delay.
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
 	}
-	if cr := res.Header.Get("Content-Range"); len(cr) > 0 {
-		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content)-fromByte)
-		if cr != expected {
-			t.Fatalf("expected Content-Range header of %q, got %q", expected, cr)
-		}
-	} else {
-		t.Fatalf("missing Content-Range header in response")
+	time.Sleep(r.delay)
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestBatchPartialDownloadErrors(t *testing.T) {
+	corrupt := plantCorruptMeta(t)
+	defer removeMeta(corrupt)
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":1},{"oid":"%s","size":1}]}`, contentOid, contentSize, corrupt, nonExistingOid))
+	batch := batchRequest(t, buf)
+
+	if len(batch.Objects) != 3 {
+		t.Fatalf("expected a result for every object, got %d", len(batch.Objects))
 	}
 
-	by, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
+	if obj := batch.Objects[0]; obj.Error != nil || obj.Actions["download"] == nil {
+		t.Fatalf("expected a download action for the healthy object, got %+v", obj)
 	}
 
-	if string(by) != content[fromByte:] {
-		t.Fatalf("expected content to be `content`, got: %s", string(by))
+	if obj := batch.Objects[1]; obj.Oid != corrupt || obj.Error == nil || obj.Error.Code != 500 || obj.Error.Message == "" || len(obj.Actions) > 0 {
+		t.Fatalf("expected an internal error for the corrupt object, got %+v", obj)
+	}
+
+	if obj := batch.Objects[2]; obj.Error == nil || obj.Error.Code != 404 {
+		t.Fatalf("expected a not found error for the missing object, got %+v", obj)
 	}
 }
 
-func TestGetUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+func TestBatchPartialUploadErrors(t *testing.T) {
+	corrupt := plantCorruptMeta(t)
+	defer removeMeta(corrupt)
+
+	upload := strings.Repeat("c", 64)
+	defer removeMeta(upload)
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":1},{"oid":"%s","size":1}]}`, corrupt, upload))
+	batch := batchRequest(t, buf)
+
+	if len(batch.Objects) != 2 {
+		t.Fatalf("expected a result for every object, got %d", len(batch.Objects))
 	}
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	if obj := batch.Objects[0]; obj.Error == nil || obj.Error.Code != 500 {
+		t.Fatalf("expected an internal error for the corrupt object, got %+v", obj)
+	}
+
+	if obj := batch.Objects[1]; obj.Oid != upload || obj.Error != nil || obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the new object, got %+v", obj)
 	}
 }
 
-func TestGetBadAuth(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
+func TestBatchMalformed(t *testing.T) {
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, bytes.NewBufferString(`{"operation":`))
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
 	}
 }
 
-func TestGetMetaAuthed(t *testing.T) {
-	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
+func TestSizeConflict(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":%d}]}`, contentOid, contentSize+1, contentOid, contentSize))
+	batch := batchRequest(t, buf)
+	if err := batch.Objects[0].Error; err == nil || err.Code != 409 || !strings.Contains(err.Message, "size") {
+		t.Fatalf("expected a batch upload with another size to conflict, got %+v", batch.Objects[0])
+	}
+	if batch.Objects[1].Error != nil {
+		t.Fatalf("expected a batch upload with the stored size to succeed, got %+v", batch.Objects[1].Error)
+	}
+
+	res, err := api("POST", "/user/repo/objects", metaMediaType, testUser, testPass, bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s","size":%d}`, contentOid, contentSize+1)))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 409 {
+		t.Fatalf("expected a legacy upload with another size to conflict, got %d", res.StatusCode)
+	}
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, bytes.NewBufferString(content+"!"))
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	var msg struct{ Message string }
+	json.NewDecoder(res.Body).Decode(&msg)
+	res.Body.Close()
+	if res.StatusCode != 409 || !strings.Contains(msg.Message, contentOid) {
+		t.Fatalf("expected an upload of another size to conflict, got %d: %q", res.StatusCode, msg.Message)
+	}
+}
+
+func TestBatchHashAlgo(t *testing.T) {
+	content := "sha512 content"
+	sum := sha512.Sum512([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid, HashAlgo: hashSHA512})
+
+	body := fmt.Sprintf(`{"operation":"upload","hash_algo":"sha512","objects":[{"oid":"%s","size":%d}]}`, oid, len(content))
+	batch := batchRequest(t, bytes.NewBufferString(body))
+	if batch.HashAlgo != hashSHA512 {
+		t.Fatalf("expected the algorithm to be echoed, got %q", batch.HashAlgo)
+	}
+	if len(batch.Objects) != 1 || batch.Objects[0].Actions["upload"] == nil {
+		t.Fatalf("expected an upload action, got %+v", batch.Objects)
+	}
 
+	res, err := api("PUT", "/user/repo/objects/"+oid, contentMediaType, testUser, testPass, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
 	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+		t.Fatalf("expected the sha512 upload to be verified, got status %d", res.StatusCode)
 	}
 
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil || meta.HashAlgo != hashSHA512 {
+		t.Fatalf("expected the algorithm to be recorded, got %+v: %v", meta, err)
+	}
 
-	if meta.Oid != contentOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
+	res, err = api("GET", "/user/repo/objects/"+oid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	by, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(by) != content {
+		t.Fatalf("expected to download the sha512 object, got %d: %q", res.StatusCode, by)
 	}
 
-	if meta.Size != contentSize {
-		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+	for _, op := range []string{"download", "upload"} {
+		batch = batchRequest(t, bytes.NewBufferString(fmt.Sprintf(`{"operation":"%s","objects":[{"oid":"%s","size":%d}]}`, op, oid, len(content))))
+		if len(batch.Objects) != 1 || batch.Objects[0].Error == nil || batch.Objects[0].Error.Code != 409 {
+			t.Fatalf("expected a sha256 %s of the sha512 object to conflict, got %+v", op, batch.Objects)
+		}
 	}
 
-	download := meta.Actions["download"]
-	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected download link, got %s", download.Href)
+	batch = batchRequest(t, bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize)))
+	if batch.HashAlgo != hashSHA256 {
+		t.Fatalf("expected batches without an algorithm to be sha256, got %q", batch.HashAlgo)
 	}
 }
 
-func TestGetMetaUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, metaMediaType, "", "", nil)
+func TestBatchUnsupportedHashAlgo(t *testing.T) {
+	body := fmt.Sprintf(`{"operation":"download","hash_algo":"md5","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize)
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("response error: %s", err)
 	}
-
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409 for an unsupported algorithm, got %d", res.StatusCode)
 	}
 }
 
-func TestPostAuthedNewObject(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":1234}`, nonExistingOid))
-	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
+func TestBatchTransferNegotiation(t *testing.T) {
+	for _, transfers := range []string{``, `"transfers":["basic"],`, `"transfers":["lfs-standalone-file","basic"],`} {
+		body := fmt.Sprintf(`{"operation":"download",%s"objects":[{"oid":"%s","size":%d}]}`, transfers, contentOid, contentSize)
+		if batch := batchRequest(t, bytes.NewBufferString(body)); batch.Transfer != transferBasic {
+			t.Fatalf("expected basic to be chosen for %s, got %q", transfers, batch.Transfer)
+		}
+	}
+
+	body := fmt.Sprintf(`{"operation":"download","transfers":["lfs-standalone-file"],"objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize)
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("response error: %s", err)
 	}
+	res.Body.Close()
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422 without a common transfer, got %d", res.StatusCode)
+	}
+}
 
-	if res.StatusCode != 202 {
-		t.Fatalf("expected status 202, got %d", res.StatusCode)
+func TestNegotiateTransfer(t *testing.T) {
+	defer func(v string) { Config.UseTus = v }(Config.UseTus)
+
+	Config.UseTus = "true"
+	if transfer, _ := negotiateTransfer("upload", []string{"basic", "tus"}); transfer != transferTus {
+		t.Fatalf("expected tus to be preferred for uploads, got %q", transfer)
+	}
+	if transfer, _ := negotiateTransfer("download", []string{"basic", "tus"}); transfer != transferBasic {
+		t.Fatalf("expected basic for downloads, got %q", transfer)
 	}
 
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
+	Config.UseTus = "false"
+	if transfer, _ := negotiateTransfer("upload", []string{"basic", "tus"}); transfer != transferBasic {
+		t.Fatalf("expected basic without tus, got %q", transfer)
+	}
+	if _, ok := negotiateTransfer("upload", []string{"tus"}); ok {
+		t.Fatalf("expected no transfer for a client only supporting tus without it")
+	}
+}
 
-	if meta.Oid != nonExistingOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", nonExistingOid, meta.Oid)
+func TestEmptyObject(t *testing.T) {
+	empty := &MetaObject{Oid: emptyOids[hashSHA256]}
+	defer removeMeta(empty.Oid)
+	defer testContentStore.Delete(empty)
+
+	body := fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":0}]}`, empty.Oid)
+	if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Actions["upload"] == nil {
+		t.Fatalf("expected an upload action for the empty object, got %+v", obj)
 	}
 
-	if meta.Size != 1234 {
-		t.Fatalf("expected to see a size of `1234`, got: `%d`", meta.Size)
+	res, err := api("PUT", "/user/repo/objects/"+empty.Oid, contentMediaType, testUser, testPass, bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 for an empty upload, got %d", res.StatusCode)
 	}
 
-	if download, ok := meta.Actions["download"]; ok {
-		t.Fatalf("expected POST to not contain a download link, got %s", download.Href)
+	if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Actions["upload"] != nil {
+		t.Fatalf("expected no upload action once the empty object is stored, got %+v", obj)
 	}
 
-	upload, ok := meta.Actions["upload"]
-	if !ok {
-		t.Fatal("expected upload link to be present")
+	// Downloads don't read the store, so they work even without the file
+	testContentStore.Delete(empty)
+	for _, method := range []string{"GET", "HEAD"} {
+		res, err = api(method, "/user/repo/objects/"+empty.Oid, contentMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || len(data) != 0 || res.ContentLength != 0 {
+			t.Fatalf("expected an empty %s response, got status %d with %d bytes", method, res.StatusCode, len(data))
+		}
 	}
+}
 
-	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+nonExistingOid {
-		t.Fatalf("expected upload link, got %s", upload.Href)
+func TestSeedEmptyObject(t *testing.T) {
+	oid := emptyOids[hashSHA256]
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	// Seeding twice, as on every start, is fine
+	for i := 0; i < 2; i++ {
+		if err := seedEmptyObject(testMetaStore, testContentStore); err != nil {
+			t.Fatalf("expected seeding to succeed, got: %s", err)
+		}
+	}
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil || !meta.Pinned || !testContentStore.Exists(meta) {
+		t.Fatalf("expected the empty object to be stored and pinned, got %+v: %v", meta, err)
+	}
+
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":0}]}`, oid)
+	if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Actions["download"] == nil {
+		t.Fatalf("expected the seeded object to be downloadable, got %+v", obj)
 	}
 }
 
-func TestPostAuthedExistingObject(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
-	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
+func batchRequest(t *testing.T, buf *bytes.Buffer) *BatchResponse {
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
+
 	if res.StatusCode != 200 {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
-
-	if meta.Oid != contentOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
 	}
+	return &batch
+}
 
-	if meta.Size != contentSize {
-		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+// plantCorruptMeta stores an undecodable meta entry and returns its oid.
+func plantCorruptMeta(t *testing.T) string {
+	oid := strings.Repeat("b", 64)
+	err := testMetaStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).Put([]byte(oid), []byte("not a gob"))
+	})
+	if err != nil {
+		t.Fatalf("expected to plant corrupt meta, got: %s", err)
 	}
+	return oid
+}
 
-	download := meta.Actions["download"]
-	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected download link, got %s", download.Href)
-	}
+func removeMeta(oid string) {
+	testMetaStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).Delete([]byte(oid))
+	})
+}
 
-	upload, ok := meta.Actions["upload"]
-	if !ok {
-		t.Fatalf("expected upload link to be present")
+func TestBatchLinksOmitExpiryWhenUnsigned(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize))
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
 	}
 
-	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected upload link, got %s", upload.Href)
+	body, _ := ioutil.ReadAll(res.Body)
+	if bytes.Contains(body, []byte("expires_")) {
+		t.Fatalf("expected unsigned links to have no expiry, got: %s", body)
 	}
 }
 
-func TestPostUnAuthed(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
-	res, err := api("POST", "/bilbo/readonly/objects", metaMediaType, "", "", buf)
+func TestBatchSignedLinksExpire(t *testing.T) {
+	defer func(key, lifetime string) {
+		Config.SigningKey, Config.LinkLifetime = key, lifetime
+	}(Config.SigningKey, Config.LinkLifetime)
+	Config.SigningKey = "secret"
+	Config.LinkLifetime = "10m"
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize))
+	res, err := api("POST", "/user/repo/objects/batch", metaMediaType, testUser, testPass, buf)
 	if err != nil {
-		t.Fatalf("response error: %s", err)
+		t.Fatalf("request error: %s", err)
 	}
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected batch response, got error: %s", err)
 	}
-}
 
-func TestPut(t *testing.T) {
-	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+	download := batch.Objects[0].Actions["download"]
+	if download == nil {
+		t.Fatalf("expected a download action")
+	}
+	if download.ExpiresIn != 600 {
+		t.Fatalf("expected expires_in of 600, got %d", download.ExpiresIn)
+	}
+	if download.ExpiresAt == nil {
+		t.Fatalf("expected expires_at to be set")
+	}
+	if d := download.ExpiresAt.Sub(time.Now()); d < 9*time.Minute || d > 10*time.Minute {
+		t.Fatalf("expected expires_at about 10 minutes from now, got %s", d)
 	}
-	req.SetBasicAuth(testUser, testPass)
-	req.Header.Set("Accept", contentMediaType)
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(content)))
 
-	res, err := http.DefaultClient.Do(req)
+	// The signed href authorizes the download without credentials
+	path := strings.TrimPrefix(download.Href, "http://localhost:8080")
+	res, err = api("GET", path, contentMediaType, "", "", nil)
 	if err != nil {
-		t.Fatalf("response error: %s", err)
+		t.Fatalf("request error: %s", err)
 	}
-
 	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+		t.Fatalf("expected signed download to return 200, got %d", res.StatusCode)
 	}
 
-	r, err := testContentStore.Get(&MetaObject{Oid: contentOid}, 0)
+	res, err = api("GET", path+"0", contentMediaType, "", "", nil)
 	if err != nil {
-		t.Fatalf("error retreiving from content store: %s", err)
-	} else {
-		defer r.Close()
+		t.Fatalf("request error: %s", err)
 	}
-	c, err := ioutil.ReadAll(r)
+	if res.StatusCode != 401 {
+		t.Fatalf("expected tampered signature to return 401, got %d", res.StatusCode)
+	}
+
+	res, err = api("PUT", path, contentMediaType, "", "", bytes.NewBufferString(content))
 	if err != nil {
-		t.Fatalf("error reading content: %s", err)
+		t.Fatalf("request error: %s", err)
 	}
-	if string(c) != content {
-		t.Fatalf("expected content, got `%s`", string(c))
+	if res.StatusCode != 401 {
+		t.Fatalf("expected download signature to be rejected for upload, got %d", res.StatusCode)
 	}
 }
 
@@ -536,6 +1787,8 @@ const (
 func TestMain(m *testing.M) {
 	os.Remove("lfs-test.db")
 
+	bcryptCost = bcrypt.MinCost
+
 	var err error
 	testMetaStore, err = NewMetaStore("lfs-test.db")
 	if err != nil {
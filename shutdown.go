@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ShutdownHooks runs the registered cleanup functions of each subsystem when
+// the server exits, so buffered work is flushed rather than lost.
+type ShutdownHooks struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownHooks = &ShutdownHooks{}
+)
+
+// Register adds a hook. Hooks run in the order they were registered.
+func (s *ShutdownHooks) Register(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, shutdownHook{name, fn})
+	s.mu.Unlock()
+}
+
+// Run calls every hook in order. All hooks share a single deadline of timeout,
+// after which the context passed to them is cancelled. A failing hook is
+// logged and does not prevent the remaining hooks from running.
+func (s *ShutdownHooks) Run(timeout time.Duration) {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, h := range hooks {
+		if err := h.fn(ctx); err != nil {
+			logger.Log(kv{"fn": "shutdown", "hook": h.name, "err": err})
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooksRunInOrder(t *testing.T) {
+	hooks := &ShutdownHooks{}
+
+	var order []string
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		hooks.Register(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	hooks.Run(time.Second)
+
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "third" {
+		t.Fatalf("expected hooks to run in registration order, got %v", order)
+	}
+}
+
+func TestShutdownHooksShareDeadline(t *testing.T) {
+	hooks := &ShutdownHooks{}
+
+	var cancelled bool
+	hooks.Register("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	hooks.Register("after", func(ctx context.Context) error {
+		cancelled = ctx.Err() != nil
+		return nil
+	})
+
+	start := time.Now()
+	hooks.Run(20 * time.Millisecond)
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected shutdown to honor the drain timeout")
+	}
+	if !cancelled {
+		t.Fatalf("expected later hooks to see the expired deadline")
+	}
+}
+
+func TestShutdownDrainsReplication(t *testing.T) {
+	primary, secondary := NewMemoryStore(), NewMemoryStore()
+	secondary.Hook = func(op string, meta *MetaObject) error {
+		if op == memoryPut {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+
+	m := &MetaObject{Oid: contentOid, Size: contentSize}
+	if err := primary.Put(m, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	r := NewReplicator(primary, secondary)
+	r.Start()
+	r.Enqueue(m)
+
+	hooks := &ShutdownHooks{}
+	hooks.Register("replication", r.Drain)
+	hooks.Run(5 * time.Second)
+
+	if !secondary.Exists(m) {
+		t.Fatalf("expected queued object to be replicated before shutdown completed")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	stdcontext "context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// resizer is implemented by stores where the location of an object depends
+// on its size, so correcting a recorded size also means moving it.
+type resizer interface {
+	// Find returns the content of meta wherever the store holds it, which
+	// for a wrong recorded size isn't where Get looks.
+	Find(meta *MetaObject) (io.ReadCloser, error)
+	Resize(meta *MetaObject, size int64) error
+}
+
+// Find returns the content of meta from whichever size class, under
+// whichever root, holds it.
+func (s *ContentStore) Find(meta *MetaObject) (io.ReadCloser, error) {
+	if s.inlined(meta) {
+		return s.Get(meta, 0)
+	}
+	path, ok := s.locate(meta)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return s.open(path, meta, 0)
+}
+
+// Resize moves the content of meta, wherever it is, to where objects of size
+// are kept. The caller records the new size.
+func (s *ContentStore) Resize(meta *MetaObject, size int64) error {
+	if s.inlined(meta) {
+		return nil
+	}
+
+	sized := *meta
+	sized.Size = size
+
+	from, ok := s.locate(meta)
+	if !ok {
+		return os.ErrNotExist
+	}
+	to := s.path(&sized)
+	if from == to {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0750); err != nil {
+		return err
+	}
+	return moveFile(from, to)
+}
+
+// locate returns the file holding the content of meta. Where its recorded
+// size puts it is tried first, then every size class under every root, as
+// the size or the roots may have changed since it was written.
+func (s *ContentStore) locate(meta *MetaObject) (string, bool) {
+	path := s.path(meta)
+	if _, err := os.Stat(path); err == nil {
+		return path, true
+	}
+
+	// Only the root and the size class differ between the candidates
+	rel, err := filepath.Rel(filepath.Join(s.root(meta.Oid), s.sizeClass(meta.Size)), path)
+	if err != nil {
+		return "", false
+	}
+	classes := []string{""}
+	for _, c := range s.SizeClasses {
+		classes = append(classes, c.Name)
+	}
+	for _, root := range s.roots() {
+		for _, class := range classes {
+			p := filepath.Join(root, class, rel)
+			if _, err := os.Stat(p); err == nil {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// AdminSizeEntry is the outcome of checking the recorded size of an object:
+// ok, fixed (or to be fixed, on a dry run), corrupt (the content doesn't hash
+// to the oid, so its length can't be trusted either) or error.
+type AdminSizeEntry struct {
+	Oid          string `json:"oid"`
+	Result       string `json:"result"`
+	RecordedSize int64  `json:"recorded_size"`
+	ActualSize   int64  `json:"actual_size,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// AdminSizeResponse reports the objects checked. For the whole store only
+// those that aren't ok are listed.
+type AdminSizeResponse struct {
+	DryRun  bool              `json:"dry_run,omitempty"`
+	Checked int               `json:"checked"`
+	Objects []*AdminSizeEntry `json:"objects"`
+}
+
+// adminFixSizeHandler checks the recorded size of one object against its
+// content, and corrects it unless called with ?dry_run=true.
+func (a *App) adminFixSizeHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	context.Set(r, "AUDIT_TARGET", oid)
+
+	meta, err := a.metaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err == errObjectNotFound {
+		writeAdminError(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+
+	dryRun := isTrue(r.FormValue("dry_run"))
+	context.Set(r, "AUDIT_DRY_RUN", dryRun)
+	writeAdminJSON(w, r, 200, &AdminSizeResponse{
+		DryRun:  dryRun,
+		Checked: 1,
+		Objects: []*AdminSizeEntry{a.fixSize(meta, dryRun)},
+	})
+}
+
+// adminFixSizesHandler checks the recorded sizes of every object, as
+// adminFixSizeHandler does for one. Each object is read in full, so this
+// takes as long as reading the whole store.
+func (a *App) adminFixSizesHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := isTrue(r.FormValue("dry_run"))
+	context.Set(r, "AUDIT_DRY_RUN", dryRun)
+	res, err := a.fixSizes(r.Context(), dryRun, nil)
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	context.Set(r, "AUDIT_TARGET", "all objects")
+	writeAdminJSON(w, r, 200, res)
+}
+
+// fixSizes checks the recorded sizes of every object that isn't deleted,
+// correcting them unless dryRun is set, and lists those that aren't ok. It
+// ends early with the error of ctx once done, and calls progress, if set,
+// with the objects checked so far.
+func (a *App) fixSizes(ctx stdcontext.Context, dryRun bool, progress func(checked int)) (*AdminSizeResponse, error) {
+	res := &AdminSizeResponse{DryRun: dryRun, Objects: []*AdminSizeEntry{}}
+
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		meta, err := a.metaStore.NextObject(after)
+		if err != nil {
+			return res, err
+		}
+		if meta == nil {
+			return res, nil
+		}
+		after = meta.Oid
+		if meta.DeletedAt != nil {
+			continue
+		}
+
+		res.Checked++
+		if e := a.fixSize(meta, dryRun); e.Result != "ok" {
+			res.Objects = append(res.Objects, e)
+		}
+		if progress != nil {
+			progress(res.Checked)
+		}
+	}
+}
+
+// fixSize measures the content of meta and records its actual size if it
+// differs, unless dryRun is set. Content and meta are then changed with the
+// upload of the object claimed, so an object being uploaded is left alone.
+func (a *App) fixSize(meta *MetaObject, dryRun bool) *AdminSizeEntry {
+	e := &AdminSizeEntry{Oid: meta.Oid, RecordedSize: meta.Size}
+	fail := func(err error) *AdminSizeEntry {
+		logger.Log(kv{"fn": "fixSize", "oid": meta.Oid, "err": err.Error()})
+		e.Result, e.Error = "error", err.Error()
+		return e
+	}
+
+	if !dryRun {
+		if claimed, _ := a.uploads.claim(meta.Oid, 0); !claimed {
+			return fail(errUploadBusy)
+		}
+		defer a.uploads.finish(meta.Oid)
+
+		// Read it again, as it may have changed before it was claimed
+		stored, err := a.metaStore.UnsafeGet(&RequestVars{Oid: meta.Oid})
+		if err != nil {
+			return fail(err)
+		}
+		*meta = *stored
+		e.RecordedSize = meta.Size
+	}
+
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return fail(err)
+	}
+	// The recorded size may put the object in the wrong size class
+	rs, resizes := a.contentStore.(resizer)
+	var content io.ReadCloser
+	if resizes {
+		content, err = rs.Find(meta)
+	} else {
+		content, err = a.contentStore.Get(meta, 0)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	n, err := io.Copy(hash, content)
+	content.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	e.ActualSize = n
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		logger.Log(kv{"fn": "fixSize", "oid": meta.Oid, "err": errHashMismatch.Error()})
+		e.Result = "corrupt"
+		return e
+	}
+	if n == meta.Size {
+		// An object found on another root goes back where it belongs
+		if resizes && !dryRun {
+			if err := rs.Resize(meta, n); err != nil {
+				return fail(err)
+			}
+		}
+		e.Result = "ok"
+		return e
+	}
+
+	logger.Log(kv{"fn": "fixSize", "oid": meta.Oid, "recorded_size": meta.Size, "actual_size": n, "dry_run": dryRun})
+	e.Result = "fixed"
+	if dryRun {
+		return e
+	}
+
+	if resizes {
+		if err := rs.Resize(meta, n); err != nil {
+			return fail(err)
+		}
+	}
+	meta.Size = n
+	if err := a.metaStore.Update(meta); err != nil {
+		return fail(err)
+	}
+	return e
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminFixSize(t *testing.T) {
+	defer setupAdmin()()
+
+	meta := putBulkObject(t, "object with a wrong size", "repo")
+	defer removeMeta(meta.Oid)
+	defer testContentStore.Delete(meta)
+
+	actual := meta.Size
+	meta.Size = actual + 10
+	if err := testMetaStore.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	entry := fixSizeRequest(t, "/admin/objects/"+meta.Oid+"/fix-size?dry_run=true")
+	if entry.Result != "fixed" || entry.RecordedSize != actual+10 || entry.ActualSize != actual {
+		t.Fatalf("expected the wrong size to be detected, got %+v", entry)
+	}
+	if stored, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: meta.Oid}); stored.Size != actual+10 {
+		t.Fatalf("expected a dry run to leave the size, got %d", stored.Size)
+	}
+
+	if entry := fixSizeRequest(t, "/admin/objects/"+meta.Oid+"/fix-size"); entry.Result != "fixed" {
+		t.Fatalf("expected the size to be fixed, got %+v", entry)
+	}
+	if stored, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: meta.Oid}); stored.Size != actual {
+		t.Fatalf("expected the size to be corrected to %d, got %d", actual, stored.Size)
+	}
+
+	if entry := fixSizeRequest(t, "/admin/objects/"+meta.Oid+"/fix-size"); entry.Result != "ok" {
+		t.Fatalf("expected the corrected size to be ok, got %+v", entry)
+	}
+	if res := adminAPI(t, "POST", "/admin/objects/"+strings.Repeat("0", 64)+"/fix-size", ""); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a missing object, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminFixSizes(t *testing.T) {
+	defer setupAdmin()()
+
+	wrong := putBulkObject(t, "one of many objects with a wrong size", "repo")
+	defer removeMeta(wrong.Oid)
+	defer testContentStore.Delete(wrong)
+	right := putBulkObject(t, "one of many objects with the right size", "repo")
+	defer removeMeta(right.Oid)
+	defer testContentStore.Delete(right)
+
+	wrong.Size = 1
+	if err := testMetaStore.Update(wrong); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	res := adminAPI(t, "POST", "/admin/objects/fix-sizes?dry_run=true", "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var result AdminSizeResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected a size report, got: %s", err)
+	}
+	if !result.DryRun || result.Checked < 2 {
+		t.Fatalf("expected a dry run over the store, got %+v", result)
+	}
+
+	var found *AdminSizeEntry
+	for _, e := range result.Objects {
+		if e.Oid == right.Oid {
+			t.Fatalf("expected objects with the right size not to be listed, got %+v", e)
+		}
+		if e.Oid == wrong.Oid {
+			found = e
+		}
+	}
+	if found == nil || found.Result != "fixed" || found.RecordedSize != 1 {
+		t.Fatalf("expected the wrong size to be reported, got %+v", found)
+	}
+}
+
+func TestFixSizeMovesSizeClass(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.SizeClasses = []SizeClass{{Name: "small", MaxSize: 10}, {Name: "large"}}
+
+	data := "content of the large size class"
+	meta := putScrubObject(t, testMetaStore, contentStore, data)
+	defer removeMeta(meta.Oid)
+
+	// Record a size of the small class for the large object, which stays
+	// in the large class
+	meta.Size = 5
+	if err := testMetaStore.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	app := NewApp(contentStore, testMetaStore)
+	if e := app.fixSize(meta, false); e.Result != "fixed" || e.ActualSize != int64(len(data)) {
+		t.Fatalf("expected the size to be fixed, got %+v", e)
+	}
+	if _, err := os.Stat(contentStore.path(meta)); err != nil || !strings.Contains(contentStore.path(meta), "large") {
+		t.Fatalf("expected the object to move to the large class, got: %v", err)
+	}
+	if !contentStore.Exists(meta) {
+		t.Fatalf("expected the object to be found by its corrected size")
+	}
+}
+
+func TestFixSizeSkipsObjectsBeingUploaded(t *testing.T) {
+	setup()
+	defer teardown()
+
+	data := "object being uploaded"
+	meta := putScrubObject(t, testMetaStore, contentStore, data)
+	defer removeMeta(meta.Oid)
+	meta.Size = 5
+	if err := testMetaStore.Update(meta); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+
+	app := NewApp(contentStore, testMetaStore)
+	if claimed, _ := app.uploads.claim(meta.Oid, 0); !claimed {
+		t.Fatalf("expected to claim the upload")
+	}
+	if e := app.fixSize(meta, false); e.Result != "error" || e.Error != errUploadBusy.Error() {
+		t.Fatalf("expected an object being uploaded to be skipped, got %+v", e)
+	}
+	if stored, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: meta.Oid}); stored.Size != 5 {
+		t.Fatalf("expected the size of an object being uploaded to be left, got %d", stored.Size)
+	}
+
+	app.uploads.finish(meta.Oid)
+	if e := app.fixSize(meta, false); e.Result != "fixed" || e.ActualSize != int64(len(data)) {
+		t.Fatalf("expected the size to be fixed once uploaded, got %+v", e)
+	}
+}
+
+func TestFixSizeFindsObjectOnAnotherRoot(t *testing.T) {
+	setup()
+	defer teardown()
+	contentStore.Roots = []string{"content-store-test/disk0", "content-store-test/disk1"}
+
+	meta := putScrubObject(t, testMetaStore, contentStore, "content left on the wrong root")
+	defer removeMeta(meta.Oid)
+
+	// Move the object to the root it doesn't belong on
+	at := contentStore.path(meta)
+	other := "content-store-test/disk0"
+	if contentStore.root(meta.Oid) == other {
+		other = "content-store-test/disk1"
+	}
+	rel, _ := filepath.Rel(contentStore.root(meta.Oid), at)
+	misplaced := filepath.Join(other, rel)
+	os.MkdirAll(filepath.Dir(misplaced), 0750)
+	if err := os.Rename(at, misplaced); err != nil {
+		t.Fatalf("expected the object to be moved, got: %s", err)
+	}
+
+	app := NewApp(contentStore, testMetaStore)
+	if e := app.fixSize(meta, false); e.Result != "ok" || e.ActualSize != meta.Size {
+		t.Fatalf("expected the object to be found and measured, got %+v", e)
+	}
+	if !contentStore.Exists(meta) {
+		t.Fatalf("expected the object to be moved back to its root")
+	}
+}
+
+func fixSizeRequest(t *testing.T, path string) *AdminSizeEntry {
+	res := adminAPI(t, "POST", path, "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var result AdminSizeResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil || len(result.Objects) != 1 {
+		t.Fatalf("expected the size of one object, got %+v: %v", result, err)
+	}
+	return result.Objects[0]
+}
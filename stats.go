@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Lifetime counters kept by LifetimeStats.
+const (
+	statBytesUploaded   = "bytes_uploaded"
+	statBytesDownloaded = "bytes_downloaded"
+	statObjectsStored   = "objects_stored"
+)
+
+// LifetimeStats keeps counters that survive restarts, such as the bytes ever
+// uploaded. Counts are gathered in memory and written to the meta store every
+// Interval, so they cost no write per request, and a crash loses at most the
+// counts since the last write.
+type LifetimeStats struct {
+	meta *MetaStore
+
+	// Interval is how often counts are written to the meta store.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewLifetimeStats creates a LifetimeStats writing to meta. Call Start to
+// write counts periodically.
+func NewLifetimeStats(meta *MetaStore, interval time.Duration) *LifetimeStats {
+	return &LifetimeStats{meta: meta, Interval: interval, pending: make(map[string]int64)}
+}
+
+// Start exposes the stored counters as metrics and launches the background
+// writer.
+func (s *LifetimeStats) Start() error {
+	stored, err := s.meta.Stats()
+	if err != nil {
+		return err
+	}
+	for name, value := range stored {
+		metrics.Add(statMetric(name), value)
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					logger.Log(kv{"fn": "stats", "err": err.Error()})
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Add counts delta towards the counter name. It does nothing on a nil
+// LifetimeStats, so callers needn't check whether stats are kept.
+func (s *LifetimeStats) Add(name string, delta int64) {
+	if s == nil || delta == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	s.pending[name] += delta
+	s.mu.Unlock()
+	metrics.Add(statMetric(name), delta)
+}
+
+// Flush writes the counts gathered since the last write.
+func (s *LifetimeStats) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]int64)
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := s.meta.AddStats(pending); err != nil {
+		// Keep the counts for the next try
+		s.mu.Lock()
+		for name, delta := range pending {
+			s.pending[name] += delta
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns the counters, including counts not written yet.
+func (s *LifetimeStats) Snapshot() (map[string]int64, error) {
+	stats, err := s.meta.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, delta := range s.pending {
+		stats[name] += delta
+	}
+	return stats, nil
+}
+
+// Drain stops the background writer and writes the remaining counts. It is
+// meant to be registered as a shutdown hook.
+func (s *LifetimeStats) Drain(ctx context.Context) error {
+	if s.stop != nil {
+		close(s.stop)
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.Flush()
+}
+
+func statMetric(name string) string {
+	return "lfs_lifetime_" + name + "_total"
+}
+
+// adminStatsHandler returns the lifetime counters.
+func (a *App) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.stats == nil {
+		writeAdminError(w, r, 404, "Lifetime stats aren't kept")
+		return
+	}
+
+	stats, err := a.stats.Snapshot()
+	if err != nil {
+		writeAdminError(w, r, 500, err.Error())
+		return
+	}
+	for _, name := range []string{statBytesUploaded, statBytesDownloaded, statObjectsStored} {
+		if _, ok := stats[name]; !ok {
+			stats[name] = 0
+		}
+	}
+	writeAdminJSON(w, r, 200, stats)
+}
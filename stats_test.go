@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLifetimeStatsSurviveReopen(t *testing.T) {
+	os.Remove("lfs-stats-test.db")
+	defer os.Remove("lfs-stats-test.db")
+
+	meta, err := NewMetaStore("lfs-stats-test.db")
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+
+	s := NewLifetimeStats(meta, time.Hour)
+	s.Add(statBytesUploaded, 100)
+	s.Add(statBytesUploaded, 23)
+	s.Add(statObjectsStored, 2)
+
+	// Counts are written in batches, not as they come in
+	if stored, _ := meta.Stats(); len(stored) != 0 {
+		t.Fatalf("expected nothing to be written before a flush, got %v", stored)
+	}
+	if snapshot, _ := s.Snapshot(); snapshot[statBytesUploaded] != 123 {
+		t.Fatalf("expected unwritten counts in the snapshot, got %v", snapshot)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+	s.Add(statBytesUploaded, 7)
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("expected drain to succeed, got: %s", err)
+	}
+	meta.Close()
+
+	meta, err = NewMetaStore("lfs-stats-test.db")
+	if err != nil {
+		t.Fatalf("error reopening meta store: %s", err)
+	}
+	defer meta.Close()
+
+	snapshot, err := NewLifetimeStats(meta, time.Hour).Snapshot()
+	if err != nil {
+		t.Fatalf("expected snapshot to succeed, got: %s", err)
+	}
+	if snapshot[statBytesUploaded] != 130 || snapshot[statObjectsStored] != 2 {
+		t.Fatalf("expected the counts to survive, got %v", snapshot)
+	}
+}
+
+func TestAdminStatsCountTransfers(t *testing.T) {
+	defer setupAdmin()()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.stats = NewLifetimeStats(testMetaStore, time.Hour)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	before := adminStats(t, server)
+
+	data := "counted content"
+	sum := sha256.Sum256([]byte(data))
+	oid := hex.EncodeToString(sum[:])
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	for _, method := range []string{"PUT", "GET", "GET"} {
+		req, _ := http.NewRequest(method, server.URL+"/user/repo/objects/"+oid, nil)
+		if method == "PUT" {
+			req.Body = ioutil.NopCloser(bytes.NewBufferString(data))
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 for %s, got %d", method, res.StatusCode)
+		}
+	}
+
+	if err := app.stats.Flush(); err != nil {
+		t.Fatalf("expected flush to succeed, got: %s", err)
+	}
+	after := adminStats(t, server)
+
+	size := int64(len(data))
+	if after[statBytesUploaded]-before[statBytesUploaded] != size ||
+		after[statBytesDownloaded]-before[statBytesDownloaded] != 2*size ||
+		after[statObjectsStored]-before[statObjectsStored] != 1 {
+		t.Fatalf("expected one upload and two downloads of %d bytes, went from %v to %v", size, before, after)
+	}
+	if metrics.Get(statMetric(statBytesDownloaded)) < 2*size {
+		t.Fatalf("expected the downloads in the metrics")
+	}
+}
+
+func adminStats(t *testing.T, server *httptest.Server) map[string]int64 {
+	req, _ := http.NewRequest("GET", server.URL+"/admin/stats", nil)
+	req.SetBasicAuth(testAdminUser, testAdminPass)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var stats map[string]int64
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatalf("expected stats, got: %s", err)
+	}
+	return stats
+}
@@ -0,0 +1,7 @@
+package main
+
+// syncDir does nothing on windows, where a directory can't be synced, so
+// renames are left to the filesystem.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"time"
+)
+
+// syslogQueue is the number of entries waiting for syslog before new ones go
+// to the fallback instead.
+const syslogQueue = 1024
+
+// syslogRetry is how long after failing to reach syslog it's tried again.
+var syslogRetry = 5 * time.Second
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// SyslogSink sends log entries to syslog from a goroutine of its own, so a
+// slow or unreachable syslog never holds up logging. Entries it can't send,
+// or that don't fit in its queue, are written to Fallback instead.
+type SyslogSink struct {
+	network  string
+	addr     string
+	facility syslog.Priority
+	tag      string
+
+	// Fallback receives the entries syslog doesn't, os.Stderr by default.
+	Fallback io.Writer
+
+	entries chan syslogEntry
+}
+
+type syslogEntry struct {
+	err     bool
+	msg     string
+	flushed chan struct{}
+}
+
+// NewSyslogSink returns a sink sending to the syslog at address, given as
+// "udp://host:port" or "tcp://host:port", or to the local syslog daemon if
+// it's empty. Entries are sent with facility, as in "local0", and tag.
+func NewSyslogSink(address, facility, tag string) (*SyslogSink, error) {
+	s := &SyslogSink{tag: tag, Fallback: os.Stderr, entries: make(chan syslogEntry, syslogQueue)}
+
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown syslog facility: %q", facility)
+	}
+	s.facility = f
+
+	if address != "" {
+		parts := strings.SplitN(address, "://", 2)
+		if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") || parts[1] == "" {
+			return nil, fmt.Errorf("Syslog address isn't given as udp://host:port or tcp://host:port: %q", address)
+		}
+		s.network, s.addr = parts[0], parts[1]
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Send queues msg for syslog, at the error severity if err is set and the
+// info one otherwise.
+func (s *SyslogSink) Send(err bool, msg string) {
+	select {
+	case s.entries <- syslogEntry{err: err, msg: msg}:
+	default:
+		metrics.Add("lfs_syslog_dropped_total", 1)
+		fmt.Fprintln(s.Fallback, msg)
+	}
+}
+
+// Flush waits up to timeout for the entries queued so far to be sent.
+func (s *SyslogSink) Flush(timeout time.Duration) {
+	flushed := make(chan struct{})
+	wait := time.NewTimer(timeout)
+	defer wait.Stop()
+
+	select {
+	case s.entries <- syslogEntry{flushed: flushed}:
+	case <-wait.C:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-wait.C:
+	}
+}
+
+func (s *SyslogSink) run() {
+	var (
+		w       *syslog.Writer
+		retryAt time.Time
+	)
+	for e := range s.entries {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
+
+		if w == nil && time.Now().After(retryAt) {
+			var err error
+			if w, err = syslog.Dial(s.network, s.addr, s.facility|syslog.LOG_INFO, s.tag); err != nil {
+				fmt.Fprintf(s.Fallback, "syslog is unreachable, logging here for %s: %s\n", syslogRetry, err)
+				w, retryAt = nil, time.Now().Add(syslogRetry)
+			}
+		}
+		if w == nil {
+			fmt.Fprintln(s.Fallback, e.msg)
+			continue
+		}
+
+		write := w.Info
+		if e.err {
+			write = w.Err
+		}
+		if err := write(e.msg); err != nil {
+			metrics.Add("lfs_syslog_errors_total", 1)
+			fmt.Fprintln(s.Fallback, e.msg)
+			w.Close()
+			w = nil
+		}
+	}
+}
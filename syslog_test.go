@@ -0,0 +1,124 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadErrorIsSentToSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected a syslog receiver, got: %s", err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp://"+conn.LocalAddr().String(), "local3", "lfs-syslog-test")
+	if err != nil {
+		t.Fatalf("expected the syslog sink, got: %s", err)
+	}
+	logger.Syslog = sink
+	defer func() { logger.Syslog = nil }()
+
+	// Content not matching its oid fails in the content store
+	data := "content sent to syslog"
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+oid, strings.NewReader(strings.ToUpper(data)))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode < 400 {
+		t.Fatalf("expected the upload to fail, got %d", res.StatusCode)
+	}
+
+	// local3 is facility 19, at the error severity 3
+	buf := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected the upload error to reach syslog, got: %s", err)
+		}
+		msg := string(buf[:n])
+		if strings.Contains(msg, "fn=PutHandler") && strings.Contains(msg, oid) {
+			if !strings.HasPrefix(msg, "<155>") || !strings.Contains(msg, "lfs-syslog-test") || !strings.Contains(msg, "err=") {
+				t.Fatalf("expected the error at local3.err with its tag, got %q", msg)
+			}
+			break
+		}
+	}
+}
+
+func TestUnreachableSyslogFallsBack(t *testing.T) {
+	// Nothing listens on a port just closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected a listener, got: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	sink, err := NewSyslogSink("tcp://"+addr, "daemon", "lfs-syslog-test")
+	if err != nil {
+		t.Fatalf("expected the syslog sink, got: %s", err)
+	}
+	fallback := &lockedBuffer{}
+	sink.Fallback = fallback
+
+	start := time.Now()
+	for i := 0; i < 2*syslogQueue; i++ {
+		sink.Send(false, "entry kept in the fallback")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected sending not to wait for syslog, took %s", d)
+	}
+	sink.Flush(5 * time.Second)
+	if out := fallback.String(); !strings.Contains(out, "syslog is unreachable") || strings.Count(out, "entry kept in the fallback") != 2*syslogQueue {
+		t.Fatalf("expected every entry in the fallback, got %d", strings.Count(out, "entry kept in the fallback"))
+	}
+
+	for _, c := range [][2]string{{"", "nope"}, {"http://host:514", "daemon"}, {"udp://", "daemon"}} {
+		if _, err := NewSyslogSink(c[0], c[1], "lfs"); err == nil {
+			t.Errorf("expected address %q with facility %q to be refused", c[0], c[1])
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to write to from the goroutine of a
+// sink while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// SyslogSink isn't implemented on windows, which has no syslog.
+type SyslogSink struct{}
+
+// NewSyslogSink always fails on windows.
+func NewSyslogSink(address, facility, tag string) (*SyslogSink, error) {
+	return nil, errors.New("Syslog is not available on windows")
+}
+
+// Send does nothing on windows.
+func (s *SyslogSink) Send(err bool, msg string) {}
+
+// Flush does nothing on windows.
+func (s *SyslogSink) Flush(timeout time.Duration) {}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// errTagsTooLarge is returned for tags over the configured limit, including
+// tags an upload would add to those an object already has.
+var errTagsTooLarge = errors.New("Tags exceed the configured size")
+
+// tagNamePattern limits tag names to what fits a filter unambiguously.
+var tagNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// validateTags checks the names of tags and that, encoded as JSON, they fit
+// in the configured limit.
+func validateTags(tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	for name := range tags {
+		if !tagNamePattern.MatchString(name) {
+			return fmt.Errorf("Invalid tag name: %q", name)
+		}
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > Config.MaxTagBytes() {
+		return errTagsTooLarge
+	}
+	return nil
+}
+
+// parseTagsHeader parses and validates tags given as a JSON object in the
+// X-Lfs-Tags header of an upload of meta, which they have to fit on along
+// with the tags it has and those its batch left pending. An empty header has
+// no tags.
+func parseTagsHeader(v string, meta *MetaObject) (map[string]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(v), &tags); err != nil {
+		return nil, fmt.Errorf("Invalid tags: %s", err)
+	}
+	if err := validateTags(tags); err != nil {
+		return nil, err
+	}
+
+	merged := &MetaObject{}
+	merged.addTags(meta.Tags)
+	merged.addTags(meta.PendingTags)
+	merged.addTags(tags)
+	return tags, validateTags(merged.Tags)
+}
+
+// addTags sets tags on the object, replacing the values of tags it already
+// has, and returns false if that changed nothing. Tags are key/value pairs
+// clients attach to an object, such as the build that uploaded it, for later
+// auditing; they never affect its content or where it's stored.
+func (m *MetaObject) addTags(tags map[string]string) bool {
+	changed := false
+	for name, value := range tags {
+		if v, ok := m.Tags[name]; ok && v == value {
+			continue
+		}
+		if m.Tags == nil {
+			m.Tags = make(map[string]string)
+		}
+		m.Tags[name] = value
+		changed = true
+	}
+	return changed
+}
+
+// addUploadTags adds the tags an upload batch gave the object, to its tags
+// if its content is stored, and otherwise to PendingTags until it is. It
+// returns false if that changed nothing.
+func (m *MetaObject) addUploadTags(tags map[string]string) bool {
+	if !m.Pending {
+		return m.addTags(tags)
+	}
+	pending := &MetaObject{Tags: m.PendingTags}
+	changed := pending.addTags(tags)
+	m.PendingTags = pending.Tags
+	return changed
+}
+
+// validateAllTags checks that the tags of the object, together with those
+// pending, fit in the configured limit.
+func (m *MetaObject) validateAllTags() error {
+	merged := &MetaObject{}
+	merged.addTags(m.Tags)
+	merged.addTags(m.PendingTags)
+	return validateTags(merged.Tags)
+}
+
+// hasTag returns true if the object matches filter, either "name" for any
+// value of the tag or "name:value" for one.
+func (m *MetaObject) hasTag(filter string) bool {
+	parts := strings.SplitN(filter, ":", 2)
+	v, ok := m.Tags[parts[0]]
+	if len(parts) == 1 {
+		return ok
+	}
+	return ok && v == parts[1]
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatchUploadTags(t *testing.T) {
+	defer setupAdmin()()
+
+	tagged := hex.EncodeToString(sha256Sum("object uploaded by a build"))
+	other := hex.EncodeToString(sha256Sum("object uploaded by another build"))
+	defer removeMeta(tagged)
+	defer removeMeta(other)
+
+	for oid, build := range map[string]string{tagged: "1234", other: "5678"} {
+		body := fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":10,"tags":{"build":"%s","commit":"abc123"}}]}`, oid, build)
+		if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Error != nil {
+			t.Fatalf("expected the tagged upload to be accepted, got %+v", obj.Error)
+		}
+	}
+
+	// The tags wait for the upload to store the objects
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: tagged})
+	if err != nil || len(meta.Tags) != 0 || meta.PendingTags["build"] != "1234" || meta.PendingTags["commit"] != "abc123" {
+		t.Fatalf("expected the tags to be kept pending, got %+v: %v", meta, err)
+	}
+	if listsObject(t, "/admin/objects?tag=build:1234", tagged) {
+		t.Fatalf("expected pending tags not to match a filter")
+	}
+	for _, oid := range []string{tagged, other} {
+		meta, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+		meta.uploaded()
+		if err := testMetaStore.Update(meta); err != nil {
+			t.Fatalf("expected meta update to succeed, got: %s", err)
+		}
+	}
+	if meta, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: tagged}); meta.Tags["build"] != "1234" || meta.PendingTags != nil {
+		t.Fatalf("expected the stored object to be tagged, got %+v", meta)
+	}
+	if err := testMetaStore.Update(&MetaObject{Oid: tagged, Size: 10}); err != nil {
+		t.Fatalf("expected meta update to succeed, got: %s", err)
+	}
+	if meta, _ := testMetaStore.UnsafeGet(&RequestVars{Oid: tagged}); meta.Tags["build"] != "1234" {
+		t.Fatalf("expected an update to keep the tags, got %v", meta.Tags)
+	}
+
+	res := adminAPI(t, "GET", "/admin/objects?tag=build:1234", "")
+	var objects []*MetaObject
+	if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+		t.Fatalf("expected an object list, got: %s", err)
+	}
+	if len(objects) != 1 || objects[0].Oid != tagged {
+		t.Fatalf("expected only the object of build 1234, got %d objects", len(objects))
+	}
+	if !listsObject(t, "/admin/objects?tag=commit", other) || listsObject(t, "/admin/objects?tag=commit&tag=build:1234", other) {
+		t.Fatalf("expected every tag filter to apply")
+	}
+}
+
+func TestBatchUploadInvalidTags(t *testing.T) {
+	defer func(v string) { Config.MaxTagsSize = v }(Config.MaxTagsSize)
+	Config.MaxTagsSize = "64"
+
+	oid := hex.EncodeToString(sha256Sum("object with too many tags"))
+	defer removeMeta(oid)
+
+	for _, tags := range []string{
+		`{"build":"` + strings.Repeat("1", 64) + `"}`,
+		`{"build id":"1234"}`,
+	} {
+		body := fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":10,"tags":%s}]}`, oid, tags)
+		obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]
+		if obj.Error == nil || obj.Error.Code != 422 {
+			t.Fatalf("expected tags %s to be refused with 422, got %+v", tags, obj.Error)
+		}
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid}); err != errObjectNotFound {
+		t.Fatalf("expected no object to be recorded for refused tags, got: %v", err)
+	}
+
+	// Tags added to those already stored count towards the limit as well
+	body := fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":10,"tags":{"build":"%s"}}]}`, oid, strings.Repeat("1", 40))
+	if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Error != nil {
+		t.Fatalf("expected the tags to be accepted, got %+v", obj.Error)
+	}
+	body = fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":10,"tags":{"commit":"%s"}}]}`, oid, strings.Repeat("a", 40))
+	if obj := batchRequest(t, bytes.NewBufferString(body)).Objects[0]; obj.Error == nil || obj.Error.Code != 422 {
+		t.Fatalf("expected the combined tags to be refused with 422, got %+v", obj.Error)
+	}
+}
+
+func TestPutTagsHeader(t *testing.T) {
+	data := "object tagged on upload"
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data)), User: testUser, Repo: "repo"}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	if res := putTagged(t, oid, data, `{"build":`); res.StatusCode != 422 {
+		t.Fatalf("expected status 422 for malformed tags, got %d", res.StatusCode)
+	}
+	if res := putTagged(t, oid, data, `{"build":"1234"}`); res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	res, err := api("GET", "/"+testUser+"/repo/objects/"+oid+"/meta", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	var meta MetaObject
+	if err := json.NewDecoder(res.Body).Decode(&meta); err != nil || meta.Tags["build"] != "1234" {
+		t.Fatalf("expected the tags in the object metadata, got %+v: %v", meta, err)
+	}
+	if meta.Oid != oid || meta.Size != int64(len(data)) {
+		t.Fatalf("expected the tags to leave the object alone, got %+v", meta)
+	}
+}
+
+func TestPutTagsHeaderOnlyTagsStoredUploads(t *testing.T) {
+	data := "object tagged by its upload only"
+	oid := hex.EncodeToString(sha256Sum(data))
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data)), User: testUser, Repo: "repo"}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	defer removeMeta(oid)
+	defer testContentStore.Delete(&MetaObject{Oid: oid})
+
+	// An upload that fails verification tags nothing
+	if res := putTagged(t, oid, strings.ToUpper(data), `{"build":"bad"}`); res.StatusCode != 500 {
+		t.Fatalf("expected status 500 for the wrong content, got %d", res.StatusCode)
+	}
+	if meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid}); err == nil && meta.Tags != nil {
+		t.Fatalf("expected a failed upload not to tag the object, got %v", meta.Tags)
+	}
+
+	if _, err := testMetaStore.Put(&RequestVars{Oid: oid, Size: int64(len(data)), User: testUser, Repo: "repo"}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+	if res := putTagged(t, oid, data, `{"build":"1234"}`); res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// Uploading the stored object again leaves its tags alone
+	if res := putTagged(t, oid, data, `{"build":"5678"}`); res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: oid})
+	if err != nil || meta.Tags["build"] != "1234" {
+		t.Fatalf("expected only the upload storing the object to tag it, got %+v: %v", meta, err)
+	}
+}
+
+func putTagged(t *testing.T, oid, data, tags string) *http.Response {
+	req, _ := http.NewRequest("PUT", lfsServer.URL+"/"+testUser+"/repo/objects/"+oid, bytes.NewBufferString(data))
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("X-Lfs-Tags", tags)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	return res
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// withDeadline returns a context of parent that is done after d, or only
+// when canceled if d is 0.
+func withDeadline(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, d)
+}
+
+// deadlineExceeded returns true if ctx ended because its deadline passed.
+func deadlineExceeded(ctx context.Context) bool {
+	return ctx.Err() == context.DeadlineExceeded
+}
+
+// timedOut returns true if err is the deadline of ctx passing, or a network
+// deadline set from it, which may fire just before ctx is done.
+func timedOut(ctx context.Context, err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return deadlineExceeded(ctx)
+}
+
+// contextReader fails reads once ctx is done, so a client sending slowly
+// enough never to be idle still can't keep an upload going past its
+// deadline, and once the client sent nothing for idle, so a stalled upload
+// ends long before it. Before every read it moves the read deadline of the
+// connection to whichever comes first, which ends a read waiting on a client
+// that stopped sending too. Stores see the error like any other read error
+// and clean up. Close must be called once the body isn't read anymore.
+type contextReader struct {
+	ctx     context.Context
+	r       io.Reader
+	rc      *http.ResponseController
+	idle    time.Duration
+	expired bool
+}
+
+func newContextReader(ctx context.Context, r io.Reader, rc *http.ResponseController, idle time.Duration) *contextReader {
+	return &contextReader{ctx: ctx, r: r, rc: rc, idle: idle}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		r.expired = true
+		return 0, err
+	}
+
+	deadline, _ := r.ctx.Deadline()
+	if r.idle > 0 {
+		if d := time.Now().Add(r.idle); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	r.rc.SetReadDeadline(deadline)
+
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && timedOut(r.ctx, err) {
+		r.expired = true
+	}
+	return n, err
+}
+
+// timedOut returns true if a read failed because the deadline passed or the
+// client was idle for too long.
+func (r *contextReader) timedOut() bool {
+	return r.expired
+}
+
+// Close clears the read deadline for the next request on the connection.
+func (r *contextReader) Close() error {
+	return r.rc.SetReadDeadline(time.Time{})
+}
+
+// contextWriter fails writes once ctx is done, ending a download that a
+// client reads too slowly to finish before its deadline.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// contextPutter is implemented by content backends whose writes can be cut
+// short, like remote ones whose own fixed timeouts would fail large objects.
+// PutHandler gives them the deadline of the upload, scaled by its size.
+type contextPutter interface {
+	PutContext(ctx context.Context, meta *MetaObject, r io.Reader) error
+}
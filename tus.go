@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,12 +21,31 @@ type TusServer struct {
 	tusBaseUrl  string
 	httpClient  *http.Client
 	oidToTusUrl map[string]string
+	createdAt   map[string]time.Time
 }
 
+// tusRequestTimeout bounds the requests made to the tus server, which
+// otherwise hold up everything waiting on serverMutex if it hangs.
+const tusRequestTimeout = 30 * time.Second
+
 var (
 	tusServer *TusServer = &TusServer{}
+
+	errTusSessionNotFound = errors.New("Upload session not found")
+	errTusSessionActive   = errors.New("Upload session is active")
 )
 
+// TusSession describes an upload session on the tus server. Age is in
+// seconds. A session is active if data was received within the idle period.
+type TusSession struct {
+	ID        string    `json:"id"`
+	Oid       string    `json:"oid"`
+	Received  int64     `json:"received"`
+	CreatedAt time.Time `json:"created_at"`
+	Age       int64     `json:"age"`
+	Active    bool      `json:"active"`
+}
+
 // Start launches the tus server & stores uploads in the given contentPath
 func (t *TusServer) Start() {
 	t.serverMutex.Lock()
@@ -85,8 +106,9 @@ func (t *TusServer) Start() {
 	procWait.Wait()
 	logger.Log(kv{"fn": "Start", "msg": "Tus server started"})
 	t.tusBaseUrl = fmt.Sprintf("http://%s:%s/files/", host, port)
-	t.httpClient = &http.Client{}
+	t.httpClient = &http.Client{Timeout: tusRequestTimeout}
 	t.oidToTusUrl = make(map[string]string)
+	t.createdAt = make(map[string]time.Time)
 }
 
 func (t *TusServer) Stop() {
@@ -124,35 +146,125 @@ func (t *TusServer) Create(oid string, size int64) (string, error) {
 		return "", fmt.Errorf("Missing Location header in tus response")
 	}
 	t.oidToTusUrl[oid] = loc
+	t.createdAt[oid] = time.Now()
 	return loc, nil
 }
 
 // Move the finished uploaded data from TUS to the content store (called by verify)
-func (t *TusServer) Finish(oid string, store *ContentStore) error {
+func (t *TusServer) Finish(oid string, store objectStore) (*MetaObject, error) {
 	t.serverMutex.Lock()
 	defer t.serverMutex.Unlock()
 
 	loc, ok := t.oidToTusUrl[oid]
 	if !ok {
-		return fmt.Errorf("Unable to find upload for %s", oid)
+		return nil, errTusSessionNotFound
 	}
-	parts := strings.Split(loc, "/")
-	filename := filepath.Join(t.dataPath, fmt.Sprintf("%s.bin", parts[len(parts)-1]))
+	filename, infoname := t.files(loc)
 	stat, err := os.Stat(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	meta := &MetaObject{Oid: oid, Size: stat.Size(), Existing: false}
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	err = store.Put(meta, f)
 	if err == nil {
 		os.Remove(filename)
 		// tus also stores a .info file, remove that
-		os.Remove(filepath.Join(t.dataPath, fmt.Sprintf("%s.info", parts[len(parts)-1])))
+		os.Remove(infoname)
+		delete(t.oidToTusUrl, oid)
+		delete(t.createdAt, oid)
+	}
+	return meta, err
+}
+
+// Sessions returns the upload sessions that weren't finished, oldest first.
+// Those that received no data for idle are reported inactive.
+func (t *TusServer) Sessions(idle time.Duration) []*TusSession {
+	t.serverMutex.Lock()
+	defer t.serverMutex.Unlock()
+
+	now := time.Now()
+	sessions := []*TusSession{}
+	for oid := range t.oidToTusUrl {
+		sessions = append(sessions, t.session(oid, idle, now))
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// Close ends the upload session id, asking the tus server to terminate it
+// and removing what's left of its data. Active sessions are only closed if
+// force is set. The session is returned as it was before closing.
+func (t *TusServer) Close(id string, idle time.Duration, force bool) (*TusSession, error) {
+	t.serverMutex.Lock()
+	var session *TusSession
+	for oid, loc := range t.oidToTusUrl {
+		if tusID(loc) == id {
+			session = t.session(oid, idle, time.Now())
+		}
+	}
+	if session == nil {
+		t.serverMutex.Unlock()
+		return nil, errTusSessionNotFound
 	}
-	return err
+	if session.Active && !force {
+		t.serverMutex.Unlock()
+		return session, errTusSessionActive
+	}
+
+	// The session is forgotten first, so no other upload of the object is
+	// held up by the tus server while it's terminated
+	loc := t.oidToTusUrl[session.Oid]
+	delete(t.oidToTusUrl, session.Oid)
+	delete(t.createdAt, session.Oid)
+	t.serverMutex.Unlock()
+
+	// The tus server may be gone or not support termination, the files
+	// are removed either way
+	if req, err := http.NewRequest("DELETE", loc, nil); err == nil {
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		if res, err := t.httpClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+	filename, infoname := t.files(loc)
+	for _, name := range []string{filename, infoname} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return session, err
+		}
+	}
+	return session, nil
+}
+
+func (t *TusServer) session(oid string, idle time.Duration, now time.Time) *TusSession {
+	loc := t.oidToTusUrl[oid]
+	created := t.createdAt[oid]
+	s := &TusSession{ID: tusID(loc), Oid: oid, CreatedAt: created, Age: int64(now.Sub(created) / time.Second)}
+
+	written := created
+	filename, _ := t.files(loc)
+	if info, err := os.Stat(filename); err == nil {
+		s.Received = info.Size()
+		written = info.ModTime()
+	}
+	s.Active = now.Sub(written) < idle
+	return s
+}
+
+// files returns the data and info files tus stores the upload at loc in.
+func (t *TusServer) files(loc string) (string, string) {
+	id := tusID(loc)
+	return filepath.Join(t.dataPath, id+".bin"), filepath.Join(t.dataPath, id+".info")
+}
+
+// tusID returns the id of the upload at loc, the last element of its URL.
+func tusID(loc string) string {
+	parts := strings.Split(loc, "/")
+	return parts[len(parts)-1]
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminCloseUpload(t *testing.T) {
+	defer setupAdmin()()
+
+	var terminated []string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.Header().Set("Location", "http://"+r.Host+"/files/"+strings.Fields(r.Header.Get("Upload-Metadata"))[1][:8])
+			w.WriteHeader(201)
+		case "DELETE":
+			terminated = append(terminated, r.URL.Path)
+			w.WriteHeader(204)
+		}
+	}))
+	defer stub.Close()
+
+	dir, err := ioutil.TempDir("", "lfs_tusserver_test")
+	if err != nil {
+		t.Fatalf("expected a temp dir, got: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := tusServer
+	defer func() { tusServer = saved }()
+	tusServer = &TusServer{
+		dataPath:    dir,
+		tusBaseUrl:  stub.URL + "/files/",
+		httpClient:  &http.Client{},
+		oidToTusUrl: make(map[string]string),
+		createdAt:   make(map[string]time.Time),
+	}
+
+	if _, err := tusServer.Create(contentOid, contentSize); err != nil {
+		t.Fatalf("expected the session to be created, got: %s", err)
+	}
+	id := contentOid[:8]
+	data, info := filepath.Join(dir, id+".bin"), filepath.Join(dir, id+".info")
+	ioutil.WriteFile(data, []byte(content[:5]), 0640)
+	ioutil.WriteFile(info, []byte("{}"), 0640)
+
+	var sessions []*TusSession
+	res := adminAPI(t, "GET", "/admin/uploads", "")
+	json.NewDecoder(res.Body).Decode(&sessions)
+	res.Body.Close()
+	if len(sessions) != 1 || sessions[0].ID != id || sessions[0].Oid != contentOid || sessions[0].Received != 5 || !sessions[0].Active {
+		t.Fatalf("expected the active session to be listed, got %+v", sessions)
+	}
+
+	if res := adminAPI(t, "DELETE", "/admin/uploads/"+id, ""); res.StatusCode != 409 {
+		t.Fatalf("expected status 409 closing an active session, got %d", res.StatusCode)
+	}
+	if _, err := os.Stat(data); err != nil {
+		t.Fatalf("expected the data of the refused close to be kept, got: %s", err)
+	}
+
+	// The client went away an hour ago
+	stale := time.Now().Add(-time.Hour)
+	os.Chtimes(data, stale, stale)
+	res = adminAPI(t, "DELETE", "/admin/uploads/"+id, "")
+	var closed TusSession
+	json.NewDecoder(res.Body).Decode(&closed)
+	res.Body.Close()
+	if res.StatusCode != 200 || closed.Active || closed.Received != 5 {
+		t.Fatalf("expected the stuck session to be closed, got status %d: %+v", res.StatusCode, closed)
+	}
+	for _, name := range []string{data, info} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got: %v", name, err)
+		}
+	}
+	if len(terminated) != 1 || terminated[0] != "/files/"+id {
+		t.Fatalf("expected the tus server to be asked to terminate the session, got %v", terminated)
+	}
+	if sessions := tusServer.Sessions(time.Minute); len(sessions) != 0 {
+		t.Fatalf("expected no sessions after closing, got %+v", sessions)
+	}
+	if _, err := tusServer.Finish(contentOid, testContentStore); err != errTusSessionNotFound {
+		t.Fatalf("expected finishing the closed session to fail, got: %v", err)
+	}
+	if res := adminAPI(t, "DELETE", "/admin/uploads/"+id, ""); res.StatusCode != 404 {
+		t.Fatalf("expected status 404 closing it again, got %d", res.StatusCode)
+	}
+
+	// Active sessions close when forced
+	tusServer.Create(contentOid, contentSize)
+	res = adminAPI(t, "DELETE", "/admin/uploads/"+id+"?force=true", "")
+	json.NewDecoder(res.Body).Decode(&closed)
+	res.Body.Close()
+	if res.StatusCode != 200 || !closed.Active {
+		t.Fatalf("expected the active session to be force closed and flagged, got status %d: %+v", res.StatusCode, closed)
+	}
+}
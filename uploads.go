@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// uploadTracker knows which objects are being uploaded, so a client retrying
+// an upload that is still being written doesn't start a second copy of it.
+type uploadTracker struct {
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{inflight: make(map[string]chan struct{})}
+}
+
+// start marks oid as being uploaded. If it already is, start returns false
+// and a channel that is closed when that upload finishes.
+func (t *uploadTracker) start(oid string) (<-chan struct{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ch, ok := t.inflight[oid]; ok {
+		return ch, false
+	}
+	t.inflight[oid] = make(chan struct{})
+	return nil, true
+}
+
+// finish marks the upload of oid as done, releasing anyone waiting on it.
+func (t *uploadTracker) finish(oid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ch, ok := t.inflight[oid]; ok {
+		close(ch)
+		delete(t.inflight, oid)
+	}
+}
+
+// claim starts the upload of oid, waiting up to wait for an upload already in
+// flight. It returns false if oid is still being uploaded after that; done is
+// true if an earlier upload finished while waiting.
+func (t *uploadTracker) claim(oid string, wait time.Duration) (claimed, done bool) {
+	ch, ok := t.start(oid)
+	if ok {
+		return true, false
+	}
+	if wait <= 0 {
+		return false, false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+		return false, false
+	}
+
+	_, ok = t.start(oid)
+	return ok, true
+}
+
+// retryAfter returns the Retry-After seconds suggested to a client whose
+// upload conflicted after waiting for wait.
+func retryAfter(wait time.Duration) int {
+	if s := int(wait / time.Second); s > 1 {
+		return s
+	}
+	return 1
+}
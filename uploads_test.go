@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadTrackerClaim(t *testing.T) {
+	tracker := newUploadTracker()
+
+	if claimed, _ := tracker.claim(contentOid, 0); !claimed {
+		t.Fatalf("expected the first upload to be claimed")
+	}
+	if claimed, _ := tracker.claim(contentOid, 10*time.Millisecond); claimed {
+		t.Fatalf("expected an upload in flight to refuse a second claim")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.finish(contentOid)
+	}()
+
+	claimed, waited := tracker.claim(contentOid, time.Second)
+	if !claimed || !waited {
+		t.Fatalf("expected the claim to succeed after waiting, got claimed=%v waited=%v", claimed, waited)
+	}
+}
+
+func TestPutRetryDuringUploadRejected(t *testing.T) {
+	wait := Config.UploadWait
+	Config.UploadWait = "0s"
+	defer func() { Config.UploadWait = wait }()
+
+	server, store, release := blockingUploadServer(t)
+	defer server.Close()
+
+	first := make(chan int)
+	go func() { first <- putContent(server.URL) }()
+	<-store.entered
+
+	res, err := putRequest(server.URL)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409 for a retry during the upload, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+
+	release()
+	if status := <-first; status != 200 {
+		t.Fatalf("expected the first upload to succeed, got %d", status)
+	}
+}
+
+func TestPutRetryDuringUploadWaits(t *testing.T) {
+	wait := Config.UploadWait
+	Config.UploadWait = "5s"
+	defer func() { Config.UploadWait = wait }()
+
+	server, store, release := blockingUploadServer(t)
+	defer server.Close()
+
+	first := make(chan int)
+	go func() { first <- putContent(server.URL) }()
+	<-store.entered
+
+	retry := make(chan int)
+	go func() { retry <- putContent(server.URL) }()
+
+	// Give the retry time to start waiting on the first upload
+	time.Sleep(20 * time.Millisecond)
+	release()
+
+	if status := <-first; status != 200 {
+		t.Fatalf("expected the first upload to succeed, got %d", status)
+	}
+	if status := <-retry; status != 200 {
+		t.Fatalf("expected the retry to succeed once the first upload finished, got %d", status)
+	}
+
+	if puts := store.Puts(); puts != 1 {
+		t.Fatalf("expected the content to be written once, got %d writes", puts)
+	}
+}
+
+type blockingStore struct {
+	*MemoryStore
+	entered chan struct{}
+
+	mu   sync.Mutex
+	puts int
+}
+
+func (s *blockingStore) Puts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+// blockingUploadServer serves an App whose content store holds every upload
+// until release is called. Closing the server removes its meta store.
+func blockingUploadServer(t *testing.T) (*uploadServer, *blockingStore, func()) {
+	os.Remove("lfs-upload-test.db")
+	meta, err := NewMetaStore("lfs-upload-test.db")
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	meta.AddUser(testUser, testPass)
+	meta.Put(&RequestVars{Oid: contentOid, Size: contentSize})
+
+	gate := make(chan struct{})
+	store := &blockingStore{MemoryStore: NewMemoryStore(), entered: make(chan struct{}, 2)}
+	store.Hook = func(op string, meta *MetaObject) error {
+		if op != memoryPut {
+			return nil
+		}
+		store.mu.Lock()
+		store.puts++
+		store.mu.Unlock()
+
+		store.entered <- struct{}{}
+		<-gate
+		return nil
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { close(gate) }) }
+
+	server := &uploadServer{Server: httptest.NewServer(NewApp(store, meta)), meta: meta}
+	return server, store, release
+}
+
+type uploadServer struct {
+	*httptest.Server
+	meta *MetaStore
+}
+
+func (s *uploadServer) Close() {
+	s.Server.Close()
+	s.meta.Close()
+	os.Remove("lfs-upload-test.db")
+}
+
+func putRequest(url string) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", url+"/user/repo/objects/"+contentOid, bytes.NewBufferString(content))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
+
+// putContent uploads the test content, returning the status or 0 if the
+// request failed.
+func putContent(url string) int {
+	res, err := putRequest(url)
+	if err != nil {
+		return 0
+	}
+	return res.StatusCode
+}
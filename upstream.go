@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUpstreamNotFound = errors.New("Object not found upstream")
+	errUpstreamAuth     = errors.New("Upstream refused the credentials")
+	errUpstreamBusy     = errors.New("Object is being fetched from upstream")
+)
+
+// Upstream is another LFS server that objects missing locally are fetched
+// from, as by a mirror.
+type Upstream struct {
+	// URL is the LFS endpoint of the upstream server. "{user}" and "{repo}"
+	// are replaced with those of the request, so one upstream can serve every
+	// repo. The batch API is at URL + "/objects/batch".
+	URL      string
+	User     string
+	Password string
+
+	Client *http.Client
+}
+
+// NewUpstream creates an Upstream at url, authenticating with user and
+// password if user is set.
+func NewUpstream(url, user, password string) *Upstream {
+	return &Upstream{URL: strings.TrimRight(url, "/"), User: user, Password: password, Client: &http.Client{}}
+}
+
+// Fetch asks upstream for the object rv through the batch API and returns its
+// content and size. An object upstream doesn't have returns
+// errUpstreamNotFound, and refused credentials errUpstreamAuth.
+func (u *Upstream) Fetch(rv *RequestVars) (io.ReadCloser, int64, error) {
+	obj, err := u.find(rv)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The link carries its own authorization, if it needs any
+	download := obj.Actions["download"]
+	req, err := http.NewRequest("GET", download.Href, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, v := range download.Header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := u.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := upstreamStatus(res.StatusCode, "download"); err != nil {
+		res.Body.Close()
+		return nil, 0, err
+	}
+	return res.Body, obj.Size, nil
+}
+
+// Size asks upstream for the size of the object rv, without downloading it.
+// It fails like Fetch does.
+func (u *Upstream) Size(rv *RequestVars) (int64, error) {
+	obj, err := u.find(rv)
+	if err != nil {
+		return 0, err
+	}
+	return obj.Size, nil
+}
+
+// find returns what upstream answered for the object rv, failing unless it
+// offers a download.
+func (u *Upstream) find(rv *RequestVars) (*Representation, error) {
+	obj, err := u.lookup(rv)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case obj == nil:
+		return nil, errUpstreamNotFound
+	case obj.Error != nil:
+		if err := upstreamStatus(obj.Error.Code, "batch"); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Upstream object error %d: %s", obj.Error.Code, obj.Error.Message)
+	case obj.Actions["download"] == nil:
+		return nil, errUpstreamNotFound
+	}
+	return obj, nil
+}
+
+// Exists asks upstream whether it still has the object rv. It returns false
+// only when upstream answers that the object is not found or gone. A batch
+// request that fails, including with a 404 of the batch endpoint itself,
+// says nothing about the object and is returned as an error.
+func (u *Upstream) Exists(rv *RequestVars) (bool, error) {
+	obj, err := u.lookup(rv)
+	switch {
+	case err == errUpstreamNotFound:
+		return false, errors.New("Upstream batch endpoint not found")
+	case err != nil:
+		return false, err
+	case obj == nil:
+		return false, errors.New("Upstream batch response is missing the object")
+	case obj.Error != nil && (obj.Error.Code == 404 || obj.Error.Code == 410):
+		return false, nil
+	case obj.Error != nil:
+		return false, fmt.Errorf("Upstream object error %d: %s", obj.Error.Code, obj.Error.Message)
+	}
+	return true, nil
+}
+
+// lookup sends a download batch request for the object rv and returns what
+// upstream answered for it, or nil if the response doesn't have it.
+func (u *Upstream) lookup(rv *RequestVars) (*Representation, error) {
+	body, err := json.Marshal(&BatchVars{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   []*RequestVars{{Oid: rv.Oid, Size: rv.Size}},
+		HashAlgo:  rv.HashAlgo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", u.endpoint(rv)+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", metaMediaType)
+	if u.User != "" {
+		req.SetBasicAuth(u.User, u.Password)
+	}
+
+	res, err := u.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := upstreamStatus(res.StatusCode, "batch"); err != nil {
+		return nil, err
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("Invalid upstream batch response: %s", err)
+	}
+	for _, o := range batch.Objects {
+		if o.Oid == rv.Oid {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
+
+func (u *Upstream) endpoint(rv *RequestVars) string {
+	return strings.NewReplacer("{user}", rv.User, "{repo}", rv.Repo).Replace(u.URL)
+}
+
+// upstreamStatus returns the error for an unsuccessful upstream status.
+func upstreamStatus(status int, what string) error {
+	switch {
+	case status == 200:
+		return nil
+	case status == 404 || status == 410:
+		return errUpstreamNotFound
+	case status == 401 || status == 403:
+		return errUpstreamAuth
+	}
+	return fmt.Errorf("Upstream %s failed with status %d", what, status)
+}
+
+// fetchUpstream fetches the object rv from upstream into the content store
+// and records it in the meta store, so it's served locally from then on. Put
+// verifies the content before it is kept. It returns errObjectNotFound if no
+// upstream is configured.
+func (a *App) fetchUpstream(rv *RequestVars) (*MetaObject, error) {
+	if a.upstream == nil {
+		return nil, errObjectNotFound
+	}
+
+	// Concurrent downloads of the object wait for a single fetch
+	claimed, _ := a.uploads.claim(rv.Oid, Config.UploadRetryWait())
+	if !claimed {
+		return nil, errUpstreamBusy
+	}
+	defer a.uploads.finish(rv.Oid)
+
+	if meta, err := a.metaStore.Get(rv); err == nil && a.contentStore.Exists(meta) {
+		return meta, nil
+	}
+
+	content, size, err := a.upstream.Fetch(rv)
+	if err != nil {
+		metrics.Add("lfs_upstream_errors_total", 1)
+		logger.Log(kv{"fn": "fetchUpstream", "oid": rv.Oid, "err": err.Error()})
+		return nil, err
+	}
+	defer content.Close()
+
+	local := *rv
+	local.Size = size
+	meta, err := a.metaStore.Put(&local)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.contentStore.Put(meta, content); err != nil {
+		if !meta.Existing {
+			a.metaStore.Delete(&local)
+		}
+		metrics.Add("lfs_upstream_errors_total", 1)
+		logger.Log(kv{"fn": "fetchUpstream", "oid": rv.Oid, "err": err.Error()})
+		return nil, err
+	}
+
+	meta.setVerified()
+	meta.setExpiry(Config.ObjectLifetime())
+	meta.Pending = false
+	meta.Mirrored = true
+	meta.MirroredFor = repoName(rv)
+	if err := a.metaStore.Update(meta); err != nil {
+		return nil, err
+	}
+	if a.replicator != nil {
+		a.replicator.Enqueue(meta)
+	}
+
+	a.stats.Add(statObjectsStored, 1)
+	metrics.Add("lfs_upstream_fetches_total", 1)
+	metrics.Add("lfs_upstream_bytes_total", meta.Size)
+	return meta, nil
+}
+
+// headUpstream answers a HEAD request for the object rv, missing locally,
+// with what upstream reports about it. Nothing is fetched: that waits for a
+// GET.
+func (a *App) headUpstream(w http.ResponseWriter, r *http.Request, rv *RequestVars) {
+	size, err := a.upstream.Size(rv)
+	if err != nil {
+		metrics.Add("lfs_upstream_errors_total", 1)
+		logger.Log(kv{"fn": "headUpstream", "oid": rv.Oid, "err": err.Error()})
+		status, _ := upstreamError(err)
+		writeStatus(w, r, status)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", `"`+rv.Oid+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(200)
+	logRequest(r, 200)
+}
+
+// UpstreamPurger periodically asks the upstream server about every mirrored
+// object, and releases the reference of the repo it was mirrored for once
+// upstream reports it gone. Only a definite answer purges anything: when
+// upstream can't be asked, or fails to answer, the object is kept. Pinned,
+// retained and soft deleted objects are skipped, as are objects uploaded
+// since, which are no longer mirrored.
+type UpstreamPurger struct {
+	// Interval is the pause between two sweeps. A sweep never runs if it
+	// is 0.
+	Interval time.Duration
+	// Replicator, if set, also has purged objects deleted from its
+	// secondary store.
+	Replicator *Replicator
+
+	meta     *MetaStore
+	store    objectStore
+	upstream *Upstream
+
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+	mu      sync.Mutex
+}
+
+// purgeSummary describes the outcome of a purge sweep.
+type purgeSummary struct {
+	Checked int
+	Purged  int
+	Freed   int64
+}
+
+// NewUpstreamPurger creates an UpstreamPurger for the mirrored objects of
+// meta, stored in store and fetched from upstream. Call Start to begin
+// sweeping.
+func NewUpstreamPurger(meta *MetaStore, store objectStore, upstream *Upstream) *UpstreamPurger {
+	return &UpstreamPurger{
+		Interval: time.Hour,
+		meta:     meta,
+		store:    store,
+		upstream: upstream,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start launches the background worker, unless sweeping is disabled.
+func (p *UpstreamPurger) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started || p.Interval <= 0 {
+		return
+	}
+	p.started = true
+	p.wg.Add(1)
+	go p.run()
+}
+
+// Stop signals the worker to exit and waits for it, or for ctx to expire. A
+// sweep in progress stops after the object it is asking about.
+func (p *UpstreamPurger) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	started := p.started
+	p.started = false
+	p.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	close(p.stop)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *UpstreamPurger) run() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.Interval):
+		}
+
+		summary, err := p.sweep()
+		if err != nil {
+			logger.Log(kv{"fn": "purgeUpstream", "err": err.Error()})
+		}
+		logger.Log(kv{"fn": "purgeUpstream", "checked": summary.Checked, "purged": summary.Purged, "freed": summary.Freed})
+	}
+}
+
+// sweep asks upstream about every mirrored object and purges those it
+// reports gone.
+func (p *UpstreamPurger) sweep() (purgeSummary, error) {
+	var summary purgeSummary
+
+	after := ""
+	for {
+		select {
+		case <-p.stop:
+			return summary, nil
+		default:
+		}
+
+		meta, err := p.meta.NextObject(after)
+		if err != nil {
+			return summary, err
+		}
+		if meta == nil {
+			break
+		}
+		after = meta.Oid
+		if !meta.Mirrored || meta.Pinned || meta.DeletedAt != nil || meta.retained(time.Now()) {
+			continue
+		}
+
+		summary.Checked++
+		rv := mirroredRequest(meta)
+		exists, err := p.upstream.Exists(rv)
+		if err != nil {
+			metrics.Add("lfs_upstream_errors_total", 1)
+			logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "err": err.Error()})
+			continue
+		}
+		if exists {
+			continue
+		}
+		if p.purge(meta, repoName(rv)) {
+			summary.Purged++
+			summary.Freed += meta.Size
+		}
+	}
+
+	metrics.Add("lfs_upstream_purges_total", int64(summary.Purged))
+	return summary, nil
+}
+
+// purge releases the reference of repo, which meta was mirrored for, and
+// deletes the content once nothing references the object any more. It
+// returns true if the object was deleted. With soft deletion the content is
+// kept for restoring, until reaped like that of any other deleted object.
+func (p *UpstreamPurger) purge(meta *MetaObject, repo string) bool {
+	released, deleted, err := p.meta.Release(meta.Oid, repo)
+	if err != nil {
+		logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "err": err.Error()})
+		return false
+	}
+	if !deleted {
+		// Other repos still reference the object, which they didn't get
+		// from upstream
+		released.Mirrored = false
+		released.MirroredFor = ""
+		if err := p.meta.Update(released); err != nil {
+			logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "err": err.Error()})
+		}
+		return false
+	}
+
+	logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "repo": repo, "msg": "purged, the object is gone upstream"})
+	if released.DeletedAt != nil {
+		return true
+	}
+	// The meta information is gone, so content left behind by a failure
+	// here is unreachable rather than served.
+	if err := p.store.Delete(released); err != nil {
+		logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "err": err.Error()})
+	}
+	if p.Replicator != nil {
+		if err := p.Replicator.Delete(released); err != nil {
+			logger.Log(kv{"fn": "purgeUpstream", "oid": meta.Oid, "err": err.Error()})
+		}
+	}
+	return true
+}
+
+// mirroredRequest returns the request to ask upstream about the mirrored
+// object meta with, in the repo it was mirrored for. Objects mirrored before
+// that was recorded are asked about in the first repo referencing them.
+func mirroredRequest(meta *MetaObject) *RequestVars {
+	repo := meta.MirroredFor
+	if repo == "" && len(meta.Repos) > 0 {
+		repo = meta.Repos[0]
+	}
+	rv := &RequestVars{Oid: meta.Oid, Size: meta.Size}
+	if i := strings.Index(repo, "/"); i >= 0 {
+		rv.User, rv.Repo = repo[:i], repo[i+1:]
+	}
+	return rv
+}
+
+// upstreamError returns the status and message reporting a failed fetch from
+// upstream to a client.
+func upstreamError(err error) (int, string) {
+	switch err {
+	case errObjectNotFound, errUpstreamNotFound:
+		return 404, "Not found"
+	case errUpstreamAuth:
+		return 502, "Upstream server refused to authorize the download"
+	case errUpstreamBusy, errUploadBusy:
+		return 503, err.Error()
+	}
+	return 502, "Could not fetch the object from the upstream server"
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamReadThrough(t *testing.T) {
+	data := "mirrored content"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	server := newUpstreamServer(up.URL+"/{user}/{repo}", "mirror", "secret")
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	// The client's size is corrected by what upstream reports
+	batch := upstreamBatch(t, server, up.oid, 1)
+	if batch.Error != nil || batch.Actions["download"] == nil || batch.Size != int64(len(data)) {
+		t.Fatalf("expected the download to be offered with the upstream size, got %+v", batch)
+	}
+	if up.downloads != 0 {
+		t.Fatalf("expected the batch not to fetch from upstream, upstream served %d", up.downloads)
+	}
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the fetched content, got %q", got)
+	}
+	if up.downloads != 1 || up.repo != "/user/repo/objects/batch" {
+		t.Fatalf("expected one download from upstream for the repo, got %d from %s", up.downloads, up.repo)
+	}
+	upstreamBatch(t, server, up.oid, int64(len(data)))
+	if up.downloads != 1 {
+		t.Fatalf("expected later downloads to be served locally, upstream served %d", up.downloads)
+	}
+
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid})
+	if err != nil || meta.Size != int64(len(data)) {
+		t.Fatalf("expected the object to be recorded with its size, got %+v: %v", meta, err)
+	}
+}
+
+func TestUpstreamGetContent(t *testing.T) {
+	data := "directly fetched content"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	server := newUpstreamServer(up.URL+"/{user}/{repo}", "mirror", "secret")
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the content to be fetched from upstream, got %q", got)
+	}
+	if !testContentStore.Exists(&MetaObject{Oid: up.oid, Encoding: encodingGzip}) {
+		t.Fatalf("expected the content to be cached")
+	}
+}
+
+func TestUpstreamHead(t *testing.T) {
+	data := "content asked about"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	server := newUpstreamServer(up.URL+"/{user}/{repo}", "mirror", "secret")
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	req, err := http.NewRequest("HEAD", server.URL+"/user/repo/objects/"+up.oid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 || res.ContentLength != int64(len(data)) {
+		t.Fatalf("expected the upstream size, got status %d and length %d", res.StatusCode, res.ContentLength)
+	}
+	if up.downloads != 0 {
+		t.Fatalf("expected HEAD not to fetch from upstream, upstream served %d", up.downloads)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid}); err != errObjectNotFound {
+		t.Fatalf("expected nothing to be recorded, got: %v", err)
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	up := newStubUpstream("upstream content")
+	defer up.Close()
+
+	server := newUpstreamServer(up.URL+"/{user}/{repo}", "mirror", "secret")
+	defer server.Close()
+
+	// Missing upstream too, which the batch finds out already
+	if batch := upstreamBatch(t, server, nonExistingOid, 1); batch.Error == nil || batch.Error.Code != 404 || batch.Actions["download"] != nil {
+		t.Fatalf("expected the batch to report the object missing upstream, got %+v", batch)
+	}
+	if status := upstreamStatusOf(t, server, nonExistingOid); status != 404 {
+		t.Fatalf("expected status 404 for an object missing upstream, got %d", status)
+	}
+
+	refused := newUpstreamServer(up.URL+"/{user}/{repo}", "mirror", "wrong")
+	defer refused.Close()
+
+	if batch := upstreamBatch(t, refused, up.oid, 1); batch.Error == nil || batch.Error.Code != 502 {
+		t.Fatalf("expected the batch to report refused upstream credentials, got %+v", batch)
+	}
+
+	if status := upstreamStatusOf(t, refused, up.oid); status != 502 {
+		t.Fatalf("expected status 502 for refused upstream credentials, got %d", status)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid}); err != errObjectNotFound {
+		t.Fatalf("expected nothing to be recorded for a failed fetch, got: %v", err)
+	}
+}
+
+func TestUpstreamPurgeGone(t *testing.T) {
+	data := "content taken down upstream"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.upstream = NewUpstream(up.URL+"/{user}/{repo}", "mirror", "secret")
+	purger := NewUpstreamPurger(testMetaStore, testContentStore, app.upstream)
+	server := httptest.NewServer(app)
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the content to be fetched from upstream, got %q", got)
+	}
+	if meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid}); err != nil || !meta.Mirrored || meta.MirroredFor != "user/repo" {
+		t.Fatalf("expected the object to be recorded as mirrored for user/repo, got %+v: %v", meta, err)
+	}
+
+	// Failing to get an answer, or a missing batch endpoint, says nothing
+	for _, status := range []int{500, 503, 401, 404} {
+		up.status = status
+		if summary, err := purger.sweep(); err != nil || summary.Purged != 0 {
+			t.Fatalf("expected nothing purged on upstream status %d, got %+v: %v", status, summary, err)
+		}
+		if got := upstreamGet(t, server, up.oid); got != data {
+			t.Fatalf("expected the local copy to be served on upstream status %d, got %q", status, got)
+		}
+	}
+	up.status = 0
+	if summary, err := purger.sweep(); err != nil || summary.Checked != 1 || summary.Purged != 0 {
+		t.Fatalf("expected the object to be kept while upstream has it, got %+v: %v", summary, err)
+	}
+	if up.repo != "/user/repo/objects/batch" {
+		t.Fatalf("expected upstream to be asked in the repo the object was mirrored for, got %s", up.repo)
+	}
+
+	up.gone = true
+	if summary, err := purger.sweep(); err != nil || summary.Purged != 1 {
+		t.Fatalf("expected the object to be purged once gone upstream, got %+v: %v", summary, err)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid}); err != errObjectNotFound {
+		t.Fatalf("expected the meta information to be purged, got: %v", err)
+	}
+	if testContentStore.Exists(&MetaObject{Oid: up.oid, Encoding: encodingGzip}) {
+		t.Fatalf("expected the content to be purged")
+	}
+	if status := upstreamStatusOf(t, server, up.oid); status != 404 {
+		t.Fatalf("expected status 404 for the purged object, got %d", status)
+	}
+}
+
+func TestUpstreamPurgeReleasesOnlyMirroredRepo(t *testing.T) {
+	data := "content another repo references"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.upstream = NewUpstream(up.URL+"/{user}/{repo}", "mirror", "secret")
+	purger := NewUpstreamPurger(testMetaStore, testContentStore, app.upstream)
+	server := httptest.NewServer(app)
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the content to be fetched from upstream, got %q", got)
+	}
+	if _, err := testMetaStore.Put(&RequestVars{User: "other", Repo: "repo", Oid: up.oid, Size: int64(len(data))}); err != nil {
+		t.Fatalf("expected meta put to succeed, got: %s", err)
+	}
+
+	up.gone = true
+	if summary, err := purger.sweep(); err != nil || summary.Purged != 0 {
+		t.Fatalf("expected the object referenced by another repo to be kept, got %+v: %v", summary, err)
+	}
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid})
+	if err != nil {
+		t.Fatalf("expected the object to be kept, got: %v", err)
+	}
+	if meta.Mirrored || len(meta.Repos) != 1 || meta.Repos[0] != "other/repo" {
+		t.Fatalf("expected only the reference of user/repo to be released, got %+v", meta)
+	}
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the kept object to be served, got %q", got)
+	}
+}
+
+func TestUpstreamPurgeRespectsSoftDelete(t *testing.T) {
+	testMetaStore.SoftDelete = true
+	defer func() { testMetaStore.SoftDelete = false }()
+
+	data := "content soft deleted once gone upstream"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.upstream = NewUpstream(up.URL+"/{user}/{repo}", "mirror", "secret")
+	purger := NewUpstreamPurger(testMetaStore, testContentStore, app.upstream)
+	server := httptest.NewServer(app)
+	defer server.Close()
+	defer removeMeta(up.oid)
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the content to be fetched from upstream, got %q", got)
+	}
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid})
+	if err != nil {
+		t.Fatalf("expected the object to be recorded, got: %v", err)
+	}
+
+	up.gone = true
+	if summary, err := purger.sweep(); err != nil || summary.Purged != 1 {
+		t.Fatalf("expected the object to be purged once gone upstream, got %+v: %v", summary, err)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid}); err != errObjectNotFound {
+		t.Fatalf("expected the object to be soft deleted, got: %v", err)
+	}
+	if !testContentStore.Exists(meta) {
+		t.Fatalf("expected the content of the soft deleted object to be kept")
+	}
+}
+
+func TestUpstreamPurgeSkipsLocalObjects(t *testing.T) {
+	up := newStubUpstream("upstream content")
+	defer up.Close()
+
+	purger := NewUpstreamPurger(testMetaStore, testContentStore, NewUpstream(up.URL+"/{user}/{repo}", "mirror", "secret"))
+
+	// The content object was uploaded, upstream never had it
+	if summary, err := purger.sweep(); err != nil || summary.Checked != 0 {
+		t.Fatalf("expected no uploaded object to be asked about, got %+v: %v", summary, err)
+	}
+	if _, err := testMetaStore.UnsafeGet(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected the uploaded object to be kept, got: %v", err)
+	}
+}
+
+func TestUploadClearsMirrored(t *testing.T) {
+	data := "content mirrored, then uploaded"
+	up := newStubUpstream(data)
+	defer up.Close()
+
+	app := NewApp(testContentStore, testMetaStore)
+	app.upstream = NewUpstream(up.URL+"/{user}/{repo}", "mirror", "secret")
+	server := httptest.NewServer(app)
+	defer server.Close()
+	defer removeMeta(up.oid)
+
+	if got := upstreamGet(t, server, up.oid); got != data {
+		t.Fatalf("expected the content to be fetched from upstream, got %q", got)
+	}
+	// The mirrored copy was lost, and the object is uploaded again
+	mirrored, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid})
+	if err != nil {
+		t.Fatalf("expected the object to be recorded, got: %v", err)
+	}
+	testContentStore.Delete(mirrored)
+
+	app.upstream = nil
+	req, err := http.NewRequest("PUT", server.URL+"/user/repo/objects/"+up.oid, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected the upload to succeed, got %d", res.StatusCode)
+	}
+	defer testContentStore.Delete(&MetaObject{Oid: up.oid})
+
+	meta, err := testMetaStore.UnsafeGet(&RequestVars{Oid: up.oid})
+	if err != nil || meta.Mirrored || meta.MirroredFor != "" {
+		t.Fatalf("expected the uploaded object to be no longer mirrored, got %+v: %v", meta, err)
+	}
+}
+
+// stubUpstream is an LFS server holding one object, accepting the user
+// "mirror" with password "secret". Once gone is set it reports the object
+// not found, and with status set batch requests fail with that status.
+type stubUpstream struct {
+	*httptest.Server
+	oid       string
+	data      string
+	repo      string
+	downloads int
+	gone      bool
+	status    int
+}
+
+func newStubUpstream(data string) *stubUpstream {
+	sum := sha256.Sum256([]byte(data))
+	up := &stubUpstream{oid: hex.EncodeToString(sum[:]), data: data}
+
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/content/"+up.oid {
+			up.downloads++
+			fmt.Fprint(w, up.data)
+			return
+		}
+
+		if user, pass, _ := r.BasicAuth(); user != "mirror" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		up.repo = r.URL.Path
+		if up.status != 0 {
+			w.WriteHeader(up.status)
+			return
+		}
+
+		var bv BatchVars
+		json.NewDecoder(r.Body).Decode(&bv)
+		res := &BatchResponse{}
+		for _, o := range bv.Objects {
+			rep := &Representation{Oid: o.Oid, Size: o.Size}
+			if o.Oid == up.oid && !up.gone {
+				rep.Size = int64(len(up.data))
+				rep.Actions = map[string]*link{"download": {Href: up.URL + "/content/" + up.oid}}
+			} else {
+				rep.Error = &ObjectError{Code: 404, Message: "Not found"}
+			}
+			res.Objects = append(res.Objects, rep)
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	return up
+}
+
+func newUpstreamServer(url, user, password string) *httptest.Server {
+	app := NewApp(testContentStore, testMetaStore)
+	app.upstream = NewUpstream(url, user, password)
+	return httptest.NewServer(app)
+}
+
+func upstreamBatch(t *testing.T, server *httptest.Server, oid string, size int64) *Representation {
+	body := fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, oid, size)
+	req, err := http.NewRequest("POST", server.URL+"/user/repo/objects/batch", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	defer res.Body.Close()
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil || len(batch.Objects) != 1 {
+		t.Fatalf("expected a batch response with one object, got %+v: %v", batch, err)
+	}
+	return batch.Objects[0]
+}
+
+func upstreamGetResponse(t *testing.T, server *httptest.Server, oid string) *http.Response {
+	req, err := http.NewRequest("GET", server.URL+"/user/repo/objects/"+oid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
+
+func upstreamGet(t *testing.T, server *httptest.Server, oid string) string {
+	res := upstreamGetResponse(t, server, oid)
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	by, _ := ioutil.ReadAll(res.Body)
+	return string(by)
+}
+
+func upstreamStatusOf(t *testing.T, server *httptest.Server, oid string) int {
+	res := upstreamGetResponse(t, server, oid)
+	res.Body.Close()
+	return res.StatusCode
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// VerifyFailure is an object whose content is missing from a store or
+// doesn't match its oid and size.
+type VerifyFailure struct {
+	Oid string
+	Err error
+}
+
+// verifyStore reads every object recorded in meta, soft deleted ones
+// included, from store and checks it hashes to its oid and has its size,
+// workers objects at a time, reporting the progress of each to progress if
+// it isn't nil. It only reads, so it's safe to run on a store that was
+// copied or imported into, as often as needed.
+func verifyStore(meta *MetaStore, store objectStore, workers int, progress func(meta *MetaObject, n int64)) (int, []*VerifyFailure, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		checked  int
+		failures []*VerifyFailure
+		wg       sync.WaitGroup
+	)
+	objects := make(chan *MetaObject)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range objects {
+				err := verifyObject(store, o, nil, progress)
+
+				mu.Lock()
+				checked++
+				if err != nil {
+					failures = append(failures, &VerifyFailure{Oid: o.Oid, Err: err})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	after := ""
+	for {
+		var o *MetaObject
+		if o, err = meta.NextObject(after); err != nil || o == nil {
+			break
+		}
+		after = o.Oid
+		objects <- o
+	}
+	close(objects)
+	wg.Wait()
+
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Oid < failures[j].Oid })
+	return checked, failures, err
+}
+
+// verifyObject reads meta from store and checks its content, throttled by
+// limit and reporting progress to progress if they aren't nil.
+func verifyObject(store objectStore, meta *MetaObject, limit *throttle, progress func(meta *MetaObject, n int64)) error {
+	hash, err := newObjectHash(meta)
+	if err != nil {
+		return err
+	}
+	r, err := store.Get(meta, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var src io.Reader = r
+	if limit != nil {
+		src = &throttledReader{r: r, limit: limit}
+	}
+	src = newProgressReader(src, progressBytes, progressInterval, objectProgress(meta, progress))
+	n, err := io.Copy(hash, src)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+	if n != meta.Size {
+		return errSizeMismatch
+	}
+	return nil
+}
+
+// runVerify checks every object of the meta store against the content path
+// named in args, or the configured one, for instance after moving a store
+// to a new backend. Each failure is logged, and any makes it fail. The
+// server has to be stopped, as it holds the lock on the meta store.
+func runVerify(args []string) error {
+	metaStore, err := NewMetaStore(Config.MetaDB)
+	if err != nil {
+		return fmt.Errorf("Could not open the meta store: %s", err)
+	}
+	defer metaStore.Close()
+
+	path := Config.ContentPath
+	if len(args) > 0 {
+		path = args[0]
+	}
+	store, err := NewContentStore(path)
+	if err != nil {
+		return fmt.Errorf("Could not open the content store: %s", err)
+	}
+	if err := configureStore(store); err != nil {
+		return err
+	}
+	// Inline objects are read from the meta store, wherever the content is
+	store.Inline = metaStore
+
+	checked, failures, err := verifyStore(metaStore, store, Config.VerifyWorkerCount(), logProgress("verify"))
+	for _, f := range failures {
+		logger.Log(kv{"fn": "verify", "oid": f.Oid, "err": f.Err.Error()})
+	}
+	logger.Log(kv{"fn": "verify", "path": path, "checked": checked, "failed": len(failures)})
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d objects failed verification", len(failures), checked)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestVerifyStoreFlagsCorrupt(t *testing.T) {
+	setup()
+	defer teardown()
+
+	meta := setupScrubMeta(t)
+	defer os.Remove("lfs-scrub-test.db")
+	defer meta.Close()
+
+	var objects []*MetaObject
+	for i := 0; i < 20; i++ {
+		objects = append(objects, putScrubObject(t, meta, contentStore, fmt.Sprintf("migrated object %d", i)))
+	}
+
+	// Replace one object with other content that still decompresses
+	corrupt := objects[7]
+	f, err := os.Create(contentStore.path(corrupt))
+	if err != nil {
+		t.Fatalf("expected to corrupt the object, got: %s", err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("migrated object 7 went wrong"))
+	gz.Close()
+	f.Close()
+
+	var mu sync.Mutex
+	read := make(map[string]int64)
+	progress := func(m *MetaObject, n int64) {
+		mu.Lock()
+		read[m.Oid] = n
+		mu.Unlock()
+	}
+
+	checked, failures, err := verifyStore(meta, contentStore, 4, progress)
+	if err != nil {
+		t.Fatalf("expected verify to succeed, got: %s", err)
+	}
+	if checked != len(objects) {
+		t.Fatalf("expected %d objects to be checked, got %d", len(objects), checked)
+	}
+	if len(failures) != 1 || failures[0].Oid != corrupt.Oid || failures[0].Err != errHashMismatch {
+		t.Fatalf("expected only %s to fail, got %+v", corrupt.Oid, failures)
+	}
+	for _, o := range objects {
+		if o != corrupt && read[o.Oid] != o.Size {
+			t.Fatalf("expected the progress of %s to reach its size, got %d", o.Oid, read[o.Oid])
+		}
+	}
+
+	// A missing object fails as well
+	os.Remove(contentStore.path(objects[3]))
+	if _, failures, _ := verifyStore(meta, contentStore, 4, nil); len(failures) != 2 {
+		t.Fatalf("expected the missing and corrupt objects to fail, got %+v", failures)
+	}
+}